@@ -0,0 +1,485 @@
+// Package admin serves the admin API: listing and inspecting files,
+// deleting, blocking and expiring them regardless of who uploaded them,
+// reporting usage per uploader and collecting garbage. It is meant to be
+// served on a listener separate from the public one
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/loggers"
+	"github.com/olzhasar/go-fileserver/manager"
+	"github.com/olzhasar/go-fileserver/registry"
+)
+
+const URL_PREFIX = "/admin/"
+
+// FILES_URL lists files. FILES_URL/<token> shows or deletes a file,
+// FILES_URL/<token>/expiry sets its expiry and FILES_URL/<token>/block
+// blocks or unblocks it
+const FILES_URL = "/admin/files"
+const USAGE_URL = "/admin/usage"
+const GC_URL = "/admin/gc"
+
+// EXPIRY_NEVER as expires_at removes the expiry of a file
+const EXPIRY_NEVER = "never"
+
+const MSG_ERR_NOT_FOUND = "Not found"
+const MSG_ERR_FILE_NOT_FOUND = "File not found"
+const MSG_ERR_INVALID_REQUEST_METHOD = "Invalid request method"
+const MSG_ERR_AUTHENTICATION_REQUIRED = "Authentication required"
+const MSG_ERR_FORBIDDEN = "Forbidden"
+const MSG_ERR_INVALID_EXPIRY = "Either expires_at as RFC 3339 time or never, or a positive extend duration is required"
+
+// Manager deletes files along with their stored content
+type Manager interface {
+	DeleteFile(ctx context.Context, token string) error
+	CollectGarbage(ctx context.Context) (manager.GCReport, error)
+}
+
+// Handler serves the admin API to requests carrying the admin token as a
+// bearer token, or an identity with the admin scope
+type Handler struct {
+	registry registry.Registry
+	manager  Manager
+	token    string
+	tokenMu  sync.RWMutex
+	logger   loggers.Logger
+	now      func() time.Time
+}
+
+type Option func(h *Handler)
+
+func WithToken(token string) Option {
+	return func(h *Handler) {
+		h.token = token
+	}
+}
+
+func WithLogger(logger loggers.Logger) Option {
+	return func(h *Handler) {
+		h.logger = logger
+	}
+}
+
+func NewHandler(r registry.Registry, m Manager, opts ...Option) *Handler {
+	h := &Handler{registry: r, manager: m, logger: loggers.NopLogger{}, now: time.Now}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+// SetToken replaces the admin token, an empty token only admits identities
+// with the admin scope
+func (h *Handler) SetToken(token string) {
+	h.tokenMu.Lock()
+	defer h.tokenMu.Unlock()
+	h.token = token
+}
+
+func (h *Handler) getToken() string {
+	h.tokenMu.RLock()
+	defer h.tokenMu.RUnlock()
+	return h.token
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	if !h.authorize(w, r, requiredScope(r.Method, path)) {
+		return
+	}
+
+	switch {
+	case path == FILES_URL:
+		h.handleList(w, r)
+	case path == USAGE_URL:
+		h.handleUsage(w, r)
+	case path == GC_URL:
+		h.handleGC(w, r)
+	case strings.HasPrefix(path, FILES_URL+"/"):
+		h.routeFile(w, r, strings.TrimPrefix(path, FILES_URL+"/"))
+	default:
+		writeError(w, http.StatusNotFound, MSG_ERR_NOT_FOUND)
+	}
+}
+
+func (h *Handler) routeFile(w http.ResponseWriter, r *http.Request, rest string) {
+	token, action, _ := strings.Cut(rest, "/")
+
+	if !h.registry.Has(r.Context(), token) {
+		writeError(w, http.StatusNotFound, MSG_ERR_FILE_NOT_FOUND)
+		return
+	}
+
+	switch action {
+	case "":
+		h.handleFile(w, r, token)
+	case "expiry":
+		h.handleExpiry(w, r, token)
+	case "block":
+		h.handleBlock(w, r, token)
+	default:
+		writeError(w, http.StatusNotFound, MSG_ERR_NOT_FOUND)
+	}
+}
+
+// requiredScope returns the scope needed for a request. Deleting a file
+// only needs the delete-any scope, while the rest of the API needs admin
+func requiredScope(method, path string) auth.Scope {
+	rest, ok := strings.CutPrefix(path, FILES_URL+"/")
+	if ok && method == http.MethodDelete && !strings.Contains(rest, "/") {
+		return auth.ScopeDeleteAny
+	}
+	return auth.ScopeAdmin
+}
+
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, scope auth.Scope) bool {
+	identity := auth.IdentityFromContext(r.Context())
+	if identity.HasScope(scope) {
+		return true
+	}
+
+	if token := h.getToken(); token != "" {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	if identity != nil {
+		writeError(w, http.StatusForbidden, MSG_ERR_FORBIDDEN)
+		return false
+	}
+
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(w, http.StatusUnauthorized, MSG_ERR_AUTHENTICATION_REQUIRED)
+	return false
+}
+
+// handleList pages through files filtered and sorted by the query params
+// of registry.ParseListQuery. The next_cursor of a response is passed as
+// cursor to get the next page
+func (h *Handler) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, MSG_ERR_INVALID_REQUEST_METHOD)
+		return
+	}
+
+	listQuery, err := registry.ParseListQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := h.registry.List(r.Context(), listQuery)
+	if errors.Is(err, registry.ErrInvalidCursor) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		h.internalError(w, r, "Unable to list files", err)
+		return
+	}
+
+	response := listResponse{Files: make([]fileResponse, 0, len(page.Files)), NextCursor: page.NextCursor}
+	for _, file := range page.Files {
+		response.Files = append(response.Files, newFileResponse(file))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *Handler) handleFile(w http.ResponseWriter, r *http.Request, token string) {
+	switch r.Method {
+	case http.MethodGet:
+		file, ok := h.getFile(r.Context(), token)
+		if !ok {
+			writeError(w, http.StatusNotFound, MSG_ERR_FILE_NOT_FOUND)
+			return
+		}
+		writeJSON(w, http.StatusOK, file)
+	case http.MethodDelete:
+		err := h.manager.DeleteFile(r.Context(), token)
+		if errors.Is(err, manager.ErrInvalidToken) {
+			writeError(w, http.StatusNotFound, MSG_ERR_FILE_NOT_FOUND)
+			return
+		}
+		if err != nil {
+			h.internalError(w, r, "Unable to delete file", err)
+			return
+		}
+		h.logAction(r, "delete", "token", token)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, MSG_ERR_INVALID_REQUEST_METHOD)
+	}
+}
+
+// handleExpiry sets the expiry to the expires_at form value, or extends
+// the current one by the extend duration. Files without an expiry or
+// already expired are extended from now
+func (h *Handler) handleExpiry(w http.ResponseWriter, r *http.Request, token string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, MSG_ERR_INVALID_REQUEST_METHOD)
+		return
+	}
+
+	protection, ok := h.registry.GetProtection(r.Context(), token)
+	if !ok {
+		writeError(w, http.StatusNotFound, MSG_ERR_FILE_NOT_FOUND)
+		return
+	}
+
+	expiresAt, ok := parseExpiry(r.FormValue("expires_at"), r.FormValue("extend"), protection.ExpiresAt, h.now())
+	if !ok {
+		writeError(w, http.StatusBadRequest, MSG_ERR_INVALID_EXPIRY)
+		return
+	}
+
+	err := h.registry.SetExpiry(r.Context(), token, expiresAt)
+	if err != nil {
+		h.internalError(w, r, "Unable to set expiry", err)
+		return
+	}
+	h.logAction(r, "set_expiry", "token", token, "expires_at", expiresAt)
+
+	h.respondWithFile(w, r, token)
+}
+
+// handleBlock blocks downloads of a file on POST and unblocks them on
+// DELETE
+func (h *Handler) handleBlock(w http.ResponseWriter, r *http.Request, token string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, MSG_ERR_INVALID_REQUEST_METHOD)
+		return
+	}
+
+	blocked := r.Method == http.MethodPost
+
+	err := h.registry.SetBlocked(r.Context(), token, blocked)
+	if err != nil {
+		h.internalError(w, r, "Unable to block file", err)
+		return
+	}
+	h.logAction(r, "set_blocked", "token", token, "blocked", blocked)
+
+	h.respondWithFile(w, r, token)
+}
+
+// handleUsage reports the usage of the uploader query param, or of every
+// uploader along with the total
+func (h *Handler) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, MSG_ERR_INVALID_REQUEST_METHOD)
+		return
+	}
+
+	if uploader := r.URL.Query().Get("uploader"); uploader != "" {
+		usage, err := h.registry.GetUsage(r.Context(), uploader)
+		if err != nil {
+			h.internalError(w, r, "Unable to report usage", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, usageResponse{Uploader: uploader, Files: usage.Files, Bytes: usage.Bytes})
+		return
+	}
+
+	usages, err := h.registry.ListUsage(r.Context())
+	if err != nil {
+		h.internalError(w, r, "Unable to report usage", err)
+		return
+	}
+
+	total, err := h.registry.GetTotalUsage(r.Context())
+	if err != nil {
+		h.internalError(w, r, "Unable to report usage", err)
+		return
+	}
+
+	response := usageListResponse{
+		Uploaders: make([]usageResponse, 0, len(usages)),
+		Total:     usageResponse{Files: total.Files, Bytes: total.Bytes},
+	}
+	for _, usage := range usages {
+		response.Uploaders = append(response.Uploaders, usageResponse{Uploader: usage.Uploader, Files: usage.Files, Bytes: usage.Bytes})
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *Handler) handleGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, MSG_ERR_INVALID_REQUEST_METHOD)
+		return
+	}
+
+	report, err := h.manager.CollectGarbage(r.Context())
+	if err != nil {
+		h.internalError(w, r, "Unable to collect garbage", err)
+		return
+	}
+	h.logAction(r, "gc", "expired_files", report.ExpiredFiles, "orphaned_files", report.OrphanedFiles)
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (h *Handler) getFile(ctx context.Context, token string) (fileResponse, bool) {
+	fileName, ok := h.registry.Get(ctx, token)
+	if !ok {
+		return fileResponse{}, false
+	}
+	protection, ok := h.registry.GetProtection(ctx, token)
+	if !ok {
+		return fileResponse{}, false
+	}
+	metadata, ok := h.registry.GetMetadata(ctx, token)
+	if !ok {
+		return fileResponse{}, false
+	}
+
+	response := newFileResponse(registry.File{
+		Token:     token,
+		FileName:  fileName,
+		Private:   protection.Private,
+		Protected: protection.IsProtected(),
+		Blocked:   protection.Blocked,
+		ExpiresAt: protection.ExpiresAt,
+		Metadata:  metadata,
+
+		ScanStatus:    protection.ScanStatus,
+		ScanSignature: protection.ScanSignature,
+	})
+	response.FailedAttempts = protection.FailedAttempts
+
+	return response, true
+}
+
+func (h *Handler) respondWithFile(w http.ResponseWriter, r *http.Request, token string) {
+	file, ok := h.getFile(r.Context(), token)
+	if !ok {
+		writeError(w, http.StatusNotFound, MSG_ERR_FILE_NOT_FOUND)
+		return
+	}
+	writeJSON(w, http.StatusOK, file)
+}
+
+func (h *Handler) internalError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	loggers.FromContext(r.Context(), h.logger).Error(msg, "error", err)
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+// logAction records changes made through the admin API along with the
+// identity that made them, if any
+func (h *Handler) logAction(r *http.Request, action string, args ...any) {
+	admin := ""
+	if identity := auth.IdentityFromContext(r.Context()); identity != nil {
+		admin = identity.Name
+	}
+
+	args = append([]any{"action", action, "admin", admin}, args...)
+	loggers.FromContext(r.Context(), h.logger).Info("Admin action", args...)
+}
+
+func parseExpiry(expiresAt, extend string, current, now time.Time) (time.Time, bool) {
+	switch {
+	case expiresAt == EXPIRY_NEVER && extend == "":
+		return time.Time{}, true
+	case expiresAt != "" && extend == "":
+		parsed, err := time.Parse(time.RFC3339, expiresAt)
+		return parsed, err == nil
+	case expiresAt == "" && extend != "":
+		duration, err := time.ParseDuration(extend)
+		if err != nil || duration <= 0 {
+			return time.Time{}, false
+		}
+		if current.IsZero() || current.Before(now) {
+			current = now
+		}
+		return current.Add(duration), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+type fileResponse struct {
+	Token          string     `json:"token"`
+	FileName       string     `json:"filename"`
+	Uploader       string     `json:"uploader,omitempty"`
+	Size           int64      `json:"size"`
+	MimeType       string     `json:"mime_type,omitempty"`
+	Private        bool       `json:"private"`
+	Protected      bool       `json:"protected"`
+	Blocked        bool       `json:"blocked"`
+	FailedAttempts int        `json:"failed_attempts,omitempty"`
+	ScanStatus     string     `json:"scan_status,omitempty"`
+	ScanSignature  string     `json:"scan_signature,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+}
+
+func newFileResponse(file registry.File) fileResponse {
+	return fileResponse{
+		Token:     file.Token,
+		FileName:  file.FileName,
+		Uploader:  file.Uploader,
+		Size:      file.Size,
+		MimeType:  file.MimeType,
+		Private:   file.Private,
+		Protected: file.Protected,
+		Blocked:   file.Blocked,
+		CreatedAt: timeOrNil(file.CreatedAt),
+		ExpiresAt: timeOrNil(file.ExpiresAt),
+
+		ScanStatus:    file.ScanStatus,
+		ScanSignature: file.ScanSignature,
+	}
+}
+
+type listResponse struct {
+	Files      []fileResponse `json:"files"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+type usageResponse struct {
+	Uploader string `json:"uploader,omitempty"`
+	Files    int64  `json:"files"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type usageListResponse struct {
+	Uploaders []usageResponse `json:"uploaders"`
+	Total     usageResponse   `json:"total"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
@@ -0,0 +1,340 @@
+package admin_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/admin"
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/manager"
+	"github.com/olzhasar/go-fileserver/registry"
+	"github.com/olzhasar/go-fileserver/storages"
+)
+
+const ADMIN_TOKEN = "admin-secret"
+
+type fixture struct {
+	registry registry.Registry
+	storage  *storages.InMemoryStorage
+	manager  *manager.FileManager
+	handler  *admin.Handler
+}
+
+func newFixture() *fixture {
+	reg := registry.NewInMemoryRegistry()
+	storage := storages.NewInMemoryStorage()
+	mgr := manager.NewFileManager(reg, storage)
+
+	return &fixture{reg, storage, mgr, admin.NewHandler(reg, mgr, admin.WithToken(ADMIN_TOKEN))}
+}
+
+func (f *fixture) upload(t *testing.T, uploader, fileName string) string {
+	t.Helper()
+
+	ctx := context.Background()
+	if uploader != "" {
+		ctx = auth.WithIdentity(ctx, &auth.Identity{Name: uploader, Scopes: []auth.Scope{auth.ScopeUpload}})
+	}
+
+	token, err := f.manager.SaveFile(ctx, fileName, bytes.NewBufferString("content of "+fileName), manager.SaveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// do sends an admin request authenticated with the admin token and decodes
+// the JSON response into body, if given
+func (f *fixture) do(t *testing.T, method, target string, form url.Values, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var request *http.Request
+	if form != nil {
+		request = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		request = httptest.NewRequest(method, target, nil)
+	}
+	request.Header.Set("Authorization", "Bearer "+ADMIN_TOKEN)
+
+	response := httptest.NewRecorder()
+	f.handler.ServeHTTP(response, request)
+
+	if body != nil {
+		if err := json.Unmarshal(response.Body.Bytes(), body); err != nil {
+			t.Fatalf("Unable to decode %q: %v", response.Body.String(), err)
+		}
+	}
+
+	return response
+}
+
+type file struct {
+	Token     string     `json:"token"`
+	FileName  string     `json:"filename"`
+	Uploader  string     `json:"uploader"`
+	Size      int64      `json:"size"`
+	Blocked   bool       `json:"blocked"`
+	CreatedAt *time.Time `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func assertStatus(t testing.TB, response *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if response.Code != want {
+		t.Fatalf("Got status %d, want %d: %s", response.Code, want, response.Body.String())
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	f := newFixture()
+
+	cases := []struct {
+		name     string
+		identity *auth.Identity
+		bearer   string
+		want     int
+	}{
+		{"anonymous", nil, "", http.StatusUnauthorized},
+		{"wrong token", nil, "guess", http.StatusUnauthorized},
+		{"admin token", nil, ADMIN_TOKEN, http.StatusOK},
+		{"identity without admin scope", &auth.Identity{Name: "alice", Scopes: []auth.Scope{auth.ScopeDeleteAny}}, "", http.StatusForbidden},
+		{"identity with admin scope", &auth.Identity{Name: "root", Scopes: []auth.Scope{auth.ScopeAdmin}}, "", http.StatusOK},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, admin.FILES_URL, nil)
+			if test.identity != nil {
+				request = request.WithContext(auth.WithIdentity(request.Context(), test.identity))
+			}
+			if test.bearer != "" {
+				request.Header.Set("Authorization", "Bearer "+test.bearer)
+			}
+
+			response := httptest.NewRecorder()
+			f.handler.ServeHTTP(response, request)
+
+			assertStatus(t, response, test.want)
+		})
+	}
+
+	t.Run("uses replaced token", func(t *testing.T) {
+		f.handler.SetToken("rotated")
+		defer f.handler.SetToken(ADMIN_TOKEN)
+
+		response := f.do(t, http.MethodGet, admin.FILES_URL, nil, nil)
+		assertStatus(t, response, http.StatusUnauthorized)
+	})
+	t.Run("lets delete-any identities delete files only", func(t *testing.T) {
+		token := f.upload(t, "bob", "b.txt")
+		identity := &auth.Identity{Name: "alice", Scopes: []auth.Scope{auth.ScopeDeleteAny}}
+
+		send := func(method, target string) *httptest.ResponseRecorder {
+			request := httptest.NewRequest(method, target, nil)
+			request = request.WithContext(auth.WithIdentity(request.Context(), identity))
+			response := httptest.NewRecorder()
+			f.handler.ServeHTTP(response, request)
+			return response
+		}
+
+		assertStatus(t, send(http.MethodGet, admin.FILES_URL+"/"+token), http.StatusForbidden)
+		assertStatus(t, send(http.MethodPost, admin.FILES_URL+"/"+token+"/block"), http.StatusForbidden)
+		assertStatus(t, send(http.MethodDelete, admin.FILES_URL+"/"+token), http.StatusNoContent)
+
+		if f.registry.Has(context.Background(), token) {
+			t.Error("Want the record to be deleted")
+		}
+	})
+}
+
+func TestListFiles(t *testing.T) {
+	f := newFixture()
+
+	for i := 0; i < 5; i++ {
+		f.upload(t, "alice", fmt.Sprintf("alice-%d.txt", i))
+	}
+	bobToken := f.upload(t, "bob", "bob.txt")
+
+	t.Run("pages through files newest first", func(t *testing.T) {
+		var names []string
+		target := admin.FILES_URL + "?limit=4"
+
+		for pages := 0; pages < 3; pages++ {
+			var body struct {
+				Files      []file `json:"files"`
+				NextCursor string `json:"next_cursor"`
+			}
+			response := f.do(t, http.MethodGet, target, nil, &body)
+			assertStatus(t, response, http.StatusOK)
+
+			for _, file := range body.Files {
+				names = append(names, file.FileName)
+			}
+			if body.NextCursor == "" {
+				break
+			}
+			target = admin.FILES_URL + "?limit=4&cursor=" + url.QueryEscape(body.NextCursor)
+		}
+
+		want := "bob.txt alice-4.txt alice-3.txt alice-2.txt alice-1.txt alice-0.txt"
+		if got := strings.Join(names, " "); got != want {
+			t.Errorf("Got %s, want %s", got, want)
+		}
+	})
+	t.Run("filters by uploader and name", func(t *testing.T) {
+		var body struct {
+			Files []file `json:"files"`
+		}
+		f.do(t, http.MethodGet, admin.FILES_URL+"?uploader=bob&name=BOB", nil, &body)
+
+		if len(body.Files) != 1 || body.Files[0].Token != bobToken || body.Files[0].Uploader != "bob" {
+			t.Errorf("Got %+v, want the file of bob", body.Files)
+		}
+	})
+	t.Run("rejects invalid cursors and limits", func(t *testing.T) {
+		assertStatus(t, f.do(t, http.MethodGet, admin.FILES_URL+"?cursor=garbage!", nil, nil), http.StatusBadRequest)
+		assertStatus(t, f.do(t, http.MethodGet, admin.FILES_URL+"?limit=-1", nil, nil), http.StatusBadRequest)
+	})
+}
+
+func TestManageFile(t *testing.T) {
+	f := newFixture()
+	token := f.upload(t, "alice", "report.pdf")
+	fileURL := admin.FILES_URL + "/" + token
+
+	t.Run("shows metadata", func(t *testing.T) {
+		var body file
+		response := f.do(t, http.MethodGet, fileURL, nil, &body)
+		assertStatus(t, response, http.StatusOK)
+
+		if body.FileName != "report.pdf" || body.Uploader != "alice" || body.Size != int64(len("content of report.pdf")) || body.CreatedAt == nil {
+			t.Errorf("Got %+v", body)
+		}
+	})
+	t.Run("returns 404 for unknown tokens", func(t *testing.T) {
+		assertStatus(t, f.do(t, http.MethodGet, admin.FILES_URL+"/unknown", nil, nil), http.StatusNotFound)
+	})
+	t.Run("blocks and unblocks downloads", func(t *testing.T) {
+		var body file
+		response := f.do(t, http.MethodPost, fileURL+"/block", nil, &body)
+		assertStatus(t, response, http.StatusOK)
+
+		if !body.Blocked {
+			t.Error("Want the file to be blocked")
+		}
+		if _, err := f.manager.LoadFile(context.Background(), token, manager.LoadOptions{}); err != manager.ErrBlockedFile {
+			t.Errorf("Got error %v, want %v", err, manager.ErrBlockedFile)
+		}
+
+		body = file{}
+		f.do(t, http.MethodDelete, fileURL+"/block", nil, &body)
+		if body.Blocked {
+			t.Error("Want the file to be unblocked")
+		}
+	})
+	t.Run("sets and extends expiry", func(t *testing.T) {
+		expiresAt := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+
+		var body file
+		response := f.do(t, http.MethodPost, fileURL+"/expiry", url.Values{"expires_at": {expiresAt.Format(time.RFC3339)}}, &body)
+		assertStatus(t, response, http.StatusOK)
+
+		if body.ExpiresAt == nil || !body.ExpiresAt.Equal(expiresAt) {
+			t.Fatalf("Got expiry %v, want %v", body.ExpiresAt, expiresAt)
+		}
+
+		f.do(t, http.MethodPost, fileURL+"/expiry", url.Values{"extend": {"24h"}}, &body)
+		if body.ExpiresAt == nil || !body.ExpiresAt.Equal(expiresAt.Add(24*time.Hour)) {
+			t.Errorf("Got expiry %v, want %v", body.ExpiresAt, expiresAt.Add(24*time.Hour))
+		}
+
+		body = file{}
+		f.do(t, http.MethodPost, fileURL+"/expiry", url.Values{"expires_at": {admin.EXPIRY_NEVER}}, &body)
+		if body.ExpiresAt != nil {
+			t.Errorf("Got expiry %v, want none", body.ExpiresAt)
+		}
+
+		for _, form := range []url.Values{{}, {"extend": {"-1h"}}, {"expires_at": {"tomorrow"}}} {
+			assertStatus(t, f.do(t, http.MethodPost, fileURL+"/expiry", form, nil), http.StatusBadRequest)
+		}
+	})
+	t.Run("force-deletes files", func(t *testing.T) {
+		response := f.do(t, http.MethodDelete, fileURL, nil, nil)
+		assertStatus(t, response, http.StatusNoContent)
+
+		if f.registry.Has(context.Background(), token) {
+			t.Error("Want the record to be deleted")
+		}
+		if _, ok := f.storage.Files[token]; ok {
+			t.Error("Want the stored file to be deleted")
+		}
+	})
+}
+
+func TestUsage(t *testing.T) {
+	f := newFixture()
+	f.upload(t, "alice", "a.txt")
+	f.upload(t, "alice", "b.txt")
+	f.upload(t, "bob", "c.txt")
+	f.upload(t, "", "anonymous.txt")
+
+	t.Run("reports every uploader", func(t *testing.T) {
+		var body struct {
+			Uploaders []struct {
+				Uploader string `json:"uploader"`
+				Files    int64  `json:"files"`
+			} `json:"uploaders"`
+			Total struct {
+				Files int64 `json:"files"`
+			} `json:"total"`
+		}
+		response := f.do(t, http.MethodGet, admin.USAGE_URL, nil, &body)
+		assertStatus(t, response, http.StatusOK)
+
+		if len(body.Uploaders) != 2 || body.Uploaders[0].Uploader != "alice" || body.Uploaders[0].Files != 2 || body.Uploaders[1].Files != 1 {
+			t.Errorf("Got %+v", body.Uploaders)
+		}
+		if body.Total.Files != 4 {
+			t.Errorf("Got %d files in total, want 4", body.Total.Files)
+		}
+	})
+	t.Run("reports a single uploader", func(t *testing.T) {
+		var body struct {
+			Files int64 `json:"files"`
+		}
+		f.do(t, http.MethodGet, admin.USAGE_URL+"?uploader=bob", nil, &body)
+
+		if body.Files != 1 {
+			t.Errorf("Got %d files, want 1", body.Files)
+		}
+	})
+}
+
+func TestGarbageCollection(t *testing.T) {
+	f := newFixture()
+	token := f.upload(t, "alice", "expired.txt")
+	f.registry.SetExpiry(context.Background(), token, time.Now().Add(-time.Minute))
+	f.storage.Files["orphan.txt"] = "left behind"
+
+	assertStatus(t, f.do(t, http.MethodGet, admin.GC_URL, nil, nil), http.StatusMethodNotAllowed)
+
+	var report manager.GCReport
+	response := f.do(t, http.MethodPost, admin.GC_URL, nil, &report)
+	assertStatus(t, response, http.StatusOK)
+
+	if report != (manager.GCReport{ExpiredFiles: 1, OrphanedFiles: 1}) {
+		t.Errorf("Got report %+v", report)
+	}
+	if len(f.storage.Files) != 0 {
+		t.Errorf("Got stored files %v, want none", f.storage.Files)
+	}
+}
@@ -0,0 +1,177 @@
+// Package auth defines authenticated identities, their permission scopes
+// and API key helpers shared by middleware, server and manager
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Scope string
+
+const (
+	ScopeUpload          Scope = "upload"
+	ScopeDownloadPrivate Scope = "download-private"
+	ScopeDeleteAny       Scope = "delete-any"
+	// ScopeAdmin grants every other scope
+	ScopeAdmin Scope = "admin"
+)
+
+var AllScopes = []Scope{ScopeUpload, ScopeDownloadPrivate, ScopeDeleteAny, ScopeAdmin}
+
+const API_KEY_PREFIX = "fs"
+const API_KEY_ID_LENGTH = 8
+const API_KEY_SECRET_LENGTH = 32
+
+// CERT_IDENTITY_PREFIX and JWT_IDENTITY_PREFIX are prepended to the names
+// of client certificates and JWT subjects, so that they can't take the
+// identity of an API key or of each other
+const CERT_IDENTITY_PREFIX = "cert:"
+const JWT_IDENTITY_PREFIX = "jwt:"
+
+var ErrInvalidKeyName = errors.New("Key names can't contain \":\", which is reserved for certificate and JWT identities")
+
+// ValidateKeyName rejects API key names that could collide with prefixed
+// identities
+func ValidateKeyName(name string) error {
+	if strings.Contains(name, ":") {
+		return ErrInvalidKeyName
+	}
+	return nil
+}
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	// Name identifies the caller and is recorded as the uploader of files
+	Name string
+	// KeyID is the id of the API key used to authenticate, if any
+	KeyID  string
+	Scopes []Scope
+}
+
+func (i *Identity) HasScope(scope Scope) bool {
+	if i == nil {
+		return false
+	}
+
+	for _, s := range i.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity attached by an authentication
+// middleware, or nil for anonymous requests
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// ParseScopes parses a comma-separated list of scopes
+func ParseScopes(value string) ([]Scope, error) {
+	var scopes []Scope
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		scope := Scope(name)
+		if !isKnownScope(scope) {
+			return nil, errors.New(fmt.Sprintf("Unknown scope %q", name))
+		}
+
+		scopes = append(scopes, scope)
+	}
+
+	return scopes, nil
+}
+
+// ParseScopeMapping parses a comma-separated list of value=scope pairs,
+// mapping claim values to scopes. A bare scope name maps to itself
+func ParseScopeMapping(value string) (map[string]Scope, error) {
+	mapping := make(map[string]Scope)
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		claim, name, found := strings.Cut(pair, "=")
+		if !found {
+			name = claim
+		}
+		claim, name = strings.TrimSpace(claim), strings.TrimSpace(name)
+
+		if claim == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid scope mapping %q", pair))
+		}
+		scope := Scope(name)
+		if !isKnownScope(scope) {
+			return nil, errors.New(fmt.Sprintf("Unknown scope %q", name))
+		}
+
+		mapping[claim] = scope
+	}
+
+	return mapping, nil
+}
+
+func isKnownScope(scope Scope) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateAPIKey returns a new API key in the fs_<id>_<secret> format along
+// with its public id. Only the hash of the key should ever be stored
+func GenerateAPIKey() (id, key string, err error) {
+	idBytes := make([]byte, API_KEY_ID_LENGTH/2)
+	if _, err = rand.Read(idBytes); err != nil {
+		return "", "", err
+	}
+
+	secret := make([]byte, API_KEY_SECRET_LENGTH)
+	if _, err = rand.Read(secret); err != nil {
+		return "", "", err
+	}
+
+	id = hex.EncodeToString(idBytes)
+	key = API_KEY_PREFIX + "_" + id + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	return id, key, nil
+}
+
+// ParseAPIKeyID extracts the public id from an API key
+func ParseAPIKeyID(key string) (id string, ok bool) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != API_KEY_PREFIX || len(parts[1]) != API_KEY_ID_LENGTH || parts[2] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,107 @@
+package auth_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/olzhasar/go-fileserver/auth"
+)
+
+func TestIdentityHasScope(t *testing.T) {
+	uploader := &auth.Identity{Name: "alice", Scopes: []auth.Scope{auth.ScopeUpload}}
+	admin := &auth.Identity{Name: "root", Scopes: []auth.Scope{auth.ScopeAdmin}}
+	var anonymous *auth.Identity
+
+	if !uploader.HasScope(auth.ScopeUpload) {
+		t.Error("Want uploader to have upload scope")
+	}
+	if uploader.HasScope(auth.ScopeDeleteAny) {
+		t.Error("Want uploader not to have delete-any scope")
+	}
+	if !admin.HasScope(auth.ScopeDeleteAny) {
+		t.Error("Want admin to have every scope")
+	}
+	if anonymous.HasScope(auth.ScopeUpload) {
+		t.Error("Want anonymous identity to have no scopes")
+	}
+}
+
+func TestIdentityContext(t *testing.T) {
+	if auth.IdentityFromContext(context.Background()) != nil {
+		t.Fatal("Want nil identity for empty context")
+	}
+
+	identity := &auth.Identity{Name: "alice"}
+	ctx := auth.WithIdentity(context.Background(), identity)
+
+	if got := auth.IdentityFromContext(ctx); got != identity {
+		t.Fatalf("Got identity %v, want %v", got, identity)
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := auth.ParseScopes("upload, download-private")
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	if len(scopes) != 2 || scopes[1] != auth.ScopeDownloadPrivate {
+		t.Errorf("Got scopes %v", scopes)
+	}
+
+	if _, err := auth.ParseScopes("upload,root"); err == nil {
+		t.Error("Got nil, want error for unknown scope")
+	}
+}
+
+func TestValidateKeyName(t *testing.T) {
+	if err := auth.ValidateKeyName("alice"); err != nil {
+		t.Errorf("Expected no error, got %q", err)
+	}
+
+	if err := auth.ValidateKeyName(auth.CERT_IDENTITY_PREFIX + "alice"); err != auth.ErrInvalidKeyName {
+		t.Errorf("Got %v, want ErrInvalidKeyName for a certificate identity", err)
+	}
+}
+
+func TestParseScopeMapping(t *testing.T) {
+	mapping, err := auth.ParseScopeMapping("upload, fileserver-admins=admin")
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	if len(mapping) != 2 || mapping["upload"] != auth.ScopeUpload || mapping["fileserver-admins"] != auth.ScopeAdmin {
+		t.Errorf("Got mapping %v", mapping)
+	}
+
+	for _, invalid := range []string{"staff=root", "=admin", "root"} {
+		if _, err := auth.ParseScopeMapping(invalid); err == nil {
+			t.Errorf("Got nil, want error for %q", invalid)
+		}
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	id, key, err := auth.GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	parsed, ok := auth.ParseAPIKeyID(key)
+	if !ok || parsed != id {
+		t.Fatalf("Got id %q from key %q, want %q", parsed, key, id)
+	}
+
+	if auth.HashAPIKey(key) == key {
+		t.Error("Want hash to differ from key")
+	}
+
+	_, other, _ := auth.GenerateAPIKey()
+	if auth.HashAPIKey(key) == auth.HashAPIKey(other) {
+		t.Error("Want different keys to have different hashes")
+	}
+
+	for _, invalid := range []string{"", "fs_abc", "xx_12345678_secret", "fs_12345678_"} {
+		if _, ok := auth.ParseAPIKeyID(invalid); ok {
+			t.Errorf("Want %q to be rejected", invalid)
+		}
+	}
+}
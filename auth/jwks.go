@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const DEFAULT_JWKS_TTL = time.Hour
+
+// Minimum delay between refreshes triggered by unknown key ids, so that
+// tokens with made up kids can't be used to hammer the identity provider
+const JWKS_MIN_REFRESH_INTERVAL = time.Minute
+
+// Maximum delay between refreshes while the identity provider fails
+const JWKS_MAX_RETRY_INTERVAL = 15 * time.Minute
+
+var ErrUnknownKey = errors.New("Unknown signing key")
+
+// KeySet resolves the public keys used to verify token signatures
+type KeySet interface {
+	Key(kid string) (crypto.PublicKey, error)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// ParseJWKS parses a JSON Web Key Set. Keys of unsupported types or not
+// meant for signatures are skipped
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set jsonWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid key %q: %s", jwk.Kid, err))
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, nil
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// StaticKeySet is a fixed set of keys, e.g. loaded from a file
+type StaticKeySet struct {
+	keys map[string]crypto.PublicKey
+}
+
+func (s *StaticKeySet) Key(kid string) (crypto.PublicKey, error) {
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+func NewJWKSFromFile(path string) (*StaticKeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StaticKeySet{keys}, nil
+}
+
+// RemoteKeySet fetches keys from a JWKS URL and caches them for ttl.
+// Unknown key ids trigger an early refresh to pick up rotated keys
+type RemoteKeySet struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+	now    func() time.Time
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	// refreshing is closed when the refresh in progress, if any, is done
+	refreshing chan struct{}
+	failures   int
+	retryAt    time.Time
+	err        error
+}
+
+func NewRemoteKeySet(url string, ttl time.Duration, client *http.Client) *RemoteKeySet {
+	if ttl <= 0 {
+		ttl = DEFAULT_JWKS_TTL
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &RemoteKeySet{url: url, ttl: ttl, client: client, now: time.Now}
+}
+
+func (r *RemoteKeySet) Key(kid string) (crypto.PublicKey, error) {
+	keys, err := r.currentKeys(false)
+	if keys == nil {
+		return nil, err
+	}
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+
+	keys, _ = r.currentKeys(true)
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, ErrUnknownKey
+}
+
+// currentKeys returns the cached keys, refreshed first if they expired or
+// if unknownKid is set and the last attempt is old enough. Only one
+// refresh runs at a time and other callers wait for its result. On
+// failure previously fetched keys are kept, so a flaky identity provider
+// doesn't lock everybody out, and refreshes back off
+func (r *RemoteKeySet) currentKeys(unknownKid bool) (map[string]crypto.PublicKey, error) {
+	r.mu.Lock()
+
+	if r.refreshing == nil {
+		now := r.now()
+
+		due := r.keys == nil || now.Sub(r.fetchedAt) >= r.ttl
+		if unknownKid {
+			due = now.Sub(r.attemptedAt) >= JWKS_MIN_REFRESH_INTERVAL
+		}
+		if !due || now.Before(r.retryAt) {
+			defer r.mu.Unlock()
+			return r.keys, r.err
+		}
+
+		r.refreshing = make(chan struct{})
+		r.attemptedAt = now
+		r.mu.Unlock()
+
+		keys, err := r.fetch()
+
+		r.mu.Lock()
+		if err != nil {
+			r.failures++
+			r.retryAt = now.Add(retryDelay(r.failures))
+		} else {
+			r.keys, r.fetchedAt = keys, now
+			r.failures, r.retryAt = 0, time.Time{}
+		}
+		r.err = err
+		close(r.refreshing)
+		r.refreshing = nil
+
+		defer r.mu.Unlock()
+		return r.keys, r.err
+	}
+
+	refreshing := r.refreshing
+	r.mu.Unlock()
+
+	<-refreshing
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keys, r.err
+}
+
+// retryDelay doubles the delay before the next refresh with each
+// consecutive failure, up to JWKS_MAX_RETRY_INTERVAL
+func retryDelay(failures int) time.Duration {
+	delay := JWKS_MIN_REFRESH_INTERVAL
+	for i := 1; i < failures && delay < JWKS_MAX_RETRY_INTERVAL; i++ {
+		delay *= 2
+	}
+	return min(delay, JWKS_MAX_RETRY_INTERVAL)
+}
+
+func (r *RemoteKeySet) fetch() (map[string]crypto.PublicKey, error) {
+	response, err := r.client.Get(r.url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Unexpected JWKS response status %d", response.StatusCode))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseJWKS(data)
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jwksServer is an in-process identity provider serving rotatable keys
+type jwksServer struct {
+	mu       sync.Mutex
+	kids     []string
+	requests int
+}
+
+func (j *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.requests++
+
+	public, _, _ := ed25519.GenerateKey(rand.Reader)
+	x := base64.RawURLEncoding.EncodeToString(public)
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"keys": [`)
+	for i, kid := range j.kids {
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		fmt.Fprintf(w, `{"kty": "OKP", "crv": "Ed25519", "kid": %q, "x": %q}`, kid, x)
+	}
+	fmt.Fprint(w, `]}`)
+}
+
+func (j *jwksServer) rotate(kids ...string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.kids = kids
+}
+
+func TestRemoteKeySet(t *testing.T) {
+	provider := &jwksServer{kids: []string{"old"}}
+	server := httptest.NewServer(provider)
+	defer server.Close()
+
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	keys := NewRemoteKeySet(server.URL, time.Hour, server.Client())
+	keys.now = func() time.Time { return now }
+
+	assertKey := func(t testing.TB, kid string, want error) {
+		t.Helper()
+		if _, err := keys.Key(kid); err != want {
+			t.Fatalf("Key %q: got error %v, want %v", kid, err, want)
+		}
+	}
+
+	assertRequests := func(t testing.TB, want int) {
+		t.Helper()
+		if provider.requests != want {
+			t.Fatalf("Got %d JWKS requests, want %d", provider.requests, want)
+		}
+	}
+
+	t.Run("caches fetched keys", func(t *testing.T) {
+		assertKey(t, "old", nil)
+		assertKey(t, "old", nil)
+		assertRequests(t, 1)
+	})
+	t.Run("throttles refreshes for unknown kids", func(t *testing.T) {
+		provider.rotate("old", "new")
+
+		assertKey(t, "new", ErrUnknownKey)
+		assertRequests(t, 1)
+	})
+	t.Run("refreshes for unknown kids after interval", func(t *testing.T) {
+		now = now.Add(JWKS_MIN_REFRESH_INTERVAL)
+
+		assertKey(t, "new", nil)
+		assertRequests(t, 2)
+	})
+	t.Run("refreshes after ttl", func(t *testing.T) {
+		provider.rotate("newest")
+		now = now.Add(time.Hour)
+
+		assertKey(t, "newest", nil)
+		assertKey(t, "old", ErrUnknownKey)
+		assertRequests(t, 3)
+	})
+	t.Run("keeps cached keys if provider is down", func(t *testing.T) {
+		server.Close()
+		now = now.Add(2 * time.Hour)
+
+		assertKey(t, "newest", nil)
+	})
+}
+
+func TestRemoteKeySetRefresh(t *testing.T) {
+	t.Run("fetches once for concurrent lookups", func(t *testing.T) {
+		provider := &jwksServer{kids: []string{"k1"}}
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			provider.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+
+		keys := NewRemoteKeySet(server.URL, time.Hour, server.Client())
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := keys.Key("k1")
+				errs <- err
+			}()
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Errorf("Expected no error, got %q", err)
+			}
+		}
+		if provider.requests != 1 {
+			t.Errorf("Got %d JWKS requests, want 1", provider.requests)
+		}
+	})
+	t.Run("backs off after failures", func(t *testing.T) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+		keys := NewRemoteKeySet(server.URL, time.Hour, server.Client())
+		keys.now = func() time.Time { return now }
+
+		for _, step := range []struct {
+			advance  time.Duration
+			requests int
+		}{
+			{0, 1},
+			{0, 1},
+			{JWKS_MIN_REFRESH_INTERVAL, 2},
+			{JWKS_MIN_REFRESH_INTERVAL, 2},
+			{JWKS_MIN_REFRESH_INTERVAL, 3},
+		} {
+			now = now.Add(step.advance)
+			if _, err := keys.Key("k1"); err == nil {
+				t.Fatal("Expected an error")
+			}
+			if requests != step.requests {
+				t.Fatalf("Got %d JWKS requests at %s, want %d", requests, now, step.requests)
+			}
+		}
+	})
+}
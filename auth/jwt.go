@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const DEFAULT_JWT_LEEWAY = time.Minute
+
+var ErrInvalidJWT = errors.New("Invalid token")
+var ErrExpiredJWT = errors.New("Token has expired")
+var ErrUnsupportedAlgorithm = errors.New("Unsupported signing algorithm")
+var ErrMissingIdentity = errors.New("Token has no identity claim")
+
+type JWTConfig struct {
+	// Issuer and Audience are required to match the iss and aud claims
+	Issuer   string
+	Audience string
+	// IdentityClaim names the claim used as identity name, "sub" by default
+	IdentityClaim string
+	// ScopesClaim names the claim holding permissions, "scope" by default.
+	// Both space-separated strings and arrays of strings are supported
+	ScopesClaim string
+	// ScopeMapping maps claim values, e.g. group names, to scopes. Values
+	// missing from the mapping grant no scope
+	ScopeMapping map[string]Scope
+	// Leeway tolerates clock skew with the identity provider
+	Leeway time.Duration
+}
+
+// JWTVerifier validates RS256, ES256 and EdDSA signed bearer tokens and
+// maps their claims to identities
+type JWTVerifier struct {
+	keys   KeySet
+	config JWTConfig
+	now    func() time.Time
+}
+
+func NewJWTVerifier(keys KeySet, config JWTConfig) *JWTVerifier {
+	if config.IdentityClaim == "" {
+		config.IdentityClaim = "sub"
+	}
+	if config.ScopesClaim == "" {
+		config.ScopesClaim = "scope"
+	}
+	if config.Leeway == 0 {
+		config.Leeway = DEFAULT_JWT_LEEWAY
+	}
+	return &JWTVerifier{keys, config, time.Now}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (v *JWTVerifier) Verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidJWT
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	key, err := v.keys.Key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	if err := v.validateClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return v.identity(claims)
+}
+
+func (v *JWTVerifier) validateClaims(claims map[string]any) error {
+	now := v.now()
+
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(v.config.Leeway)) {
+			return ErrExpiredJWT
+		}
+	} else {
+		return ErrInvalidJWT
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(v.config.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return ErrInvalidJWT
+		}
+	}
+
+	if v.config.Issuer == "" || claims["iss"] != v.config.Issuer {
+		return ErrInvalidJWT
+	}
+
+	if v.config.Audience == "" || !containsString(stringValues(claims["aud"]), v.config.Audience) {
+		return ErrInvalidJWT
+	}
+
+	return nil
+}
+
+func (v *JWTVerifier) identity(claims map[string]any) (*Identity, error) {
+	name, _ := claims[v.config.IdentityClaim].(string)
+	if name == "" {
+		return nil, ErrMissingIdentity
+	}
+
+	identity := &Identity{Name: JWT_IDENTITY_PREFIX + name}
+
+	for _, value := range stringValues(claims[v.config.ScopesClaim]) {
+		if scope, ok := v.config.ScopeMapping[value]; ok {
+			identity.Scopes = append(identity.Scopes, scope)
+		}
+	}
+
+	return identity, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidJWT
+		}
+		digest := sha256.Sum256([]byte(signed))
+		if rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return ErrInvalidJWT
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve != elliptic.P256() || len(signature) != 64 {
+			return ErrInvalidJWT
+		}
+		digest := sha256.Sum256([]byte(signed))
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return ErrInvalidJWT
+		}
+	case "EdDSA":
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(edKey, []byte(signed), signature) {
+			return ErrInvalidJWT
+		}
+	default:
+		return ErrUnsupportedAlgorithm
+	}
+
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringValues reads claims that are either a space-separated string or
+// an array of strings
+func stringValues(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []any:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func containsString(values []string, want string) bool {
+	for _, value := range values {
+		if value == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package auth_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/auth"
+)
+
+// testKey is a locally generated key pair used to sign test tokens
+type testKey struct {
+	kid     string
+	alg     string
+	private crypto.Signer
+}
+
+func newTestKey(t testing.TB, kid, alg string) testKey {
+	t.Helper()
+
+	var private crypto.Signer
+	var err error
+
+	switch alg {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	return testKey{kid, alg, private}
+}
+
+func (k testKey) jwk() map[string]string {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	pad := func(n *big.Int) []byte { return n.FillBytes(make([]byte, 32)) }
+
+	switch public := k.private.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": k.kid, "n": encode(public.N.Bytes()), "e": encode(big.NewInt(int64(public.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": k.kid, "crv": "P-256", "x": encode(pad(public.X)), "y": encode(pad(public.Y))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": k.kid, "crv": "Ed25519", "x": encode(public)}
+	}
+	return nil
+}
+
+func (k testKey) sign(t testing.TB, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": k.alg, "kid": k.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	var err error
+
+	switch private := k.private.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		r, s, signErr := ecdsa.Sign(rand.Reader, private, digest[:])
+		signature, err = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), signErr
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(private, []byte(signed))
+	}
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func jwksJSON(keys ...testKey) []byte {
+	set := map[string][]map[string]string{"keys": {}}
+	for _, key := range keys {
+		set["keys"] = append(set["keys"], key.jwk())
+	}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+func writeJWKS(t testing.TB, keys ...testKey) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwksJSON(keys...), 0644); err != nil {
+		t.Fatalf("Error writing JWKS: %v", err)
+	}
+	return path
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"sub":   "alice",
+		"iss":   "https://id.example.com",
+		"aud":   []string{"fileserver"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "upload download-private",
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	config := auth.JWTConfig{
+		Issuer:       "https://id.example.com",
+		Audience:     "fileserver",
+		ScopeMapping: map[string]auth.Scope{"upload": auth.ScopeUpload, "download-private": auth.ScopeDownloadPrivate},
+	}
+
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		t.Run(alg+":verifies signed token", func(t *testing.T) {
+			key := newTestKey(t, "k1", alg)
+			keys, err := auth.NewJWKSFromFile(writeJWKS(t, key))
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			verifier := auth.NewJWTVerifier(keys, config)
+
+			identity, err := verifier.Verify(key.sign(t, validClaims()))
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			if identity.Name != "jwt:alice" {
+				t.Errorf("Got identity %q, want %q", identity.Name, "jwt:alice")
+			}
+			if !identity.HasScope(auth.ScopeUpload) || !identity.HasScope(auth.ScopeDownloadPrivate) || identity.HasScope(auth.ScopeAdmin) {
+				t.Errorf("Got scopes %v", identity.Scopes)
+			}
+		})
+	}
+
+	key := newTestKey(t, "k1", "ES256")
+	keys, _ := auth.NewJWKSFromFile(writeJWKS(t, key))
+	verifier := auth.NewJWTVerifier(keys, config)
+
+	invalid := []struct {
+		name   string
+		modify func(claims map[string]any)
+		want   error
+	}{
+		{"expired", func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, auth.ErrExpiredJWT},
+		{"missing exp", func(c map[string]any) { delete(c, "exp") }, auth.ErrInvalidJWT},
+		{"not yet valid", func(c map[string]any) { c["nbf"] = time.Now().Add(time.Hour).Unix() }, auth.ErrInvalidJWT},
+		{"wrong issuer", func(c map[string]any) { c["iss"] = "https://evil.example.com" }, auth.ErrInvalidJWT},
+		{"wrong audience", func(c map[string]any) { c["aud"] = "other" }, auth.ErrInvalidJWT},
+		{"missing issuer", func(c map[string]any) { delete(c, "iss") }, auth.ErrInvalidJWT},
+		{"missing audience", func(c map[string]any) { delete(c, "aud") }, auth.ErrInvalidJWT},
+		{"missing subject", func(c map[string]any) { delete(c, "sub") }, auth.ErrMissingIdentity},
+	}
+
+	for _, test := range invalid {
+		t.Run("rejects "+test.name, func(t *testing.T) {
+			claims := validClaims()
+			test.modify(claims)
+
+			_, err := verifier.Verify(key.sign(t, claims))
+			if err != test.want {
+				t.Errorf("Got error %v, want %v", err, test.want)
+			}
+		})
+	}
+
+	t.Run("rejects tampered payload", func(t *testing.T) {
+		token := key.sign(t, validClaims())
+		parts := strings.Split(token, ".")
+
+		claims := validClaims()
+		claims["sub"] = "mallory"
+		payload, _ := json.Marshal(claims)
+		parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+
+		_, err := verifier.Verify(strings.Join(parts, "."))
+		if err != auth.ErrInvalidJWT {
+			t.Errorf("Got error %v, want %v", err, auth.ErrInvalidJWT)
+		}
+	})
+	t.Run("rejects token signed by unknown key", func(t *testing.T) {
+		other := newTestKey(t, "k2", "ES256")
+
+		_, err := verifier.Verify(other.sign(t, validClaims()))
+		if err != auth.ErrUnknownKey {
+			t.Errorf("Got error %v, want %v", err, auth.ErrUnknownKey)
+		}
+	})
+	t.Run("rejects algorithm not matching the key", func(t *testing.T) {
+		confused := testKey{kid: "k1", alg: "EdDSA", private: newTestKey(t, "k1", "EdDSA").private}
+
+		_, err := verifier.Verify(confused.sign(t, validClaims()))
+		if err != auth.ErrInvalidJWT {
+			t.Errorf("Got error %v, want %v", err, auth.ErrInvalidJWT)
+		}
+	})
+	t.Run("maps claims to scopes", func(t *testing.T) {
+		mapped := auth.NewJWTVerifier(keys, auth.JWTConfig{
+			Issuer:        config.Issuer,
+			Audience:      config.Audience,
+			IdentityClaim: "email",
+			ScopesClaim:   "groups",
+			ScopeMapping:  map[string]auth.Scope{"fileserver-admins": auth.ScopeAdmin},
+		})
+
+		claims := validClaims()
+		claims["email"] = "alice@example.com"
+		claims["groups"] = []string{"staff", "fileserver-admins"}
+
+		identity, err := mapped.Verify(key.sign(t, claims))
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+		if identity.Name != "jwt:alice@example.com" {
+			t.Errorf("Got identity %q, want %q", identity.Name, "jwt:alice@example.com")
+		}
+		if len(identity.Scopes) != 1 || identity.Scopes[0] != auth.ScopeAdmin {
+			t.Errorf("Got scopes %v, want [admin]", identity.Scopes)
+		}
+	})
+	t.Run("grants only mapped scopes", func(t *testing.T) {
+		claims := validClaims()
+		claims["scope"] = "upload admin"
+
+		identity, err := verifier.Verify(key.sign(t, claims))
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+		if identity.HasScope(auth.ScopeAdmin) || !identity.HasScope(auth.ScopeUpload) {
+			t.Errorf("Got scopes %v, want [upload]", identity.Scopes)
+		}
+	})
+	t.Run("rejects every token without issuer and audience", func(t *testing.T) {
+		unconfigured := auth.NewJWTVerifier(keys, auth.JWTConfig{ScopeMapping: config.ScopeMapping})
+
+		_, err := unconfigured.Verify(key.sign(t, validClaims()))
+		if err != auth.ErrInvalidJWT {
+			t.Errorf("Got error %v, want %v", err, auth.ErrInvalidJWT)
+		}
+	})
+}
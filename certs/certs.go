@@ -0,0 +1,137 @@
+// Package certs serves TLS certificates that are reloaded from disk, so
+// that they can be renewed without restarting the server or dropping
+// established connections
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const CLIENT_AUTH_NONE = "none"
+const CLIENT_AUTH_OPTIONAL = "optional"
+const CLIENT_AUTH_REQUIRE = "require"
+
+// Reloader holds the current certificate of a PEM certificate chain and key
+// file pair. New handshakes use the certificate loaded last
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload loads the certificate files. The current certificate is kept if
+// they are invalid, e.g. while only one of them has been replaced
+func (r *Reloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to load TLS certificate %s\n%s", r.certFile, err))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// ReloadIfChanged reloads the certificate if either file was modified since
+// it was last loaded
+func (r *Reloader) ReloadIfChanged() (bool, error) {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	changed := !modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+
+	return true, r.Reload()
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *Reloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// NewTLSConfig builds a server config serving the certificates of r over
+// HTTP/2 and HTTP/1.1. Client certificates are verified against the PEM
+// bundle clientCAFile, depending on clientAuth
+func NewTLSConfig(r *Reloader, clientCAFile, clientAuth string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: r.GetCertificate,
+	}
+
+	switch clientAuth {
+	case "", CLIENT_AUTH_NONE:
+		return config, nil
+	case CLIENT_AUTH_OPTIONAL:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case CLIENT_AUTH_REQUIRE:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown client auth mode %q", clientAuth))
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New(fmt.Sprintf("No certificates found in %s", clientCAFile))
+	}
+
+	return config, nil
+}
@@ -0,0 +1,271 @@
+package certs_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/certs"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCert creates a certificate for name, signed by parent or self-signed if
+// parent is nil
+func newCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	signer := &testCert{template, key}
+	if parent != nil {
+		signer = parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert, key}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+
+	if err := os.WriteFile(certFile, c.certPEM(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, c.keyPEM(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// serve starts an HTTPS server with config and returns its URL
+func serve(t *testing.T, config *tls.Config, handler http.Handler) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: handler, TLSConfig: config}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+
+	return "https://" + listener.Addr().String()
+}
+
+func newClient(roots *x509.Certificate, certificates ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(roots)
+
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool, Certificates: certificates},
+		ForceAttemptHTTP2: true,
+	}}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	first := newCert(t, "first", nil, true)
+	first.write(t, certFile, keyFile)
+
+	reloader, err := certs.NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := certs.NewTLSConfig(reloader, "", certs.CLIENT_AUTH_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := serve(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	t.Run("serves HTTP/2", func(t *testing.T) {
+		response, err := newClient(first.cert).Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if response.ProtoMajor != 2 {
+			t.Errorf("Got protocol %s, want HTTP/2", response.Proto)
+		}
+	})
+	t.Run("keeps the certificate if files are unchanged", func(t *testing.T) {
+		changed, err := reloader.ReloadIfChanged()
+		if err != nil || changed {
+			t.Errorf("Got changed %v and error %v, want neither", changed, err)
+		}
+	})
+	t.Run("keeps the certificate if files are invalid", func(t *testing.T) {
+		os.WriteFile(keyFile, []byte("garbage"), 0600)
+		defer first.write(t, certFile, keyFile)
+
+		if err := reloader.Reload(); err == nil {
+			t.Error("Expected an error")
+		}
+
+		cert, _ := reloader.GetCertificate(nil)
+		if cert == nil || cert.Leaf != nil && cert.Leaf.Subject.CommonName != "first" {
+			t.Errorf("Got %v, want the first certificate", cert)
+		}
+	})
+	t.Run("serves renewed certificates", func(t *testing.T) {
+		second := newCert(t, "second", nil, true)
+		second.write(t, certFile, keyFile)
+
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(certFile, later, later)
+
+		changed, err := reloader.ReloadIfChanged()
+		if err != nil || !changed {
+			t.Fatalf("Got changed %v and error %v, want a reload", changed, err)
+		}
+
+		response, err := newClient(second.cert).Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		_, err = newClient(first.cert).Get(url)
+		if err == nil {
+			t.Error("Want the first certificate to be replaced")
+		}
+	})
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+
+	ca := newCert(t, "ca", nil, true)
+	newCert(t, "server", ca, false).write(t, certFile, keyFile)
+	os.WriteFile(caFile, ca.certPEM(), 0644)
+
+	alice := newCert(t, "alice", ca, false).tlsCertificate(t)
+	mallory := newCert(t, "mallory", nil, false).tlsCertificate(t)
+
+	reloader, err := certs.NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.Header().Set("X-Client", r.TLS.VerifiedChains[0][0].Subject.CommonName)
+		}
+	})
+
+	t.Run("requires client certificates", func(t *testing.T) {
+		config, err := certs.NewTLSConfig(reloader, caFile, certs.CLIENT_AUTH_REQUIRE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		url := serve(t, config, handler)
+
+		response, err := newClient(ca.cert, alice).Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if got := response.Header.Get("X-Client"); got != "alice" {
+			t.Errorf("Got client %q, want alice", got)
+		}
+
+		if _, err := newClient(ca.cert).Get(url); err == nil {
+			t.Error("Want requests without certificates to be rejected")
+		}
+		if _, err := newClient(ca.cert, mallory).Get(url); err == nil {
+			t.Error("Want certificates of other CAs to be rejected")
+		}
+	})
+	t.Run("accepts requests without certificates if optional", func(t *testing.T) {
+		config, err := certs.NewTLSConfig(reloader, caFile, certs.CLIENT_AUTH_OPTIONAL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		url := serve(t, config, handler)
+
+		response, err := newClient(ca.cert).Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Got status %d, want 200", response.StatusCode)
+		}
+	})
+	t.Run("rejects unknown modes", func(t *testing.T) {
+		_, err := certs.NewTLSConfig(reloader, caFile, "sometimes")
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
@@ -0,0 +1,390 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/middleware"
+	"github.com/olzhasar/go-fileserver/policy"
+	"github.com/olzhasar/go-fileserver/preview"
+	"github.com/olzhasar/go-fileserver/scanner"
+	"github.com/olzhasar/go-fileserver/sniff"
+)
+
+const REGISTRY_SQLITE = "sqlite"
+const REGISTRY_MEMORY = "memory"
+
+const STORAGE_FILESYSTEM = "filesystem"
+const STORAGE_MEMORY = "memory"
+
+const LOG_OUTPUT_STDERR = "stderr"
+const LOG_OUTPUT_FILE = "file"
+
+const REDACTED = "REDACTED"
+
+const DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+
+// Config is the complete server configuration. Fields are filled from
+// defaults, a YAML file, FILESERVER_* environment variables and flags, in
+// that order of precedence. Every field can be set with a flag named after
+// its YAML path, e.g. -server.address or -log.level. The env tag of nested
+// structs is a prefix of the env tags of their fields. Fields tagged with
+// secret are redacted by Redacted, fields and structs tagged with reload can
+// be changed without a restart
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Registry  RegistryConfig  `yaml:"registry"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Log       LogConfig       `yaml:"log" reload:"true"`
+	AccessLog AccessLogConfig `yaml:"access_log"`
+	Signing   SigningConfig   `yaml:"signing" reload:"true"`
+	Admin     AdminConfig     `yaml:"admin" reload:"true"`
+	JWT       JWTConfig       `yaml:"jwt" reload:"true"`
+	Quotas    QuotasConfig    `yaml:"quotas" reload:"true"`
+	Preview   PreviewConfig   `yaml:"preview" reload:"true"`
+	Uploads   UploadsConfig   `yaml:"uploads" reload:"true"`
+	Scanning  ScanningConfig  `yaml:"scanning"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+}
+
+type ServerConfig struct {
+	// Address and AdminAddress are comma-separated lists of host:port,
+	// unix:/path/to.sock or systemd:name addresses
+	Address          string   `yaml:"address" env:"FILESERVER_ADDRESS" usage:"Comma-separated addresses to listen on: host:port, unix:path or systemd:name"`
+	AdminAddress     string   `yaml:"admin_address" env:"FILESERVER_ADMIN_ADDRESS" usage:"Comma-separated addresses serving health checks, metrics and the admin API"`
+	SocketMode       string   `yaml:"socket_mode" env:"FILESERVER_SOCKET_MODE" usage:"Octal permissions of Unix sockets"`
+	AnonymousUploads bool     `yaml:"anonymous_uploads" env:"FILESERVER_ANONYMOUS_UPLOADS" usage:"Allow uploads without authentication"`
+	ShutdownTimeout  Duration `yaml:"shutdown_timeout" env:"FILESERVER_SHUTDOWN_TIMEOUT" usage:"Time given to in-flight requests on shutdown"`
+	DrainDelay       Duration `yaml:"drain_delay" env:"FILESERVER_DRAIN_DELAY" usage:"Time to fail readiness checks before shutting down"`
+	// TrustedProxies is a comma-separated list of IPs, CIDRs and "unix"
+	TrustedProxies string `yaml:"trusted_proxies" env:"FILESERVER_TRUSTED_PROXIES" usage:"Comma-separated IPs, CIDRs or unix allowed to set X-Forwarded-For"`
+}
+
+// TLSConfig enables HTTPS on the server address when a certificate is set.
+// Certificate files are reloaded when they change
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file" env:"FILESERVER_TLS_CERT_FILE" usage:"PEM certificate chain, enables HTTPS"`
+	KeyFile      string `yaml:"key_file" env:"FILESERVER_TLS_KEY_FILE" usage:"PEM private key of the certificate"`
+	ClientCAFile string `yaml:"client_ca_file" env:"FILESERVER_TLS_CLIENT_CA_FILE" usage:"PEM bundle of CAs verifying client certificates"`
+	// ClientAuth is "none", "optional" or "require"
+	ClientAuth      string `yaml:"client_auth" env:"FILESERVER_TLS_CLIENT_AUTH" usage:"Client certificates: none, optional or require"`
+	ClientScopes    string `yaml:"client_scopes" env:"FILESERVER_TLS_CLIENT_SCOPES" usage:"Comma-separated scopes granted to client certificates"`
+	RedirectAddress string `yaml:"redirect_address" env:"FILESERVER_TLS_REDIRECT_ADDRESS" usage:"Address of a listener redirecting HTTP to HTTPS"`
+}
+
+type RegistryConfig struct {
+	// Backend is "sqlite" or "memory"
+	Backend string `yaml:"backend" env:"FILESERVER_REGISTRY" usage:"Registry backend: sqlite or memory"`
+	Path    string `yaml:"path" env:"FILESERVER_DB_PATH" usage:"Path of the SQLite database"`
+}
+
+type StorageConfig struct {
+	// Backend is "filesystem" or "memory"
+	Backend      string `yaml:"backend" env:"FILESERVER_STORAGE" usage:"Storage backend: filesystem or memory"`
+	Dir          string `yaml:"dir" env:"FILESERVER_UPLOAD_DIR" usage:"Directory of uploaded files"`
+	MinFreeBytes int64  `yaml:"min_free_bytes" env:"FILESERVER_MIN_FREE_BYTES" usage:"Free disk space below which readiness checks fail"`
+}
+
+type LogConfig struct {
+	Level string `yaml:"level" env:"FILESERVER_LOG_LEVEL" usage:"Log level: debug, info, warn or error"`
+	// Format is "plain", "text" or "json"
+	Format string `yaml:"format" env:"FILESERVER_LOG_FORMAT" usage:"Log format: plain, text or json"`
+	// Output is "stderr" or "file"
+	Output     string `yaml:"output" env:"FILESERVER_LOG_OUTPUT" usage:"Log output: stderr or file"`
+	File       string `yaml:"file" env:"FILESERVER_LOG_FILE" usage:"Log file path, implies file output"`
+	MaxSize    int64  `yaml:"max_size" env:"FILESERVER_LOG_MAX_SIZE" usage:"Size in bytes at which the log file is rotated"`
+	Daily      bool   `yaml:"daily" env:"FILESERVER_LOG_DAILY" usage:"Rotate the log file daily"`
+	MaxBackups int    `yaml:"max_backups" env:"FILESERVER_LOG_MAX_BACKUPS" usage:"Number of rotated log files to keep"`
+}
+
+type AccessLogConfig struct {
+	Format string `yaml:"format" env:"FILESERVER_ACCESS_LOG_FORMAT" usage:"Access log format: combined or json"`
+}
+
+type SigningConfig struct {
+	Keys      string `yaml:"keys" env:"FILESERVER_SIGNING_KEYS" secret:"true" usage:"Comma-separated id:secret URL signing keys"`
+	SignToken string `yaml:"sign_token" env:"FILESERVER_SIGN_TOKEN" secret:"true" usage:"Bearer token allowed to sign URLs"`
+}
+
+// AdminConfig secures the admin API served on the admin address. API keys
+// with the admin scope are accepted as well
+type AdminConfig struct {
+	Token string `yaml:"token" env:"FILESERVER_ADMIN_TOKEN" secret:"true" usage:"Bearer token of the admin API"`
+}
+
+type JWTConfig struct {
+	JWKSFile      string `yaml:"jwks_file" env:"FILESERVER_JWKS_FILE" usage:"Path of a JWKS file"`
+	JWKSURL       string `yaml:"jwks_url" env:"FILESERVER_JWKS_URL" usage:"URL of a JWKS endpoint"`
+	Issuer        string `yaml:"issuer" env:"FILESERVER_JWT_ISSUER" usage:"Required JWT issuer"`
+	Audience      string `yaml:"audience" env:"FILESERVER_JWT_AUDIENCE" usage:"Required JWT audience"`
+	IdentityClaim string `yaml:"identity_claim" env:"FILESERVER_JWT_IDENTITY_CLAIM" usage:"JWT claim holding the identity name"`
+	ScopesClaim   string `yaml:"scopes_claim" env:"FILESERVER_JWT_SCOPES_CLAIM" usage:"JWT claim holding the scopes"`
+	ScopeMapping  string `yaml:"scope_mapping" env:"FILESERVER_JWT_SCOPE_MAPPING" usage:"Comma-separated claim=scope pairs granting scopes to JWT claim values"`
+}
+
+type QuotaConfig struct {
+	MaxFiles int64 `yaml:"max_files" env:"MAX_FILES" usage:"Maximum number of files"`
+	MaxBytes int64 `yaml:"max_bytes" env:"MAX_BYTES" usage:"Maximum total size of files"`
+}
+
+// QuotasConfig reads FILESERVER_USER_MAX_FILES, FILESERVER_MAX_FILES and
+// so on from the environment
+type QuotasConfig struct {
+	PerUser QuotaConfig `yaml:"per_user" env:"FILESERVER_USER_"`
+	Global  QuotaConfig `yaml:"global" env:"FILESERVER_"`
+}
+
+// PreviewConfig lists the types served inline by previews. HTML, SVG and
+// XML are always served as attachments
+type PreviewConfig struct {
+	InlineTypes string `yaml:"inline_types" env:"FILESERVER_PREVIEW_INLINE_TYPES" usage:"Comma-separated MIME types previewed inline, e.g. image/* or application/pdf"`
+}
+
+// UploadsConfig holds the upload rules applying to everyone. Types are
+// detected from the first bytes of uploads, whatever their file name, and
+// UsersFile overrides the rules for some identities
+type UploadsConfig struct {
+	AllowedTypes      string `yaml:"allowed_types" env:"FILESERVER_ALLOWED_TYPES" usage:"Comma-separated MIME types accepted on upload, e.g. image/* or application/pdf"`
+	BlockedTypes      string `yaml:"blocked_types" env:"FILESERVER_BLOCKED_TYPES" usage:"Comma-separated MIME types rejected on upload, e.g. application/x-executable or video/*"`
+	AllowedExtensions string `yaml:"allowed_extensions" env:"FILESERVER_ALLOWED_EXTENSIONS" usage:"Comma-separated file extensions accepted on upload, e.g. pdf,tar.gz"`
+	BlockedExtensions string `yaml:"blocked_extensions" env:"FILESERVER_BLOCKED_EXTENSIONS" usage:"Comma-separated file extensions rejected on upload, e.g. exe,bat"`
+	AllowedNames      string `yaml:"allowed_names" env:"FILESERVER_ALLOWED_NAMES" usage:"Comma-separated glob patterns of file names accepted on upload, e.g. report-*"`
+	BlockedNames      string `yaml:"blocked_names" env:"FILESERVER_BLOCKED_NAMES" usage:"Comma-separated glob patterns of file names rejected on upload, e.g. .htaccess,*.tmp"`
+	RejectMismatch    bool   `yaml:"reject_mismatch" env:"FILESERVER_REJECT_MISMATCHED_TYPES" usage:"Reject uploads whose content does not match their extension"`
+	MaxSize           int64  `yaml:"max_size" env:"FILESERVER_MAX_FILE_SIZE" usage:"Maximum size of uploaded files in bytes"`
+	MaxSizes          string `yaml:"max_sizes" env:"FILESERVER_MAX_FILE_SIZES" usage:"Comma-separated maximum sizes in bytes by MIME type, e.g. image/*=10485760"`
+	UsersFile         string `yaml:"users_file" env:"FILESERVER_UPLOAD_USERS_FILE" usage:"YAML file overriding upload rules for some identities"`
+}
+
+// ScanningConfig streams uploads to a clamd daemon. Scanning is disabled
+// unless ClamdAddress is set
+type ScanningConfig struct {
+	ClamdAddress string   `yaml:"clamd_address" env:"FILESERVER_CLAMD_ADDRESS" usage:"Address of clamd, e.g. 127.0.0.1:3310 or unix:/run/clamav/clamd.ctl"`
+	Mode         string   `yaml:"mode" env:"FILESERVER_SCAN_MODE" usage:"sync to scan uploads before responding, async to scan them afterwards"`
+	Timeout      Duration `yaml:"timeout" env:"FILESERVER_SCAN_TIMEOUT" usage:"Maximum duration of a scan"`
+}
+
+type RateLimitConfig struct {
+	// Requests per minute
+	Requests int64 `yaml:"requests" env:"FILESERVER_RATE_LIMIT_REQUESTS" reload:"true" usage:"Requests per minute per client"`
+	// UploadBytes per second
+	UploadBytes int64 `yaml:"upload_bytes" env:"FILESERVER_RATE_LIMIT_UPLOAD_BYTES" reload:"true" usage:"Upload bytes per second per client"`
+	// FailedLookups per hour
+	FailedLookups int64  `yaml:"failed_lookups" env:"FILESERVER_RATE_LIMIT_FAILED_LOOKUPS" reload:"true" usage:"Failed downloads per hour per client"`
+	Redis         string `yaml:"redis" env:"FILESERVER_RATE_LIMIT_REDIS" secret:"true" usage:"Address of a Redis server shared by instances"`
+}
+
+type MetricsConfig struct {
+	Enabled bool `yaml:"enabled" env:"FILESERVER_METRICS" usage:"Expose Prometheus metrics at /metrics"`
+}
+
+type TracingConfig struct {
+	// Exporter is "none", "stdout", "file" or "otlp"
+	Exporter    string  `yaml:"exporter" env:"FILESERVER_TRACE_EXPORTER" usage:"Trace exporter: none, stdout, file or otlp"`
+	Endpoint    string  `yaml:"endpoint" env:"FILESERVER_TRACE_ENDPOINT" usage:"OTLP/HTTP collector host:port"`
+	File        string  `yaml:"file" env:"FILESERVER_TRACE_FILE" usage:"File receiving spans with the file exporter"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"FILESERVER_TRACE_SAMPLE_RATIO" usage:"Fraction of new traces to sample"`
+}
+
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Address:         ":8080",
+			SocketMode:      "0660",
+			ShutdownTimeout: Duration(DEFAULT_SHUTDOWN_TIMEOUT),
+		},
+		TLS:      TLSConfig{ClientAuth: "none", ClientScopes: "upload"},
+		Registry: RegistryConfig{Backend: REGISTRY_SQLITE, Path: "./db.sqlite3"},
+		Storage:  StorageConfig{Backend: STORAGE_FILESYSTEM, Dir: "uploads"},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "plain",
+			Output: LOG_OUTPUT_STDERR,
+		},
+		AccessLog: AccessLogConfig{Format: "combined"},
+		Preview:   PreviewConfig{InlineTypes: preview.DEFAULT_INLINE_TYPES},
+		Scanning:  ScanningConfig{Mode: "sync", Timeout: Duration(scanner.DEFAULT_TIMEOUT)},
+		Tracing:   TracingConfig{Exporter: "none"},
+	}
+}
+
+// Validate reports every invalid setting at once
+func (c Config) Validate() error {
+	var errs []error
+
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, errors.New(fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(c.Server.Address != "", "server.address is required")
+	_, err := strconv.ParseUint(c.Server.SocketMode, 8, 32)
+	check(err == nil, "server.socket_mode %q is not an octal file mode", c.Server.SocketMode)
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Server.DrainDelay >= 0, "server.drain_delay must not be negative")
+	if _, err := middleware.ParseTrustedProxies(c.Server.TrustedProxies); err != nil {
+		errs = append(errs, errors.New(fmt.Sprintf("server.trusted_proxies: %s", err)))
+	}
+
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.cert_file and tls.key_file must be set together")
+	check(oneOf(c.TLS.ClientAuth, "none", "optional", "require"), "tls.client_auth %q is not one of none, optional, require", c.TLS.ClientAuth)
+	check(c.TLS.ClientAuth == "none" || c.TLS.ClientCAFile != "", "tls.client_ca_file is required to verify client certificates")
+	check(c.TLS.ClientAuth == "none" || c.TLS.CertFile != "", "tls.cert_file is required to verify client certificates")
+	check(c.TLS.RedirectAddress == "" || c.TLS.CertFile != "", "tls.cert_file is required by the redirect listener")
+	if _, err := auth.ParseScopes(c.TLS.ClientScopes); err != nil {
+		errs = append(errs, errors.New(fmt.Sprintf("tls.client_scopes: %s", err)))
+	}
+
+	check(oneOf(c.Registry.Backend, REGISTRY_SQLITE, REGISTRY_MEMORY), "registry.backend %q is not one of sqlite, memory", c.Registry.Backend)
+	check(c.Registry.Backend != REGISTRY_SQLITE || c.Registry.Path != "", "registry.path is required by the sqlite registry")
+
+	check(oneOf(c.Storage.Backend, STORAGE_FILESYSTEM, STORAGE_MEMORY), "storage.backend %q is not one of filesystem, memory", c.Storage.Backend)
+	check(c.Storage.Backend != STORAGE_FILESYSTEM || c.Storage.Dir != "", "storage.dir is required by the filesystem storage")
+	check(c.Storage.MinFreeBytes >= 0, "storage.min_free_bytes must not be negative")
+
+	check(oneOf(strings.ToLower(c.Log.Level), "debug", "info", "warn", "warning", "error"), "log.level %q is not one of debug, info, warn, error", c.Log.Level)
+	check(oneOf(c.Log.Format, "plain", "text", "json"), "log.format %q is not one of plain, text, json", c.Log.Format)
+	check(oneOf(c.Log.Output, LOG_OUTPUT_STDERR, LOG_OUTPUT_FILE), "log.output %q is not one of stderr, file", c.Log.Output)
+	check(c.Log.Output != LOG_OUTPUT_FILE || c.Log.File != "", "log.file is required by the file log output")
+	check(c.Log.MaxSize >= 0 && c.Log.MaxBackups >= 0, "log.max_size and log.max_backups must not be negative")
+
+	check(oneOf(c.AccessLog.Format, "combined", "json"), "access_log.format %q is not one of combined, json", c.AccessLog.Format)
+
+	check(c.Admin.Token == "" || c.Server.AdminAddress != "", "server.admin_address is required by the admin API")
+
+	check(c.JWT.JWKSFile == "" || c.JWT.JWKSURL == "", "jwt.jwks_file and jwt.jwks_url are mutually exclusive")
+	if c.JWT.JWKSFile != "" || c.JWT.JWKSURL != "" {
+		check(c.JWT.Issuer != "" && c.JWT.Audience != "", "jwt.issuer and jwt.audience are required by JWT authentication")
+	}
+	if _, err := auth.ParseScopeMapping(c.JWT.ScopeMapping); err != nil {
+		errs = append(errs, errors.New(fmt.Sprintf("jwt.scope_mapping: %s", err)))
+	}
+
+	for name, quota := range map[string]QuotaConfig{"per_user": c.Quotas.PerUser, "global": c.Quotas.Global} {
+		check(quota.MaxFiles >= 0 && quota.MaxBytes >= 0, "quotas.%s must not be negative", name)
+	}
+
+	if _, err := preview.ParsePolicy(c.Preview.InlineTypes); err != nil {
+		errs = append(errs, errors.New(fmt.Sprintf("preview.inline_types: %s", err)))
+	}
+	for _, list := range []struct {
+		key   string
+		value string
+		parse func(string) ([]string, error)
+	}{
+		{"allowed_types", c.Uploads.AllowedTypes, sniff.ParseTypes},
+		{"blocked_types", c.Uploads.BlockedTypes, sniff.ParseTypes},
+		{"allowed_extensions", c.Uploads.AllowedExtensions, policy.ParseExtensions},
+		{"blocked_extensions", c.Uploads.BlockedExtensions, policy.ParseExtensions},
+		{"allowed_names", c.Uploads.AllowedNames, policy.ParseNames},
+		{"blocked_names", c.Uploads.BlockedNames, policy.ParseNames},
+	} {
+		if _, err := list.parse(list.value); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("uploads.%s: %s", list.key, err)))
+		}
+	}
+	if _, err := policy.ParseSizes(c.Uploads.MaxSizes); err != nil {
+		errs = append(errs, errors.New(fmt.Sprintf("uploads.max_sizes: %s", err)))
+	}
+	check(c.Uploads.MaxSize >= 0, "uploads.max_size must not be negative")
+
+	if c.Scanning.ClamdAddress != "" {
+		if _, err := scanner.NewClamd(c.Scanning.ClamdAddress); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("scanning.clamd_address: %s", err)))
+		}
+	}
+	check(oneOf(c.Scanning.Mode, "sync", "async"), "scanning.mode %q is not one of sync, async", c.Scanning.Mode)
+	check(c.Scanning.Timeout >= 0, "scanning.timeout must not be negative")
+
+	check(c.RateLimit.Requests >= 0 && c.RateLimit.UploadBytes >= 0 && c.RateLimit.FailedLookups >= 0, "rate_limit values must not be negative")
+
+	check(oneOf(c.Tracing.Exporter, "none", "stdout", "file", "otlp"), "tracing.exporter %q is not one of none, stdout, file, otlp", c.Tracing.Exporter)
+	check(c.Tracing.Exporter != "file" || c.Tracing.File != "", "tracing.file is required by the file exporter")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with secrets replaced by REDACTED
+func (c Config) Redacted() Config {
+	redactSecrets(&c)
+	return c
+}
+
+// Reload returns next with every setting that requires a restart reset to
+// its value in c, and the keys of the settings that were reset
+func (c Config) Reload(next Config) (Config, []string) {
+	var current []field
+	walkFields(reflect.ValueOf(&c).Elem(), "", "", false, func(f field) {
+		current = append(current, f)
+	})
+
+	var rejected []string
+	i := 0
+	walkFields(reflect.ValueOf(&next).Elem(), "", "", false, func(f field) {
+		old := current[i]
+		i++
+
+		if !f.reloadable && !f.value.Equal(old.value) {
+			f.value.Set(old.value)
+			rejected = append(rejected, f.key)
+		}
+	})
+
+	return next, rejected
+}
+
+// WriteYAML writes the config in the format read by LoadFile
+func (c Config) WriteYAML(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	err := encoder.Encode(c)
+	if err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
+
+func oneOf(value string, options ...string) bool {
+	for _, option := range options {
+		if value == option {
+			return true
+		}
+	}
+	return false
+}
+
+// Duration is a time.Duration written as "30s" in YAML, environment
+// variables and flags
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := time.ParseDuration(node.Value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,258 @@
+package config_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/config"
+)
+
+func newLoader(env map[string]string) *config.Loader {
+	loader := config.NewLoader("fileserver")
+	loader.LookupEnv = func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+	return loader
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("uses defaults", func(t *testing.T) {
+		got, err := newLoader(nil).Load(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := config.Default()
+		if got != want {
+			t.Errorf("Got %+v, want %+v", got, want)
+		}
+	})
+	t.Run("applies file, env and flags in order", func(t *testing.T) {
+		path := writeFile(t, `
+server:
+  address: ":9000"
+  shutdown_timeout: 1m
+log:
+  level: debug
+quotas:
+  per_user:
+    max_files: 10
+rate_limit:
+  requests: 60
+`)
+		loader := newLoader(map[string]string{
+			"FILESERVER_CONFIG":         path,
+			"FILESERVER_LOG_LEVEL":      "warn",
+			"FILESERVER_USER_MAX_BYTES": "2048",
+			"FILESERVER_MAX_FILES":      "100",
+			"FILESERVER_ADDRESS":        ":9001",
+		})
+
+		got, err := loader.Load([]string{"-server.address", ":9002", "-metrics.enabled"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Server.Address != ":9002" {
+			t.Errorf("Got address %q, want the flag value", got.Server.Address)
+		}
+		if got.Server.ShutdownTimeout != config.Duration(time.Minute) {
+			t.Errorf("Got shutdown timeout %s, want the file value", got.Server.ShutdownTimeout)
+		}
+		if got.Log.Level != "warn" {
+			t.Errorf("Got log level %q, want the env value", got.Log.Level)
+		}
+		if got.Quotas.PerUser != (config.QuotaConfig{MaxFiles: 10, MaxBytes: 2048}) {
+			t.Errorf("Got per user quota %+v", got.Quotas.PerUser)
+		}
+		if got.Quotas.Global.MaxFiles != 100 {
+			t.Errorf("Got global quota %+v", got.Quotas.Global)
+		}
+		if got.RateLimit.Requests != 60 || !got.Metrics.Enabled {
+			t.Errorf("Got rate limit %+v and metrics %+v", got.RateLimit, got.Metrics)
+		}
+	})
+	t.Run("prefers the config flag over the env", func(t *testing.T) {
+		path := writeFile(t, "registry:\n  backend: memory\n")
+		loader := newLoader(map[string]string{"FILESERVER_CONFIG": "missing.yaml"})
+
+		got, err := loader.Load([]string{"-config", path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Registry.Backend != config.REGISTRY_MEMORY {
+			t.Errorf("Got registry %q, want memory", got.Registry.Backend)
+		}
+	})
+	t.Run("logs to the configured file", func(t *testing.T) {
+		got, err := newLoader(map[string]string{"FILESERVER_LOG_FILE": "server.log"}).Load(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Log.Output != config.LOG_OUTPUT_FILE {
+			t.Errorf("Got log output %q, want file", got.Log.Output)
+		}
+	})
+	t.Run("rejects unknown file keys", func(t *testing.T) {
+		path := writeFile(t, "server:\n  port: 8080\n")
+
+		_, err := newLoader(nil).Load([]string{"-config", path})
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+	t.Run("rejects malformed env values", func(t *testing.T) {
+		_, err := newLoader(map[string]string{"FILESERVER_MAX_FILES": "many"}).Load(nil)
+		if err == nil || !strings.Contains(err.Error(), "FILESERVER_MAX_FILES") {
+			t.Errorf("Got %v, want an error naming the variable", err)
+		}
+	})
+	t.Run("rejects unknown flags", func(t *testing.T) {
+		loader := newLoader(nil)
+		loader.FlagSet().SetOutput(&bytes.Buffer{})
+
+		_, err := loader.Load([]string{"-server.port", "8080"})
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	c := config.Default()
+	c.Registry.Backend = "postgres"
+	c.Storage.Dir = ""
+	c.Tracing.SampleRatio = 2
+	c.Server.SocketMode = "rw"
+	c.Server.TrustedProxies = "10.0.0.0/33"
+	c.Admin.Token = "secret"
+	c.Preview.InlineTypes = "image"
+	c.Uploads.BlockedTypes = "*/*"
+	c.Uploads.AllowedNames = "[a-"
+	c.Uploads.MaxSizes = "image/*"
+	c.Scanning.ClamdAddress = "localhost"
+	c.Scanning.Mode = "later"
+	c.JWT.JWKSURL = "https://id.example.com/jwks"
+	c.JWT.ScopeMapping = "staff=root"
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	for _, want := range []string{"registry.backend", "storage.dir", "tracing.sample_ratio", "server.socket_mode", "server.trusted_proxies", "server.admin_address", "preview.inline_types", "uploads.blocked_types", "uploads.allowed_names", "uploads.max_sizes", "scanning.clamd_address", "scanning.mode", "jwt.issuer", "jwt.scope_mapping"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Got %q, want it to mention %s", err, want)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := config.Default()
+	c.Signing.Keys = "k1:secret"
+	c.Signing.SignToken = "token"
+
+	redacted := c.Redacted()
+
+	if redacted.Signing.Keys != config.REDACTED || redacted.Signing.SignToken != config.REDACTED {
+		t.Errorf("Got %+v, want secrets redacted", redacted.Signing)
+	}
+	if redacted.RateLimit.Redis != "" {
+		t.Errorf("Got %q, want unset secrets to stay empty", redacted.RateLimit.Redis)
+	}
+	if c.Signing.Keys != "k1:secret" {
+		t.Error("Want the original config to be unchanged")
+	}
+}
+
+func TestWriteYAML(t *testing.T) {
+	c := config.Default()
+	c.Server.DrainDelay = config.Duration(5 * time.Second)
+	c.Quotas.Global.MaxBytes = 1 << 30
+
+	var buf bytes.Buffer
+	err := c.WriteYAML(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeFile(t, buf.String())
+	got := config.Config{}
+	err = config.LoadFile(path, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != c {
+		t.Errorf("Got %+v, want %+v", got, c)
+	}
+}
+
+func TestReload(t *testing.T) {
+	current := config.Default()
+
+	next := config.Default()
+	next.Server.Address = ":9000"
+	next.Storage.Backend = config.STORAGE_MEMORY
+	next.Log.Level = "debug"
+	next.Quotas.PerUser.MaxFiles = 10
+	next.RateLimit.Requests = 60
+	next.RateLimit.Redis = "localhost:6379"
+
+	got, rejected := current.Reload(next)
+
+	if got.Log.Level != "debug" || got.Quotas.PerUser.MaxFiles != 10 || got.RateLimit.Requests != 60 {
+		t.Errorf("Got %+v, want reloadable settings applied", got)
+	}
+	if got.Server.Address != current.Server.Address || got.Storage.Backend != current.Storage.Backend || got.RateLimit.Redis != "" {
+		t.Errorf("Got %+v, want restart-only settings kept", got)
+	}
+
+	want := []string{"server.address", "storage.backend", "rate_limit.redis"}
+	if strings.Join(rejected, ",") != strings.Join(want, ",") {
+		t.Errorf("Got rejected %v, want %v", rejected, want)
+	}
+}
+
+func TestLoaderReload(t *testing.T) {
+	path := writeFile(t, "log:\n  level: info\n")
+	loader := newLoader(nil)
+
+	_, err := loader.Load([]string{"-config", path, "-quotas.global.max_files", "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, []byte("log:\n  level: error\nquotas:\n  global:\n    max_files: 1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loader.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Log.Level != "error" {
+		t.Errorf("Got log level %q, want the new file value", got.Log.Level)
+	}
+	if got.Quotas.Global.MaxFiles != 5 {
+		t.Errorf("Got max files %d, want the flag to keep precedence", got.Quotas.Global.MaxFiles)
+	}
+}
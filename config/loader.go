@@ -0,0 +1,271 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const CONFIG_ENV = "FILESERVER_CONFIG"
+const CONFIG_FLAG = "config"
+
+// Loader builds a Config from defaults, a YAML file, environment variables
+// and command line flags. Later sources override earlier ones
+type Loader struct {
+	// LookupEnv reads environment variables, os.LookupEnv by default
+	LookupEnv func(key string) (string, bool)
+
+	flags      *flag.FlagSet
+	flagValues map[string]string
+	configPath string
+}
+
+// NewLoader registers a flag for every config field on a new flag set named
+// name, plus -config for the YAML file path
+func NewLoader(name string) *Loader {
+	l := &Loader{
+		LookupEnv:  os.LookupEnv,
+		flags:      flag.NewFlagSet(name, flag.ContinueOnError),
+		flagValues: map[string]string{},
+	}
+
+	l.flags.StringVar(&l.configPath, CONFIG_FLAG, "", "Path of a YAML config file, also read from "+CONFIG_ENV)
+
+	defaults := Default()
+	walkFields(reflect.ValueOf(&defaults).Elem(), "", "", false, func(f field) {
+		usage := f.usage
+		if f.env != "" {
+			usage += " (" + f.env + ")"
+		}
+		l.flags.Var(&flagValue{l, f.key, f.value.Kind() == reflect.Bool, formatValue(f.value)}, f.key, usage)
+	})
+
+	return l
+}
+
+// FlagSet returns the flags of the loader, so that callers can register
+// their own before calling Load
+func (l *Loader) FlagSet() *flag.FlagSet {
+	return l.flags
+}
+
+// Load parses args and returns the validated config
+func (l *Loader) Load(args []string) (Config, error) {
+	err := l.flags.Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+
+	return l.Reload()
+}
+
+// Path returns the path of the YAML file, empty if there is none
+func (l *Loader) Path() string {
+	if l.configPath != "" {
+		return l.configPath
+	}
+	path, _ := l.LookupEnv(CONFIG_ENV)
+	return path
+}
+
+// Reload reads the YAML file and environment again and applies the flags
+// parsed by Load. Only the file is expected to change while running
+func (l *Loader) Reload() (Config, error) {
+	config := Default()
+
+	if path := l.Path(); path != "" {
+		err := LoadFile(path, &config)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	var errs []error
+	var logOutputSet bool
+
+	walkFields(reflect.ValueOf(&config).Elem(), "", "", false, func(f field) {
+		if f.env != "" {
+			if value, ok := l.LookupEnv(f.env); ok && value != "" {
+				if err := setValue(f.value, value); err != nil {
+					errs = append(errs, errors.New(fmt.Sprintf("%s: invalid value %q", f.env, value)))
+				}
+				logOutputSet = logOutputSet || f.key == "log.output"
+			}
+		}
+
+		if value, ok := l.flagValues[f.key]; ok {
+			if err := setValue(f.value, value); err != nil {
+				errs = append(errs, errors.New(fmt.Sprintf("-%s: invalid value %q", f.key, value)))
+			}
+			logOutputSet = logOutputSet || f.key == "log.output"
+		}
+	})
+
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, err
+	}
+
+	// Setting a log file is enough to log to it
+	if config.Log.File != "" && !logOutputSet && config.Log.Output == LOG_OUTPUT_STDERR {
+		config.Log.Output = LOG_OUTPUT_FILE
+	}
+
+	return config, config.Validate()
+}
+
+// LoadFile reads the YAML file at path into config. Keys missing from the
+// file keep their current values, unknown keys are errors
+func LoadFile(path string, config *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errors.New(fmt.Sprintf("Invalid config file %s\n%s", path, err))
+	}
+
+	return nil
+}
+
+func redactSecrets(config *Config) {
+	walkFields(reflect.ValueOf(config).Elem(), "", "", false, func(f field) {
+		if f.secret && f.value.String() != "" {
+			f.value.SetString(REDACTED)
+		}
+	})
+}
+
+// field is a settable leaf of the config
+type field struct {
+	key        string
+	env        string
+	usage      string
+	secret     bool
+	reloadable bool
+	value      reflect.Value
+}
+
+// walkFields calls fn for every leaf of the struct v. Keys are joined YAML
+// names, env tags of nested structs prefix those of their fields and
+// fields of reloadable structs are reloadable
+func walkFields(v reflect.Value, keyPrefix, envPrefix string, reloadable bool, fn func(f field)) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+
+		key := keyPrefix + structField.Tag.Get("yaml")
+		env := structField.Tag.Get("env")
+		if env != "" {
+			env = envPrefix + env
+		}
+
+		fieldReloadable := reloadable || structField.Tag.Get("reload") == "true"
+
+		value := v.Field(i)
+		if value.Kind() == reflect.Struct {
+			walkFields(value, key+".", env, fieldReloadable, fn)
+			continue
+		}
+
+		fn(field{
+			key:        key,
+			env:        env,
+			usage:      structField.Tag.Get("usage"),
+			secret:     structField.Tag.Get("secret") == "true",
+			reloadable: fieldReloadable,
+			value:      value,
+		})
+	}
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+func setValue(v reflect.Value, raw string) error {
+	if v.Type() == durationType {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(parsed))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(parsed)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(parsed)
+	default:
+		return errors.New(fmt.Sprintf("Unsupported config field type %s", v.Type()))
+	}
+
+	return nil
+}
+
+func formatValue(v reflect.Value) string {
+	if v.Type() == durationType {
+		return Duration(v.Int()).String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// flagValue records the raw flag value, which is applied after the YAML
+// file and environment variables
+type flagValue struct {
+	loader       *Loader
+	key          string
+	isBool       bool
+	defaultValue string
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.defaultValue
+}
+
+func (f *flagValue) Set(value string) error {
+	if f.isBool {
+		_, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+	}
+	f.loader.flagValues[f.key] = value
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
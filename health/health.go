@@ -0,0 +1,147 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const STATUS_OK = "ok"
+const STATUS_ERROR = "error"
+
+const DEFAULT_TIMEOUT = 5 * time.Second
+
+// HealthChecker is implemented by registries, storages and other backends
+// able to verify that they can serve requests
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+type ComponentStatus struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type Report struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+func (r Report) IsHealthy() bool {
+	return r.Status == STATUS_OK
+}
+
+type component struct {
+	name    string
+	checker HealthChecker
+}
+
+// Checker runs the health checks of registered components concurrently
+type Checker struct {
+	components []component
+	timeout    time.Duration
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	return &Checker{timeout: timeout}
+}
+
+// Add registers value under name if it implements HealthChecker and reports
+// whether it was added
+func (c *Checker) Add(name string, value any) bool {
+	checker, ok := value.(HealthChecker)
+	if ok {
+		c.components = append(c.components, component{name, checker})
+	}
+	return ok
+}
+
+// Check reports every component as failed if its check errors or does not
+// finish before the checker timeout
+func (c *Checker) Check(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	report := Report{Status: STATUS_OK, Components: make(map[string]ComponentStatus)}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, comp := range c.components {
+		wg.Add(1)
+		go func(comp component) {
+			defer wg.Done()
+
+			status := checkComponent(ctx, comp.checker)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Components[comp.name] = status
+			if status.Status != STATUS_OK {
+				report.Status = STATUS_ERROR
+			}
+		}(comp)
+	}
+	wg.Wait()
+
+	return report
+}
+
+func checkComponent(ctx context.Context, checker HealthChecker) ComponentStatus {
+	start := time.Now()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- checker.CheckHealth(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	status := ComponentStatus{Status: STATUS_OK, DurationMs: float64(time.Since(start)) / float64(time.Millisecond)}
+	if err != nil {
+		status.Status = STATUS_ERROR
+		status.Error = err.Error()
+	}
+
+	return status
+}
+
+// ReadinessHandler responds with the report as JSON, with 503 if any
+// component is unhealthy
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Check(r.Context())
+
+		status := http.StatusOK
+		if !report.IsHealthy() {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, status, report)
+	})
+}
+
+// LivenessHandler responds with 200 as long as the process serves requests
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Report{Status: STATUS_OK})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,114 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/health"
+)
+
+type StubChecker struct {
+	err   error
+	delay time.Duration
+}
+
+func (s *StubChecker) CheckHealth(ctx context.Context) error {
+	time.Sleep(s.delay)
+	return s.err
+}
+
+func TestChecker(t *testing.T) {
+	t.Run("reports healthy components", func(t *testing.T) {
+		checker := health.NewChecker(time.Second)
+		checker.Add("registry", &StubChecker{})
+		checker.Add("storage", &StubChecker{})
+
+		report := checker.Check(context.Background())
+
+		if !report.IsHealthy() || len(report.Components) != 2 {
+			t.Errorf("Got %+v, want two healthy components", report)
+		}
+	})
+	t.Run("reports failing components", func(t *testing.T) {
+		checker := health.NewChecker(time.Second)
+		checker.Add("registry", &StubChecker{})
+		checker.Add("storage", &StubChecker{err: errors.New("disk full")})
+
+		report := checker.Check(context.Background())
+
+		if report.IsHealthy() {
+			t.Error("Want report to be unhealthy")
+		}
+		if got := report.Components["storage"]; got.Status != health.STATUS_ERROR || got.Error != "disk full" {
+			t.Errorf("Got storage status %+v, want error", got)
+		}
+		if got := report.Components["registry"]; got.Status != health.STATUS_OK {
+			t.Errorf("Got registry status %+v, want ok", got)
+		}
+	})
+	t.Run("fails slow components", func(t *testing.T) {
+		checker := health.NewChecker(10 * time.Millisecond)
+		checker.Add("registry", &StubChecker{delay: time.Second})
+
+		start := time.Now()
+		report := checker.Check(context.Background())
+
+		if report.IsHealthy() {
+			t.Error("Want report to be unhealthy")
+		}
+		if time.Since(start) > 500*time.Millisecond {
+			t.Error("Want check to return at the timeout")
+		}
+	})
+	t.Run("ignores values without health checks", func(t *testing.T) {
+		checker := health.NewChecker(time.Second)
+
+		if checker.Add("cache", struct{}{}) {
+			t.Error("Want value without CheckHealth to be ignored")
+		}
+	})
+}
+
+func TestHandlers(t *testing.T) {
+	t.Run("readiness responds 503 when unhealthy", func(t *testing.T) {
+		checker := health.NewChecker(time.Second)
+		checker.Add("registry", &StubChecker{err: errors.New("database is locked")})
+
+		response := httptest.NewRecorder()
+		checker.ReadinessHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		if response.Code != http.StatusServiceUnavailable {
+			t.Errorf("Got status %d, want %d", response.Code, http.StatusServiceUnavailable)
+		}
+
+		var report health.Report
+		json.NewDecoder(response.Body).Decode(&report)
+		if report.Components["registry"].Error != "database is locked" {
+			t.Errorf("Got report %+v, want registry error", report)
+		}
+	})
+	t.Run("readiness responds 200 when healthy", func(t *testing.T) {
+		checker := health.NewChecker(time.Second)
+		checker.Add("registry", &StubChecker{})
+
+		response := httptest.NewRecorder()
+		checker.ReadinessHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		if response.Code != http.StatusOK {
+			t.Errorf("Got status %d, want %d", response.Code, http.StatusOK)
+		}
+	})
+	t.Run("liveness responds 200", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		health.LivenessHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+		if response.Code != http.StatusOK {
+			t.Errorf("Got status %d, want %d", response.Code, http.StatusOK)
+		}
+	})
+}
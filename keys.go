@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/registry"
+)
+
+const KEYS_USAGE = `Usage: go-fileserver keys <command> [arguments]
+
+Commands:
+  create -name <name> -scopes <scope,...>   create a new API key
+  list                                      list API keys
+  revoke <id>                               revoke an API key
+`
+
+// runKeysCommand manages API keys stored in the registry
+func runKeysCommand(ctx context.Context, reg registry.Registry, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(KEYS_USAGE)
+	}
+
+	switch args[0] {
+	case "create":
+		return createKey(ctx, reg, args[1:], out)
+	case "list":
+		return listKeys(ctx, reg, out)
+	case "revoke":
+		return revokeKey(ctx, reg, args[1:], out)
+	default:
+		return errors.New(KEYS_USAGE)
+	}
+}
+
+func createKey(ctx context.Context, reg registry.Registry, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	name := flags.String("name", "", "identity recorded as the uploader of files")
+	scopeList := flags.String("scopes", string(auth.ScopeUpload), "comma-separated list of scopes")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *name == "" {
+		return errors.New("Key name is required")
+	}
+	if err := auth.ValidateKeyName(*name); err != nil {
+		return err
+	}
+
+	scopes, err := auth.ParseScopes(*scopeList)
+	if err != nil {
+		return err
+	}
+
+	id, key, err := auth.GenerateAPIKey()
+	if err != nil {
+		return err
+	}
+
+	stored := registry.APIKey{
+		ID:        id,
+		Name:      *name,
+		Hash:      auth.HashAPIKey(key),
+		CreatedAt: time.Now(),
+	}
+	for _, scope := range scopes {
+		stored.Scopes = append(stored.Scopes, string(scope))
+	}
+
+	if err := reg.RecordAPIKey(ctx, stored); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Created key %s for %q. Store it now, it won't be shown again:\n%s\n", id, *name, key)
+	return nil
+}
+
+func listKeys(ctx context.Context, reg registry.Registry, out io.Writer) error {
+	keys, err := reg.ListAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED\tSTATUS")
+
+	for _, key := range keys {
+		status := "active"
+		if key.IsRevoked() {
+			status = "revoked " + key.RevokedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, strings.Join(key.Scopes, ","), key.CreatedAt.Format(time.RFC3339), status)
+	}
+
+	return w.Flush()
+}
+
+func revokeKey(ctx context.Context, reg registry.Registry, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New(KEYS_USAGE)
+	}
+
+	if err := reg.RevokeAPIKey(ctx, args[0], time.Now()); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Revoked key %s\n", args[0])
+	return nil
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,181 @@
+// Package listeners opens the sockets the server accepts connections on:
+// TCP addresses, Unix domain sockets and sockets passed by systemd socket
+// activation
+package listeners
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const UNIX_PREFIX = "unix:"
+const SYSTEMD_PREFIX = "systemd:"
+
+// SD_LISTEN_FDS_START is the first file descriptor passed by systemd
+const SD_LISTEN_FDS_START = 3
+
+const DEFAULT_SOCKET_MODE fs.FileMode = 0660
+
+// Opener opens listeners by address:
+//
+//	:8080 or 127.0.0.1:8080   TCP
+//	unix:/run/fileserver.sock Unix domain socket
+//	systemd:public            socket passed by systemd, by FileDescriptorName
+//	systemd:0                 socket passed by systemd, by position
+type Opener struct {
+	// SocketMode is applied to Unix domain sockets created by Listen
+	SocketMode fs.FileMode
+
+	inherited []inheritedListener
+}
+
+type inheritedListener struct {
+	name     string
+	listener net.Listener
+	used     bool
+}
+
+// NewOpener takes over the sockets passed by systemd, if any
+func NewOpener(socketMode fs.FileMode) (*Opener, error) {
+	inherited, err := inheritListeners(os.Getpid(), os.Getenv, SD_LISTEN_FDS_START)
+	if err != nil {
+		return nil, err
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	return &Opener{SocketMode: socketMode, inherited: inherited}, nil
+}
+
+func (o *Opener) Listen(address string) (net.Listener, error) {
+	if name, ok := strings.CutPrefix(address, SYSTEMD_PREFIX); ok {
+		return o.inheritedListener(name)
+	}
+
+	if path, ok := strings.CutPrefix(address, UNIX_PREFIX); ok {
+		return listenUnix(path, o.SocketMode)
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// CloseUnused closes the sockets passed by systemd that no address asked for
+func (o *Opener) CloseUnused() {
+	for _, inherited := range o.inherited {
+		if !inherited.used {
+			inherited.listener.Close()
+		}
+	}
+}
+
+func (o *Opener) inheritedListener(name string) (net.Listener, error) {
+	index := -1
+	for i, inherited := range o.inherited {
+		if inherited.name == name {
+			index = i
+			break
+		}
+	}
+
+	if position, err := strconv.Atoi(name); index < 0 && err == nil && position >= 0 && position < len(o.inherited) {
+		index = position
+	}
+
+	if index < 0 {
+		return nil, errors.New(fmt.Sprintf("No socket named %q was passed by systemd", name))
+	}
+	if o.inherited[index].used {
+		return nil, errors.New(fmt.Sprintf("Socket %q passed by systemd is already in use", name))
+	}
+
+	o.inherited[index].used = true
+	return o.inherited[index].listener, nil
+}
+
+// inheritListeners implements the LISTEN_FDS protocol of sd_listen_fds(3)
+func inheritListeners(pid int, getenv func(string) string, firstFD int) ([]inheritedListener, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	var names []string
+	if value := getenv("LISTEN_FDNAMES"); value != "" {
+		names = strings.Split(value, ":")
+	}
+
+	inherited := make([]inheritedListener, 0, count)
+	for i := 0; i < count; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(firstFD+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, opened := range inherited {
+				opened.listener.Close()
+			}
+			return nil, errors.New(fmt.Sprintf("Socket %q passed by systemd is not a listener\n%s", name, err))
+		}
+
+		inherited = append(inherited, inheritedListener{name: name, listener: listener})
+	}
+
+	return inherited, nil
+}
+
+// listenUnix replaces stale sockets left by a previous run. The socket file
+// is removed when the listener is closed
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, errors.New(fmt.Sprintf("%s exists and is not a socket", path))
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New(fmt.Sprintf("%s is in use by another process", path))
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, mode)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// SplitAddresses splits a comma-separated list of addresses
+func SplitAddresses(value string) []string {
+	var addresses []string
+
+	for _, address := range strings.Split(value, ",") {
+		address = strings.TrimSpace(address)
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
@@ -0,0 +1,135 @@
+//go:build linux || darwin
+
+package listeners
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fileserver.sock")
+	opener := &Opener{SocketMode: 0600}
+
+	listener, err := opener.Listen(UNIX_PREFIX + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Got mode %s, want 0600", info.Mode().Perm())
+	}
+
+	t.Run("refuses sockets in use", func(t *testing.T) {
+		_, err := opener.Listen(UNIX_PREFIX + path)
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+
+	listener.Close()
+	if _, err := os.Stat(path); err == nil {
+		t.Error("Want the socket to be removed on close")
+	}
+
+	t.Run("replaces stale sockets", func(t *testing.T) {
+		stale, _ := net.Listen("unix", path)
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		listener, err := opener.Listen(UNIX_PREFIX + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener.Close()
+	})
+	t.Run("refuses to replace other files", func(t *testing.T) {
+		os.WriteFile(path, nil, 0644)
+
+		_, err := opener.Listen(UNIX_PREFIX + path)
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
+
+func TestInheritListeners(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	// A duplicate of the descriptor stands in for the one passed by systemd
+	file, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"LISTEN_PID":     strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS":     "1",
+		"LISTEN_FDNAMES": "public",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	t.Run("ignores sockets passed to other processes", func(t *testing.T) {
+		inherited, err := inheritListeners(os.Getpid()+1, getenv, fd)
+		if err != nil || inherited != nil {
+			t.Errorf("Got %v and error %v, want nothing", inherited, err)
+		}
+	})
+
+	inherited, err := inheritListeners(os.Getpid(), getenv, fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opener := &Opener{inherited: inherited}
+
+	listener, err := opener.Listen(SYSTEMD_PREFIX + "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if listener.Addr().String() != tcp.Addr().String() {
+		t.Errorf("Got address %s, want %s", listener.Addr(), tcp.Addr())
+	}
+
+	t.Run("hands out each socket once", func(t *testing.T) {
+		_, err := opener.Listen(SYSTEMD_PREFIX + "0")
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+	t.Run("rejects unknown names", func(t *testing.T) {
+		_, err := opener.Listen(SYSTEMD_PREFIX + "admin")
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
+
+func TestSplitAddresses(t *testing.T) {
+	got := SplitAddresses(" :8080, unix:/run/fileserver.sock,,systemd:admin ")
+	want := []string{":8080", "unix:/run/fileserver.sock", "systemd:admin"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
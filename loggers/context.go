@@ -0,0 +1,39 @@
+package loggers
+
+import "context"
+
+type requestIDKey struct{}
+
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext returns an empty string for contexts without a request ID
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// FromContext returns a logger adding the request ID of ctx to every message,
+// so log lines of one request can be correlated
+func FromContext(ctx context.Context, logger Logger) Logger {
+	requestID := RequestIDFromContext(ctx)
+	if requestID == "" {
+		return logger
+	}
+	return &contextLogger{logger: logger, args: []any{"request_id", requestID}}
+}
+
+type contextLogger struct {
+	logger Logger
+	args   []any
+}
+
+func (c *contextLogger) Debug(msg string, args ...any) { c.logger.Debug(msg, c.with(args)...) }
+func (c *contextLogger) Info(msg string, args ...any)  { c.logger.Info(msg, c.with(args)...) }
+func (c *contextLogger) Warn(msg string, args ...any)  { c.logger.Warn(msg, c.with(args)...) }
+func (c *contextLogger) Error(msg string, args ...any) { c.logger.Error(msg, c.with(args)...) }
+
+func (c *contextLogger) with(args []any) []any {
+	return append(append([]any{}, c.args...), args...)
+}
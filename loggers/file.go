@@ -0,0 +1,310 @@
+package loggers
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const BACKUP_TIME_FORMAT = "20060102-150405.000000"
+const BACKUP_EXTENSION = ".gz"
+
+type FileLoggerConfig struct {
+	Path string
+	// MaxSize rotates the file before it grows past the given number of
+	// bytes. Zero disables size-based rotation
+	MaxSize int64
+	// Daily rotates the file on the first write of a new day
+	Daily bool
+	// MaxBackups is the number of compressed backups to keep. Zero keeps
+	// all of them
+	MaxBackups int
+	Level      Level
+}
+
+// FileLogger writes LEVEL message key=value lines to a file and rotates it
+// into gzip compressed backups named <path>.<time>.gz. It also implements
+// io.Writer, so it can back a slog handler. It is safe for concurrent use
+type FileLogger struct {
+	config FileLoggerConfig
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	// compressing serializes background compression and pruning of backups
+	compressing sync.Mutex
+	wg          sync.WaitGroup
+
+	now func() time.Time
+}
+
+// NewFileLogger opens or creates the log file, appending to existing content
+func NewFileLogger(config FileLoggerConfig) (*FileLogger, error) {
+	if config.Path == "" {
+		return nil, errors.New("Log file path is required")
+	}
+
+	logger := &FileLogger{config: config, now: time.Now}
+
+	err := logger.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return logger, nil
+}
+
+func (f *FileLogger) Debug(msg string, args ...any) { f.log(LevelDebug, msg, args) }
+func (f *FileLogger) Info(msg string, args ...any)  { f.log(LevelInfo, msg, args) }
+func (f *FileLogger) Warn(msg string, args ...any)  { f.log(LevelWarn, msg, args) }
+func (f *FileLogger) Error(msg string, args ...any) { f.log(LevelError, msg, args) }
+
+func (f *FileLogger) log(level Level, msg string, args []any) {
+	if level < f.config.Level {
+		return
+	}
+
+	line := f.now().Format(time.RFC3339) + " " + formatLine(level, msg, args) + "\n"
+	f.Write([]byte(line))
+}
+
+// Write appends p to the file as a single record, rotating the file first
+// if p would not fit or the day has changed
+func (f *FileLogger) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	if f.file == nil {
+		err := f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if f.shouldRotate(int64(len(p))) {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Rotate moves the current file to a compressed backup and starts a new one
+func (f *FileLogger) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	return f.rotate()
+}
+
+// Reopen closes and reopens the file at the configured path. It is meant to
+// be called on SIGHUP after an external tool such as logrotate moved the file
+func (f *FileLogger) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	err := f.close()
+	if err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+// Close closes the file and waits for pending backups to be compressed
+func (f *FileLogger) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	err := f.close()
+	f.mu.Unlock()
+
+	f.wg.Wait()
+
+	return err
+}
+
+func (f *FileLogger) shouldRotate(writeSize int64) bool {
+	if f.config.MaxSize > 0 && f.size > 0 && f.size+writeSize > f.config.MaxSize {
+		return true
+	}
+
+	if f.config.Daily && !sameDay(f.openedAt, f.now()) {
+		return true
+	}
+
+	return false
+}
+
+func (f *FileLogger) open() error {
+	err := os.MkdirAll(filepath.Dir(f.config.Path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = stat.Size()
+	f.openedAt = f.now()
+	if f.size > 0 {
+		f.openedAt = stat.ModTime()
+	}
+
+	return nil
+}
+
+func (f *FileLogger) close() error {
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
+
+func (f *FileLogger) rotate() error {
+	err := f.close()
+	if err != nil {
+		return err
+	}
+
+	backup := f.config.Path + "." + f.now().Format(BACKUP_TIME_FORMAT)
+
+	err = os.Rename(f.config.Path, backup)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = f.open()
+	if err != nil {
+		return err
+	}
+	f.openedAt = f.now()
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+
+		f.compressing.Lock()
+		defer f.compressing.Unlock()
+
+		err := compressFile(backup)
+		if err != nil {
+			f.Error("Unable to compress log backup", "path", backup, "error", err)
+		}
+
+		err = f.pruneBackups()
+		if err != nil {
+			f.Error("Unable to remove old log backups", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// Backups returns the paths of compressed backups, oldest first
+func (f *FileLogger) Backups() ([]string, error) {
+	matches, err := filepath.Glob(f.config.Path + ".*" + BACKUP_EXTENSION)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(matches)
+
+	return matches, nil
+}
+
+func (f *FileLogger) pruneBackups() error {
+	if f.config.MaxBackups <= 0 {
+		return nil
+	}
+
+	backups, err := f.Backups()
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > f.config.MaxBackups {
+		err = os.Remove(backups[0])
+		if err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+func compressFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(path+BACKUP_EXTENSION, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(target)
+
+	_, err = io.Copy(gz, source)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(target.Name())
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
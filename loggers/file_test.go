@@ -0,0 +1,211 @@
+package loggers
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	return string(content)
+}
+
+func readBackup(t *testing.T, path string) string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	content, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	return string(content)
+}
+
+func TestFileLogger(t *testing.T) {
+	t.Run("writes leveled lines", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "logs", "server.log")
+
+		logger, err := NewFileLogger(FileLoggerConfig{Path: path, Level: LevelInfo})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		logger.Debug("hidden")
+		logger.Info("File saved", "token", "abc")
+		logger.Close()
+
+		got := readFile(t, path)
+		if strings.Contains(got, "hidden") {
+			t.Errorf("Want debug message dropped, got %q", got)
+		}
+		if !strings.HasSuffix(got, "INFO File saved token=abc\n") {
+			t.Errorf("Got %q, want INFO line", got)
+		}
+	})
+	t.Run("rotates by size into compressed backups", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "server.log")
+
+		logger, err := NewFileLogger(FileLoggerConfig{Path: path, MaxSize: 10})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		fmt.Fprint(logger, "first\n")
+		fmt.Fprint(logger, "second\n")
+		logger.Close()
+
+		if got := readFile(t, path); got != "second\n" {
+			t.Errorf("Got %q in current file, want %q", got, "second\n")
+		}
+
+		backups, _ := logger.Backups()
+		if len(backups) != 1 {
+			t.Fatalf("Got %d backups, want 1", len(backups))
+		}
+		if got := readBackup(t, backups[0]); got != "first\n" {
+			t.Errorf("Got %q in backup, want %q", got, "first\n")
+		}
+	})
+	t.Run("rotates daily", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "server.log")
+
+		logger, err := NewFileLogger(FileLoggerConfig{Path: path, Daily: true})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		now := time.Now()
+		logger.now = func() time.Time { return now }
+
+		fmt.Fprint(logger, "today\n")
+		now = now.Add(24 * time.Hour)
+		fmt.Fprint(logger, "tomorrow\n")
+		fmt.Fprint(logger, "tomorrow again\n")
+		logger.Close()
+
+		backups, _ := logger.Backups()
+		if len(backups) != 1 {
+			t.Fatalf("Got %d backups, want 1", len(backups))
+		}
+		if got := readFile(t, path); got != "tomorrow\ntomorrow again\n" {
+			t.Errorf("Got %q in current file", got)
+		}
+	})
+	t.Run("keeps max backups", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "server.log")
+
+		logger, err := NewFileLogger(FileLoggerConfig{Path: path, MaxBackups: 2})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		now := time.Now()
+		logger.now = func() time.Time { return now }
+
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(logger, "line %d\n", i)
+			logger.Rotate()
+			now = now.Add(time.Second)
+		}
+		logger.Close()
+
+		backups, _ := logger.Backups()
+		if len(backups) != 2 {
+			t.Fatalf("Got %d backups, want 2", len(backups))
+		}
+		if got := readBackup(t, backups[1]); got != "line 3\n" {
+			t.Errorf("Got %q in newest backup, want %q", got, "line 3\n")
+		}
+	})
+	t.Run("reopens moved file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "server.log")
+
+		logger, err := NewFileLogger(FileLoggerConfig{Path: path})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		fmt.Fprint(logger, "before\n")
+		os.Rename(path, path+".1")
+
+		err = logger.Reopen()
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		fmt.Fprint(logger, "after\n")
+		logger.Close()
+
+		if got := readFile(t, path+".1"); got != "before\n" {
+			t.Errorf("Got %q in moved file, want %q", got, "before\n")
+		}
+		if got := readFile(t, path); got != "after\n" {
+			t.Errorf("Got %q in new file, want %q", got, "after\n")
+		}
+	})
+	t.Run("is safe for concurrent use", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "server.log")
+
+		logger, err := NewFileLogger(FileLoggerConfig{Path: path, MaxSize: 1000})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					logger.Info("Request", "worker", i, "n", j)
+				}
+			}(i)
+		}
+		wg.Wait()
+		logger.Close()
+
+		lines := strings.Count(readFile(t, path), "\n")
+		backups, _ := logger.Backups()
+		for _, backup := range backups {
+			lines += strings.Count(readBackup(t, backup), "\n")
+		}
+
+		if lines != 1000 {
+			t.Errorf("Got %d lines, want 1000", lines)
+		}
+	})
+	t.Run("rejects writes after close", func(t *testing.T) {
+		logger, err := NewFileLogger(FileLoggerConfig{Path: filepath.Join(t.TempDir(), "server.log")})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+		logger.Close()
+
+		_, err = fmt.Fprint(logger, "late\n")
+		if err == nil {
+			t.Error("Want error writing to closed logger, got nil")
+		}
+	})
+}
@@ -1,16 +1,134 @@
 package loggers
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"strings"
 )
 
+type Level int
+
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+// ParseLevel parses level names such as "debug" or "ERROR"
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, errors.New(fmt.Sprintf("Unknown log level %q", name))
+	}
+}
+
+// Logger records leveled messages with alternating key-value fields, e.g.
+// logger.Error("Unable to save file", "file", name, "error", err).
+// *slog.Logger satisfies the interface as is
 type Logger interface {
-	Log(message string)
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// StdLogger writes messages through the standard library log package as
+// LEVEL message key=value lines
+type StdLogger struct {
+	// Logger defaults to the standard logger
+	Logger *log.Logger
+	// Messages below Level are dropped
+	Level Level
+}
+
+func (s *StdLogger) Debug(msg string, args ...any) { s.log(LevelDebug, msg, args) }
+func (s *StdLogger) Info(msg string, args ...any)  { s.log(LevelInfo, msg, args) }
+func (s *StdLogger) Warn(msg string, args ...any)  { s.log(LevelWarn, msg, args) }
+func (s *StdLogger) Error(msg string, args ...any) { s.log(LevelError, msg, args) }
+
+func (s *StdLogger) log(level Level, msg string, args []any) {
+	if level < s.Level {
+		return
+	}
+
+	logger := s.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	logger.Print(formatLine(level, msg, args))
 }
 
-type StdLogger struct{}
+func formatLine(level Level, msg string, args []any) string {
+	var b strings.Builder
 
-func (s *StdLogger) Log(message string) {
-	log.Print(message)
+	b.WriteString(level.String())
+	b.WriteString(" ")
+	b.WriteString(msg)
+
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " !BADKEY=%s", quoteIfNeeded(fmt.Sprint(args[i])))
+			break
+		}
+		fmt.Fprintf(&b, " %v=%s", args[i], quoteIfNeeded(fmt.Sprint(args[i+1])))
+	}
+
+	return b.String()
+}
 
+func quoteIfNeeded(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		return fmt.Sprintf("%q", value)
+	}
+	return value
 }
+
+// NewSlogLogger returns a log/slog logger writing "text" or "json" records
+func NewSlogLogger(w io.Writer, format string, level Level) (Logger, error) {
+	opts := &slog.HandlerOptions{Level: slog.Level(level * 4)}
+
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown log format %q", format))
+	}
+}
+
+// NopLogger drops all messages. It is used when no logger is configured
+type NopLogger struct{}
+
+func (NopLogger) Debug(msg string, args ...any) {}
+func (NopLogger) Info(msg string, args ...any)  {}
+func (NopLogger) Warn(msg string, args ...any)  {}
+func (NopLogger) Error(msg string, args ...any) {}
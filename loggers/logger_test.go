@@ -0,0 +1,111 @@
+package loggers_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/olzhasar/go-fileserver/loggers"
+)
+
+func TestStdLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := &loggers.StdLogger{Logger: log.New(buf, "", 0), Level: loggers.LevelInfo}
+
+	logger.Debug("hidden")
+	logger.Info("File saved", "token", "abc", "size", 12)
+	logger.Error("Query failed", "error", errors.New("database is locked"))
+	logger.Warn("Odd fields", "key")
+
+	want := strings.Join([]string{
+		"INFO File saved token=abc size=12",
+		`ERROR Query failed error="database is locked"`,
+		"WARN Odd fields !BADKEY=key",
+		"",
+	}, "\n")
+
+	if buf.String() != want {
+		t.Errorf("Got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	logger, err := loggers.NewSlogLogger(buf, "json", loggers.LevelWarn)
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	logger.Info("hidden")
+	logger.Warn("Disk almost full", "free_bytes", 1024)
+
+	got := buf.String()
+	if strings.Contains(got, "hidden") {
+		t.Errorf("Want messages below level to be dropped, got %q", got)
+	}
+	if !strings.Contains(got, `"level":"WARN","msg":"Disk almost full","free_bytes":1024`) {
+		t.Errorf("Got %q, want JSON record", got)
+	}
+
+	if _, err := loggers.NewSlogLogger(buf, "xml", loggers.LevelInfo); err == nil {
+		t.Error("Got nil, want error for unknown format")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	cases := map[string]loggers.Level{
+		"debug": loggers.LevelDebug,
+		"":      loggers.LevelInfo,
+		"WARN":  loggers.LevelWarn,
+		"error": loggers.LevelError,
+	}
+
+	for name, want := range cases {
+		got, err := loggers.ParseLevel(name)
+		if err != nil || got != want {
+			t.Errorf("Level %q: got %v, %v, want %v", name, got, err, want)
+		}
+	}
+
+	if _, err := loggers.ParseLevel("verbose"); err == nil {
+		t.Error("Got nil, want error for unknown level")
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := &loggers.StdLogger{Logger: log.New(buf, "", 0)}
+
+	loggers.FromContext(context.Background(), logger).Info("No request")
+
+	ctx := loggers.WithRequestID(context.Background(), "req-1")
+	loggers.FromContext(ctx, logger).Error("Query failed", "operation", "Get")
+
+	want := "INFO No request\nERROR Query failed request_id=req-1 operation=Get\n"
+	if buf.String() != want {
+		t.Errorf("Got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestSwappableLogger(t *testing.T) {
+	first := &bytes.Buffer{}
+	second := &bytes.Buffer{}
+
+	logger := loggers.NewSwappableLogger(&loggers.StdLogger{Logger: log.New(first, "", 0), Level: loggers.LevelInfo})
+	logger.Debug("hidden")
+	logger.Info("before")
+
+	logger.Swap(&loggers.StdLogger{Logger: log.New(second, "", 0), Level: loggers.LevelDebug})
+	logger.Debug("after")
+
+	if first.String() != "INFO before\n" {
+		t.Errorf("Got %q from the first logger", first.String())
+	}
+	if second.String() != "DEBUG after\n" {
+		t.Errorf("Got %q from the second logger", second.String())
+	}
+}
@@ -0,0 +1,67 @@
+package loggers
+
+import (
+	"io"
+	"sync"
+)
+
+// SwappableLogger forwards to a logger that can be replaced at any time,
+// e.g. when the log level is reloaded from the config
+type SwappableLogger struct {
+	mu     sync.RWMutex
+	logger Logger
+}
+
+func NewSwappableLogger(logger Logger) *SwappableLogger {
+	return &SwappableLogger{logger: logger}
+}
+
+// Swap replaces the logger and returns the previous one
+func (s *SwappableLogger) Swap(logger Logger) Logger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.logger
+	s.logger = logger
+	return previous
+}
+
+func (s *SwappableLogger) Debug(msg string, args ...any) { s.current().Debug(msg, args...) }
+func (s *SwappableLogger) Info(msg string, args ...any)  { s.current().Info(msg, args...) }
+func (s *SwappableLogger) Warn(msg string, args ...any)  { s.current().Warn(msg, args...) }
+func (s *SwappableLogger) Error(msg string, args ...any) { s.current().Error(msg, args...) }
+
+func (s *SwappableLogger) current() Logger {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.logger
+}
+
+// SwappableWriter forwards writes to a writer that can be replaced at any
+// time, e.g. when the log file is reloaded from the config
+type SwappableWriter struct {
+	mu     sync.RWMutex
+	writer io.Writer
+}
+
+func NewSwappableWriter(writer io.Writer) *SwappableWriter {
+	return &SwappableWriter{writer: writer}
+}
+
+// Swap replaces the writer and returns the previous one
+func (s *SwappableWriter) Swap(writer io.Writer) io.Writer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.writer
+	s.writer = writer
+	return previous
+}
+
+// Write holds the writer until it returns, so that writes finish before
+// a swapped writer is closed
+func (s *SwappableWriter) Write(p []byte) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.writer.Write(p)
+}
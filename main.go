@@ -1,33 +1,574 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/olzhasar/go-fileserver/admin"
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/certs"
+	"github.com/olzhasar/go-fileserver/config"
+	"github.com/olzhasar/go-fileserver/health"
+	"github.com/olzhasar/go-fileserver/listeners"
 	"github.com/olzhasar/go-fileserver/loggers"
 	"github.com/olzhasar/go-fileserver/manager"
+	"github.com/olzhasar/go-fileserver/metrics"
 	"github.com/olzhasar/go-fileserver/middleware"
+	"github.com/olzhasar/go-fileserver/policy"
+	"github.com/olzhasar/go-fileserver/preview"
 	"github.com/olzhasar/go-fileserver/registry"
+	"github.com/olzhasar/go-fileserver/scanner"
 	"github.com/olzhasar/go-fileserver/server"
+	"github.com/olzhasar/go-fileserver/signer"
+	"github.com/olzhasar/go-fileserver/sniff"
 	"github.com/olzhasar/go-fileserver/storages"
+	"github.com/olzhasar/go-fileserver/tracing"
+	"github.com/redis/go-redis/v9"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
-const UPLOAD_DIR = "uploads"
-const PORT = "8080"
+const METRICS_URL = "/metrics"
+const HEALTHZ_URL = "/healthz"
+const READYZ_URL = "/readyz"
 
 func main() {
-	storage := storages.NewFileSystemStoage(UPLOAD_DIR)
-	registry, err := registry.NewSQLiteRegistry("./db.sqlite3")
+	var hooks shutdownHooks
+
+	loader := config.NewLoader(os.Args[0])
+	printConfig := loader.FlagSet().Bool("print-config", false, "Print the effective config with secrets redacted and exit")
+
+	// The keys subcommand reads the config file and environment only
+	args := os.Args[1:]
+	keysCommand := len(args) > 0 && args[0] == "keys"
+	if keysCommand {
+		args = nil
+	}
+
+	cfg, err := loader.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration\n%s", err)
+	}
+
+	if *printConfig {
+		exitOnError(cfg.Redacted().WriteYAML(os.Stdout))
+		return
+	}
+
+	baseLogger, fileLogger, err := newLogger(cfg.Log)
+	if err != nil {
+		log.Fatalf("Error while initializing logger\n%s", err)
+	}
+
+	logger := loggers.NewSwappableLogger(baseLogger)
+	accessLogWriter := loggers.NewSwappableWriter(logWriter(fileLogger))
+	reloader := &reloader{loader: loader, current: cfg, logger: logger, fileLogger: fileLogger, accessLogWriter: accessLogWriter}
+	hooks.add("log file", func(ctx context.Context) error {
+		return reloader.closeLog()
+	})
+
+	registry, err := newRegistry(cfg.Registry, logger)
+	if err != nil {
+		log.Fatalf("Error while initializing %s registry\n%s", cfg.Registry.Backend, err)
+	}
+
+	hooks.add("registry", func(ctx context.Context) error {
+		registry.Close()
+		return nil
+	})
+
+	if keysCommand {
+		err = runKeysCommand(context.Background(), registry, os.Args[2:], os.Stdout)
+		registry.Close()
+		exitOnError(err)
+		return
+	}
+
+	storage := newStorage(cfg.Storage, logger)
+
+	checker := health.NewChecker(health.DEFAULT_TIMEOUT)
+	checker.Add("registry", registry)
+	checker.Add("storage", storage)
+
+	var serverMetrics *metrics.Metrics
+	if cfg.Metrics.Enabled {
+		serverMetrics = metrics.NewMetrics()
+		registry = metrics.InstrumentRegistry(registry, serverMetrics)
+		storage = metrics.InstrumentStorage(storage, serverMetrics)
+		serverMetrics.ObserveUsage(registry)
+	}
+
+	tracerProvider, err := newTracerProvider(cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Error while initializing tracing\n%s", err)
+	}
+	if tracerProvider != nil {
+		hooks.add("tracing", tracerProvider.Shutdown)
+		registry = tracing.InstrumentRegistry(registry, tracerProvider)
+		storage = tracing.InstrumentStorage(storage, tracerProvider)
+	}
+
+	uploadPolicy, err := newUploadPolicy(cfg.Uploads)
+	if err != nil {
+		log.Fatalf("Error while loading upload rules\n%s", err)
+	}
+
+	managerOpts := []manager.Option{
+		manager.WithQuotas(newQuotas(cfg.Quotas)),
+		manager.WithUploadPolicy(uploadPolicy),
+		manager.WithLogger(logger),
+	}
+	if cfg.Scanning.ClamdAddress != "" {
+		clamd, err := scanner.NewClamd(cfg.Scanning.ClamdAddress, scanner.WithTimeout(time.Duration(cfg.Scanning.Timeout)))
+		if err != nil {
+			log.Fatalf("Error while initializing virus scanning\n%s", err)
+		}
+		// Async uploads are accepted while clamd is down and scanned later
+		if cfg.Scanning.Mode == manager.SCAN_SYNC {
+			checker.Add("clamd", clamd)
+		}
+		managerOpts = append(managerOpts, manager.WithScanner(clamd, cfg.Scanning.Mode))
+	}
+
+	fileManager := manager.NewFileManager(registry, storage, managerOpts...)
+	reloader.manager = fileManager
+
+	pendingScans, err := fileManager.ScanPending(context.Background())
+	if err != nil {
+		logger.Error("Unable to scan pending files", "error", err)
+	} else if pendingScans > 0 {
+		logger.Info("Scanning pending files", "files", pendingScans)
+	}
+	retryCtx, stopRetries := context.WithCancel(context.Background())
+	if cfg.Scanning.ClamdAddress != "" {
+		go fileManager.RetryPendingScans(retryCtx, manager.SCAN_RETRY_INTERVAL)
+	}
+	hooks.add("scanner", func(ctx context.Context) error {
+		stopRetries()
+		return fileManager.WaitForScans(ctx)
+	})
+
+	var mgr manager.SaverLoader = fileManager
+	if tracerProvider != nil {
+		mgr = tracing.InstrumentManager(mgr, tracerProvider)
+	}
+
+	inlinePolicy, _ := preview.ParsePolicy(cfg.Preview.InlineTypes)
+	opts := []server.Option{server.WithLogger(logger), server.WithInlinePolicy(inlinePolicy)}
+	if cfg.Signing.Keys != "" {
+		urlSigner, err := newSigner(cfg.Signing.Keys)
+		if err != nil {
+			log.Fatalf("Error while initializing URL signer\n%s", err)
+		}
+		opts = append(opts, server.WithSigner(urlSigner, cfg.Signing.SignToken))
+	}
+
+	fileServer := server.NewFileServer(mgr, opts...)
+	reloader.fileServer = fileServer
+
+	rules := map[string]auth.Scope{server.UPLOAD_URL: auth.ScopeUpload}
+	if cfg.Server.AnonymousUploads {
+		delete(rules, server.UPLOAD_URL)
+	}
+
+	var handler http.Handler = fileServer
+	handler = middleware.MakeScopedHandler(handler, rules)
+	ipStore, identityStore := newRateLimitStores(cfg.RateLimit, &hooks)
+	reloader.rateLimiter = middleware.NewRateLimitMiddleware(handler, identityStore, newRateLimitConfig(cfg.RateLimit))
+	handler = middleware.MakeAPIKeyHandler(reloader.rateLimiter, registry)
+
+	if cfg.TLS.ClientAuth != certs.CLIENT_AUTH_NONE {
+		scopes, _ := auth.ParseScopes(cfg.TLS.ClientScopes)
+		handler = middleware.MakeClientCertHandler(handler, scopes)
+	}
+
+	verifier, err := newJWTVerifier(cfg.JWT)
+	if err != nil {
+		log.Fatalf("Error while initializing JWT verifier\n%s", err)
+	}
+	// JWT middleware is always installed, so a JWKS can be configured later
+	reloader.jwt = middleware.NewJWTMiddleware(handler, nil)
+	if verifier != nil {
+		reloader.jwt.SetVerifier(verifier)
+	}
+	handler = reloader.jwt
+
+	reloader.ipRateLimiter = middleware.NewRateLimitMiddleware(handler, ipStore, newIPRateLimitConfig(cfg.RateLimit))
+	handler = reloader.ipRateLimiter
+
+	accessLogger, err := middleware.NewAccessLogger(cfg.AccessLog.Format, accessLogWriter, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	drainer := middleware.NewDrainMiddleware(handler, []string{server.UPLOAD_URL})
+	checker.Add("server", drainer)
+
+	loggedServer := middleware.MakeAccessLoggedHandler(drainer, accessLogger)
+
+	if serverMetrics != nil {
+		loggedServer = middleware.MakeMetricsHandler(loggedServer, serverMetrics, middleware.MetricsConfig{
+			Routes:        []string{"/", server.UPLOAD_URL, server.DOWNLOAD_URL, server.SIGN_URL, server.USAGE_URL, server.FILES_URL, server.DELETE_URL, server.PREVIEW_URL},
+			UploadPaths:   []string{server.UPLOAD_URL},
+			DownloadPaths: []string{server.DOWNLOAD_URL, server.PREVIEW_URL},
+		})
+	}
+
+	// Metrics move to the admin listeners if there are any
+	mux := newAdminMux(checker, serverMetrics, cfg.Server.AdminAddress == "", nil)
+	mux.Handle("/", loggedServer)
+	loggedServer = mux
+
+	if tracerProvider != nil {
+		routes := []string{"/", server.UPLOAD_URL, server.DOWNLOAD_URL, server.SIGN_URL, server.USAGE_URL, server.FILES_URL, server.DELETE_URL, server.PREVIEW_URL, METRICS_URL}
+		loggedServer = middleware.MakeTracedHandler(loggedServer, tracerProvider, tracing.Propagator(), routes)
+	}
+
+	// The client address is resolved first, so every middleware sees it
+	trustedProxies, _ := middleware.ParseTrustedProxies(cfg.Server.TrustedProxies)
+	loggedServer = middleware.MakeRequestIDHandler(loggedServer)
+	loggedServer = middleware.MakeClientIPHandler(loggedServer, trustedProxies)
+
+	opener, err := listeners.NewOpener(fs.FileMode(socketMode(cfg.Server.SocketMode)))
+	if err != nil {
+		log.Fatalf("Error while inheriting sockets\n%s", err)
+	}
+
+	httpServer := &http.Server{Handler: loggedServer, ReadHeaderTimeout: 10 * time.Second}
+	servers := []serving{{httpServer, listen(opener, cfg.Server.Address)}}
+
+	if cfg.Server.AdminAddress != "" {
+		// The admin API accepts the admin token or API keys with the admin scope
+		reloader.admin = admin.NewHandler(registry, fileManager, admin.WithToken(cfg.Admin.Token), admin.WithLogger(logger))
+
+		var adminAPI http.Handler = middleware.MakeAPIKeyHandler(reloader.admin, registry)
+		adminAPI = middleware.MakeAccessLoggedHandler(adminAPI, accessLogger)
+		adminAPI = middleware.MakeRequestIDHandler(adminAPI)
+		adminAPI = middleware.MakeClientIPHandler(adminAPI, trustedProxies)
+
+		adminServer := &http.Server{Handler: newAdminMux(checker, serverMetrics, true, adminAPI), ReadHeaderTimeout: 10 * time.Second}
+		servers = append(servers, serving{adminServer, listen(opener, cfg.Server.AdminAddress)})
+	}
+
+	if cfg.TLS.CertFile != "" {
+		reloader.certs, err = certs.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			log.Fatalf("Error while loading TLS certificate\n%s", err)
+		}
+
+		httpServer.TLSConfig, err = certs.NewTLSConfig(reloader.certs, cfg.TLS.ClientCAFile, cfg.TLS.ClientAuth)
+		if err != nil {
+			log.Fatalf("Error while initializing TLS\n%s", err)
+		}
+	}
+
+	if cfg.TLS.RedirectAddress != "" {
+		redirectServer := &http.Server{
+			Handler:           middleware.MakeHTTPSRedirectHandler(httpsPort(cfg.Server.Address)),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		servers = append(servers, serving{redirectServer, listen(opener, cfg.TLS.RedirectAddress)})
+	}
+
+	opener.CloseUnused()
+
+	shutdownTimeout := time.Duration(cfg.Server.ShutdownTimeout)
+
+	reloader.watch()
+
+	log.Printf("Starting the server on %s...\n", cfg.Server.Address)
+	err = serveUntilSignal(servers, drainer, logger, time.Duration(cfg.Server.DrainDelay), shutdownTimeout)
 	if err != nil {
-		log.Fatalf("Error while initializing SQLite registry\n%s", err)
+		logger.Error("Server stopped", "error", err)
 	}
 
-	mgr := manager.NewFileManager(registry, storage)
-	server := server.NewFileServer(mgr)
+	hookCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	hooks.run(hookCtx, logger)
+	cancel()
 
-	logger := &loggers.StdLogger{}
-	loggedServer := middleware.MakeLoggedHandler(server, logger)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// newAdminMux serves health checks, metrics if withMetrics is set and the
+// admin API if adminAPI isn't nil
+func newAdminMux(checker *health.Checker, serverMetrics *metrics.Metrics, withMetrics bool, adminAPI http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(HEALTHZ_URL, health.LivenessHandler())
+	mux.Handle(READYZ_URL, checker.ReadinessHandler())
+	if serverMetrics != nil && withMetrics {
+		mux.Handle(METRICS_URL, serverMetrics.Handler())
+	}
+	if adminAPI != nil {
+		mux.Handle(admin.URL_PREFIX, adminAPI)
+	}
+	return mux
+}
+
+// listen opens every address of a comma-separated list
+func listen(opener *listeners.Opener, addresses string) []net.Listener {
+	var opened []net.Listener
+
+	for _, address := range listeners.SplitAddresses(addresses) {
+		listener, err := opener.Listen(address)
+		if err != nil {
+			log.Fatalf("Error while listening on %s\n%s", address, err)
+		}
+		opened = append(opened, listener)
+	}
+
+	return opened
+}
+
+// httpsPort is the port of the first TCP address, which HTTP requests are
+// redirected to
+func httpsPort(addresses string) string {
+	for _, address := range listeners.SplitAddresses(addresses) {
+		if strings.HasPrefix(address, listeners.UNIX_PREFIX) || strings.HasPrefix(address, listeners.SYSTEMD_PREFIX) {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(address); err == nil {
+			return port
+		}
+	}
+	return "443"
+}
+
+func socketMode(value string) uint64 {
+	mode, _ := strconv.ParseUint(value, 8, 32)
+	return mode
+}
+
+// newLogger builds a standard library logger unless the log format asks for
+// slog text or JSON records. The file output writes to a rotated file
+// instead of stderr, which is returned so that it can be reopened and closed
+func newLogger(cfg config.LogConfig) (loggers.Logger, *loggers.FileLogger, error) {
+	level, err := loggers.ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.Output != config.LOG_OUTPUT_FILE {
+		if cfg.Format == "" || cfg.Format == "plain" {
+			return &loggers.StdLogger{Level: level}, nil, nil
+		}
+		logger, err := loggers.NewSlogLogger(os.Stderr, cfg.Format, level)
+		return logger, nil, err
+	}
+
+	fileLogger, err := loggers.NewFileLogger(loggers.FileLoggerConfig{
+		Path:       cfg.File,
+		MaxSize:    cfg.MaxSize,
+		Daily:      cfg.Daily,
+		MaxBackups: cfg.MaxBackups,
+		Level:      level,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.Format == "" || cfg.Format == "plain" {
+		return fileLogger, fileLogger, nil
+	}
+
+	logger, err := loggers.NewSlogLogger(fileLogger, cfg.Format, level)
+	if err != nil {
+		fileLogger.Close()
+		return nil, nil, err
+	}
+
+	return logger, fileLogger, nil
+}
+
+// logWriter returns the destination of log records, for access log lines
+// written without a logger
+func logWriter(fileLogger *loggers.FileLogger) io.Writer {
+	if fileLogger != nil {
+		return fileLogger
+	}
+	return os.Stderr
+}
+
+// newRegistry opens the registry backend selected by name
+func newRegistry(cfg config.RegistryConfig, logger loggers.Logger) (registry.Registry, error) {
+	switch cfg.Backend {
+	case config.REGISTRY_SQLITE:
+		return registry.NewSQLiteRegistry(cfg.Path, registry.WithLogger(logger))
+	case config.REGISTRY_MEMORY:
+		return registry.NewInMemoryRegistry(), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown registry backend %q", cfg.Backend))
+	}
+}
+
+// newStorage returns the storage backend selected by name. The config is
+// validated, so anything but memory is the file system
+func newStorage(cfg config.StorageConfig, logger loggers.Logger) storages.Storage {
+	if cfg.Backend == config.STORAGE_MEMORY {
+		return storages.NewInMemoryStorage()
+	}
+
+	return storages.NewFileSystemStoage(
+		cfg.Dir,
+		storages.WithLogger(logger),
+		storages.WithMinFreeBytes(uint64(cfg.MinFreeBytes)),
+	)
+}
+
+// newTracerProvider returns nil unless a trace exporter is configured
+func newTracerProvider(cfg config.TracingConfig) (*sdktrace.TracerProvider, error) {
+	if cfg.Exporter == "" || cfg.Exporter == tracing.EXPORTER_NONE {
+		return nil, nil
+	}
+
+	return tracing.NewTracerProvider(context.Background(), tracing.Config{
+		Exporter:    cfg.Exporter,
+		Endpoint:    cfg.Endpoint,
+		FilePath:    cfg.File,
+		SampleRatio: cfg.SampleRatio,
+	})
+}
+
+// newQuotas converts the quotas config of the file manager
+func newQuotas(cfg config.QuotasConfig) manager.Quotas {
+	return manager.Quotas{
+		PerUser: manager.Quota{MaxFiles: cfg.PerUser.MaxFiles, MaxBytes: cfg.PerUser.MaxBytes},
+		Global:  manager.Quota{MaxFiles: cfg.Global.MaxFiles, MaxBytes: cfg.Global.MaxBytes},
+	}
+}
+
+// newUploadPolicy converts the uploads config of the file manager and
+// reads the rules of its users file
+func newUploadPolicy(cfg config.UploadsConfig) (*policy.Policy, error) {
+	rules := policy.Rules{RejectMismatch: &cfg.RejectMismatch, MaxSize: cfg.MaxSize}
+
+	var err error
+	for _, list := range []struct {
+		value string
+		rules *[]string
+		parse func(string) ([]string, error)
+	}{
+		{cfg.AllowedTypes, &rules.AllowedTypes, sniff.ParseTypes},
+		{cfg.BlockedTypes, &rules.BlockedTypes, sniff.ParseTypes},
+		{cfg.AllowedExtensions, &rules.AllowedExtensions, policy.ParseExtensions},
+		{cfg.BlockedExtensions, &rules.BlockedExtensions, policy.ParseExtensions},
+		{cfg.AllowedNames, &rules.AllowedNames, policy.ParseNames},
+		{cfg.BlockedNames, &rules.BlockedNames, policy.ParseNames},
+	} {
+		*list.rules, err = list.parse(list.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rules.MaxSizes, err = policy.ParseSizes(cfg.MaxSizes)
+	if err != nil {
+		return nil, err
+	}
+
+	var users map[string]policy.Rules
+	if cfg.UsersFile != "" {
+		users, err = policy.LoadUsers(cfg.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return policy.New(rules, users)
+}
+
+// newRateLimitConfig limits requests per minute, upload bytes per second
+// and failed download lookups per hour per API key or client IP
+func newRateLimitConfig(cfg config.RateLimitConfig) middleware.RateLimitConfig {
+	requests := float64(cfg.Requests)
+	uploadBytes := float64(cfg.UploadBytes)
+	failedLookups := float64(cfg.FailedLookups)
+
+	return middleware.RateLimitConfig{
+		Requests:      middleware.Limit{Rate: requests / 60, Burst: requests},
+		UploadBytes:   middleware.Limit{Rate: uploadBytes, Burst: uploadBytes},
+		UploadPaths:   []string{server.UPLOAD_URL},
+		FailedLookups: middleware.Limit{Rate: failedLookups / 3600, Burst: failedLookups},
+		LookupPaths:   []string{server.DOWNLOAD_URL, server.PREVIEW_URL, server.DELETE_URL},
+		Key:           middleware.KeyByIdentity,
+	}
+}
+
+// newIPRateLimitConfig limits requests per client IP in front of
+// authentication, so invalid credentials can't be tried without limits
+func newIPRateLimitConfig(cfg config.RateLimitConfig) middleware.RateLimitConfig {
+	requests := float64(cfg.Requests)
+
+	return middleware.RateLimitConfig{
+		Requests: middleware.Limit{Rate: requests / 60, Burst: requests},
+		Key:      middleware.KeyByIP,
+	}
+}
+
+// newRateLimitStores returns the stores of the per-IP and the per-identity
+// limiters. Their buckets are kept apart, so anonymous requests aren't
+// counted twice. Limiters are installed even without limits, so that they
+// can be enabled by reloading the config. The stores can't be changed later
+func newRateLimitStores(cfg config.RateLimitConfig, hooks *shutdownHooks) (ip middleware.RateLimitStore, identity middleware.RateLimitStore) {
+	if cfg.Redis == "" {
+		return middleware.NewInMemoryRateLimitStore(), middleware.NewInMemoryRateLimitStore()
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: cfg.Redis})
+	hooks.add("redis", func(ctx context.Context) error {
+		return client.Close()
+	})
+	return middleware.NewRedisRateLimitStore(client, "fileserver:ratelimit:ip:"), middleware.NewRedisRateLimitStore(client, "fileserver:ratelimit:")
+}
+
+func newSigner(keys string) (*signer.Signer, error) {
+	parsed, err := signer.ParseKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return signer.NewSigner(parsed...)
+}
+
+// newJWTVerifier returns nil unless a JWKS file or URL is configured
+func newJWTVerifier(cfg config.JWTConfig) (*auth.JWTVerifier, error) {
+	var keys auth.KeySet
+
+	if cfg.JWKSFile != "" {
+		fileKeys, err := auth.NewJWKSFromFile(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = fileKeys
+	} else if cfg.JWKSURL != "" {
+		keys = auth.NewRemoteKeySet(cfg.JWKSURL, auth.DEFAULT_JWKS_TTL, nil)
+	} else {
+		return nil, nil
+	}
+
+	// Validated along with the rest of the config
+	scopeMapping, _ := auth.ParseScopeMapping(cfg.ScopeMapping)
+
+	jwtConfig := auth.JWTConfig{
+		Issuer:        cfg.Issuer,
+		Audience:      cfg.Audience,
+		IdentityClaim: cfg.IdentityClaim,
+		ScopesClaim:   cfg.ScopesClaim,
+		ScopeMapping:  scopeMapping,
+	}
 
-	log.Printf("Starting the server on port %s...\n", PORT)
-	log.Fatal(http.ListenAndServe(":"+PORT, loggedServer))
+	return auth.NewJWTVerifier(keys, jwtConfig), nil
 }
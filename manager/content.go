@@ -0,0 +1,85 @@
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/olzhasar/go-fileserver/policy"
+	"github.com/olzhasar/go-fileserver/sniff"
+)
+
+func WithUploadPolicy(p *policy.Policy) Option {
+	return func(f *FileManager) {
+		f.uploads = p
+	}
+}
+
+// SetUploadPolicy replaces the upload policy. Uploads in progress keep the
+// policy they started with
+func (f *FileManager) SetUploadPolicy(p *policy.Policy) {
+	f.uploadsMu.Lock()
+	defer f.uploadsMu.Unlock()
+	f.uploads = p
+}
+
+func (f *FileManager) getUploadPolicy() *policy.Policy {
+	f.uploadsMu.RLock()
+	defer f.uploadsMu.RUnlock()
+	return f.uploads
+}
+
+// checkContent reads the first bytes of content to detect its type and
+// applies the type and size rules. It returns the type to record along
+// with a reader replaying those bytes, which fails with a violation once
+// the size limit of the type is crossed
+func (f *FileManager) checkContent(rules policy.Rules, fileName string, content io.Reader, size int64) (string, io.Reader, error) {
+	head := make([]byte, sniff.HEAD_SIZE)
+
+	n, err := io.ReadFull(content, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", nil, err
+	}
+	head = head[:n]
+
+	detected := sniff.Detect(head)
+	mimeType := sniff.Resolve(detected, sniff.TypeByExtension(fileName))
+
+	err = rules.CheckType(fileName, detected)
+	if err != nil {
+		return "", nil, err
+	}
+
+	replay := io.MultiReader(bytes.NewReader(head), content)
+
+	maxSize := rules.MaxSizeFor(detected, mimeType)
+	if maxSize <= 0 {
+		return mimeType, replay, nil
+	}
+
+	tooLarge := &policy.Violation{Reason: policy.REASON_TOO_LARGE, FileName: fileName, DetectedType: mimeType, MaxSize: maxSize}
+	if size > maxSize {
+		return "", nil, tooLarge
+	}
+
+	return mimeType, &limitReader{reader: replay, limit: maxSize, exceeded: tooLarge}, nil
+}
+
+// limitReader fails with exceeded once more than limit bytes have been read
+type limitReader struct {
+	reader   io.Reader
+	read     int64
+	limit    int64
+	exceeded error
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	l.read += int64(n)
+
+	if l.read > l.limit {
+		return n, l.exceeded
+	}
+
+	return n, err
+}
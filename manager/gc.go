@@ -0,0 +1,145 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+
+	"github.com/olzhasar/go-fileserver/registry"
+)
+
+// GCReport counts the files deleted by CollectGarbage
+type GCReport struct {
+	ExpiredFiles  int `json:"expired_files"`
+	OrphanedFiles int `json:"orphaned_files"`
+}
+
+// CollectGarbage deletes expired files, then stored content that no record
+// points to, e.g. left behind by a crash during an upload
+func (f *FileManager) CollectGarbage(ctx context.Context) (GCReport, error) {
+	var report GCReport
+
+	expired, err := f.deleteExpired(ctx)
+	report.ExpiredFiles = expired
+	if err != nil {
+		return report, err
+	}
+
+	orphaned, err := f.deleteOrphaned(ctx)
+	report.OrphanedFiles = orphaned
+	if err != nil {
+		return report, err
+	}
+
+	f.log(ctx).Info("Garbage collected", "expired_files", report.ExpiredFiles, "orphaned_files", report.OrphanedFiles)
+	return report, nil
+}
+
+func (f *FileManager) deleteExpired(ctx context.Context) (int, error) {
+	deleted := 0
+	query := registry.ListQuery{ExpiresBefore: f.clock(), Limit: registry.MAX_LIST_LIMIT}
+
+	for {
+		page, err := f.registry.List(ctx, query)
+		if err != nil {
+			return deleted, err
+		}
+
+		for _, file := range page.Files {
+			err := f.DeleteFile(ctx, file.Token)
+			if err != nil && !errors.Is(err, ErrInvalidToken) {
+				return deleted, err
+			}
+			deleted++
+		}
+
+		if page.NextCursor == "" {
+			return deleted, nil
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+// deleteOrphaned lists the storage before the registry, as files are
+// recorded before they are stored
+func (f *FileManager) deleteOrphaned(ctx context.Context) (int, error) {
+	stored, err := f.storage.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	referenced := make(map[string]bool)
+	query := registry.ListQuery{Limit: registry.MAX_LIST_LIMIT}
+
+	for {
+		page, err := f.registry.List(ctx, query)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, file := range page.Files {
+			referenced[file.StorageKey] = true
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+
+	deleted := 0
+	for _, key := range stored {
+		if referenced[key] {
+			continue
+		}
+
+		// Files recorded while the registry was paged through are not in
+		// referenced, so check again before deleting
+		recorded, err := f.isRecorded(ctx, key)
+		if err != nil {
+			return deleted, err
+		}
+		if recorded {
+			continue
+		}
+
+		err = f.storage.Delete(ctx, key)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return deleted, err
+		}
+
+		f.log(ctx).Info("Orphaned file deleted", "key", key)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// isRecorded reports whether a record points to the content stored under
+// key. Keys are tokens, or file names for files recorded before content
+// was stored by token
+func (f *FileManager) isRecorded(ctx context.Context, key string) (bool, error) {
+	if f.registry.Has(ctx, key) {
+		return true, nil
+	}
+
+	query := registry.ListQuery{NameContains: key, Limit: registry.MAX_LIST_LIMIT}
+
+	for {
+		page, err := f.registry.List(ctx, query)
+		if err != nil {
+			return false, err
+		}
+
+		for _, file := range page.Files {
+			if file.StorageKey == key {
+				return true, nil
+			}
+		}
+
+		if page.NextCursor == "" {
+			return false, nil
+		}
+		query.Cursor = page.NextCursor
+	}
+}
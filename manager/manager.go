@@ -1,52 +1,610 @@
 package manager
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"sync"
+	"time"
 
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/loggers"
+	"github.com/olzhasar/go-fileserver/policy"
 	"github.com/olzhasar/go-fileserver/registry"
 	"github.com/olzhasar/go-fileserver/storages"
 )
 
+// Number of wrong passwords accepted for a token before backoff kicks in
+const FREE_PASSWORD_ATTEMPTS = 5
+
+const PASSWORD_BACKOFF_BASE = time.Second
+const PASSWORD_BACKOFF_MAX = 15 * time.Minute
+
+var ErrInvalidToken = errors.New("Invalid token")
+var ErrPasswordRequired = errors.New("Password required")
+var ErrInvalidPassword = errors.New("Invalid password")
+var ErrPrivateFile = errors.New("Private file requires a signed URL")
+var ErrBlockedFile = errors.New("File has been blocked")
+var ErrExpiredFile = errors.New("File has expired")
+var ErrAnonymousListing = errors.New("Only authenticated uploaders can list their files")
+var ErrAnonymousDelete = errors.New("Only authenticated uploaders can delete files")
+var ErrNotUploader = errors.New("Only the uploader can delete this file")
+
+// TooManyAttemptsError is returned by LoadFile while a protected token is
+// locked after repeated wrong passwords
+type TooManyAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyAttemptsError) Error() string {
+	return fmt.Sprintf("Too many failed password attempts, retry after %v", e.RetryAfter)
+}
+
+type SaveOptions struct {
+	// Password protects downloads of the file if not empty
+	Password string
+	// Private files can only be downloaded through signed URLs
+	Private bool
+	// ExpiresAt is zero for files that never expire
+	ExpiresAt time.Time
+	// Size is the length of the content if known in advance, so that size
+	// limits are checked before anything is stored
+	Size int64
+	// Trailer is called once the content has been stored and returns the
+	// options sent after it, such as form fields following the file of a
+	// multipart upload. They are applied along with the others
+	Trailer func() (SaveOptions, error)
+}
+
+// withTrailer adds the options returned by Trailer
+func (o SaveOptions) withTrailer() (SaveOptions, error) {
+	if o.Trailer == nil {
+		return o, nil
+	}
+
+	trailer, err := o.Trailer()
+	if err != nil {
+		return o, err
+	}
+
+	if trailer.Password != "" {
+		o.Password = trailer.Password
+	}
+	if trailer.Private {
+		o.Private = true
+	}
+	if !trailer.ExpiresAt.IsZero() {
+		o.ExpiresAt = trailer.ExpiresAt
+	}
+	return o, nil
+}
+
+type LoadOptions struct {
+	Password string
+	// AllowPrivate is set when access to private files has been granted
+	// out of band, e.g. by a verified signed URL
+	AllowPrivate bool
+}
+
+// SaverLoader saves and loads files on behalf of the identity attached to
+// the context with auth.WithIdentity, if any
 type SaverLoader interface {
-	SaveFile(fileName string, content io.Reader) (token string, err error)
-	LoadFile(token string) (upload storages.UploadedFile, err error)
+	SaveFile(ctx context.Context, fileName string, content io.Reader, opts SaveOptions) (token string, err error)
+	LoadFile(ctx context.Context, token string, opts LoadOptions) (upload storages.UploadedFile, err error)
+	Usage(ctx context.Context) (report UsageReport, err error)
+	ListFiles(ctx context.Context, query registry.ListQuery) (page registry.ListPage, err error)
+	DescribeFile(ctx context.Context, token string, opts LoadOptions) (info FileInfo, err error)
+	RemoveFile(ctx context.Context, token string) (err error)
+}
+
+// FileInfo describes a file to anyone who may download it
+type FileInfo struct {
+	FileName string
+	Size     int64
+	MimeType string
+	// Protected files need a password to be downloaded
+	Protected bool
+	ExpiresAt time.Time
 }
 
 type FileManager struct {
 	registry registry.Registry
 	storage  storages.Storage
+	quotas   Quotas
+	quotasMu sync.RWMutex
+	// reservations counts uploads in progress against quotas
+	reservations reservations
+	uploads      *policy.Policy
+	uploadsMu    sync.RWMutex
+	logger       loggers.Logger
+	now          func() time.Time
+	// attempts serializes password checks by token
+	attempts keyedMutex
+
+	scanning   scanning
+	scanningMu sync.RWMutex
+	// scans tracks background scans, and inFlight their tokens
+	scans      sync.WaitGroup
+	scanSlots  chan struct{}
+	inFlight   map[string]bool
+	inFlightMu sync.Mutex
 }
 
-func NewFileManager(r registry.Registry, s storages.Storage) *FileManager {
-	return &FileManager{r, s}
+type Option func(f *FileManager)
+
+func WithQuotas(quotas Quotas) Option {
+	return func(f *FileManager) {
+		f.quotas = quotas
+	}
 }
 
-func (f *FileManager) SaveFile(fileName string, content io.Reader) (string, error) {
-	token, err := registry.RecordFile(f.registry, fileName, registry.GenerateUniqueToken)
+func WithLogger(logger loggers.Logger) Option {
+	return func(f *FileManager) {
+		f.logger = logger
+	}
+}
+
+func NewFileManager(r registry.Registry, s storages.Storage, opts ...Option) *FileManager {
+	mgr := &FileManager{registry: r, storage: s, logger: loggers.NopLogger{}, now: time.Now}
+
+	for _, opt := range opts {
+		opt(mgr)
+	}
+
+	return mgr
+}
+
+// SetQuotas replaces the quotas. Uploads in progress keep the quotas they
+// started with
+func (f *FileManager) SetQuotas(quotas Quotas) {
+	f.quotasMu.Lock()
+	defer f.quotasMu.Unlock()
+	f.quotas = quotas
+}
+
+func (f *FileManager) getQuotas() Quotas {
+	f.quotasMu.RLock()
+	defer f.quotasMu.RUnlock()
+	return f.quotas
+}
+
+// SaveFile records the identity from ctx as the uploader of the file.
+// Uploads are aborted with QuotaExceededError as soon as they cross the
+// quotas of the uploader or the global ones. The type of the file is
+// detected from its first bytes, and uploads breaking the rules of the
+// upload policy for the uploader fail with policy.Violation, before
+// anything is recorded except for files crossing their size limit. With a
+// scanner, files are recorded as pending until scanned, and infected files
+// are kept in quarantine
+func (f *FileManager) SaveFile(ctx context.Context, fileName string, content io.Reader, opts SaveOptions) (_ string, err error) {
+	uploader := ""
+	if identity := auth.IdentityFromContext(ctx); identity != nil {
+		uploader = identity.Name
+	}
+
+	rules := f.getUploadPolicy().For(uploader)
+	scan := f.getScanner()
+
+	err = rules.CheckName(fileName)
+	if err != nil {
+		f.log(ctx).Warn("Upload rejected", "uploader", uploader, "error", err)
+		return "", err
+	}
+
+	reader, err := f.reserveQuota(ctx, uploader, content, opts.Size)
 	if err != nil {
+		f.log(ctx).Warn("Upload rejected", "uploader", uploader, "error", err)
 		return "", err
 	}
+	defer reader.release()
 
-	err = f.storage.SaveFile(fileName, content)
+	mimeType, checked, err := f.checkContent(rules, fileName, reader, opts.Size)
 	if err != nil {
+		if ctx.Err() != nil {
+			f.log(ctx).Info("Upload cancelled", "file", fileName, "error", err)
+		} else {
+			f.log(ctx).Warn("Upload rejected", "uploader", uploader, "error", err)
+		}
 		return "", err
 	}
 
+	token, err := registry.RecordFile(ctx, f.registry, fileName, registry.GenerateUniqueToken)
+	if err != nil {
+		return "", err
+	}
+	reader.recorded()
+
+	// Cleanup must still run when the upload failed because ctx was cancelled
+	cleanupCtx := context.WithoutCancel(ctx)
+
+	defer func() {
+		var infected *InfectedError
+		if err != nil && !errors.As(err, &infected) {
+			deleteErr := f.registry.Delete(cleanupCtx, token)
+			if deleteErr != nil {
+				f.log(ctx).Error("Unable to delete registry record", "token", token, "error", deleteErr)
+			}
+		}
+	}()
+
+	// Content is stored by token, as file names are shared by uploads
+	err = f.registry.SetStorageKey(ctx, token, token)
+	if err != nil {
+		return "", err
+	}
+
+	if uploader != "" {
+		err = f.registry.SetUploader(ctx, token, uploader)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = f.registry.SetMimeType(ctx, token, mimeType)
+	if err != nil {
+		return "", err
+	}
+
+	if scan.scanner != nil {
+		err = f.registry.SetScanResult(ctx, token, registry.SCAN_PENDING, "")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = f.storage.SaveFile(ctx, token, checked)
+	if err != nil {
+		var violation *policy.Violation
+		switch {
+		case reader.exceeded != nil, errors.As(err, &violation):
+			f.log(ctx).Warn("Upload rejected", "uploader", uploader, "error", err)
+		case ctx.Err() != nil:
+			f.log(ctx).Info("Upload cancelled", "file", fileName, "error", err)
+		default:
+			f.log(ctx).Error("Unable to save file", "file", fileName, "error", err)
+		}
+
+		deleteErr := f.storage.Delete(cleanupCtx, token)
+		if deleteErr != nil && !errors.Is(deleteErr, fs.ErrNotExist) {
+			f.log(ctx).Error("Unable to delete partial file", "token", token, "file", fileName, "error", deleteErr)
+		}
+		return "", err
+	}
+
+	// The token is only handed out once options sent after the content are
+	// applied, so nobody can download the file in the meantime
+	err = f.protect(ctx, token, opts)
+	if err != nil {
+		deleteErr := f.storage.Delete(cleanupCtx, token)
+		if deleteErr != nil && !errors.Is(deleteErr, fs.ErrNotExist) {
+			f.log(ctx).Error("Unable to delete file", "token", token, "file", fileName, "error", deleteErr)
+		}
+		return "", err
+	}
+
+	err = f.registry.SetSize(ctx, token, reader.read)
+	if err != nil {
+		return "", err
+	}
+	reader.release()
+
+	if scan.scanner != nil {
+		err = f.scanUpload(ctx, scan, token, token)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	return token, nil
 }
 
-func (f *FileManager) LoadFile(token string) (storages.UploadedFile, error) {
-	fileName, ok := f.registry.Get(token)
+// protect applies the access options of an upload, including the ones
+// returned by their trailer
+func (f *FileManager) protect(ctx context.Context, token string, opts SaveOptions) error {
+	opts, err := opts.withTrailer()
+	if err != nil {
+		return err
+	}
+
+	if opts.Private {
+		err = f.registry.SetPrivate(ctx, token, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !opts.ExpiresAt.IsZero() {
+		err = f.registry.SetExpiry(ctx, token, opts.ExpiresAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Password != "" {
+		hash, err := HashPassword(opts.Password)
+		if err != nil {
+			return err
+		}
+
+		err = f.registry.SetPassword(ctx, token, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadFile lets identities from ctx with the download-private scope load
+// private files without a signed URL
+func (f *FileManager) LoadFile(ctx context.Context, token string, opts LoadOptions) (storages.UploadedFile, error) {
+	fileName, ok := f.registry.Get(ctx, token)
+	if !ok {
+		return storages.UploadedFile{}, ErrInvalidToken
+	}
+
+	if auth.IdentityFromContext(ctx).HasScope(auth.ScopeDownloadPrivate) {
+		opts.AllowPrivate = true
+	}
+
+	err := f.checkAccess(ctx, token, opts)
+	if err != nil {
+		return storages.UploadedFile{}, err
+	}
+
+	metadata, ok := f.registry.GetMetadata(ctx, token)
 	if !ok {
-		return storages.UploadedFile{}, errors.New("Invalid token")
+		return storages.UploadedFile{}, ErrInvalidToken
 	}
 
-	upload, err := f.storage.LoadFile(fileName)
+	upload, err := f.storage.LoadFile(ctx, metadata.StorageKey)
 
 	if err != nil {
+		f.log(ctx).Error("Unable to load file", "token", token, "file", fileName, "error", err)
 		return storages.UploadedFile{}, err
 	}
 
+	upload.Name = fileName
+	upload.MimeType = metadata.MimeType
+
 	return upload, nil
 }
+
+// DescribeFile applies the access rules of LoadFile except for the
+// password, so that protected files can be described before it is entered
+func (f *FileManager) DescribeFile(ctx context.Context, token string, opts LoadOptions) (FileInfo, error) {
+	fileName, ok := f.registry.Get(ctx, token)
+	if !ok {
+		return FileInfo{}, ErrInvalidToken
+	}
+
+	if auth.IdentityFromContext(ctx).HasScope(auth.ScopeDownloadPrivate) {
+		opts.AllowPrivate = true
+	}
+
+	protection, ok := f.registry.GetProtection(ctx, token)
+	if !ok {
+		return FileInfo{}, ErrInvalidToken
+	}
+
+	err := f.checkAvailability(protection, opts)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	metadata, ok := f.registry.GetMetadata(ctx, token)
+	if !ok {
+		return FileInfo{}, ErrInvalidToken
+	}
+
+	return FileInfo{
+		FileName:  fileName,
+		Size:      metadata.Size,
+		MimeType:  metadata.MimeType,
+		Protected: protection.IsProtected(),
+		ExpiresAt: protection.ExpiresAt,
+	}, nil
+}
+
+// ListFiles lists the files uploaded by the identity from ctx, whatever
+// the uploader of query
+func (f *FileManager) ListFiles(ctx context.Context, query registry.ListQuery) (registry.ListPage, error) {
+	identity := auth.IdentityFromContext(ctx)
+	if identity == nil {
+		return registry.ListPage{}, ErrAnonymousListing
+	}
+
+	query.Uploader = identity.Name
+	return f.registry.List(ctx, query)
+}
+
+// RemoveFile deletes token on behalf of the identity from ctx, which must
+// have uploaded it or have the delete-any scope
+func (f *FileManager) RemoveFile(ctx context.Context, token string) error {
+	identity := auth.IdentityFromContext(ctx)
+	if identity == nil {
+		return ErrAnonymousDelete
+	}
+
+	metadata, ok := f.registry.GetMetadata(ctx, token)
+	if !ok {
+		return ErrInvalidToken
+	}
+
+	if metadata.Uploader != identity.Name && !identity.HasScope(auth.ScopeDeleteAny) {
+		return ErrNotUploader
+	}
+
+	return f.DeleteFile(ctx, token)
+}
+
+// DeleteFile deletes the record of token and the stored file, regardless
+// of who uploaded it
+func (f *FileManager) DeleteFile(ctx context.Context, token string) error {
+	fileName, ok := f.registry.Get(ctx, token)
+	if !ok {
+		return ErrInvalidToken
+	}
+
+	metadata, ok := f.registry.GetMetadata(ctx, token)
+	if !ok {
+		return ErrInvalidToken
+	}
+
+	err := f.registry.Delete(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	err = f.deleteStored(ctx, token, metadata.StorageKey)
+	if err != nil {
+		f.log(ctx).Error("Unable to delete stored file", "token", token, "file", fileName, "error", err)
+		return err
+	}
+
+	f.log(ctx).Info("File deleted", "token", token, "file", fileName)
+	return nil
+}
+
+// deleteStored deletes the content stored under key for token. Files
+// recorded before content was stored by token share the key with other
+// files of the same name, so it is kept as long as a record points to it
+func (f *FileManager) deleteStored(ctx context.Context, token, key string) error {
+	if key != token {
+		recorded, err := f.isRecorded(ctx, key)
+		if err != nil || recorded {
+			return err
+		}
+	}
+
+	err := f.storage.Delete(ctx, key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *FileManager) checkAccess(ctx context.Context, token string, opts LoadOptions) error {
+	protection, ok := f.registry.GetProtection(ctx, token)
+	if !ok {
+		return ErrInvalidToken
+	}
+
+	err := f.checkAvailability(protection, opts)
+	if err != nil {
+		return err
+	}
+
+	if !protection.IsProtected() {
+		return nil
+	}
+
+	return f.checkPassword(ctx, token, opts.Password)
+}
+
+// checkAvailability rejects blocked, quarantined, expired and unscanned
+// files, and private ones unless opts allow them
+func (f *FileManager) checkAvailability(protection registry.Protection, opts LoadOptions) error {
+	if protection.Blocked {
+		return ErrBlockedFile
+	}
+
+	if protection.ScanStatus == registry.SCAN_INFECTED {
+		return ErrQuarantinedFile
+	}
+
+	if protection.IsExpired(f.clock()) {
+		return ErrExpiredFile
+	}
+
+	if protection.ScanStatus == registry.SCAN_PENDING {
+		return ErrScanPending
+	}
+
+	if protection.Private && !opts.AllowPrivate {
+		return ErrPrivateFile
+	}
+
+	return nil
+}
+
+// checkPassword holds the lock of token from reading the failed attempts
+// until the outcome is recorded, so that parallel guesses can't all pass
+// the backoff check before any failure is counted
+func (f *FileManager) checkPassword(ctx context.Context, token, password string) error {
+	if password == "" {
+		return ErrPasswordRequired
+	}
+
+	unlock := f.attempts.Lock(token)
+	defer unlock()
+
+	protection, ok := f.registry.GetProtection(ctx, token)
+	if !ok {
+		return ErrInvalidToken
+	}
+
+	now := f.clock()
+
+	wait := passwordBackoff(protection.FailedAttempts)
+	if unlockAt := protection.LastFailedAt.Add(wait); wait > 0 && now.Before(unlockAt) {
+		return &TooManyAttemptsError{RetryAfter: unlockAt.Sub(now)}
+	}
+
+	valid, err := VerifyPassword(password, protection.PasswordHash)
+	if err != nil {
+		return err
+	}
+
+	if !valid {
+		f.log(ctx).Warn("Wrong password", "token", token, "failed_attempts", protection.FailedAttempts+1)
+
+		err = f.registry.RecordFailedAttempt(ctx, token, now)
+		if err != nil {
+			return err
+		}
+		return ErrInvalidPassword
+	}
+
+	if protection.FailedAttempts > 0 {
+		return f.registry.ResetFailedAttempts(ctx, token)
+	}
+
+	return nil
+}
+
+// log returns a logger tagging messages with the request ID from ctx
+func (f *FileManager) log(ctx context.Context) loggers.Logger {
+	if f.logger == nil {
+		return loggers.NopLogger{}
+	}
+	return loggers.FromContext(ctx, f.logger)
+}
+
+func (f *FileManager) clock() time.Time {
+	if f.now == nil {
+		return time.Now()
+	}
+	return f.now()
+}
+
+// passwordBackoff returns how long a token stays locked after the given
+// number of consecutive failed attempts. The delay doubles with every
+// attempt past FREE_PASSWORD_ATTEMPTS
+func passwordBackoff(failedAttempts int) time.Duration {
+	if failedAttempts < FREE_PASSWORD_ATTEMPTS {
+		return 0
+	}
+
+	wait := PASSWORD_BACKOFF_BASE
+	for i := FREE_PASSWORD_ATTEMPTS; i < failedAttempts; i++ {
+		wait *= 2
+		if wait >= PASSWORD_BACKOFF_MAX {
+			return PASSWORD_BACKOFF_MAX
+		}
+	}
+
+	return wait
+}
@@ -2,9 +2,20 @@ package manager
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/policy"
 	"github.com/olzhasar/go-fileserver/registry"
+	"github.com/olzhasar/go-fileserver/scanner"
+	"github.com/olzhasar/go-fileserver/scanner/clamdtest"
 	"github.com/olzhasar/go-fileserver/storages"
 )
 
@@ -19,13 +30,13 @@ func TestSaveFile(t *testing.T) {
 	buf := &bytes.Buffer{}
 	buf.WriteString(fileContent)
 
-	token, err := mgr.SaveFile(fileName, buf)
+	token, err := mgr.SaveFile(context.Background(), fileName, buf, SaveOptions{})
 
 	if err != nil {
 		t.Fatalf("Expected no error, got %q", err)
 	}
 
-	savedName, ok := reg.Get(token)
+	savedName, ok := reg.Get(context.Background(), token)
 
 	if !ok {
 		t.Fatalf("Want token %q to be in registry, but it's not", token)
@@ -35,10 +46,13 @@ func TestSaveFile(t *testing.T) {
 		t.Fatalf("Got filename %q, want %q", savedName, fileName)
 	}
 
-	upload, err := storage.LoadFile(fileName)
+	if _, err := storage.LoadFile(context.Background(), token); err != nil {
+		t.Fatalf("Error loading file from storage:\n%v", err)
+	}
 
+	upload, err := mgr.LoadFile(context.Background(), token, LoadOptions{})
 	if err != nil {
-		t.Fatalf("Error loading file from storage:\n%v", err)
+		t.Fatalf("Expected no error, got %q", err)
 	}
 
 	if upload.Name != fileName {
@@ -46,6 +60,121 @@ func TestSaveFile(t *testing.T) {
 	}
 }
 
+func TestSaveFileWithSameName(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+	storage := storages.NewInMemoryStorage()
+	mgr := NewFileManager(reg, storage)
+
+	first, _ := mgr.SaveFile(context.Background(), "report.txt", bytes.NewBufferString("first"), SaveOptions{})
+	second, _ := mgr.SaveFile(context.Background(), "report.txt", bytes.NewBufferString("second"), SaveOptions{})
+
+	broken := io.MultiReader(bytes.NewBufferString("third"), iotest.ErrReader(errors.New("connection reset")))
+	if _, err := mgr.SaveFile(context.Background(), "report.txt", broken, SaveOptions{}); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	for token, want := range map[string]string{first: "first", second: "second"} {
+		upload, err := mgr.LoadFile(context.Background(), token, LoadOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+		content, _ := io.ReadAll(upload.File)
+		if string(content) != want || upload.Name != "report.txt" {
+			t.Errorf("Got %q named %q, want %q named report.txt", content, upload.Name, want)
+		}
+	}
+}
+
+func TestSaveFileRecordsUploader(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+	mgr := NewFileManager(reg, storages.NewInMemoryStorage())
+
+	ctx := auth.WithIdentity(context.Background(), &auth.Identity{Name: "alice"})
+
+	buf := bytes.NewBufferString("test content")
+	token, err := mgr.SaveFile(ctx, "example.txt", buf, SaveOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	metadata, _ := reg.GetMetadata(context.Background(), token)
+	if metadata.Uploader != "alice" {
+		t.Errorf("Got uploader %q, want %q", metadata.Uploader, "alice")
+	}
+	if metadata.MimeType != "text/plain" {
+		t.Errorf("Got MIME type %q, want text/plain", metadata.MimeType)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+	mgr := NewFileManager(reg, storages.NewInMemoryStorage())
+
+	alice := auth.WithIdentity(context.Background(), &auth.Identity{Name: "alice"})
+	bob := auth.WithIdentity(context.Background(), &auth.Identity{Name: "bob"})
+
+	mgr.SaveFile(alice, "alice.txt", bytes.NewBufferString("a"), SaveOptions{})
+	mgr.SaveFile(bob, "bob.txt", bytes.NewBufferString("b"), SaveOptions{})
+	mgr.SaveFile(context.Background(), "anonymous.bin", bytes.NewBufferString("\x00\x01"), SaveOptions{})
+
+	t.Run("lists only files of the identity", func(t *testing.T) {
+		page, err := mgr.ListFiles(alice, registry.ListQuery{Uploader: "bob"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		if len(page.Files) != 1 || page.Files[0].FileName != "alice.txt" {
+			t.Errorf("Got %+v, want only alice.txt", page.Files)
+		}
+	})
+	t.Run("requires an identity", func(t *testing.T) {
+		_, err := mgr.ListFiles(context.Background(), registry.ListQuery{})
+		if err != ErrAnonymousListing {
+			t.Errorf("Got error %v, want %v", err, ErrAnonymousListing)
+		}
+	})
+	t.Run("records unknown types as octet streams", func(t *testing.T) {
+		page, _ := reg.List(context.Background(), registry.ListQuery{MimeType: "application/octet-stream"})
+		if len(page.Files) != 1 || page.Files[0].FileName != "anonymous.bin" {
+			t.Errorf("Got %+v, want only anonymous.bin", page.Files)
+		}
+	})
+}
+
+// cancellingReader cancels the upload context after the first read, like a
+// client disconnecting in the middle of an upload
+type cancellingReader struct {
+	reader io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancellingReader) Read(p []byte) (int, error) {
+	defer c.cancel()
+	return c.reader.Read(p[:1])
+}
+
+func TestSaveFileCancelled(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+	storage := storages.NewInMemoryStorage()
+	mgr := NewFileManager(reg, storage)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	content := &cancellingReader{strings.NewReader("test content"), cancel}
+
+	_, err := mgr.SaveFile(ctx, "example.txt", content, SaveOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Want context.Canceled, got %v", err)
+	}
+
+	usage, _ := reg.GetTotalUsage(context.Background())
+	if usage.Files != 0 {
+		t.Errorf("Got %d files in registry, want 0", usage.Files)
+	}
+	if len(storage.Files) != 0 {
+		t.Errorf("Got %d files in storage, want 0", len(storage.Files))
+	}
+}
+
 func TestLoadFile(t *testing.T) {
 	reg := registry.NewInMemoryRegistry()
 	storage := storages.NewInMemoryStorage()
@@ -58,9 +187,9 @@ func TestLoadFile(t *testing.T) {
 		buf := &bytes.Buffer{}
 		buf.WriteString(fileContent)
 
-		token, _ := mgr.SaveFile(fileName, buf)
+		token, _ := mgr.SaveFile(context.Background(), fileName, buf, SaveOptions{})
 
-		upload, err := mgr.LoadFile(token)
+		upload, err := mgr.LoadFile(context.Background(), token, LoadOptions{})
 
 		if err != nil {
 			t.Fatalf("Expected no error, got %q", err)
@@ -72,10 +201,1205 @@ func TestLoadFile(t *testing.T) {
 	})
 
 	t.Run("throws error for unexisting file", func(t *testing.T) {
-		_, err := mgr.LoadFile("123456")
+		_, err := mgr.LoadFile(context.Background(), "123456", LoadOptions{})
 
 		if err == nil {
 			t.Fatal("Got nil, want error")
 		}
 	})
 }
+
+func TestLoadProtectedFile(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+	storage := storages.NewInMemoryStorage()
+
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	mgr := &FileManager{registry: reg, storage: storage, now: func() time.Time { return now }}
+
+	saveProtected := func() string {
+		buf := bytes.NewBufferString("secret content")
+		token, err := mgr.SaveFile(context.Background(), "secret.txt", buf, SaveOptions{Password: "hunter2"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+		return token
+	}
+
+	t.Run("stores password hash instead of password", func(t *testing.T) {
+		token := saveProtected()
+
+		protection, _ := reg.GetProtection(context.Background(), token)
+		if !protection.IsProtected() {
+			t.Fatal("Want file to be protected, but it's not")
+		}
+		if strings.Contains(protection.PasswordHash, "hunter2") {
+			t.Fatalf("Password stored in plain text: %q", protection.PasswordHash)
+		}
+	})
+	t.Run("applies the password of the trailer", func(t *testing.T) {
+		trailer := func() (SaveOptions, error) {
+			return SaveOptions{Password: "hunter2"}, nil
+		}
+		token, err := mgr.SaveFile(context.Background(), "secret.txt", bytes.NewBufferString("secret content"), SaveOptions{Trailer: trailer})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		_, err = mgr.LoadFile(context.Background(), token, LoadOptions{})
+		if err != ErrPasswordRequired {
+			t.Fatalf("Got error %v, want %v", err, ErrPasswordRequired)
+		}
+	})
+	t.Run("discards the upload if the trailer fails", func(t *testing.T) {
+		trailerErr := errors.New("invalid field")
+		trailer := func() (SaveOptions, error) {
+			return SaveOptions{}, trailerErr
+		}
+		_, err := mgr.SaveFile(context.Background(), "failed.txt", bytes.NewBufferString("content"), SaveOptions{Trailer: trailer})
+		if err != trailerErr {
+			t.Fatalf("Got error %v, want %v", err, trailerErr)
+		}
+
+		page, _ := reg.List(context.Background(), registry.ListQuery{NameContains: "failed"})
+		if len(page.Files) != 0 {
+			t.Errorf("Got %d records, want the upload discarded", len(page.Files))
+		}
+	})
+	t.Run("requires password", func(t *testing.T) {
+		token := saveProtected()
+
+		_, err := mgr.LoadFile(context.Background(), token, LoadOptions{})
+		if err != ErrPasswordRequired {
+			t.Fatalf("Got error %v, want %v", err, ErrPasswordRequired)
+		}
+	})
+	t.Run("loads file with valid password", func(t *testing.T) {
+		token := saveProtected()
+
+		upload, err := mgr.LoadFile(context.Background(), token, LoadOptions{Password: "hunter2"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+		if upload.Name != "secret.txt" {
+			t.Fatalf("Got filename %q, want %q", upload.Name, "secret.txt")
+		}
+	})
+	t.Run("locks token after repeated failures", func(t *testing.T) {
+		token := saveProtected()
+
+		for i := 0; i < FREE_PASSWORD_ATTEMPTS; i++ {
+			_, err := mgr.LoadFile(context.Background(), token, LoadOptions{Password: "wrong"})
+			if err != ErrInvalidPassword {
+				t.Fatalf("Attempt %d: got error %v, want %v", i, err, ErrInvalidPassword)
+			}
+		}
+
+		_, err := mgr.LoadFile(context.Background(), token, LoadOptions{Password: "hunter2"})
+
+		var tooMany *TooManyAttemptsError
+		if !errors.As(err, &tooMany) {
+			t.Fatalf("Got error %v, want TooManyAttemptsError", err)
+		}
+		if tooMany.RetryAfter != PASSWORD_BACKOFF_BASE {
+			t.Errorf("Got retry after %v, want %v", tooMany.RetryAfter, PASSWORD_BACKOFF_BASE)
+		}
+
+		now = now.Add(PASSWORD_BACKOFF_BASE)
+
+		_, err = mgr.LoadFile(context.Background(), token, LoadOptions{Password: "hunter2"})
+		if err != nil {
+			t.Fatalf("Expected no error after backoff, got %q", err)
+		}
+
+		protection, _ := reg.GetProtection(context.Background(), token)
+		if protection.FailedAttempts != 0 {
+			t.Errorf("Got %d failed attempts after success, want 0", protection.FailedAttempts)
+		}
+	})
+	t.Run("counts parallel guesses", func(t *testing.T) {
+		token := saveProtected()
+
+		errs := make(chan error, 3*FREE_PASSWORD_ATTEMPTS)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(errs); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := mgr.LoadFile(context.Background(), token, LoadOptions{Password: "wrong"})
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		guesses := 0
+		for err := range errs {
+			if err == ErrInvalidPassword {
+				guesses++
+			}
+		}
+		if guesses != FREE_PASSWORD_ATTEMPTS {
+			t.Errorf("Got %d passwords checked, want %d", guesses, FREE_PASSWORD_ATTEMPTS)
+		}
+	})
+}
+
+func TestLoadPrivateFile(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+	storage := storages.NewInMemoryStorage()
+	mgr := NewFileManager(reg, storage)
+
+	buf := bytes.NewBufferString("private content")
+	token, err := mgr.SaveFile(context.Background(), "private.txt", buf, SaveOptions{Private: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	t.Run("rejects unsigned requests", func(t *testing.T) {
+		_, err := mgr.LoadFile(context.Background(), token, LoadOptions{})
+		if err != ErrPrivateFile {
+			t.Fatalf("Got error %v, want %v", err, ErrPrivateFile)
+		}
+	})
+	t.Run("loads file for identities with download-private scope", func(t *testing.T) {
+		identity := &auth.Identity{Name: "alice", Scopes: []auth.Scope{auth.ScopeDownloadPrivate}}
+		ctx := auth.WithIdentity(context.Background(), identity)
+
+		_, err := mgr.LoadFile(ctx, token, LoadOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+	})
+	t.Run("loads file for signed requests", func(t *testing.T) {
+		upload, err := mgr.LoadFile(context.Background(), token, LoadOptions{AllowPrivate: true})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+		if upload.Name != "private.txt" {
+			t.Fatalf("Got filename %q, want %q", upload.Name, "private.txt")
+		}
+	})
+}
+
+func TestLoadBlockedOrExpiredFile(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+	mgr := NewFileManager(reg, storages.NewInMemoryStorage())
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	mgr.now = func() time.Time { return now }
+
+	token, _ := mgr.SaveFile(context.Background(), "file.txt", bytes.NewBufferString("content"), SaveOptions{})
+
+	t.Run("rejects blocked files", func(t *testing.T) {
+		reg.SetBlocked(context.Background(), token, true)
+		defer reg.SetBlocked(context.Background(), token, false)
+
+		_, err := mgr.LoadFile(context.Background(), token, LoadOptions{AllowPrivate: true})
+		if err != ErrBlockedFile {
+			t.Fatalf("Got error %v, want %v", err, ErrBlockedFile)
+		}
+	})
+	t.Run("rejects expired files", func(t *testing.T) {
+		reg.SetExpiry(context.Background(), token, now)
+
+		_, err := mgr.LoadFile(context.Background(), token, LoadOptions{})
+		if err != ErrExpiredFile {
+			t.Fatalf("Got error %v, want %v", err, ErrExpiredFile)
+		}
+	})
+	t.Run("loads files before they expire", func(t *testing.T) {
+		reg.SetExpiry(context.Background(), token, now.Add(time.Second))
+
+		_, err := mgr.LoadFile(context.Background(), token, LoadOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+	})
+	t.Run("sets expiry on save", func(t *testing.T) {
+		expiring, _ := mgr.SaveFile(context.Background(), "expiring.txt", bytes.NewBufferString("content"), SaveOptions{ExpiresAt: now})
+
+		_, err := mgr.LoadFile(context.Background(), expiring, LoadOptions{})
+		if err != ErrExpiredFile {
+			t.Fatalf("Got error %v, want %v", err, ErrExpiredFile)
+		}
+	})
+}
+
+func TestDescribeFile(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+	mgr := NewFileManager(reg, storages.NewInMemoryStorage())
+
+	expiresAt := time.Now().Add(time.Hour)
+	token, _ := mgr.SaveFile(context.Background(), "report.pdf", bytes.NewBufferString("%PDF-1."), SaveOptions{Password: "password", ExpiresAt: expiresAt})
+	private, _ := mgr.SaveFile(context.Background(), "private.txt", bytes.NewBufferString("content"), SaveOptions{Private: true})
+
+	t.Run("describes protected files without password", func(t *testing.T) {
+		info, err := mgr.DescribeFile(context.Background(), token, LoadOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		want := FileInfo{FileName: "report.pdf", Size: 7, MimeType: "application/pdf", Protected: true, ExpiresAt: expiresAt}
+		if info != want {
+			t.Errorf("Got %+v, want %+v", info, want)
+		}
+	})
+	t.Run("applies access rules", func(t *testing.T) {
+		_, err := mgr.DescribeFile(context.Background(), private, LoadOptions{})
+		if err != ErrPrivateFile {
+			t.Errorf("Got error %v, want %v", err, ErrPrivateFile)
+		}
+
+		_, err = mgr.DescribeFile(context.Background(), private, LoadOptions{AllowPrivate: true})
+		if err != nil {
+			t.Errorf("Expected no error, got %q", err)
+		}
+
+		reg.SetBlocked(context.Background(), token, true)
+		_, err = mgr.DescribeFile(context.Background(), token, LoadOptions{})
+		if err != ErrBlockedFile {
+			t.Errorf("Got error %v, want %v", err, ErrBlockedFile)
+		}
+	})
+	t.Run("throws error for unexisting file", func(t *testing.T) {
+		_, err := mgr.DescribeFile(context.Background(), "unknown", LoadOptions{})
+		if err != ErrInvalidToken {
+			t.Errorf("Got error %v, want %v", err, ErrInvalidToken)
+		}
+	})
+}
+
+func TestDeleteFile(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+	storage := storages.NewInMemoryStorage()
+	mgr := NewFileManager(reg, storage)
+
+	token, _ := mgr.SaveFile(context.Background(), "file.txt", bytes.NewBufferString("content"), SaveOptions{})
+
+	err := mgr.DeleteFile(context.Background(), token)
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	if reg.Has(context.Background(), token) {
+		t.Error("Want the record to be deleted")
+	}
+	if _, ok := storage.Files[token]; ok {
+		t.Error("Want the stored file to be deleted")
+	}
+
+	if err := mgr.DeleteFile(context.Background(), token); err != ErrInvalidToken {
+		t.Errorf("Got error %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestRemoveFile(t *testing.T) {
+	alice := auth.WithIdentity(context.Background(), &auth.Identity{Name: "alice"})
+	bob := auth.WithIdentity(context.Background(), &auth.Identity{Name: "bob"})
+	moderator := auth.WithIdentity(context.Background(), &auth.Identity{Name: "moderator", Scopes: []auth.Scope{auth.ScopeDeleteAny}})
+
+	newManager := func() (*FileManager, registry.Registry) {
+		reg := registry.NewInMemoryRegistry()
+		return NewFileManager(reg, storages.NewInMemoryStorage()), reg
+	}
+
+	t.Run("lets uploaders delete their files", func(t *testing.T) {
+		mgr, reg := newManager()
+		token, _ := mgr.SaveFile(alice, "a.txt", bytes.NewBufferString("a"), SaveOptions{})
+
+		if err := mgr.RemoveFile(alice, token); err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+		if reg.Has(context.Background(), token) {
+			t.Error("Want the record to be deleted")
+		}
+	})
+	t.Run("rejects other identities", func(t *testing.T) {
+		mgr, reg := newManager()
+		token, _ := mgr.SaveFile(alice, "a.txt", bytes.NewBufferString("a"), SaveOptions{})
+
+		if err := mgr.RemoveFile(bob, token); err != ErrNotUploader {
+			t.Errorf("Got error %v, want %v", err, ErrNotUploader)
+		}
+		if err := mgr.RemoveFile(context.Background(), token); err != ErrAnonymousDelete {
+			t.Errorf("Got error %v, want %v", err, ErrAnonymousDelete)
+		}
+		if !reg.Has(context.Background(), token) {
+			t.Error("Want the record to be kept")
+		}
+	})
+	t.Run("lets delete-any identities delete any file", func(t *testing.T) {
+		mgr, reg := newManager()
+		token, _ := mgr.SaveFile(alice, "a.txt", bytes.NewBufferString("a"), SaveOptions{})
+
+		if err := mgr.RemoveFile(moderator, token); err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+		if reg.Has(context.Background(), token) {
+			t.Error("Want the record to be deleted")
+		}
+	})
+	t.Run("rejects unknown tokens", func(t *testing.T) {
+		mgr, _ := newManager()
+
+		if err := mgr.RemoveFile(moderator, "missing"); err != ErrInvalidToken {
+			t.Errorf("Got error %v, want %v", err, ErrInvalidToken)
+		}
+	})
+}
+
+func TestDeleteFileWithSharedName(t *testing.T) {
+	t.Run("keeps other files with the same name", func(t *testing.T) {
+		reg := registry.NewInMemoryRegistry()
+		storage := storages.NewInMemoryStorage()
+		mgr := NewFileManager(reg, storage)
+
+		deleted, _ := mgr.SaveFile(context.Background(), "file.txt", bytes.NewBufferString("deleted"), SaveOptions{})
+		kept, _ := mgr.SaveFile(context.Background(), "file.txt", bytes.NewBufferString("kept"), SaveOptions{})
+
+		if err := mgr.DeleteFile(context.Background(), deleted); err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		if _, err := mgr.LoadFile(context.Background(), kept, LoadOptions{}); err != nil {
+			t.Errorf("Want the other file to be kept, got %q", err)
+		}
+	})
+	t.Run("deletes content stored by name once unreferenced", func(t *testing.T) {
+		reg := registry.NewInMemoryRegistry()
+		storage := storages.NewInMemoryStorage()
+		mgr := NewFileManager(reg, storage)
+
+		// Files recorded before content was stored by token
+		reg.Record(context.Background(), "legacy1", "old.txt")
+		reg.Record(context.Background(), "legacy2", "old.txt")
+		storage.Files["old.txt"] = "shared"
+
+		mgr.DeleteFile(context.Background(), "legacy1")
+		if _, err := mgr.LoadFile(context.Background(), "legacy2", LoadOptions{}); err != nil {
+			t.Fatalf("Want shared content to be kept, got %q", err)
+		}
+
+		mgr.DeleteFile(context.Background(), "legacy2")
+		if len(storage.Files) != 0 {
+			t.Errorf("Got stored files %v, want none", storage.Files)
+		}
+	})
+}
+
+func TestCollectGarbage(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+	storage := storages.NewInMemoryStorage()
+	mgr := NewFileManager(reg, storage)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	mgr.now = func() time.Time { return now }
+
+	expired, _ := mgr.SaveFile(context.Background(), "expired.txt", bytes.NewBufferString("old"), SaveOptions{})
+	kept, _ := mgr.SaveFile(context.Background(), "kept.txt", bytes.NewBufferString("new"), SaveOptions{})
+	reg.SetExpiry(context.Background(), expired, now.Add(-time.Minute))
+	reg.SetExpiry(context.Background(), kept, now.Add(time.Minute))
+	storage.Files["orphan.txt"] = "left behind"
+
+	report, err := mgr.CollectGarbage(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	if report != (GCReport{ExpiredFiles: 1, OrphanedFiles: 1}) {
+		t.Errorf("Got report %+v", report)
+	}
+
+	names, _ := storage.List(context.Background())
+	if len(names) != 1 || names[0] != kept {
+		t.Errorf("Got stored files %v, want only %s", names, kept)
+	}
+	if reg.Has(context.Background(), expired) || !reg.Has(context.Background(), kept) {
+		t.Error("Want only the expired record to be deleted")
+	}
+}
+
+func TestCollectGarbageWithSharedName(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+	storage := storages.NewInMemoryStorage()
+	mgr := NewFileManager(reg, storage)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	mgr.now = func() time.Time { return now }
+
+	expired, _ := mgr.SaveFile(context.Background(), "report.pdf", bytes.NewBufferString("old"), SaveOptions{})
+	kept, _ := mgr.SaveFile(context.Background(), "report.pdf", bytes.NewBufferString("new"), SaveOptions{})
+	reg.SetExpiry(context.Background(), expired, now.Add(-time.Minute))
+
+	reg.Record(context.Background(), "legacy", "legacy.pdf")
+	storage.Files["legacy.pdf"] = "stored by name"
+
+	report, err := mgr.CollectGarbage(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	if report != (GCReport{ExpiredFiles: 1}) {
+		t.Errorf("Got report %+v", report)
+	}
+	if storage.Files[kept] != "new" || storage.Files["legacy.pdf"] == "" {
+		t.Errorf("Got stored files %v, want the unexpired ones", storage.Files)
+	}
+}
+
+func TestPasswordBackoff(t *testing.T) {
+	cases := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 0},
+		{FREE_PASSWORD_ATTEMPTS - 1, 0},
+		{FREE_PASSWORD_ATTEMPTS, PASSWORD_BACKOFF_BASE},
+		{FREE_PASSWORD_ATTEMPTS + 3, 8 * PASSWORD_BACKOFF_BASE},
+		{FREE_PASSWORD_ATTEMPTS + 100, PASSWORD_BACKOFF_MAX},
+	}
+
+	for _, test := range cases {
+		got := passwordBackoff(test.attempts)
+		if got != test.want {
+			t.Errorf("Attempts %d: got %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		t.Errorf("Got hash %q, want argon2id PHC string", hash)
+	}
+
+	ok, _ := VerifyPassword("hunter2", hash)
+	if !ok {
+		t.Error("Want password to match its hash")
+	}
+
+	ok, _ = VerifyPassword("hunter3", hash)
+	if ok {
+		t.Error("Want wrong password not to match")
+	}
+
+	_, err = VerifyPassword("hunter2", "plain")
+	if err == nil {
+		t.Error("Got nil, want error for malformed hash")
+	}
+}
+
+// countingReader serves size bytes and counts how many were consumed
+type countingReader struct {
+	size int64
+	read int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.read >= c.size {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	if n > c.size-c.read {
+		n = c.size - c.read
+	}
+	c.read += n
+	return int(n), nil
+}
+
+// gatedReader serves content, then blocks before EOF until gate is closed.
+// consumed is closed once the content has been read
+type gatedReader struct {
+	content  io.Reader
+	consumed chan struct{}
+	gate     chan struct{}
+	once     sync.Once
+}
+
+func newGatedReader(content string, gate chan struct{}) *gatedReader {
+	return &gatedReader{content: strings.NewReader(content), consumed: make(chan struct{}), gate: gate}
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	n, err := g.content.Read(p)
+	if err == io.EOF {
+		g.once.Do(func() { close(g.consumed) })
+		<-g.gate
+	}
+	return n, err
+}
+
+// blockingUsageRegistry blocks reading the usage of uploader until gate is
+// closed, and closes blocked once it does
+type blockingUsageRegistry struct {
+	registry.Registry
+	uploader string
+	blocked  chan struct{}
+	gate     chan struct{}
+	once     sync.Once
+}
+
+func (b *blockingUsageRegistry) GetUsage(ctx context.Context, uploader string) (registry.Usage, error) {
+	if uploader == b.uploader {
+		b.once.Do(func() { close(b.blocked) })
+		<-b.gate
+	}
+	return b.Registry.GetUsage(ctx, uploader)
+}
+
+func TestQuotas(t *testing.T) {
+	alice := auth.WithIdentity(context.Background(), &auth.Identity{Name: "alice"})
+	bob := auth.WithIdentity(context.Background(), &auth.Identity{Name: "bob"})
+
+	newManager := func(quotas Quotas) (*FileManager, registry.Registry, *storages.InMemoryStorage) {
+		reg := registry.NewInMemoryRegistry()
+		storage := storages.NewInMemoryStorage()
+		return NewFileManager(reg, storage, WithQuotas(quotas)), reg, storage
+	}
+
+	assertQuotaError := func(t testing.TB, err error, scope, limit string) {
+		t.Helper()
+
+		var exceeded *QuotaExceededError
+		if !errors.As(err, &exceeded) {
+			t.Fatalf("Got error %v, want QuotaExceededError", err)
+		}
+		if exceeded.Scope != scope || exceeded.Limit != limit {
+			t.Errorf("Got %s %s quota error, want %s %s", exceeded.Scope, exceeded.Limit, scope, limit)
+		}
+	}
+
+	t.Run("records file size", func(t *testing.T) {
+		mgr, reg, _ := newManager(Quotas{})
+
+		token, _ := mgr.SaveFile(alice, "a.txt", bytes.NewBufferString("12345"), SaveOptions{})
+
+		metadata, _ := reg.GetMetadata(context.Background(), token)
+		if metadata.Size != 5 {
+			t.Errorf("Got size %d, want 5", metadata.Size)
+		}
+	})
+	t.Run("rejects files over per-user file count", func(t *testing.T) {
+		mgr, _, _ := newManager(Quotas{PerUser: Quota{MaxFiles: 1}})
+
+		_, err := mgr.SaveFile(alice, "a.txt", bytes.NewBufferString("a"), SaveOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		_, err = mgr.SaveFile(alice, "b.txt", bytes.NewBufferString("b"), SaveOptions{})
+		assertQuotaError(t, err, QUOTA_USER, QUOTA_LIMIT_FILES)
+
+		_, err = mgr.SaveFile(bob, "c.txt", bytes.NewBufferString("c"), SaveOptions{})
+		if err != nil {
+			t.Fatalf("Want other users to be unaffected, got %q", err)
+		}
+	})
+	t.Run("aborts upload as soon as per-user bytes are crossed", func(t *testing.T) {
+		mgr, reg, storage := newManager(Quotas{PerUser: Quota{MaxBytes: 1024}})
+
+		mgr.SaveFile(alice, "a.txt", &countingReader{size: 1000}, SaveOptions{})
+
+		content := &countingReader{size: 10 << 20}
+		_, err := mgr.SaveFile(alice, "big.bin", content, SaveOptions{})
+		assertQuotaError(t, err, QUOTA_USER, QUOTA_LIMIT_BYTES)
+
+		if content.read >= content.size {
+			t.Errorf("Read all %d bytes, want upload to be aborted early", content.read)
+		}
+
+		if len(storage.Files) != 1 {
+			t.Error("Want aborted upload to be removed from storage")
+		}
+
+		usage, _ := reg.GetUsage(context.Background(), "alice")
+		if usage != (registry.Usage{Files: 1, Bytes: 1000}) {
+			t.Errorf("Got usage %+v, want aborted upload not to be recorded", usage)
+		}
+	})
+	t.Run("accepts upload exactly at the quota", func(t *testing.T) {
+		mgr, _, _ := newManager(Quotas{PerUser: Quota{MaxBytes: 10}})
+
+		_, err := mgr.SaveFile(alice, "a.txt", &countingReader{size: 10}, SaveOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+	})
+	t.Run("enforces global quotas across users", func(t *testing.T) {
+		mgr, _, _ := newManager(Quotas{Global: Quota{MaxBytes: 15}})
+
+		_, err := mgr.SaveFile(alice, "a.txt", &countingReader{size: 10}, SaveOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		_, err = mgr.SaveFile(bob, "b.txt", &countingReader{size: 10}, SaveOptions{})
+		assertQuotaError(t, err, QUOTA_GLOBAL, QUOTA_LIMIT_BYTES)
+
+		_, err = mgr.SaveFile(context.Background(), "c.txt", &countingReader{size: 10}, SaveOptions{})
+		assertQuotaError(t, err, QUOTA_GLOBAL, QUOTA_LIMIT_BYTES)
+	})
+	t.Run("reports usage", func(t *testing.T) {
+		quota := Quota{MaxFiles: 10, MaxBytes: 100}
+		mgr, _, _ := newManager(Quotas{PerUser: quota})
+
+		mgr.SaveFile(alice, "a.txt", &countingReader{size: 10}, SaveOptions{})
+		mgr.SaveFile(alice, "b.txt", &countingReader{size: 20}, SaveOptions{})
+
+		report, err := mgr.Usage(alice)
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		want := UsageReport{Uploader: "alice", Usage: registry.Usage{Files: 2, Bytes: 30}, Quota: quota}
+		if report != want {
+			t.Errorf("Got report %+v, want %+v", report, want)
+		}
+
+		_, err = mgr.Usage(context.Background())
+		if err != ErrAnonymousUsage {
+			t.Errorf("Got error %v, want %v", err, ErrAnonymousUsage)
+		}
+	})
+	t.Run("counts uploads in progress", func(t *testing.T) {
+		mgr, reg, _ := newManager(Quotas{PerUser: Quota{MaxFiles: 2}, Global: Quota{MaxBytes: 100}})
+
+		gate := make(chan struct{})
+		errs := make(chan error, 2)
+		for _, content := range []string{"a", strings.Repeat("b", 60)} {
+			reader := newGatedReader(content, gate)
+			go func() {
+				_, err := mgr.SaveFile(alice, "a.txt", reader, SaveOptions{Size: int64(len(content))})
+				errs <- err
+			}()
+			<-reader.consumed
+		}
+
+		_, err := mgr.SaveFile(alice, "b.txt", bytes.NewBufferString("b"), SaveOptions{})
+		assertQuotaError(t, err, QUOTA_USER, QUOTA_LIMIT_FILES)
+
+		_, err = mgr.SaveFile(bob, "c.txt", strings.NewReader(strings.Repeat("c", 60)), SaveOptions{})
+		assertQuotaError(t, err, QUOTA_GLOBAL, QUOTA_LIMIT_BYTES)
+
+		close(gate)
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+		}
+
+		usage, _ := reg.GetTotalUsage(context.Background())
+		if usage != (registry.Usage{Files: 2, Bytes: 61}) {
+			t.Errorf("Got usage %+v, want the two uploads", usage)
+		}
+
+		_, err = mgr.SaveFile(bob, "c.txt", strings.NewReader(strings.Repeat("c", 39)), SaveOptions{})
+		if err != nil {
+			t.Errorf("Want reservations to be released, got %q", err)
+		}
+	})
+	t.Run("reads stored usage without blocking other uploads", func(t *testing.T) {
+		reg := &blockingUsageRegistry{Registry: registry.NewInMemoryRegistry(), uploader: "alice", blocked: make(chan struct{}), gate: make(chan struct{})}
+		mgr := NewFileManager(reg, storages.NewInMemoryStorage(), WithQuotas(Quotas{PerUser: Quota{MaxFiles: 1}}))
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := mgr.SaveFile(alice, "a.txt", bytes.NewBufferString("a"), SaveOptions{})
+			errs <- err
+		}()
+		<-reg.blocked
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := mgr.SaveFile(bob, "b.txt", bytes.NewBufferString("b"), SaveOptions{})
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Expected no error, got %q", err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Want uploads to proceed while usage is read")
+		}
+
+		close(reg.gate)
+		if err := <-errs; err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+	})
+	t.Run("applies replaced quotas to new uploads", func(t *testing.T) {
+		mgr, _, _ := newManager(Quotas{PerUser: Quota{MaxFiles: 1}})
+
+		mgr.SaveFile(alice, "a.txt", bytes.NewBufferString("a"), SaveOptions{})
+		mgr.SetQuotas(Quotas{PerUser: Quota{MaxFiles: 2}})
+
+		_, err := mgr.SaveFile(alice, "b.txt", bytes.NewBufferString("b"), SaveOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		_, err = mgr.SaveFile(alice, "c.txt", bytes.NewBufferString("c"), SaveOptions{})
+		assertQuotaError(t, err, QUOTA_USER, QUOTA_LIMIT_FILES)
+	})
+}
+
+func TestUploadPolicy(t *testing.T) {
+	elf := "\x7fELF\x02\x01\x01" + strings.Repeat("\x00", 9)
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 16)
+	reject := true
+
+	alice := auth.WithIdentity(context.Background(), &auth.Identity{Name: "alice"})
+
+	newManager := func(rules policy.Rules, users map[string]policy.Rules) (*FileManager, registry.Registry, *storages.InMemoryStorage) {
+		p, err := policy.New(rules, users)
+		if err != nil {
+			t.Fatalf("Invalid policy: %s", err)
+		}
+
+		reg := registry.NewInMemoryRegistry()
+		storage := storages.NewInMemoryStorage()
+		return NewFileManager(reg, storage, WithUploadPolicy(p)), reg, storage
+	}
+
+	assertViolation := func(t testing.TB, err error, reason, detected string) {
+		t.Helper()
+
+		var violation *policy.Violation
+		if !errors.As(err, &violation) {
+			t.Fatalf("Want policy.Violation, got %v", err)
+		}
+		if violation.Reason != reason || violation.DetectedType != detected {
+			t.Errorf("Got %s of %q, want %s of %q", violation.Reason, violation.DetectedType, reason, detected)
+		}
+	}
+
+	assertNothingStored := func(t testing.TB, reg registry.Registry, storage *storages.InMemoryStorage) {
+		t.Helper()
+
+		usage, _ := reg.GetTotalUsage(context.Background())
+		if usage.Files != 0 || len(storage.Files) != 0 {
+			t.Errorf("Got %d records and %d stored files, want none", usage.Files, len(storage.Files))
+		}
+	}
+
+	t.Run("records the detected type", func(t *testing.T) {
+		mgr, reg, _ := newManager(policy.Rules{}, nil)
+
+		token, err := mgr.SaveFile(context.Background(), "photo.txt", bytes.NewBufferString(png), SaveOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		metadata, _ := reg.GetMetadata(context.Background(), token)
+		if metadata.MimeType != "image/png" {
+			t.Errorf("Got MIME type %q, want image/png", metadata.MimeType)
+		}
+
+		upload, _ := mgr.LoadFile(context.Background(), token, LoadOptions{})
+		if upload.MimeType != "image/png" {
+			t.Errorf("Got loaded MIME type %q, want image/png", upload.MimeType)
+		}
+	})
+	t.Run("refines text by extension", func(t *testing.T) {
+		mgr, reg, _ := newManager(policy.Rules{}, nil)
+
+		token, _ := mgr.SaveFile(context.Background(), "notes.md", bytes.NewBufferString("# Notes"), SaveOptions{})
+
+		metadata, _ := reg.GetMetadata(context.Background(), token)
+		if metadata.MimeType != "text/markdown" {
+			t.Errorf("Got MIME type %q, want text/markdown", metadata.MimeType)
+		}
+	})
+	t.Run("keeps unrecognized content as binary", func(t *testing.T) {
+		mgr, reg, _ := newManager(policy.Rules{}, nil)
+
+		token, _ := mgr.SaveFile(context.Background(), "photo.png", bytes.NewBuffer([]byte{0x00, 0x9f, 0x42, 0x13, 0xee, 0x01}), SaveOptions{})
+
+		metadata, _ := reg.GetMetadata(context.Background(), token)
+		if metadata.MimeType != "application/octet-stream" {
+			t.Errorf("Got MIME type %q, want application/octet-stream", metadata.MimeType)
+		}
+	})
+	t.Run("saves the whole content", func(t *testing.T) {
+		mgr, reg, storage := newManager(policy.Rules{MaxSize: 1 << 20}, nil)
+
+		content := strings.Repeat("line\n", 5000)
+		token, _ := mgr.SaveFile(context.Background(), "long.txt", strings.NewReader(content), SaveOptions{})
+
+		upload, _ := storage.LoadFile(context.Background(), token)
+		saved, _ := io.ReadAll(upload.File)
+		if string(saved) != content {
+			t.Errorf("Got %d bytes saved, want %d", len(saved), len(content))
+		}
+
+		metadata, _ := reg.GetMetadata(context.Background(), token)
+		if metadata.Size != int64(len(content)) {
+			t.Errorf("Got size %d, want %d", metadata.Size, len(content))
+		}
+	})
+	t.Run("rejects blocked types", func(t *testing.T) {
+		mgr, reg, storage := newManager(policy.Rules{BlockedTypes: []string{"application/x-executable"}}, nil)
+
+		_, err := mgr.SaveFile(context.Background(), "innocent.txt", bytes.NewBufferString(elf), SaveOptions{})
+		assertViolation(t, err, policy.REASON_BLOCKED, "application/x-executable")
+		assertNothingStored(t, reg, storage)
+	})
+	t.Run("rejects blocked wildcards", func(t *testing.T) {
+		mgr, _, _ := newManager(policy.Rules{BlockedTypes: []string{"image/*"}}, nil)
+
+		_, err := mgr.SaveFile(context.Background(), "photo.png", bytes.NewBufferString(png), SaveOptions{})
+		assertViolation(t, err, policy.REASON_BLOCKED, "image/png")
+	})
+	t.Run("rejects types not allowed", func(t *testing.T) {
+		mgr, _, _ := newManager(policy.Rules{AllowedTypes: []string{"text/*"}}, nil)
+
+		_, err := mgr.SaveFile(context.Background(), "photo.png", bytes.NewBufferString(png), SaveOptions{})
+		assertViolation(t, err, policy.REASON_NOT_ALLOWED, "image/png")
+	})
+	t.Run("rejects mismatched extensions", func(t *testing.T) {
+		mgr, _, _ := newManager(policy.Rules{RejectMismatch: &reject}, nil)
+
+		_, err := mgr.SaveFile(context.Background(), "photo.jpg", bytes.NewBufferString(png), SaveOptions{})
+		assertViolation(t, err, policy.REASON_MISMATCH, "image/png")
+
+		for name, content := range map[string]string{"photo.png": png, "notes.md": "# Notes", "data.bin": elf, "photo": png} {
+			_, err = mgr.SaveFile(context.Background(), name, bytes.NewBufferString(content), SaveOptions{})
+			if err != nil {
+				t.Errorf("Expected no error for %s, got %q", name, err)
+			}
+		}
+	})
+	t.Run("rejects names before reading content", func(t *testing.T) {
+		mgr, reg, storage := newManager(policy.Rules{BlockedExtensions: []string{".exe"}}, nil)
+
+		_, err := mgr.SaveFile(context.Background(), "setup.exe", &countingReader{size: 10}, SaveOptions{})
+		assertViolation(t, err, policy.REASON_EXTENSION, "")
+		assertNothingStored(t, reg, storage)
+	})
+	t.Run("rejects declared sizes over the limit of the type", func(t *testing.T) {
+		mgr, reg, storage := newManager(policy.Rules{MaxSize: 1000, MaxSizes: map[string]int64{"image/*": 10}}, nil)
+
+		_, err := mgr.SaveFile(context.Background(), "photo.png", bytes.NewBufferString(png), SaveOptions{Size: int64(len(png))})
+		assertViolation(t, err, policy.REASON_TOO_LARGE, "image/png")
+		assertNothingStored(t, reg, storage)
+
+		_, err = mgr.SaveFile(context.Background(), "notes.txt", bytes.NewBufferString(png[8:]), SaveOptions{Size: 16})
+		if err != nil {
+			t.Errorf("Expected no error, got %q", err)
+		}
+	})
+	t.Run("aborts uploads crossing the limit of the type", func(t *testing.T) {
+		mgr, reg, storage := newManager(policy.Rules{MaxSize: 1000}, nil)
+
+		content := strings.Repeat("a", 10000)
+		_, err := mgr.SaveFile(context.Background(), "long.txt", strings.NewReader(content), SaveOptions{})
+
+		var violation *policy.Violation
+		if !errors.As(err, &violation) || violation.Reason != policy.REASON_TOO_LARGE || violation.MaxSize != 1000 {
+			t.Fatalf("Want a violation of the 1000 bytes limit, got %v", err)
+		}
+		assertNothingStored(t, reg, storage)
+	})
+	t.Run("applies the rules of the uploader", func(t *testing.T) {
+		mgr, _, _ := newManager(policy.Rules{BlockedTypes: []string{"image/*"}}, map[string]policy.Rules{"alice": {BlockedTypes: []string{}}})
+
+		_, err := mgr.SaveFile(alice, "photo.png", bytes.NewBufferString(png), SaveOptions{})
+		if err != nil {
+			t.Errorf("Expected no error for alice, got %q", err)
+		}
+
+		_, err = mgr.SaveFile(context.Background(), "photo.png", bytes.NewBufferString(png), SaveOptions{})
+		assertViolation(t, err, policy.REASON_BLOCKED, "image/png")
+	})
+	t.Run("applies replaced policies to new uploads", func(t *testing.T) {
+		mgr, _, _ := newManager(policy.Rules{}, nil)
+
+		replaced, _ := policy.New(policy.Rules{RejectMismatch: &reject}, nil)
+		mgr.SetUploadPolicy(replaced)
+
+		_, err := mgr.SaveFile(context.Background(), "photo.jpg", bytes.NewBufferString(png), SaveOptions{})
+		assertViolation(t, err, policy.REASON_MISMATCH, "image/png")
+	})
+}
+
+func TestScanning(t *testing.T) {
+	infected := "infected " + clamdtest.EICAR
+
+	newManager := func(t testing.TB, mode string) (*FileManager, registry.Registry, *storages.InMemoryStorage, *clamdtest.Server) {
+		t.Helper()
+
+		clamd := clamdtest.NewServer()
+		t.Cleanup(clamd.Close)
+
+		s, err := scanner.NewClamd(clamd.Address)
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		reg := registry.NewInMemoryRegistry()
+		storage := storages.NewInMemoryStorage()
+		return NewFileManager(reg, storage, WithScanner(s, mode)), reg, storage, clamd
+	}
+
+	assertScanStatus := func(t testing.TB, reg registry.Registry, token, status string) {
+		t.Helper()
+
+		protection, _ := reg.GetProtection(context.Background(), token)
+		if protection.ScanStatus != status {
+			t.Errorf("Got scan status %q, want %q", protection.ScanStatus, status)
+		}
+	}
+
+	assertLoadError := func(t testing.TB, mgr *FileManager, token string, want error) {
+		t.Helper()
+
+		_, err := mgr.LoadFile(context.Background(), token, LoadOptions{})
+		if !errors.Is(err, want) {
+			t.Errorf("Got %v from LoadFile, want %v", err, want)
+		}
+		_, err = mgr.DescribeFile(context.Background(), token, LoadOptions{})
+		if !errors.Is(err, want) {
+			t.Errorf("Got %v from DescribeFile, want %v", err, want)
+		}
+	}
+
+	t.Run("scans sync uploads", func(t *testing.T) {
+		mgr, reg, _, clamd := newManager(t, SCAN_SYNC)
+
+		token, err := mgr.SaveFile(context.Background(), "notes.txt", bytes.NewBufferString("hello world"), SaveOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		assertScanStatus(t, reg, token, registry.SCAN_CLEAN)
+		assertLoadError(t, mgr, token, nil)
+
+		if clamd.Scans() != 1 {
+			t.Errorf("Got %d scans, want 1", clamd.Scans())
+		}
+	})
+	t.Run("quarantines infected sync uploads", func(t *testing.T) {
+		mgr, reg, storage, _ := newManager(t, SCAN_SYNC)
+
+		token, err := mgr.SaveFile(context.Background(), "eicar.txt", bytes.NewBufferString(infected), SaveOptions{})
+
+		var infectedErr *InfectedError
+		if !errors.As(err, &infectedErr) {
+			t.Fatalf("Got %v, want InfectedError", err)
+		}
+		if infectedErr.Signature != clamdtest.SIGNATURE || token != "" {
+			t.Errorf("Got signature %q and token %q, want %q and no token", infectedErr.Signature, token, clamdtest.SIGNATURE)
+		}
+
+		page, _ := reg.List(context.Background(), registry.ListQuery{ScanStatus: registry.SCAN_INFECTED})
+		if len(page.Files) != 1 || page.Files[0].ScanSignature != clamdtest.SIGNATURE {
+			t.Fatalf("Got %+v, want the quarantined file", page.Files)
+		}
+		if _, ok := storage.Files[page.Files[0].Token]; !ok {
+			t.Error("Expected the quarantined file to be kept")
+		}
+
+		assertLoadError(t, mgr, page.Files[0].Token, ErrQuarantinedFile)
+	})
+	t.Run("keeps clean files sharing the name of rejected ones", func(t *testing.T) {
+		mgr, _, storage, clamd := newManager(t, SCAN_SYNC)
+
+		clean, _ := mgr.SaveFile(context.Background(), "notes.txt", bytes.NewBufferString("hello world"), SaveOptions{})
+
+		_, err := mgr.SaveFile(context.Background(), "notes.txt", bytes.NewBufferString(infected), SaveOptions{})
+		var infectedErr *InfectedError
+		if !errors.As(err, &infectedErr) {
+			t.Fatalf("Got %v, want InfectedError", err)
+		}
+
+		clamd.Close()
+		_, err = mgr.SaveFile(context.Background(), "notes.txt", bytes.NewBufferString("unscanned"), SaveOptions{})
+		if !errors.Is(err, ErrScanFailed) {
+			t.Fatalf("Got %v, want %v", err, ErrScanFailed)
+		}
+
+		if storage.Files[clean] != "hello world" {
+			t.Errorf("Got %q stored for the clean file, want it unchanged", storage.Files[clean])
+		}
+		assertLoadError(t, mgr, clean, nil)
+	})
+	t.Run("rejects sync uploads when the scanner fails", func(t *testing.T) {
+		mgr, reg, storage, clamd := newManager(t, SCAN_SYNC)
+		clamd.Close()
+
+		_, err := mgr.SaveFile(context.Background(), "notes.txt", bytes.NewBufferString("hello world"), SaveOptions{})
+		if !errors.Is(err, ErrScanFailed) {
+			t.Errorf("Got %v, want %v", err, ErrScanFailed)
+		}
+
+		usage, _ := reg.GetTotalUsage(context.Background())
+		if usage.Files != 0 || len(storage.Files) != 0 {
+			t.Errorf("Got %d records and %d stored files, want none", usage.Files, len(storage.Files))
+		}
+	})
+	t.Run("blocks downloads until async scans finish", func(t *testing.T) {
+		mgr, reg, _, clamd := newManager(t, SCAN_ASYNC)
+
+		for _, test := range []struct {
+			fileName, content, status string
+			err                       error
+		}{
+			{"notes.txt", "hello world", registry.SCAN_CLEAN, nil},
+			{"eicar.txt", infected, registry.SCAN_INFECTED, ErrQuarantinedFile},
+		} {
+			clamd.Block()
+			token, err := mgr.SaveFile(context.Background(), test.fileName, bytes.NewBufferString(test.content), SaveOptions{})
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			assertLoadError(t, mgr, token, ErrScanPending)
+
+			clamd.Unblock()
+			mgr.WaitForScans(context.Background())
+
+			assertScanStatus(t, reg, token, test.status)
+			assertLoadError(t, mgr, token, test.err)
+		}
+	})
+	t.Run("rescans pending files", func(t *testing.T) {
+		mgr, reg, _, clamd := newManager(t, SCAN_ASYNC)
+		clamd.Close()
+
+		token, err := mgr.SaveFile(context.Background(), "notes.txt", bytes.NewBufferString("hello world"), SaveOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+		mgr.WaitForScans(context.Background())
+
+		assertScanStatus(t, reg, token, registry.SCAN_PENDING)
+
+		restarted := clamdtest.NewServer()
+		defer restarted.Close()
+		s, _ := scanner.NewClamd(restarted.Address)
+		mgr.SetScanner(s, SCAN_ASYNC)
+
+		started, err := mgr.ScanPending(context.Background())
+		if err != nil || started != 1 {
+			t.Fatalf("Got %d scans and %v, want 1 scan", started, err)
+		}
+		mgr.WaitForScans(context.Background())
+
+		assertScanStatus(t, reg, token, registry.SCAN_CLEAN)
+		assertLoadError(t, mgr, token, nil)
+	})
+	t.Run("retries pending files once the scanner recovers", func(t *testing.T) {
+		s := &flakyScanner{failures: 2}
+		reg := registry.NewInMemoryRegistry()
+		mgr := NewFileManager(reg, storages.NewInMemoryStorage(), WithScanner(s, SCAN_ASYNC))
+
+		token, err := mgr.SaveFile(context.Background(), "notes.txt", bytes.NewBufferString("hello world"), SaveOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+		mgr.WaitForScans(context.Background())
+		assertScanStatus(t, reg, token, registry.SCAN_PENDING)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			mgr.RetryPendingScans(ctx, time.Millisecond)
+			close(done)
+		}()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			protection, _ := reg.GetProtection(context.Background(), token)
+			if protection.ScanStatus == registry.SCAN_CLEAN || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		<-done
+		mgr.WaitForScans(context.Background())
+
+		assertScanStatus(t, reg, token, registry.SCAN_CLEAN)
+		if s.scans() != 3 {
+			t.Errorf("Got %d scans, want 3", s.scans())
+		}
+	})
+	t.Run("skips scanning without a scanner", func(t *testing.T) {
+		mgr := NewFileManager(registry.NewInMemoryRegistry(), storages.NewInMemoryStorage())
+
+		token, _ := mgr.SaveFile(context.Background(), "notes.txt", bytes.NewBufferString("hello world"), SaveOptions{})
+		assertLoadError(t, mgr, token, nil)
+
+		if started, _ := mgr.ScanPending(context.Background()); started != 0 {
+			t.Errorf("Got %d scans, want none", started)
+		}
+	})
+}
+
+// flakyScanner fails its first scans, like clamd during an outage
+type flakyScanner struct {
+	mu       sync.Mutex
+	failures int
+	count    int
+}
+
+func (s *flakyScanner) Scan(ctx context.Context, content io.Reader) (scanner.Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.count++
+	if s.count <= s.failures {
+		return scanner.Result{}, errors.New("Scanner unavailable")
+	}
+	return scanner.Result{}, nil
+}
+
+func (s *flakyScanner) scans() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+type StubLogger struct {
+	warnings []string
+	errors   []string
+}
+
+func (s *StubLogger) Debug(msg string, args ...any) {}
+func (s *StubLogger) Info(msg string, args ...any)  {}
+
+func (s *StubLogger) Warn(msg string, args ...any) {
+	s.warnings = append(s.warnings, msg)
+}
+
+func (s *StubLogger) Error(msg string, args ...any) {
+	s.errors = append(s.errors, msg)
+}
+
+func TestLogging(t *testing.T) {
+	logger := &StubLogger{}
+	mgr := NewFileManager(registry.NewInMemoryRegistry(), storages.NewInMemoryStorage(), WithLogger(logger))
+
+	token, err := mgr.SaveFile(context.Background(), "secret.txt", strings.NewReader("content"), SaveOptions{Password: "hunter2"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	_, err = mgr.LoadFile(context.Background(), token, LoadOptions{Password: "wrong"})
+	if !errors.Is(err, ErrInvalidPassword) {
+		t.Fatalf("Want ErrInvalidPassword, got %v", err)
+	}
+
+	if len(logger.warnings) != 1 {
+		t.Errorf("Got %d logged warnings, want 1", len(logger.warnings))
+	}
+	if len(logger.errors) != 0 {
+		t.Errorf("Got logged errors %q, want none", logger.errors)
+	}
+}
@@ -0,0 +1,86 @@
+package manager
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const ARGON2_TIME = 1
+const ARGON2_MEMORY = 64 * 1024
+const ARGON2_THREADS = 4
+const ARGON2_KEY_LENGTH = 32
+const ARGON2_SALT_LENGTH = 16
+
+// Number of passwords hashed at once, as each hash takes ARGON2_MEMORY KiB
+const MAX_CONCURRENT_HASHES = 4
+
+var hashSlots = make(chan struct{}, MAX_CONCURRENT_HASHES)
+
+var errInvalidHash = errors.New("Invalid password hash format")
+
+// HashPassword returns an Argon2id hash of the password encoded in the
+// PHC string format, e.g. $argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, ARGON2_SALT_LENGTH)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hashSlots <- struct{}{}
+	key := argon2.IDKey([]byte(password), salt, ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS, ARGON2_KEY_LENGTH)
+	<-hashSlots
+
+	encoded := fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		ARGON2_MEMORY,
+		ARGON2_TIME,
+		ARGON2_THREADS,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return encoded, nil
+}
+
+// VerifyPassword reports whether the password matches the encoded hash
+// produced by HashPassword
+func VerifyPassword(password, encoded string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errInvalidHash
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errInvalidHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, errInvalidHash
+	}
+
+	hashSlots <- struct{}{}
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	<-hashSlots
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
@@ -0,0 +1,290 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/registry"
+)
+
+const QUOTA_USER = "user"
+const QUOTA_GLOBAL = "global"
+
+const QUOTA_LIMIT_FILES = "files"
+const QUOTA_LIMIT_BYTES = "bytes"
+
+var ErrAnonymousUsage = errors.New("Usage is only tracked for authenticated uploaders")
+
+// Quota limits stored files and bytes. Zero values mean no limit
+type Quota struct {
+	MaxFiles int64 `json:"max_files"`
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// Quotas apply PerUser to every authenticated uploader and Global to all
+// stored files
+type Quotas struct {
+	PerUser Quota
+	Global  Quota
+}
+
+type QuotaExceededError struct {
+	// Scope is either QUOTA_USER or QUOTA_GLOBAL
+	Scope string
+	// Limit is either QUOTA_LIMIT_FILES or QUOTA_LIMIT_BYTES
+	Limit string
+	Max   int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("The %s quota of %d %s has been exceeded", e.Scope, e.Max, e.Limit)
+}
+
+type UsageReport struct {
+	Uploader string
+	Usage    registry.Usage
+	Quota    Quota
+}
+
+// Usage reports stored files and bytes of the identity from ctx
+func (f *FileManager) Usage(ctx context.Context) (UsageReport, error) {
+	identity := auth.IdentityFromContext(ctx)
+	if identity == nil {
+		return UsageReport{}, ErrAnonymousUsage
+	}
+
+	usage, err := f.registry.GetUsage(ctx, identity.Name)
+	if err != nil {
+		return UsageReport{}, err
+	}
+
+	return UsageReport{Uploader: identity.Name, Usage: usage, Quota: f.getQuotas().PerUser}, nil
+}
+
+// Bytes reserved at once by uploads of unknown size, so that quotas aren't
+// checked on every read
+const QUOTA_RESERVATION_STEP = 1024 * 1024
+
+// Times usage is read from the registry outside the lock of reservations
+// before reading it under the lock
+const QUOTA_USAGE_ATTEMPTS = 3
+
+// reservations counts the files and bytes of uploads in progress against
+// quotas, so that concurrent uploads can't cross them together. Files are
+// counted until recorded, and bytes until the size is recorded
+type reservations struct {
+	mu    sync.Mutex
+	users map[string]registry.Usage
+	total registry.Usage
+	// version changes whenever reservations are given back, as usage read
+	// from the registry before may miss what they moved there
+	version uint64
+}
+
+// reserveQuota reserves a file and size bytes, and wraps content in a
+// reader that reserves more bytes as they are read, failing as soon as a
+// quota would be crossed. The reservation must be released
+func (f *FileManager) reserveQuota(ctx context.Context, uploader string, content io.Reader, size int64) (*quotaReader, error) {
+	reader := &quotaReader{reader: content, ctx: ctx, manager: f, uploader: uploader, quotas: f.getQuotas()}
+	if size <= 0 {
+		reader.step = QUOTA_RESERVATION_STEP
+	}
+
+	err := f.reserve(reader, 1, max(size, 0), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// reserve adds files and bytes to the reservation of q if the quotas allow
+// them along with stored files and other uploads in progress, plus up to
+// extra bytes that the quotas allow. Stored usage is read without holding
+// the lock of reservations, and read again if reservations were given back
+// in the meantime
+func (f *FileManager) reserve(q *quotaReader, files, bytes, extra int64) error {
+	for attempt := 0; attempt < QUOTA_USAGE_ATTEMPTS; attempt++ {
+		f.reservations.mu.Lock()
+		version := f.reservations.version
+		f.reservations.mu.Unlock()
+
+		stored, err := f.storedUsage(q)
+		if err != nil {
+			return err
+		}
+
+		f.reservations.mu.Lock()
+		if f.reservations.version == version {
+			err = f.reserveLocked(q, stored, files, bytes, extra)
+			f.reservations.mu.Unlock()
+			return err
+		}
+		f.reservations.mu.Unlock()
+	}
+
+	f.reservations.mu.Lock()
+	defer f.reservations.mu.Unlock()
+
+	stored, err := f.storedUsage(q)
+	if err != nil {
+		return err
+	}
+	return f.reserveLocked(q, stored, files, bytes, extra)
+}
+
+// storedUsage is the usage of an uploader and of all files in the registry
+type storedUsage struct {
+	user  registry.Usage
+	total registry.Usage
+}
+
+// storedUsage reads the usage limited by the quotas of q from the registry
+func (f *FileManager) storedUsage(q *quotaReader) (storedUsage, error) {
+	var stored storedUsage
+	var err error
+
+	if q.uploader != "" && q.quotas.PerUser != (Quota{}) {
+		stored.user, err = f.registry.GetUsage(q.ctx, q.uploader)
+		if err != nil {
+			return storedUsage{}, err
+		}
+	}
+
+	if q.quotas.Global != (Quota{}) {
+		stored.total, err = f.registry.GetTotalUsage(q.ctx)
+		if err != nil {
+			return storedUsage{}, err
+		}
+	}
+
+	return stored, nil
+}
+
+// reserveLocked checks the quotas of q against stored usage and the
+// reservations. The caller must hold the lock of reservations
+func (f *FileManager) reserveLocked(q *quotaReader, stored storedUsage, files, bytes, extra int64) error {
+	if q.uploader != "" && q.quotas.PerUser != (Quota{}) {
+		room, err := roomLeft(QUOTA_USER, q.quotas.PerUser, addUsage(stored.user, f.reservations.users[q.uploader]), files, bytes)
+		if err != nil {
+			return err
+		}
+		extra = min(extra, room-bytes)
+	}
+
+	if q.quotas.Global != (Quota{}) {
+		room, err := roomLeft(QUOTA_GLOBAL, q.quotas.Global, addUsage(stored.total, f.reservations.total), files, bytes)
+		if err != nil {
+			return err
+		}
+		extra = min(extra, room-bytes)
+	}
+
+	f.adjustReservation(q, registry.Usage{Files: files, Bytes: bytes + extra})
+	return nil
+}
+
+// adjustReservation adds delta to the reservation of q. The caller must
+// hold the lock of reservations
+func (f *FileManager) adjustReservation(q *quotaReader, delta registry.Usage) {
+	if f.reservations.users == nil {
+		f.reservations.users = map[string]registry.Usage{}
+	}
+
+	q.reserved = addUsage(q.reserved, delta)
+	f.reservations.total = addUsage(f.reservations.total, delta)
+
+	if q.uploader == "" {
+		return
+	}
+	user := addUsage(f.reservations.users[q.uploader], delta)
+	if user == (registry.Usage{}) {
+		delete(f.reservations.users, q.uploader)
+	} else {
+		f.reservations.users[q.uploader] = user
+	}
+}
+
+// roomLeft checks that files and bytes more fit in quota along with usage,
+// and returns the bytes left by quota
+func roomLeft(scope string, quota Quota, usage registry.Usage, files, bytes int64) (int64, error) {
+	if files > 0 && quota.MaxFiles > 0 && usage.Files+files > quota.MaxFiles {
+		return 0, &QuotaExceededError{scope, QUOTA_LIMIT_FILES, quota.MaxFiles}
+	}
+
+	if quota.MaxBytes <= 0 {
+		return math.MaxInt64, nil
+	}
+
+	room := max(quota.MaxBytes-usage.Bytes, 0)
+	if bytes > room {
+		return 0, &QuotaExceededError{scope, QUOTA_LIMIT_BYTES, quota.MaxBytes}
+	}
+	return room, nil
+}
+
+func addUsage(a, b registry.Usage) registry.Usage {
+	return registry.Usage{Files: a.Files + b.Files, Bytes: a.Bytes + b.Bytes}
+}
+
+// quotaReader counts bytes read and reserves them, failing with exceeded
+// once a quota doesn't allow more
+type quotaReader struct {
+	reader   io.Reader
+	read     int64
+	exceeded error
+
+	ctx      context.Context
+	manager  *FileManager
+	uploader string
+	quotas   Quotas
+	reserved registry.Usage
+	// step is the extra bytes reserved when more are read than reserved
+	step int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.exceeded != nil {
+		return 0, q.exceeded
+	}
+
+	n, err := q.reader.Read(p)
+	q.read += int64(n)
+
+	if q.read > q.reserved.Bytes {
+		reserveErr := q.manager.reserve(q, 0, q.read-q.reserved.Bytes, q.step)
+		var exceeded *QuotaExceededError
+		if errors.As(reserveErr, &exceeded) {
+			q.exceeded = reserveErr
+		}
+		if reserveErr != nil {
+			return n, reserveErr
+		}
+	}
+
+	return n, err
+}
+
+// recorded stops counting the reserved file once it is recorded
+func (q *quotaReader) recorded() {
+	q.manager.reservations.mu.Lock()
+	defer q.manager.reservations.mu.Unlock()
+
+	q.manager.adjustReservation(q, registry.Usage{Files: -q.reserved.Files})
+	q.manager.reservations.version++
+}
+
+// release gives back what is left of the reservation, once the upload
+// failed or its size is recorded
+func (q *quotaReader) release() {
+	q.manager.reservations.mu.Lock()
+	defer q.manager.reservations.mu.Unlock()
+
+	q.manager.adjustReservation(q, registry.Usage{Files: -q.reserved.Files, Bytes: -q.reserved.Bytes})
+	q.manager.reservations.version++
+}
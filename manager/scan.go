@@ -0,0 +1,239 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/registry"
+	"github.com/olzhasar/go-fileserver/scanner"
+)
+
+// Scan modes. Sync scans block the response to the upload, while async
+// scans run after it and files can't be downloaded until found clean
+const SCAN_SYNC = "sync"
+const SCAN_ASYNC = "async"
+
+// Number of files scanned at once in the background
+const MAX_CONCURRENT_SCANS = 4
+
+// Delays between retries of pending scans, doubled while they keep failing
+const SCAN_RETRY_INTERVAL = 10 * time.Second
+const SCAN_RETRY_MAX_INTERVAL = 10 * time.Minute
+
+var ErrScanPending = errors.New("File is being scanned")
+var ErrQuarantinedFile = errors.New("File has been quarantined")
+var ErrScanFailed = errors.New("Unable to scan file")
+
+// InfectedError is returned by sync uploads of infected files, which are
+// kept in quarantine
+type InfectedError struct {
+	Signature string
+}
+
+func (e *InfectedError) Error() string {
+	return fmt.Sprintf("The file is infected with %s", e.Signature)
+}
+
+type scanning struct {
+	scanner scanner.Scanner
+	mode    string
+}
+
+func WithScanner(s scanner.Scanner, mode string) Option {
+	return func(f *FileManager) {
+		f.scanning = scanning{s, mode}
+	}
+}
+
+// SetScanner replaces the scanner. A nil scanner disables scanning of new
+// uploads, while files already pending stay unavailable
+func (f *FileManager) SetScanner(s scanner.Scanner, mode string) {
+	f.scanningMu.Lock()
+	defer f.scanningMu.Unlock()
+	f.scanning = scanning{s, mode}
+}
+
+func (f *FileManager) getScanner() scanning {
+	f.scanningMu.RLock()
+	defer f.scanningMu.RUnlock()
+	return f.scanning
+}
+
+// ScanPending starts background scans of the files left pending, e.g. by
+// a restart during async scans or an outage of the scanner, and returns
+// their number
+func (f *FileManager) ScanPending(ctx context.Context) (int, error) {
+	scan := f.getScanner()
+	if scan.scanner == nil {
+		return 0, nil
+	}
+
+	query := registry.ListQuery{ScanStatus: registry.SCAN_PENDING, Limit: registry.MAX_LIST_LIMIT}
+	started := 0
+
+	for {
+		page, err := f.registry.List(ctx, query)
+		if err != nil {
+			return started, err
+		}
+
+		for _, file := range page.Files {
+			if f.scanLater(ctx, scan.scanner, file.Token, file.StorageKey) {
+				started++
+			}
+		}
+
+		if page.NextCursor == "" {
+			return started, nil
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+// RetryPendingScans runs ScanPending every interval until ctx is done, so
+// that files left pending by an outage of the scanner are scanned once it
+// is back. The interval doubles up to SCAN_RETRY_MAX_INTERVAL while there
+// are pending files left to retry
+func (f *FileManager) RetryPendingScans(ctx context.Context, interval time.Duration) {
+	delay := interval
+
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		started, err := f.ScanPending(ctx)
+		switch {
+		case err != nil:
+			f.log(ctx).Error("Unable to scan pending files", "error", err)
+			delay = min(2*delay, SCAN_RETRY_MAX_INTERVAL)
+		case started > 0:
+			f.log(ctx).Info("Retrying scans of pending files", "files", started)
+			delay = min(2*delay, SCAN_RETRY_MAX_INTERVAL)
+		default:
+			delay = interval
+		}
+	}
+}
+
+// WaitForScans waits for background scans to finish, or until ctx is done
+func (f *FileManager) WaitForScans(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		f.scans.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// scanUpload scans a file that has just been stored under key. Sync scans
+// of infected files fail with InfectedError, and other failures delete the
+// stored file and fail with ErrScanFailed
+func (f *FileManager) scanUpload(ctx context.Context, scan scanning, token, key string) error {
+	if scan.mode == SCAN_ASYNC {
+		f.scanLater(ctx, scan.scanner, token, key)
+		return nil
+	}
+
+	err := f.scanFile(ctx, scan.scanner, token, key)
+
+	var infected *InfectedError
+	if err == nil || errors.As(err, &infected) {
+		return err
+	}
+
+	if ctx.Err() != nil {
+		f.log(ctx).Info("Upload cancelled", "token", token, "error", err)
+	} else {
+		f.log(ctx).Error("Unable to scan file", "token", token, "error", err)
+	}
+
+	deleteErr := f.storage.Delete(context.WithoutCancel(ctx), key)
+	if deleteErr != nil && !errors.Is(deleteErr, fs.ErrNotExist) {
+		f.log(ctx).Error("Unable to delete unscanned file", "token", token, "error", deleteErr)
+	}
+
+	return ErrScanFailed
+}
+
+// scanLater scans the file stored under key in the background unless it
+// is already being scanned, and reports whether a scan was started. Files
+// stay pending when the scan fails
+func (f *FileManager) scanLater(ctx context.Context, s scanner.Scanner, token, key string) bool {
+	f.inFlightMu.Lock()
+	if f.inFlight == nil {
+		f.inFlight = map[string]bool{}
+		f.scanSlots = make(chan struct{}, MAX_CONCURRENT_SCANS)
+	}
+	if f.inFlight[token] {
+		f.inFlightMu.Unlock()
+		return false
+	}
+	f.inFlight[token] = true
+	slots := f.scanSlots
+	f.inFlightMu.Unlock()
+
+	ctx = context.WithoutCancel(ctx)
+
+	f.scans.Add(1)
+	go func() {
+		defer f.scans.Done()
+		defer func() {
+			f.inFlightMu.Lock()
+			delete(f.inFlight, token)
+			f.inFlightMu.Unlock()
+		}()
+
+		slots <- struct{}{}
+		defer func() { <-slots }()
+
+		err := f.scanFile(ctx, s, token, key)
+
+		var infected *InfectedError
+		if err != nil && !errors.As(err, &infected) {
+			f.log(ctx).Error("Unable to scan file, it stays pending until retried", "token", token, "error", err)
+		}
+	}()
+
+	return true
+}
+
+// scanFile scans the content stored under key and records the result for
+// token
+func (f *FileManager) scanFile(ctx context.Context, s scanner.Scanner, token, key string) error {
+	upload, err := f.storage.LoadFile(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer upload.File.Close()
+
+	result, err := s.Scan(ctx, upload.File)
+	if err != nil {
+		return err
+	}
+
+	if !result.Infected {
+		return f.registry.SetScanResult(ctx, token, registry.SCAN_CLEAN, "")
+	}
+
+	err = f.registry.SetScanResult(ctx, token, registry.SCAN_INFECTED, result.Signature)
+	if err != nil {
+		return err
+	}
+
+	f.log(ctx).Warn("Infected file quarantined", "token", token, "signature", result.Signature)
+	return &InfectedError{Signature: result.Signature}
+}
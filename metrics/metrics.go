@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/olzhasar/go-fileserver/registry"
+)
+
+const NAMESPACE = "fileserver"
+
+const DIRECTION_UPLOAD = "upload"
+const DIRECTION_DOWNLOAD = "download"
+
+// Metrics holds the Prometheus collectors of the server. Every instance has
+// its own Prometheus registry, so tests can create as many as they like
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	transferBytes   *prometheus.CounterVec
+	activeTransfers *prometheus.GaugeVec
+
+	registryDuration *prometheus.HistogramVec
+	registryErrors   *prometheus.CounterVec
+	storageDuration  *prometheus.HistogramVec
+	storageErrors    *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: NAMESPACE,
+			Name:      "http_requests_total",
+			Help:      "Number of served HTTP requests by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: NAMESPACE,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of served HTTP requests by route, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		transferBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: NAMESPACE,
+			Name:      "transfer_bytes_total",
+			Help:      "Bytes received by uploads and sent by downloads.",
+		}, []string{"direction"}),
+		activeTransfers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: NAMESPACE,
+			Name:      "active_transfers",
+			Help:      "Uploads and downloads in progress.",
+		}, []string{"direction"}),
+		registryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: NAMESPACE,
+			Name:      "registry_operation_duration_seconds",
+			Help:      "Latency of registry operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}, []string{"operation"}),
+		registryErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: NAMESPACE,
+			Name:      "registry_errors_total",
+			Help:      "Failed registry operations.",
+		}, []string{"operation"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: NAMESPACE,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Latency of storage operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+		}, []string{"operation"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: NAMESPACE,
+			Name:      "storage_errors_total",
+			Help:      "Failed storage operations.",
+		}, []string{"operation"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.transferBytes,
+		m.activeTransfers,
+		m.registryDuration,
+		m.registryErrors,
+		m.storageDuration,
+		m.storageErrors,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ObserveUsage reports the number of stored files and bytes, queried from r
+// on every scrape
+func (m *Metrics) ObserveUsage(r registry.Registry) {
+	m.registry.MustRegister(&usageCollector{
+		registry: r,
+		files:    prometheus.NewDesc(NAMESPACE+"_stored_files", "Number of stored files.", nil, nil),
+		bytes:    prometheus.NewDesc(NAMESPACE+"_stored_bytes", "Total size of stored files.", nil, nil),
+	})
+}
+
+func (m *Metrics) ObserveRequest(route, method string, status int, duration time.Duration) {
+	labels := prometheus.Labels{"route": route, "method": method, "status": strconv.Itoa(status)}
+
+	m.requests.With(labels).Inc()
+	m.requestDuration.With(labels).Observe(duration.Seconds())
+}
+
+func (m *Metrics) AddTransferBytes(direction string, n int64) {
+	m.transferBytes.WithLabelValues(direction).Add(float64(n))
+}
+
+// StartTransfer marks a transfer as active until the returned func is called
+func (m *Metrics) StartTransfer(direction string) (done func()) {
+	gauge := m.activeTransfers.WithLabelValues(direction)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+func (m *Metrics) observeRegistry(operation string, start time.Time, err error) {
+	m.registryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.registryErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func (m *Metrics) observeStorage(operation string, start time.Time, err error) {
+	m.storageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.storageErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+type usageCollector struct {
+	registry registry.Registry
+	files    *prometheus.Desc
+	bytes    *prometheus.Desc
+}
+
+func (u *usageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- u.files
+	ch <- u.bytes
+}
+
+func (u *usageCollector) Collect(ch chan<- prometheus.Metric) {
+	usage, err := u.registry.GetTotalUsage(context.Background())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(u.files, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(u.files, prometheus.GaugeValue, float64(usage.Files))
+	ch <- prometheus.MustNewConstMetric(u.bytes, prometheus.GaugeValue, float64(usage.Bytes))
+}
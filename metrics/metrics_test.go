@@ -0,0 +1,87 @@
+package metrics_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/metrics"
+	"github.com/olzhasar/go-fileserver/registry"
+	"github.com/olzhasar/go-fileserver/storages"
+)
+
+func scrape(t *testing.T, m *metrics.Metrics) string {
+	t.Helper()
+
+	response := httptest.NewRecorder()
+	m.Handler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body, _ := io.ReadAll(response.Body)
+	return string(body)
+}
+
+func assertMetric(t *testing.T, body, line string) {
+	t.Helper()
+
+	if !strings.Contains(body, line+"\n") {
+		t.Errorf("Want metrics to contain %q", line)
+	}
+}
+
+func TestInstrumentRegistry(t *testing.T) {
+	m := metrics.NewMetrics()
+	reg := metrics.InstrumentRegistry(registry.NewInMemoryRegistry(), m)
+	m.ObserveUsage(reg)
+
+	ctx := context.Background()
+	reg.Record(ctx, "abc", "file.txt")
+	reg.SetSize(ctx, "abc", 42)
+	reg.Get(ctx, "missing")
+	reg.Delete(ctx, "missing")
+
+	body := scrape(t, m)
+
+	assertMetric(t, body, `fileserver_registry_operation_duration_seconds_count{operation="record"} 1`)
+	assertMetric(t, body, `fileserver_registry_operation_duration_seconds_count{operation="get"} 1`)
+	assertMetric(t, body, `fileserver_registry_errors_total{operation="delete"} 1`)
+	assertMetric(t, body, `fileserver_stored_files 1`)
+	assertMetric(t, body, `fileserver_stored_bytes 42`)
+
+	if strings.Contains(body, `fileserver_registry_errors_total{operation="get"}`) {
+		t.Error("Want missing tokens not to be counted as errors")
+	}
+}
+
+func TestInstrumentStorage(t *testing.T) {
+	m := metrics.NewMetrics()
+	storage := metrics.InstrumentStorage(storages.NewInMemoryStorage(), m)
+
+	ctx := context.Background()
+	storage.SaveFile(ctx, "file.txt", strings.NewReader("content"))
+	storage.LoadFile(ctx, "missing.txt")
+
+	body := scrape(t, m)
+
+	assertMetric(t, body, `fileserver_storage_operation_duration_seconds_count{operation="save"} 1`)
+	assertMetric(t, body, `fileserver_storage_errors_total{operation="load"} 1`)
+}
+
+func TestObserveRequest(t *testing.T) {
+	m := metrics.NewMetrics()
+
+	m.ObserveRequest("/upload", http.MethodPost, http.StatusOK, 20*time.Millisecond)
+	m.ObserveRequest("/upload", http.MethodPost, http.StatusOK, 30*time.Millisecond)
+	done := m.StartTransfer(metrics.DIRECTION_DOWNLOAD)
+
+	body := scrape(t, m)
+
+	assertMetric(t, body, `fileserver_http_requests_total{method="POST",route="/upload",status="200"} 2`)
+	assertMetric(t, body, `fileserver_active_transfers{direction="download"} 1`)
+
+	done()
+	assertMetric(t, scrape(t, m), `fileserver_active_transfers{direction="download"} 0`)
+}
@@ -0,0 +1,211 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/health"
+	"github.com/olzhasar/go-fileserver/registry"
+)
+
+// InstrumentRegistry wraps r so that the latency and errors of every
+// operation are recorded in m. Lookups of missing tokens are not errors
+func InstrumentRegistry(r registry.Registry, m *Metrics) registry.Registry {
+	return &instrumentedRegistry{r, m}
+}
+
+type instrumentedRegistry struct {
+	registry registry.Registry
+	metrics  *Metrics
+}
+
+func (i *instrumentedRegistry) Record(ctx context.Context, token, fileName string) error {
+	start := time.Now()
+	err := i.registry.Record(ctx, token, fileName)
+	i.metrics.observeRegistry("record", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) Get(ctx context.Context, token string) (string, bool) {
+	start := time.Now()
+	value, ok := i.registry.Get(ctx, token)
+	i.metrics.observeRegistry("get", start, nil)
+	return value, ok
+}
+
+func (i *instrumentedRegistry) Has(ctx context.Context, token string) bool {
+	start := time.Now()
+	ok := i.registry.Has(ctx, token)
+	i.metrics.observeRegistry("has", start, nil)
+	return ok
+}
+
+func (i *instrumentedRegistry) Delete(ctx context.Context, token string) error {
+	start := time.Now()
+	err := i.registry.Delete(ctx, token)
+	i.metrics.observeRegistry("delete", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) SetPassword(ctx context.Context, token, passwordHash string) error {
+	start := time.Now()
+	err := i.registry.SetPassword(ctx, token, passwordHash)
+	i.metrics.observeRegistry("set_password", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) SetPrivate(ctx context.Context, token string, private bool) error {
+	start := time.Now()
+	err := i.registry.SetPrivate(ctx, token, private)
+	i.metrics.observeRegistry("set_private", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) GetProtection(ctx context.Context, token string) (registry.Protection, bool) {
+	start := time.Now()
+	value, ok := i.registry.GetProtection(ctx, token)
+	i.metrics.observeRegistry("get_protection", start, nil)
+	return value, ok
+}
+
+func (i *instrumentedRegistry) RecordFailedAttempt(ctx context.Context, token string, at time.Time) error {
+	start := time.Now()
+	err := i.registry.RecordFailedAttempt(ctx, token, at)
+	i.metrics.observeRegistry("record_failed_attempt", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) ResetFailedAttempts(ctx context.Context, token string) error {
+	start := time.Now()
+	err := i.registry.ResetFailedAttempts(ctx, token)
+	i.metrics.observeRegistry("reset_failed_attempts", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) SetUploader(ctx context.Context, token, uploader string) error {
+	start := time.Now()
+	err := i.registry.SetUploader(ctx, token, uploader)
+	i.metrics.observeRegistry("set_uploader", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) SetSize(ctx context.Context, token string, size int64) error {
+	start := time.Now()
+	err := i.registry.SetSize(ctx, token, size)
+	i.metrics.observeRegistry("set_size", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) GetMetadata(ctx context.Context, token string) (registry.Metadata, bool) {
+	start := time.Now()
+	value, ok := i.registry.GetMetadata(ctx, token)
+	i.metrics.observeRegistry("get_metadata", start, nil)
+	return value, ok
+}
+
+func (i *instrumentedRegistry) GetUsage(ctx context.Context, uploader string) (registry.Usage, error) {
+	start := time.Now()
+	value, err := i.registry.GetUsage(ctx, uploader)
+	i.metrics.observeRegistry("get_usage", start, err)
+	return value, err
+}
+
+func (i *instrumentedRegistry) GetTotalUsage(ctx context.Context) (registry.Usage, error) {
+	start := time.Now()
+	value, err := i.registry.GetTotalUsage(ctx)
+	i.metrics.observeRegistry("get_total_usage", start, err)
+	return value, err
+}
+
+func (i *instrumentedRegistry) SetMimeType(ctx context.Context, token, mimeType string) error {
+	start := time.Now()
+	err := i.registry.SetMimeType(ctx, token, mimeType)
+	i.metrics.observeRegistry("set_mime_type", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) ListUsage(ctx context.Context) ([]registry.UploaderUsage, error) {
+	start := time.Now()
+	value, err := i.registry.ListUsage(ctx)
+	i.metrics.observeRegistry("list_usage", start, err)
+	return value, err
+}
+
+func (i *instrumentedRegistry) SetExpiry(ctx context.Context, token string, at time.Time) error {
+	start := time.Now()
+	err := i.registry.SetExpiry(ctx, token, at)
+	i.metrics.observeRegistry("set_expiry", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) SetBlocked(ctx context.Context, token string, blocked bool) error {
+	start := time.Now()
+	err := i.registry.SetBlocked(ctx, token, blocked)
+	i.metrics.observeRegistry("set_blocked", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) SetScanResult(ctx context.Context, token, status, signature string) error {
+	start := time.Now()
+	err := i.registry.SetScanResult(ctx, token, status, signature)
+	i.metrics.observeRegistry("set_scan_result", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) SetStorageKey(ctx context.Context, token, key string) error {
+	start := time.Now()
+	err := i.registry.SetStorageKey(ctx, token, key)
+	i.metrics.observeRegistry("set_storage_key", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) List(ctx context.Context, query registry.ListQuery) (registry.ListPage, error) {
+	start := time.Now()
+	value, err := i.registry.List(ctx, query)
+	i.metrics.observeRegistry("list", start, err)
+	return value, err
+}
+
+func (i *instrumentedRegistry) RecordAPIKey(ctx context.Context, key registry.APIKey) error {
+	start := time.Now()
+	err := i.registry.RecordAPIKey(ctx, key)
+	i.metrics.observeRegistry("record_api_key", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) GetAPIKey(ctx context.Context, id string) (registry.APIKey, bool) {
+	start := time.Now()
+	value, ok := i.registry.GetAPIKey(ctx, id)
+	i.metrics.observeRegistry("get_api_key", start, nil)
+	return value, ok
+}
+
+func (i *instrumentedRegistry) ListAPIKeys(ctx context.Context) ([]registry.APIKey, error) {
+	start := time.Now()
+	value, err := i.registry.ListAPIKeys(ctx)
+	i.metrics.observeRegistry("list_api_keys", start, err)
+	return value, err
+}
+
+func (i *instrumentedRegistry) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	start := time.Now()
+	err := i.registry.RevokeAPIKey(ctx, id, at)
+	i.metrics.observeRegistry("revoke_api_key", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) Clear() {
+	i.registry.Clear()
+}
+
+func (i *instrumentedRegistry) Close() {
+	i.registry.Close()
+}
+
+// CheckHealth forwards to the wrapped registry if it is a health.HealthChecker
+func (i *instrumentedRegistry) CheckHealth(ctx context.Context) error {
+	if checker, ok := i.registry.(health.HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
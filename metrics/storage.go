@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/health"
+	"github.com/olzhasar/go-fileserver/storages"
+)
+
+// InstrumentStorage wraps s so that the latency and errors of every
+// operation are recorded in m. Saves are timed until the whole content is
+// written, loads only until the file is opened
+func InstrumentStorage(s storages.Storage, m *Metrics) storages.Storage {
+	return &instrumentedStorage{s, m}
+}
+
+type instrumentedStorage struct {
+	storage storages.Storage
+	metrics *Metrics
+}
+
+func (i *instrumentedStorage) SaveFile(ctx context.Context, fileName string, content io.Reader) error {
+	start := time.Now()
+	err := i.storage.SaveFile(ctx, fileName, content)
+	i.metrics.observeStorage("save", start, err)
+	return err
+}
+
+func (i *instrumentedStorage) LoadFile(ctx context.Context, fileName string) (storages.UploadedFile, error) {
+	start := time.Now()
+	upload, err := i.storage.LoadFile(ctx, fileName)
+	i.metrics.observeStorage("load", start, err)
+	return upload, err
+}
+
+func (i *instrumentedStorage) Delete(ctx context.Context, fileName string) error {
+	start := time.Now()
+	err := i.storage.Delete(ctx, fileName)
+	i.metrics.observeStorage("delete", start, err)
+	return err
+}
+
+func (i *instrumentedStorage) List(ctx context.Context) ([]string, error) {
+	start := time.Now()
+	names, err := i.storage.List(ctx)
+	i.metrics.observeStorage("list", start, err)
+	return names, err
+}
+
+// CheckHealth forwards to the wrapped storage if it is a health.HealthChecker
+func (i *instrumentedStorage) CheckHealth(ctx context.Context) error {
+	if checker, ok := i.storage.(health.HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/registry"
+)
+
+const API_KEY_HEADER = "X-API-Key"
+
+const MSG_ERR_INVALID_API_KEY = "Invalid API key"
+const MSG_ERR_AUTHENTICATION_REQUIRED = "Authentication required"
+const MSG_ERR_FORBIDDEN = "Forbidden"
+
+// KeyLookup finds stored API keys by their public id
+type KeyLookup interface {
+	GetAPIKey(ctx context.Context, id string) (key registry.APIKey, ok bool)
+}
+
+// APIKeyMiddleware authenticates requests carrying an API key in the
+// X-API-Key header or as a bearer token and attaches the identity of the
+// key owner to the request context. Requests without a key pass through
+// anonymously, requests with an invalid or revoked key are rejected
+type APIKeyMiddleware struct {
+	handler http.Handler
+	keys    KeyLookup
+}
+
+func (a *APIKeyMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, ok := extractAPIKey(r)
+	if !ok {
+		a.handler.ServeHTTP(w, r)
+		return
+	}
+
+	identity, ok := a.authenticate(r.Context(), key)
+	if !ok {
+		http.Error(w, MSG_ERR_INVALID_API_KEY, http.StatusUnauthorized)
+		return
+	}
+
+	logIdentity(r.Context(), identity)
+	a.handler.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+}
+
+func (a *APIKeyMiddleware) authenticate(ctx context.Context, key string) (*auth.Identity, bool) {
+	id, ok := auth.ParseAPIKeyID(key)
+	if !ok {
+		return nil, false
+	}
+
+	stored, ok := a.keys.GetAPIKey(ctx, id)
+	if !ok || stored.IsRevoked() {
+		return nil, false
+	}
+
+	hash := auth.HashAPIKey(key)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(stored.Hash)) != 1 {
+		return nil, false
+	}
+
+	identity := &auth.Identity{Name: stored.Name, KeyID: stored.ID}
+	for _, scope := range stored.Scopes {
+		identity.Scopes = append(identity.Scopes, auth.Scope(scope))
+	}
+
+	return identity, true
+}
+
+// extractAPIKey returns the key from the X-API-Key header, or from the
+// Authorization header if the bearer token looks like an API key. Other
+// bearer tokens are left to other authenticators
+func extractAPIKey(r *http.Request) (string, bool) {
+	if key := r.Header.Get(API_KEY_HEADER); key != "" {
+		return key, true
+	}
+
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !strings.HasPrefix(bearer, auth.API_KEY_PREFIX+"_") {
+		return "", false
+	}
+
+	return bearer, true
+}
+
+func MakeAPIKeyHandler(handler http.Handler, keys KeyLookup) http.Handler {
+	return &APIKeyMiddleware{handler, keys}
+}
+
+// ScopeMiddleware requires the identity attached by an authentication
+// middleware to have a scope for the paths listed in rules
+type ScopeMiddleware struct {
+	handler http.Handler
+	rules   map[string]auth.Scope
+}
+
+func (s *ScopeMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scope, ok := s.rules[r.URL.Path]
+	if !ok {
+		s.handler.ServeHTTP(w, r)
+		return
+	}
+
+	identity := auth.IdentityFromContext(r.Context())
+	if identity == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, MSG_ERR_AUTHENTICATION_REQUIRED, http.StatusUnauthorized)
+		return
+	}
+
+	if !identity.HasScope(scope) {
+		http.Error(w, MSG_ERR_FORBIDDEN, http.StatusForbidden)
+		return
+	}
+
+	s.handler.ServeHTTP(w, r)
+}
+
+func MakeScopedHandler(handler http.Handler, rules map[string]auth.Scope) http.Handler {
+	return &ScopeMiddleware{handler, rules}
+}
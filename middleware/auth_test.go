@@ -0,0 +1,149 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/middleware"
+	"github.com/olzhasar/go-fileserver/registry"
+)
+
+type IdentityRecorder struct {
+	identity *auth.Identity
+	calls    int
+}
+
+func (i *IdentityRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i.identity = auth.IdentityFromContext(r.Context())
+	i.calls++
+}
+
+func createAPIKey(t testing.TB, reg registry.Registry, name string, scopes ...string) (id, key string) {
+	t.Helper()
+
+	id, key, err := auth.GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	reg.RecordAPIKey(context.Background(), registry.APIKey{
+		ID:        id,
+		Name:      name,
+		Hash:      auth.HashAPIKey(key),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	})
+
+	return id, key
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+	handler := &IdentityRecorder{}
+	authHandler := middleware.MakeAPIKeyHandler(handler, reg)
+
+	id, key := createAPIKey(t, reg, "alice", "upload")
+
+	serve := func(header, value string) *httptest.ResponseRecorder {
+		handler.identity = nil
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			request.Header.Set(header, value)
+		}
+		response := httptest.NewRecorder()
+		authHandler.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("passes anonymous requests through", func(t *testing.T) {
+		response := serve("", "")
+
+		if response.Code != http.StatusOK || handler.identity != nil {
+			t.Errorf("Got status %d and identity %v, want anonymous pass through", response.Code, handler.identity)
+		}
+	})
+	t.Run("authenticates X-API-Key header", func(t *testing.T) {
+		serve(middleware.API_KEY_HEADER, key)
+
+		if handler.identity == nil || handler.identity.Name != "alice" || handler.identity.KeyID != id {
+			t.Fatalf("Got identity %+v, want alice", handler.identity)
+		}
+		if !handler.identity.HasScope(auth.ScopeUpload) {
+			t.Error("Want identity to have upload scope")
+		}
+	})
+	t.Run("authenticates bearer token", func(t *testing.T) {
+		serve("Authorization", "Bearer "+key)
+
+		if handler.identity == nil || handler.identity.Name != "alice" {
+			t.Fatalf("Got identity %+v, want alice", handler.identity)
+		}
+	})
+	t.Run("ignores other bearer tokens", func(t *testing.T) {
+		response := serve("Authorization", "Bearer some.jwt.token")
+
+		if response.Code != http.StatusOK || handler.identity != nil {
+			t.Errorf("Got status %d and identity %v, want anonymous pass through", response.Code, handler.identity)
+		}
+	})
+	t.Run("rejects invalid key", func(t *testing.T) {
+		response := serve(middleware.API_KEY_HEADER, key+"x")
+
+		if response.Code != http.StatusUnauthorized {
+			t.Errorf("Got status %d, want %d", response.Code, http.StatusUnauthorized)
+		}
+	})
+	t.Run("rejects revoked key", func(t *testing.T) {
+		revokedID, revokedKey := createAPIKey(t, reg, "bob", "upload")
+		reg.RevokeAPIKey(context.Background(), revokedID, time.Now())
+
+		response := serve(middleware.API_KEY_HEADER, revokedKey)
+
+		if response.Code != http.StatusUnauthorized {
+			t.Errorf("Got status %d, want %d", response.Code, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestScopeMiddleware(t *testing.T) {
+	handler := &IdentityRecorder{}
+	rules := map[string]auth.Scope{"/upload": auth.ScopeUpload}
+	scopedHandler := middleware.MakeScopedHandler(handler, rules)
+
+	serve := func(path string, identity *auth.Identity) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		if identity != nil {
+			request = request.WithContext(auth.WithIdentity(request.Context(), identity))
+		}
+		response := httptest.NewRecorder()
+		scopedHandler.ServeHTTP(response, request)
+		return response
+	}
+
+	cases := []struct {
+		name     string
+		path     string
+		identity *auth.Identity
+		want     int
+	}{
+		{"unprotected path", "/download", nil, http.StatusOK},
+		{"anonymous", "/upload", nil, http.StatusUnauthorized},
+		{"missing scope", "/upload", &auth.Identity{Name: "bob", Scopes: []auth.Scope{auth.ScopeDownloadPrivate}}, http.StatusForbidden},
+		{"matching scope", "/upload", &auth.Identity{Name: "alice", Scopes: []auth.Scope{auth.ScopeUpload}}, http.StatusOK},
+		{"admin", "/upload", &auth.Identity{Name: "root", Scopes: []auth.Scope{auth.ScopeAdmin}}, http.StatusOK},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(test.path, test.identity)
+
+			if response.Code != test.want {
+				t.Errorf("Got status %d, want %d", response.Code, test.want)
+			}
+		})
+	}
+}
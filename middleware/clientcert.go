@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/olzhasar/go-fileserver/auth"
+)
+
+// ClientCertMiddleware attaches the identity of a verified TLS client
+// certificate to the request context, with the given scopes. Identities are
+// named after the certificate with CERT_IDENTITY_PREFIX. Credentials
+// checked further down, such as API keys, take precedence
+type ClientCertMiddleware struct {
+	handler http.Handler
+	scopes  []auth.Scope
+}
+
+func (c *ClientCertMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		c.handler.ServeHTTP(w, r)
+		return
+	}
+
+	name := certificateName(r.TLS.VerifiedChains[0][0])
+	if name == "" {
+		c.handler.ServeHTTP(w, r)
+		return
+	}
+
+	identity := &auth.Identity{Name: auth.CERT_IDENTITY_PREFIX + name, Scopes: c.scopes}
+
+	logIdentity(r.Context(), identity)
+	c.handler.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+}
+
+func MakeClientCertHandler(handler http.Handler, scopes []auth.Scope) http.Handler {
+	return &ClientCertMiddleware{handler, scopes}
+}
+
+// certificateName is the common name of cert, or its first email address or
+// DNS name if it has none
+func certificateName(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// MakeHTTPSRedirectHandler permanently redirects requests to the same URL
+// over HTTPS on httpsPort, which is left out of URLs if it is 443
+func MakeHTTPSRedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host += ":" + httpsPort
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
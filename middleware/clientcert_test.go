@@ -0,0 +1,84 @@
+package middleware_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/middleware"
+)
+
+func TestClientCertMiddleware(t *testing.T) {
+	scopes := []auth.Scope{auth.ScopeUpload}
+
+	cases := []struct {
+		name     string
+		state    *tls.ConnectionState
+		wantName string
+	}{
+		{"plain HTTP", nil, ""},
+		{"no certificate", &tls.ConnectionState{}, ""},
+		{
+			"common name",
+			&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "alice"}}}}},
+			"cert:alice",
+		},
+		{
+			"email address",
+			&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{EmailAddresses: []string{"bob@example.com"}}}}},
+			"cert:bob@example.com",
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			handler := &IdentityRecorder{}
+
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.TLS = test.state
+
+			middleware.MakeClientCertHandler(handler, scopes).ServeHTTP(httptest.NewRecorder(), request)
+
+			if test.wantName == "" {
+				if handler.identity != nil {
+					t.Errorf("Got identity %v, want none", handler.identity)
+				}
+				return
+			}
+
+			if handler.identity == nil || handler.identity.Name != test.wantName || !handler.identity.HasScope(auth.ScopeUpload) {
+				t.Errorf("Got identity %+v, want %s with upload scope", handler.identity, test.wantName)
+			}
+		})
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	cases := []struct {
+		port   string
+		target string
+		want   string
+	}{
+		{"443", "http://files.example.com/download?token=abc", "https://files.example.com/download?token=abc"},
+		{"8443", "http://files.example.com:8080/upload", "https://files.example.com:8443/upload"},
+		{"8443", "http://[::1]:8080/", "https://[::1]:8443/"},
+	}
+
+	for _, test := range cases {
+		request := httptest.NewRequest(http.MethodGet, test.target, nil)
+		response := httptest.NewRecorder()
+
+		middleware.MakeHTTPSRedirectHandler(test.port).ServeHTTP(response, request)
+
+		if response.Code != http.StatusPermanentRedirect {
+			t.Errorf("Got status %d, want 308", response.Code)
+		}
+		if got := response.Header().Get("Location"); got != test.want {
+			t.Errorf("Got location %q, want %q", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const FORWARDED_FOR_HEADER = "X-Forwarded-For"
+const REAL_IP_HEADER = "X-Real-IP"
+
+// TRUSTED_PROXY_UNIX trusts every connection made over a Unix socket
+const TRUSTED_PROXY_UNIX = "unix"
+
+// TrustedProxies lists the peers allowed to report the client address
+type TrustedProxies struct {
+	nets []*net.IPNet
+	unix bool
+}
+
+// ParseTrustedProxies parses a comma-separated list of IPs, CIDRs and the
+// "unix" keyword
+func ParseTrustedProxies(value string) (*TrustedProxies, error) {
+	proxies := &TrustedProxies{}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case entry == TRUSTED_PROXY_UNIX:
+			proxies.unix = true
+			continue
+		case !strings.Contains(entry, "/"):
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("Invalid proxy address %q", entry))
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies.nets = append(proxies.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid proxy network %q", entry))
+		}
+		proxies.nets = append(proxies.nets, network)
+	}
+
+	return proxies, nil
+}
+
+func (p *TrustedProxies) trusts(address string) bool {
+	if p == nil {
+		return false
+	}
+	if isUnixPeer(address) {
+		return p.unix
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnixPeer reports connections accepted on Unix sockets, whose peers have
+// no address
+func isUnixPeer(address string) bool {
+	return address == "" || address == "@"
+}
+
+// ClientIPMiddleware resolves the client address from X-Forwarded-For or
+// X-Real-IP when the connection comes from a trusted proxy, so rate limits,
+// access logs and traces see clients instead of the proxy
+type ClientIPMiddleware struct {
+	handler http.Handler
+	proxies *TrustedProxies
+}
+
+func (m *ClientIPMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip := m.resolve(r)
+	m.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+}
+
+// resolve walks X-Forwarded-For from the right and returns the first address
+// not belonging to a trusted proxy. Proxies append to the header, so entries
+// left of it may be forged by the client
+func (m *ClientIPMiddleware) resolve(r *http.Request) string {
+	peer := remoteIP(r)
+	if !m.proxies.trusts(peer) {
+		return peer
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values(FORWARDED_FOR_HEADER) {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	if len(forwarded) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get(REAL_IP_HEADER))); ip != nil {
+			return ip.String()
+		}
+		return peer
+	}
+
+	client := peer
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !m.proxies.trusts(client) {
+			break
+		}
+	}
+	return client
+}
+
+func MakeClientIPHandler(handler http.Handler, proxies *TrustedProxies) http.Handler {
+	return &ClientIPMiddleware{handler, proxies}
+}
+
+type clientIPKey struct{}
+
+// clientIP prefers the address resolved by ClientIPMiddleware over the
+// remote address of the connection
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
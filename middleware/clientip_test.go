@@ -0,0 +1,85 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/olzhasar/go-fileserver/middleware"
+)
+
+func TestClientIPMiddleware(t *testing.T) {
+	serve := func(t *testing.T, proxies string, remoteAddr string, headers map[string]string) string {
+		t.Helper()
+		trusted, err := middleware.ParseTrustedProxies(proxies)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var key string
+		handler := middleware.MakeClientIPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key = middleware.KeyByIP(r)
+		}), trusted)
+
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = remoteAddr
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		return key
+	}
+
+	t.Run("ignores headers from untrusted peers", func(t *testing.T) {
+		got := serve(t, "10.0.0.0/8", "192.0.2.1:1234", map[string]string{middleware.FORWARDED_FOR_HEADER: "198.51.100.7"})
+
+		if got != "ip:192.0.2.1" {
+			t.Errorf("Got %q, want ip:192.0.2.1", got)
+		}
+	})
+	t.Run("skips trusted proxies from the right", func(t *testing.T) {
+		got := serve(t, "10.0.0.0/8", "10.0.0.1:1234", map[string]string{middleware.FORWARDED_FOR_HEADER: "203.0.113.9, 198.51.100.7, 10.0.0.2"})
+
+		if got != "ip:198.51.100.7" {
+			t.Errorf("Got %q, want ip:198.51.100.7", got)
+		}
+	})
+	t.Run("falls back to X-Real-IP", func(t *testing.T) {
+		got := serve(t, "10.0.0.1", "10.0.0.1:1234", map[string]string{middleware.REAL_IP_HEADER: "198.51.100.7"})
+
+		if got != "ip:198.51.100.7" {
+			t.Errorf("Got %q, want ip:198.51.100.7", got)
+		}
+	})
+	t.Run("trusts Unix socket peers only if configured", func(t *testing.T) {
+		headers := map[string]string{middleware.FORWARDED_FOR_HEADER: "198.51.100.7"}
+
+		if got := serve(t, "unix", "@", headers); got != "ip:198.51.100.7" {
+			t.Errorf("Got %q, want ip:198.51.100.7", got)
+		}
+		if got := serve(t, "10.0.0.0/8", "@", headers); got != "ip:@" {
+			t.Errorf("Got %q, want ip:@", got)
+		}
+	})
+	t.Run("keeps the peer when headers are invalid", func(t *testing.T) {
+		got := serve(t, "10.0.0.1", "10.0.0.1:1234", map[string]string{middleware.FORWARDED_FOR_HEADER: "unknown"})
+
+		if got != "ip:10.0.0.1" {
+			t.Errorf("Got %q, want ip:10.0.0.1", got)
+		}
+	})
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, value := range []string{"", "10.0.0.1", "10.0.0.0/8, ::1, unix"} {
+		if _, err := middleware.ParseTrustedProxies(value); err != nil {
+			t.Errorf("Got error %v for %q", err, value)
+		}
+	}
+	for _, value := range []string{"proxy", "10.0.0.0/33", "10.0.0.1:80"} {
+		if _, err := middleware.ParseTrustedProxies(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
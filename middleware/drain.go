@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const MSG_ERR_SHUTTING_DOWN = "Server is shutting down, please retry"
+
+// Clients rejected while draining are asked to retry after this delay,
+// likely reaching another instance
+const DRAIN_RETRY_AFTER = 5 * time.Second
+
+var ErrDraining = errors.New("Server is shutting down")
+
+// DrainMiddleware rejects new requests to the listed paths with 503 once
+// Drain is called, while requests already in flight keep running. It also
+// fails health checks, so load balancers stop routing to the instance
+type DrainMiddleware struct {
+	handler  http.Handler
+	paths    []string
+	draining atomic.Bool
+}
+
+func (d *DrainMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if d.IsDraining() && containsPath(d.paths, r.URL.Path) {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(DRAIN_RETRY_AFTER.Seconds()))))
+		http.Error(w, MSG_ERR_SHUTTING_DOWN, http.StatusServiceUnavailable)
+		return
+	}
+
+	d.handler.ServeHTTP(w, r)
+}
+
+func (d *DrainMiddleware) Drain() {
+	d.draining.Store(true)
+}
+
+func (d *DrainMiddleware) IsDraining() bool {
+	return d.draining.Load()
+}
+
+func (d *DrainMiddleware) CheckHealth(ctx context.Context) error {
+	if d.IsDraining() {
+		return ErrDraining
+	}
+	return nil
+}
+
+func NewDrainMiddleware(handler http.Handler, paths []string) *DrainMiddleware {
+	return &DrainMiddleware{handler: handler, paths: paths}
+}
@@ -0,0 +1,50 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/olzhasar/go-fileserver/middleware"
+)
+
+func TestDrainMiddleware(t *testing.T) {
+	handler := &StubHandler{}
+	drainer := middleware.NewDrainMiddleware(handler, []string{"/upload"})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		drainer.ServeHTTP(response, httptest.NewRequest(http.MethodPost, path, nil))
+		return response
+	}
+
+	if response := serve("/upload"); response.Code != http.StatusOK {
+		t.Fatalf("Got status %d before draining, want %d", response.Code, http.StatusOK)
+	}
+	if err := drainer.CheckHealth(context.Background()); err != nil {
+		t.Fatalf("Expected no error before draining, got %q", err)
+	}
+
+	drainer.Drain()
+
+	response := serve("/upload")
+	if response.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d for upload while draining, want %d", response.Code, http.StatusServiceUnavailable)
+	}
+	if response.Header().Get("Retry-After") == "" {
+		t.Error("Want Retry-After header while draining")
+	}
+
+	if response := serve("/download"); response.Code != http.StatusOK {
+		t.Errorf("Got status %d for download while draining, want %d", response.Code, http.StatusOK)
+	}
+
+	if err := drainer.CheckHealth(context.Background()); err == nil {
+		t.Error("Expected health check to fail while draining")
+	}
+
+	if len(handler.urls) != 2 {
+		t.Errorf("Got %d requests passed through, want 2", len(handler.urls))
+	}
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/olzhasar/go-fileserver/auth"
+)
+
+const MSG_ERR_INVALID_TOKEN = "Invalid bearer token"
+
+type TokenVerifier interface {
+	Verify(token string) (identity *auth.Identity, err error)
+}
+
+// JWTMiddleware authenticates requests carrying a JWT bearer token and
+// attaches the identity from its claims to the request context. Bearer
+// tokens that look like API keys are left to APIKeyMiddleware. Without a
+// verifier all requests are passed through
+type JWTMiddleware struct {
+	handler  http.Handler
+	verifier TokenVerifier
+	mu       sync.RWMutex
+}
+
+func (j *JWTMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	verifier := j.getVerifier()
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if verifier == nil || !ok || strings.HasPrefix(token, auth.API_KEY_PREFIX+"_") || strings.Count(token, ".") != 2 {
+		j.handler.ServeHTTP(w, r)
+		return
+	}
+
+	identity, err := verifier.Verify(token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, MSG_ERR_INVALID_TOKEN, http.StatusUnauthorized)
+		return
+	}
+
+	logIdentity(r.Context(), identity)
+	j.handler.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+}
+
+// SetVerifier replaces the verifier, e.g. after the JWKS location changed
+func (j *JWTMiddleware) SetVerifier(verifier TokenVerifier) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.verifier = verifier
+}
+
+func (j *JWTMiddleware) getVerifier() TokenVerifier {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.verifier
+}
+
+func NewJWTMiddleware(handler http.Handler, verifier TokenVerifier) *JWTMiddleware {
+	return &JWTMiddleware{handler: handler, verifier: verifier}
+}
+
+func MakeJWTHandler(handler http.Handler, verifier TokenVerifier) http.Handler {
+	return NewJWTMiddleware(handler, verifier)
+}
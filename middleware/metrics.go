@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/metrics"
+)
+
+const ROUTE_OTHER = "other"
+
+// MetricsConfig lists the paths reported by MetricsMiddleware. Other paths
+// are reported as "other" to keep the number of label values bounded
+type MetricsConfig struct {
+	Routes []string
+	// Request bodies sent to UploadPaths are counted as uploaded bytes
+	UploadPaths []string
+	// Responses from DownloadPaths are counted as downloaded bytes
+	DownloadPaths []string
+}
+
+// MetricsMiddleware records request counts, latencies and transferred bytes
+type MetricsMiddleware struct {
+	handler http.Handler
+	metrics *metrics.Metrics
+	config  MetricsConfig
+}
+
+func (m *MetricsMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	var body *countingBody
+	if containsPath(m.config.UploadPaths, r.URL.Path) && r.Body != nil {
+		done := m.metrics.StartTransfer(metrics.DIRECTION_UPLOAD)
+		defer done()
+
+		body = &countingBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+
+	download := containsPath(m.config.DownloadPaths, r.URL.Path)
+	if download {
+		done := m.metrics.StartTransfer(metrics.DIRECTION_DOWNLOAD)
+		defer done()
+	}
+
+	recorder := newResponseRecorder(w)
+	m.handler.ServeHTTP(recorder, r)
+
+	if body != nil {
+		m.metrics.AddTransferBytes(metrics.DIRECTION_UPLOAD, body.read)
+	}
+	if download {
+		m.metrics.AddTransferBytes(metrics.DIRECTION_DOWNLOAD, recorder.bytes)
+	}
+
+	m.metrics.ObserveRequest(m.route(r), methodLabel(r.Method), recorder.status, time.Since(start))
+}
+
+func (m *MetricsMiddleware) route(r *http.Request) string {
+	if containsPath(m.config.Routes, r.URL.Path) {
+		return r.URL.Path
+	}
+	return ROUTE_OTHER
+}
+
+func MakeMetricsHandler(handler http.Handler, m *metrics.Metrics, config MetricsConfig) http.Handler {
+	return &MetricsMiddleware{handler, m, config}
+}
+
+// methodLabel maps non-standard methods to "other"
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	default:
+		return ROUTE_OTHER
+	}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.read += int64(n)
+	return n, err
+}
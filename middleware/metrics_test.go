@@ -0,0 +1,62 @@
+package middleware_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/olzhasar/go-fileserver/metrics"
+	"github.com/olzhasar/go-fileserver/middleware"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	m := metrics.NewMetrics()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/upload":
+			io.Copy(io.Discard, r.Body)
+		case "/download":
+			w.Write([]byte("file content"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	instrumented := middleware.MakeMetricsHandler(handler, m, middleware.MetricsConfig{
+		Routes:        []string{"/upload", "/download"},
+		UploadPaths:   []string{"/upload"},
+		DownloadPaths: []string{"/download"},
+	})
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("uploaded")),
+		httptest.NewRequest(http.MethodGet, "/download?token=abc", nil),
+		httptest.NewRequest(http.MethodGet, "/random/path", nil),
+		httptest.NewRequest("BREW", "/download", nil),
+	}
+	for _, request := range requests {
+		instrumented.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	response := httptest.NewRecorder()
+	m.Handler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := response.Body.String()
+
+	want := []string{
+		`fileserver_http_requests_total{method="POST",route="/upload",status="200"} 1`,
+		`fileserver_http_requests_total{method="GET",route="/download",status="200"} 1`,
+		`fileserver_http_requests_total{method="GET",route="other",status="404"} 1`,
+		`fileserver_http_requests_total{method="other",route="/download",status="200"} 1`,
+		`fileserver_transfer_bytes_total{direction="upload"} 8`,
+		`fileserver_transfer_bytes_total{direction="download"} 24`,
+		`fileserver_active_transfers{direction="download"} 0`,
+	}
+	for _, line := range want {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Want metrics to contain %q", line)
+		}
+	}
+}
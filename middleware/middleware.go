@@ -1,27 +1,187 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/olzhasar/go-fileserver/auth"
 	"github.com/olzhasar/go-fileserver/loggers"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+const ACCESS_LOG_COMBINED = "combined"
+const ACCESS_LOG_JSON = "json"
+
+// AccessLogEntry describes a served request
+type AccessLogEntry struct {
+	Time      time.Time
+	RequestID string
+	RemoteIP  string
+	Method    string
+	URL       string
+	Proto     string
+	Status    int
+	Bytes     int64
+	Duration  time.Duration
+	UserAgent string
+	Referer   string
+	Uploader  string
+	Token     string
+	// Aborted is set when the client went away before the response was sent
+	Aborted bool
+}
+
+// AccessLogger records served requests
+type AccessLogger func(entry AccessLogEntry)
+
+// FormatCombined renders entries in the Apache Combined Log Format. Values
+// sent by clients are escaped, so that they can't forge fields or lines
+func FormatCombined(e AccessLogEntry) string {
+	return fmt.Sprintf(
+		"%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"",
+		e.RemoteIP,
+		// The uploader is the only unquoted field holding spaces
+		dashIfEmpty(strings.ReplaceAll(escapeLogValue(e.Uploader), " ", `\x20`)),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		escapeLogValue(e.Method),
+		escapeLogValue(e.URL),
+		escapeLogValue(e.Proto),
+		e.Status,
+		dashIfEmpty(fmt.Sprint(e.Bytes)),
+		dashIfEmpty(escapeLogValue(e.Referer)),
+		dashIfEmpty(escapeLogValue(e.UserAgent)),
+	)
+}
+
+// escapeLogValue escapes quotes, backslashes, control characters and
+// non-ASCII bytes as \xHH, like the default escaping of nginx
+func escapeLogValue(value string) string {
+	var escaped strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '"' || c == '\\' || c < 0x20 || c > 0x7e {
+			fmt.Fprintf(&escaped, "\\x%02X", c)
+		} else {
+			escaped.WriteByte(c)
+		}
+	}
+
+	return escaped.String()
+}
+
+// Fields returns the entry as alternating key-value pairs, leaving out
+// empty optional values
+func (e AccessLogEntry) Fields() []any {
+	fields := []any{}
+	add := func(key string, value string) {
+		if value != "" {
+			fields = append(fields, key, value)
+		}
+	}
+
+	add("request_id", e.RequestID)
+	fields = append(fields, "remote_ip", e.RemoteIP, "method", e.Method, "url", e.URL, "proto", e.Proto,
+		"status", e.Status, "bytes", e.Bytes, "duration_ms", float64(e.Duration)/float64(time.Millisecond))
+	add("user_agent", e.UserAgent)
+	add("referer", e.Referer)
+	add("uploader", e.Uploader)
+	add("token", e.Token)
+
+	return append(fields, "aborted", e.Aborted)
+}
+
+// WriteCombined writes entries to w as Apache Combined Log Format lines,
+// without the time and level prefix of loggers, so that log tools can
+// parse them
+func WriteCombined(w io.Writer) AccessLogger {
+	return func(entry AccessLogEntry) {
+		io.WriteString(w, FormatCombined(entry)+"\n")
+	}
+}
+
+// LogFields passes entries to logger as key-value fields, which are
+// encoded along with the other records of the logger
+func LogFields(logger loggers.Logger) AccessLogger {
+	return func(entry AccessLogEntry) {
+		logger.Info("Request served", entry.Fields()...)
+	}
+}
+
+// NewAccessLogger returns the access logger of the format named "combined"
+// or "json". Combined lines are written to w, JSON entries are passed as
+// fields to logger
+func NewAccessLogger(format string, w io.Writer, logger loggers.Logger) (AccessLogger, error) {
+	switch strings.ToLower(format) {
+	case "", ACCESS_LOG_COMBINED:
+		return WriteCombined(w), nil
+	case ACCESS_LOG_JSON:
+		return LogFields(logger), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown access log format %q", format))
+	}
+}
+
+func dashIfEmpty(value string) string {
+	if value == "" || value == "0" {
+		return "-"
+	}
+	return value
+}
+
 type LoggingMiddleware struct {
 	handler http.Handler
-	logger  loggers.Logger
+	log     AccessLogger
 }
 
 func (l *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	l.handler.ServeHTTP(w, r)
+	entry := &AccessLogEntry{
+		Time:      start,
+		RequestID: requestID(r),
+		RemoteIP:  clientIP(r),
+		Method:    r.Method,
+		URL:       r.URL.RequestURI(),
+		Proto:     r.Proto,
+		UserAgent: r.UserAgent(),
+		Referer:   r.Referer(),
+		Token:     r.URL.Query().Get("token"),
+	}
 
-	message := fmt.Sprintf("%s %s DURATION: %v", r.Method, r.URL, time.Since(start))
+	recorder := newResponseRecorder(w)
+	r = r.WithContext(context.WithValue(r.Context(), accessLogEntryKey{}, entry))
 
-	l.logger.Log(message)
+	l.handler.ServeHTTP(recorder, r)
+
+	entry.Status = recorder.status
+	entry.Bytes = recorder.bytes
+	entry.Duration = time.Since(start)
+	entry.Aborted = recorder.err != nil || errors.Is(r.Context().Err(), context.Canceled)
+
+	l.log(*entry)
 }
 
+// MakeLoggedHandler logs requests as fields of logger
 func MakeLoggedHandler(handler http.Handler, logger loggers.Logger) http.Handler {
-	return &LoggingMiddleware{handler, logger}
+	return MakeAccessLoggedHandler(handler, LogFields(logger))
+}
+
+func MakeAccessLoggedHandler(handler http.Handler, log AccessLogger) http.Handler {
+	return &LoggingMiddleware{handler, log}
+}
+
+type accessLogEntryKey struct{}
+
+// logIdentity records the authenticated identity in the access log entry of
+// the request, as authentication happens in handlers wrapped by the logger
+func logIdentity(ctx context.Context, identity *auth.Identity) {
+	if entry, ok := ctx.Value(accessLogEntryKey{}).(*AccessLogEntry); ok && identity != nil {
+		entry.Uploader = identity.Name
+	}
 }
@@ -2,19 +2,28 @@ package middleware_test
 
 import (
 	"bytes"
+	"context"
 	"github.com/olzhasar/go-fileserver/middleware"
+	"github.com/olzhasar/go-fileserver/registry"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 )
 
 type StubLogger struct {
 	messages []string
+	args     [][]any
 }
 
-func (s *StubLogger) Log(message string) {
+func (s *StubLogger) Debug(message string, args ...any) {}
+func (s *StubLogger) Warn(message string, args ...any)  {}
+func (s *StubLogger) Error(message string, args ...any) {}
+
+func (s *StubLogger) Info(message string, args ...any) {
 	s.messages = append(s.messages, message)
+	s.args = append(s.args, args)
 }
 
 type StubHandler struct {
@@ -54,3 +63,153 @@ func TestLoggingMiddleWare(t *testing.T) {
 		t.Errorf("Got %d logged messages, want %d", len(logger.messages), len(urls))
 	}
 }
+
+type WritingHandler struct {
+	status int
+	body   string
+}
+
+func (h *WritingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(h.status)
+	w.Write([]byte(h.body))
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	entry := middleware.AccessLogEntry{
+		Time:      time.Date(2023, 5, 1, 12, 30, 0, 0, time.UTC),
+		RequestID: "req-1",
+		RemoteIP:  "10.0.0.1",
+		Method:    "GET",
+		URL:       "/download?token=abc",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		Bytes:     1234,
+		Duration:  1500 * time.Microsecond,
+		UserAgent: "curl/8.0",
+		Uploader:  "alice",
+		Token:     "abc",
+	}
+
+	t.Run("combined", func(t *testing.T) {
+		got := middleware.FormatCombined(entry)
+		want := `10.0.0.1 - alice [01/May/2023:12:30:00 +0000] "GET /download?token=abc HTTP/1.1" 200 1234 "-" "curl/8.0"`
+
+		if got != want {
+			t.Errorf("Got %q, want %q", got, want)
+		}
+	})
+	t.Run("combined escapes client values", func(t *testing.T) {
+		forged := entry
+		forged.URL = "/download?token=\"abc\" 200 1 \"-\" \"x\"\n10.0.0.2 - -"
+		forged.Referer = `C:\evil`
+		forged.UserAgent = "curl\x00/é"
+		forged.Uploader = "alice smith"
+
+		got := middleware.FormatCombined(forged)
+		want := `10.0.0.1 - alice\x20smith [01/May/2023:12:30:00 +0000] "GET /download?token=\x22abc\x22 200 1 \x22-\x22 \x22x\x22\x0A10.0.0.2 - - HTTP/1.1" 200 1234 "C:\x5Cevil" "curl\x00/\xC3\xA9"`
+
+		if got != want {
+			t.Errorf("Got %q, want %q", got, want)
+		}
+	})
+	t.Run("fields", func(t *testing.T) {
+		got := entry.Fields()
+		want := []any{"request_id", "req-1", "remote_ip", "10.0.0.1", "method", "GET", "url", "/download?token=abc", "proto", "HTTP/1.1",
+			"status", 200, "bytes", int64(1234), "duration_ms", 1.5, "user_agent", "curl/8.0", "uploader", "alice", "token", "abc", "aborted", false}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	})
+	t.Run("writes combined lines as is", func(t *testing.T) {
+		var buffer bytes.Buffer
+		logger := &StubLogger{}
+		log, err := middleware.NewAccessLogger("combined", &buffer, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		log(entry)
+
+		if buffer.String() != middleware.FormatCombined(entry)+"\n" || len(logger.messages) != 0 {
+			t.Errorf("Got %q written and %d logged messages", buffer.String(), len(logger.messages))
+		}
+	})
+	t.Run("logs json entries as fields", func(t *testing.T) {
+		var buffer bytes.Buffer
+		logger := &StubLogger{}
+		log, err := middleware.NewAccessLogger("JSON", &buffer, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		log(entry)
+
+		if buffer.Len() != 0 || len(logger.args) != 1 || !reflect.DeepEqual(logger.args[0], entry.Fields()) {
+			t.Errorf("Got %q written and fields %v", buffer.String(), logger.args)
+		}
+	})
+	t.Run("rejects unknown formats", func(t *testing.T) {
+		if _, err := middleware.NewAccessLogger("xml", &bytes.Buffer{}, &StubLogger{}); err == nil {
+			t.Error("Got nil, want error for unknown format")
+		}
+	})
+}
+
+func TestAccessLogEntry(t *testing.T) {
+	serve := func(handler http.Handler, r *http.Request) middleware.AccessLogEntry {
+		var got middleware.AccessLogEntry
+		logged := middleware.MakeAccessLoggedHandler(handler, func(e middleware.AccessLogEntry) {
+			got = e
+		})
+		logged.ServeHTTP(httptest.NewRecorder(), r)
+
+		return got
+	}
+
+	t.Run("captures response and client info", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/download?token=abc", nil)
+		request.RemoteAddr = "10.0.0.1:5555"
+		request.Header.Set("User-Agent", "curl/8.0")
+		request.Header.Set(middleware.REQUEST_ID_HEADER, "req-1")
+
+		entry := serve(&WritingHandler{http.StatusNotFound, "not found"}, request)
+
+		if entry.Status != http.StatusNotFound || entry.Bytes != 9 {
+			t.Errorf("Got status %d and %d bytes, want 404 and 9", entry.Status, entry.Bytes)
+		}
+		if entry.RemoteIP != "10.0.0.1" || entry.UserAgent != "curl/8.0" || entry.RequestID != "req-1" || entry.Token != "abc" {
+			t.Errorf("Got entry %+v", entry)
+		}
+		if entry.Aborted {
+			t.Error("Want request not to be aborted")
+		}
+	})
+	t.Run("detects aborted requests", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		request := httptest.NewRequest(http.MethodGet, "/download", nil).WithContext(ctx)
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cancel()
+		})
+
+		entry := serve(handler, request)
+
+		if !entry.Aborted {
+			t.Error("Want request to be aborted")
+		}
+	})
+	t.Run("records authenticated identity", func(t *testing.T) {
+		reg := registry.NewInMemoryRegistry()
+		_, key := createAPIKey(t, reg, "alice", "upload")
+
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set(middleware.API_KEY_HEADER, key)
+
+		entry := serve(middleware.MakeAPIKeyHandler(&StubHandler{}, reg), request)
+
+		if entry.Uploader != "alice" {
+			t.Errorf("Got uploader %q, want %q", entry.Uploader, "alice")
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/auth"
+)
+
+const MSG_ERR_RATE_LIMITED = "Too many requests"
+
+// KeyFunc identifies the client a request is accounted to
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP accounts requests to the client address
+func KeyByIP(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// KeyByIdentity accounts requests to the API key or identity attached by
+// authentication middlewares, falling back to the client IP
+func KeyByIdentity(r *http.Request) string {
+	identity := auth.IdentityFromContext(r.Context())
+	switch {
+	case identity == nil:
+		return KeyByIP(r)
+	case identity.KeyID != "":
+		return "key:" + identity.KeyID
+	default:
+		return "user:" + identity.Name
+	}
+}
+
+// KeyByRoute keeps separate buckets per request path
+func KeyByRoute(key KeyFunc) KeyFunc {
+	return func(r *http.Request) string {
+		return r.URL.Path + "|" + key(r)
+	}
+}
+
+type RateLimitConfig struct {
+	// Requests limits the number of requests
+	Requests Limit
+	// UploadBytes throttles request bodies sent to UploadPaths, in bytes
+	UploadBytes Limit
+	UploadPaths []string
+	// FailedLookups limits 404 responses from LookupPaths, e.g. guessed
+	// download tokens. Clients are blocked from LookupPaths once exhausted
+	FailedLookups Limit
+	LookupPaths   []string
+	// Key defaults to KeyByIP
+	Key KeyFunc
+}
+
+// RateLimitMiddleware applies token bucket limits and reports them with
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers.
+// Requests are served if the store fails, so an outage of a shared store
+// doesn't take the server down with it
+type RateLimitMiddleware struct {
+	handler http.Handler
+	store   RateLimitStore
+	config  RateLimitConfig
+	mu      sync.RWMutex
+	now     func() time.Time
+}
+
+func (m *RateLimitMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config := m.getConfig()
+	key := config.Key(r)
+	ctx := r.Context()
+
+	if config.Requests.Enabled() {
+		result, err := m.store.Take(ctx, "req:"+key, 1, config.Requests, m.now())
+		if err == nil {
+			setRateLimitHeaders(w, config.Requests, result)
+			if !result.Allowed {
+				rejectRateLimited(w, result.RetryAfter)
+				return
+			}
+		}
+	}
+
+	// Lookups are charged up front and refunded unless they fail, so that
+	// concurrent guesses can't all pass before any failure is counted
+	charged := false
+	if config.FailedLookups.Enabled() && containsPath(config.LookupPaths, r.URL.Path) {
+		result, err := m.store.Take(ctx, "fail:"+key, 1, config.FailedLookups, m.now())
+		if err == nil && !result.Allowed {
+			setRateLimitHeaders(w, config.FailedLookups, result)
+			rejectRateLimited(w, result.RetryAfter)
+			return
+		}
+		charged = err == nil
+	}
+
+	if config.UploadBytes.Enabled() && containsPath(config.UploadPaths, r.URL.Path) && r.Body != nil {
+		r.Body = &throttledReader{
+			body:  r.Body,
+			ctx:   ctx,
+			key:   "bytes:" + key,
+			store: m.store,
+			limit: config.UploadBytes,
+			now:   m.now,
+		}
+	}
+
+	recorder := newResponseRecorder(w)
+	m.handler.ServeHTTP(recorder, r)
+
+	if charged && recorder.status != http.StatusNotFound {
+		m.store.Take(context.WithoutCancel(ctx), "fail:"+key, -1, config.FailedLookups, m.now())
+	}
+}
+
+// SetConfig replaces the limits. Buckets in the store are kept, so clients
+// don't get a fresh burst
+func (m *RateLimitMiddleware) SetConfig(config RateLimitConfig) {
+	if config.Key == nil {
+		config.Key = KeyByIP
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = config
+}
+
+func (m *RateLimitMiddleware) getConfig() RateLimitConfig {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.config
+}
+
+func NewRateLimitMiddleware(handler http.Handler, store RateLimitStore, config RateLimitConfig) *RateLimitMiddleware {
+	m := &RateLimitMiddleware{handler: handler, store: store, now: time.Now}
+	m.SetConfig(config)
+	return m
+}
+
+func MakeRateLimitedHandler(handler http.Handler, store RateLimitStore, config RateLimitConfig) http.Handler {
+	return NewRateLimitMiddleware(handler, store, config)
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, limit Limit, result TakeResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(int(limit.Burst)))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(math.Floor(result.Remaining))))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+}
+
+func rejectRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+	http.Error(w, MSG_ERR_RATE_LIMITED, http.StatusTooManyRequests)
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// throttledReader takes a token per byte read from the body, waiting for
+// the bucket to refill when it runs dry
+type throttledReader struct {
+	body  io.ReadCloser
+	ctx   context.Context
+	key   string
+	store RateLimitStore
+	limit Limit
+	now   func() time.Time
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// reading more than a full bucket at once could never be allowed
+	if burst := int(t.limit.Burst); len(p) > burst {
+		p = p[:burst]
+	}
+
+	n, err := t.body.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	for {
+		result, takeErr := t.store.Take(t.ctx, t.key, float64(n), t.limit, t.now())
+		if takeErr != nil || result.Allowed {
+			return n, err
+		}
+
+		timer := time.NewTimer(result.RetryAfter)
+		select {
+		case <-t.ctx.Done():
+			timer.Stop()
+			return n, t.ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (t *throttledReader) Close() error {
+	return t.body.Close()
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript atomically refills and takes tokens from a bucket stored as a
+// hash of tokens and last update time in milliseconds. The key expires once
+// the bucket would be full again
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(state[1])
+local updated = tonumber(state[2])
+
+if tokens == nil then
+	tokens = burst
+	updated = now
+end
+
+local elapsed = math.max(0, now - updated) / 1000
+tokens = math.min(burst, tokens + elapsed * rate)
+
+local allowed = 0
+if tokens >= n then
+	tokens = math.min(burst, tokens - n)
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+
+return {allowed, tostring(tokens)}
+`)
+
+// RedisRateLimitStore shares buckets between server instances
+type RedisRateLimitStore struct {
+	client redis.Scripter
+	prefix string
+}
+
+func NewRedisRateLimitStore(client redis.Scripter, prefix string) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client, prefix}
+}
+
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, n float64, limit Limit, now time.Time) (TakeResult, error) {
+	values, err := takeScript.Run(
+		ctx,
+		s.client,
+		[]string{s.prefix + key},
+		limit.Rate,
+		limit.Burst,
+		n,
+		now.UnixMilli(),
+	).Slice()
+	if err != nil {
+		return TakeResult{}, err
+	}
+
+	allowed, _ := values[0].(int64)
+	remaining, _ := values[1].(string)
+
+	tokens, err := strconv.ParseFloat(remaining, 64)
+	if err != nil {
+		return TakeResult{}, err
+	}
+
+	result := TakeResult{
+		Allowed:   allowed == 1,
+		Remaining: tokens,
+		Reset:     limit.fullIn(tokens),
+	}
+	if !result.Allowed {
+		result.RetryAfter = secondsToDuration(math.Max(0, n-tokens) / limit.Rate)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit configures a token bucket refilled with Rate tokens per second up
+// to Burst tokens. A zero Rate disables the limit
+type Limit struct {
+	Rate  float64
+	Burst float64
+}
+
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// fullIn returns how long an empty bucket takes to refill
+func (l Limit) fullIn(tokens float64) time.Duration {
+	return secondsToDuration((l.Burst - tokens) / l.Rate)
+}
+
+type TakeResult struct {
+	Allowed bool
+	// Remaining tokens in the bucket after the take
+	Remaining float64
+	// RetryAfter is how long to wait until n tokens are available
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// RateLimitStore keeps token buckets. Taking 0 tokens inspects a bucket
+// without changing it, and taking negative tokens returns them, up to the
+// burst
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, n float64, limit Limit, now time.Time) (TakeResult, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// InMemoryRateLimitStore keeps buckets of a single server instance
+type InMemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// Interval between sweeps of buckets that refilled completely
+const RATE_LIMIT_SWEEP_INTERVAL = time.Minute
+
+func NewInMemoryRateLimitStore() *InMemoryRateLimitStore {
+	return &InMemoryRateLimitStore{buckets: make(map[string]*bucket)}
+}
+
+func (s *InMemoryRateLimitStore) Take(ctx context.Context, key string, n float64, limit Limit, now time.Time) (TakeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit.Burst, updated: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = refill(b.tokens, b.updated, limit, now)
+	b.updated = now
+	b.limit = limit
+
+	result := TakeResult{Allowed: b.tokens >= n}
+	if result.Allowed {
+		b.tokens = math.Min(limit.Burst, b.tokens-n)
+	} else {
+		result.RetryAfter = secondsToDuration((n - b.tokens) / limit.Rate)
+	}
+
+	result.Remaining = b.tokens
+	result.Reset = limit.fullIn(b.tokens)
+
+	return result, nil
+}
+
+// sweep drops buckets that would be full by now, as they are equivalent to
+// missing ones
+func (s *InMemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < RATE_LIMIT_SWEEP_INTERVAL {
+		return
+	}
+	s.lastSweep = now
+
+	for key, b := range s.buckets {
+		if refill(b.tokens, b.updated, b.limit, now) >= b.limit.Burst {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func refill(tokens float64, updated time.Time, limit Limit, now time.Time) float64 {
+	elapsed := now.Sub(updated).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(limit.Burst, tokens+elapsed*limit.Rate)
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
@@ -0,0 +1,339 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/olzhasar/go-fileserver/auth"
+)
+
+func TestRateLimitStores(t *testing.T) {
+	cases := []struct {
+		name        string
+		createStore func(t *testing.T) RateLimitStore
+	}{
+		{
+			"InMemory",
+			func(t *testing.T) RateLimitStore { return NewInMemoryRateLimitStore() },
+		},
+		{
+			"Redis",
+			func(t *testing.T) RateLimitStore {
+				server := miniredis.RunT(t)
+				client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+				t.Cleanup(func() { client.Close() })
+				return NewRedisRateLimitStore(client, "ratelimit:")
+			},
+		},
+	}
+
+	limit := Limit{Rate: 2, Burst: 4}
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	for _, test := range cases {
+		t.Run(fmt.Sprintf("%s:allows burst then rejects", test.name), func(t *testing.T) {
+			store := test.createStore(t)
+
+			for i := 0; i < 4; i++ {
+				result, err := store.Take(ctx, "key", 1, limit, now)
+				if err != nil {
+					t.Fatalf("Expected no error, got %q", err)
+				}
+				if !result.Allowed {
+					t.Fatalf("Take %d: want allowed", i)
+				}
+				if result.Remaining != float64(3-i) {
+					t.Errorf("Take %d: got remaining %v, want %d", i, result.Remaining, 3-i)
+				}
+			}
+
+			result, _ := store.Take(ctx, "key", 1, limit, now)
+			if result.Allowed {
+				t.Fatal("Want take past burst to be rejected")
+			}
+			if result.RetryAfter != 500*time.Millisecond {
+				t.Errorf("Got retry after %v, want 500ms", result.RetryAfter)
+			}
+			if result.Reset != 2*time.Second {
+				t.Errorf("Got reset %v, want 2s", result.Reset)
+			}
+		})
+		t.Run(fmt.Sprintf("%s:refills over time", test.name), func(t *testing.T) {
+			store := test.createStore(t)
+
+			store.Take(ctx, "key", 4, limit, now)
+
+			result, _ := store.Take(ctx, "key", 1, limit, now.Add(500*time.Millisecond))
+			if !result.Allowed || result.Remaining != 0 {
+				t.Errorf("Got %+v, want one refilled token to be taken", result)
+			}
+
+			result, _ = store.Take(ctx, "key", 0, limit, now.Add(time.Hour))
+			if result.Remaining != limit.Burst {
+				t.Errorf("Got remaining %v, want bucket to be capped at burst", result.Remaining)
+			}
+		})
+		t.Run(fmt.Sprintf("%s:keeps separate buckets per key", test.name), func(t *testing.T) {
+			store := test.createStore(t)
+
+			store.Take(ctx, "a", 4, limit, now)
+
+			result, _ := store.Take(ctx, "b", 1, limit, now)
+			if !result.Allowed {
+				t.Error("Want other keys to be unaffected")
+			}
+		})
+		t.Run(fmt.Sprintf("%s:returns tokens up to burst", test.name), func(t *testing.T) {
+			store := test.createStore(t)
+
+			store.Take(ctx, "key", 2, limit, now)
+			result, _ := store.Take(ctx, "key", -1, limit, now)
+			if result.Remaining != 3 {
+				t.Errorf("Got remaining %v, want 3", result.Remaining)
+			}
+
+			result, _ = store.Take(ctx, "key", -5, limit, now)
+			if result.Remaining != limit.Burst {
+				t.Errorf("Got remaining %v, want bucket to be capped at burst", result.Remaining)
+			}
+		})
+		t.Run(fmt.Sprintf("%s:inspects bucket without taking", test.name), func(t *testing.T) {
+			store := test.createStore(t)
+
+			store.Take(ctx, "key", 1, limit, now)
+			store.Take(ctx, "key", 0, limit, now)
+
+			result, _ := store.Take(ctx, "key", 0, limit, now)
+			if result.Remaining != 3 {
+				t.Errorf("Got remaining %v, want 3", result.Remaining)
+			}
+		})
+	}
+}
+
+func TestInMemoryRateLimitStoreSweep(t *testing.T) {
+	store := NewInMemoryRateLimitStore()
+	limit := Limit{Rate: 1, Burst: 10}
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	store.Take(context.Background(), "stale", 5, limit, now)
+	store.Take(context.Background(), "fresh", 5, limit, now.Add(RATE_LIMIT_SWEEP_INTERVAL))
+
+	if _, ok := store.buckets["stale"]; ok {
+		t.Error("Want refilled bucket to be swept")
+	}
+	if _, ok := store.buckets["fresh"]; !ok {
+		t.Error("Want active bucket to be kept")
+	}
+}
+
+type BodyReader struct {
+	status int
+	body   []byte
+}
+
+func (b *BodyReader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.body, _ = io.ReadAll(r.Body)
+	w.WriteHeader(b.status)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	newHandler := func(config RateLimitConfig, next http.Handler) *RateLimitMiddleware {
+		handler := MakeRateLimitedHandler(next, NewInMemoryRateLimitStore(), config).(*RateLimitMiddleware)
+		handler.now = func() time.Time { return now }
+		return handler
+	}
+
+	serve := func(handler http.Handler, path, remoteAddr string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.RemoteAddr = remoteAddr
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("limits requests per client IP", func(t *testing.T) {
+		handler := newHandler(RateLimitConfig{Requests: Limit{Rate: 1, Burst: 2}}, &BodyReader{status: http.StatusOK})
+
+		for i := 0; i < 2; i++ {
+			response := serve(handler, "/", "10.0.0.1:1234")
+			if response.Code != http.StatusOK {
+				t.Fatalf("Request %d: got status %d, want 200", i, response.Code)
+			}
+		}
+
+		response := serve(handler, "/", "10.0.0.1:5678")
+		if response.Code != http.StatusTooManyRequests {
+			t.Fatalf("Got status %d, want 429", response.Code)
+		}
+
+		assertHeader(t, response, "RateLimit-Limit", "2")
+		assertHeader(t, response, "RateLimit-Remaining", "0")
+		assertHeader(t, response, "RateLimit-Reset", "2")
+		assertHeader(t, response, "Retry-After", "1")
+
+		response = serve(handler, "/", "10.0.0.2:1234")
+		if response.Code != http.StatusOK {
+			t.Errorf("Got status %d for other client, want 200", response.Code)
+		}
+	})
+	t.Run("applies replaced limits", func(t *testing.T) {
+		handler := newHandler(RateLimitConfig{}, &BodyReader{status: http.StatusOK})
+
+		for i := 0; i < 3; i++ {
+			if response := serve(handler, "/", "10.0.0.1:1234"); response.Code != http.StatusOK {
+				t.Fatalf("Request %d: got status %d without limits, want 200", i, response.Code)
+			}
+		}
+
+		handler.SetConfig(RateLimitConfig{Requests: Limit{Rate: 1, Burst: 1}})
+
+		serve(handler, "/", "10.0.0.1:1234")
+		if response := serve(handler, "/", "10.0.0.1:1234"); response.Code != http.StatusTooManyRequests {
+			t.Errorf("Got status %d, want 429", response.Code)
+		}
+	})
+	t.Run("blocks clients after failed lookups", func(t *testing.T) {
+		next := &BodyReader{status: http.StatusNotFound}
+		config := RateLimitConfig{FailedLookups: Limit{Rate: 0.1, Burst: 3}, LookupPaths: []string{"/download"}}
+		handler := newHandler(config, next)
+
+		for i := 0; i < 3; i++ {
+			response := serve(handler, "/download", "10.0.0.1:1234")
+			if response.Code != http.StatusNotFound {
+				t.Fatalf("Request %d: got status %d, want 404", i, response.Code)
+			}
+		}
+
+		next.status = http.StatusOK
+
+		response := serve(handler, "/download", "10.0.0.1:1234")
+		if response.Code != http.StatusTooManyRequests {
+			t.Fatalf("Got status %d, want 429", response.Code)
+		}
+		assertHeader(t, response, "Retry-After", "10")
+
+		response = serve(handler, "/upload", "10.0.0.1:1234")
+		if response.Code != http.StatusOK {
+			t.Errorf("Got status %d for other path, want 200", response.Code)
+		}
+	})
+	t.Run("counts concurrent lookups before they fail", func(t *testing.T) {
+		release := make(chan struct{})
+		started := make(chan struct{}, 2)
+		var lookups atomic.Int32
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Only the first lookups wait, so that a third one can't hang
+			if lookups.Add(1) <= 2 {
+				started <- struct{}{}
+				<-release
+			}
+			w.WriteHeader(http.StatusNotFound)
+		})
+		config := RateLimitConfig{FailedLookups: Limit{Rate: 0.1, Burst: 2}, LookupPaths: []string{"/download"}}
+		handler := newHandler(config, next)
+
+		done := make(chan int, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				done <- serve(handler, "/download", "10.0.0.1:1234").Code
+			}()
+			<-started
+		}
+
+		if response := serve(handler, "/download", "10.0.0.1:1234"); response.Code != http.StatusTooManyRequests {
+			t.Errorf("Got status %d while lookups are in flight, want 429", response.Code)
+		}
+
+		close(release)
+		for i := 0; i < 2; i++ {
+			if code := <-done; code != http.StatusNotFound {
+				t.Errorf("Got status %d, want 404", code)
+			}
+		}
+	})
+	t.Run("does not count successful lookups", func(t *testing.T) {
+		config := RateLimitConfig{FailedLookups: Limit{Rate: 0.1, Burst: 1}, LookupPaths: []string{"/download"}}
+		handler := newHandler(config, &BodyReader{status: http.StatusOK})
+
+		for i := 0; i < 3; i++ {
+			response := serve(handler, "/download", "10.0.0.1:1234")
+			if response.Code != http.StatusOK {
+				t.Fatalf("Request %d: got status %d, want 200", i, response.Code)
+			}
+		}
+	})
+	t.Run("keys by API key", func(t *testing.T) {
+		handler := newHandler(RateLimitConfig{Requests: Limit{Rate: 1, Burst: 1}, Key: KeyByIdentity}, &BodyReader{status: http.StatusOK})
+
+		serveAs := func(keyID string) int {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			identity := &auth.Identity{Name: "alice", KeyID: keyID}
+			request = request.WithContext(auth.WithIdentity(request.Context(), identity))
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			return response.Code
+		}
+
+		if serveAs("aaaa") != http.StatusOK || serveAs("bbbb") != http.StatusOK {
+			t.Fatal("Want different keys to have separate buckets")
+		}
+		if serveAs("aaaa") != http.StatusTooManyRequests {
+			t.Error("Want second request with the same key to be limited")
+		}
+	})
+	t.Run("keys by route", func(t *testing.T) {
+		handler := newHandler(RateLimitConfig{Requests: Limit{Rate: 1, Burst: 1}, Key: KeyByRoute(KeyByIP)}, &BodyReader{status: http.StatusOK})
+
+		if serve(handler, "/upload", "10.0.0.1:1").Code != http.StatusOK || serve(handler, "/download", "10.0.0.1:1").Code != http.StatusOK {
+			t.Fatal("Want different routes to have separate buckets")
+		}
+		if serve(handler, "/upload", "10.0.0.1:1").Code != http.StatusTooManyRequests {
+			t.Error("Want second request to the same route to be limited")
+		}
+	})
+	t.Run("throttles upload bytes", func(t *testing.T) {
+		next := &BodyReader{status: http.StatusOK}
+		config := RateLimitConfig{UploadBytes: Limit{Rate: 1000, Burst: 100}, UploadPaths: []string{"/upload"}}
+		handler := MakeRateLimitedHandler(next, NewInMemoryRateLimitStore(), config)
+
+		content := bytes.Repeat([]byte("a"), 300)
+
+		request := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(content))
+		response := httptest.NewRecorder()
+
+		start := time.Now()
+		handler.ServeHTTP(response, request)
+		elapsed := time.Since(start)
+
+		if !bytes.Equal(next.body, content) {
+			t.Fatalf("Got body of %d bytes, want %d", len(next.body), len(content))
+		}
+
+		// the first 100 bytes fit the burst, the rest refill at 1000 bytes/sec
+		if elapsed < 150*time.Millisecond {
+			t.Errorf("Upload took %v, want it to be throttled to about 200ms", elapsed)
+		}
+	})
+}
+
+func assertHeader(t testing.TB, response *httptest.ResponseRecorder, header, want string) {
+	t.Helper()
+
+	if got := response.Header().Get(header); got != want {
+		t.Errorf("Got header %s %q, want %q", header, got, want)
+	}
+}
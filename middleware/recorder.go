@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// responseRecorder wraps a ResponseWriter to capture the status code, the
+// number of body bytes written and the first write error
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	err         error
+	wroteHeader bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
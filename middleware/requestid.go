@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/olzhasar/go-fileserver/loggers"
+)
+
+const MAX_REQUEST_ID_LENGTH = 128
+
+// RequestIDMiddleware attaches a request ID to the request context and the
+// response headers. Incoming X-Request-ID headers are honored, so IDs set by
+// a proxy in front of the server show up in its logs
+type RequestIDMiddleware struct {
+	handler http.Handler
+}
+
+func (m *RequestIDMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(REQUEST_ID_HEADER)
+	if !isValidRequestID(id) {
+		id = generateRequestID()
+	}
+
+	w.Header().Set(REQUEST_ID_HEADER, id)
+	m.handler.ServeHTTP(w, r.WithContext(loggers.WithRequestID(r.Context(), id)))
+}
+
+func MakeRequestIDHandler(handler http.Handler) http.Handler {
+	return &RequestIDMiddleware{handler}
+}
+
+// requestID prefers the ID attached by RequestIDMiddleware over the header
+func requestID(r *http.Request) string {
+	if id := loggers.RequestIDFromContext(r.Context()); id != "" {
+		return id
+	}
+	return r.Header.Get(REQUEST_ID_HEADER)
+}
+
+// isValidRequestID accepts short IDs made of printable ASCII characters, so
+// clients can't inject arbitrary content into log lines
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func generateRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
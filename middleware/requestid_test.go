@@ -0,0 +1,72 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/olzhasar/go-fileserver/loggers"
+	"github.com/olzhasar/go-fileserver/middleware"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	serve := func(header string) (contextID string, responseID string) {
+		handler := middleware.MakeRequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contextID = loggers.RequestIDFromContext(r.Context())
+		}))
+
+		request := httptest.NewRequest(http.MethodGet, "/download?token=abc", nil)
+		if header != "" {
+			request.Header.Set(middleware.REQUEST_ID_HEADER, header)
+		}
+		response := httptest.NewRecorder()
+
+		handler.ServeHTTP(response, request)
+
+		return contextID, response.Header().Get(middleware.REQUEST_ID_HEADER)
+	}
+
+	t.Run("honors incoming request ID", func(t *testing.T) {
+		contextID, responseID := serve("req-1")
+
+		if contextID != "req-1" || responseID != "req-1" {
+			t.Errorf("Got context ID %q and response ID %q, want req-1", contextID, responseID)
+		}
+	})
+	t.Run("generates missing request ID", func(t *testing.T) {
+		contextID, responseID := serve("")
+
+		if contextID == "" || contextID != responseID {
+			t.Errorf("Got context ID %q and response ID %q, want equal generated IDs", contextID, responseID)
+		}
+
+		otherID, _ := serve("")
+		if otherID == contextID {
+			t.Errorf("Got the same generated ID %q twice", otherID)
+		}
+	})
+	t.Run("replaces invalid request IDs", func(t *testing.T) {
+		for _, header := range []string{"has space", "line\nbreak", strings.Repeat("a", middleware.MAX_REQUEST_ID_LENGTH+1)} {
+			contextID, _ := serve(header)
+
+			if contextID == header || contextID == "" {
+				t.Errorf("Got context ID %q for header %q, want a generated one", contextID, header)
+			}
+		}
+	})
+	t.Run("shows up in access log entries", func(t *testing.T) {
+		var entry middleware.AccessLogEntry
+		handler := middleware.MakeAccessLoggedHandler(&StubHandler{}, func(e middleware.AccessLogEntry) {
+			entry = e
+		})
+		handler = middleware.MakeRequestIDHandler(handler)
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if entry.RequestID == "" || entry.RequestID != response.Header().Get(middleware.REQUEST_ID_HEADER) {
+			t.Errorf("Got access log request ID %q, want the generated one", entry.RequestID)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const TRACER_NAME = "github.com/olzhasar/go-fileserver/middleware"
+
+// TracingMiddleware starts a server span for every request, continuing the
+// trace of an incoming W3C traceparent header. Paths missing from routes are
+// named "other" to keep span names bounded
+type TracingMiddleware struct {
+	handler    http.Handler
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	routes     []string
+}
+
+func (t *TracingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	route := ROUTE_OTHER
+	if containsPath(t.routes, r.URL.Path) {
+		route = r.URL.Path
+	}
+
+	ctx, span := t.tracer.Start(ctx, fmt.Sprintf("%s %s", methodLabel(r.Method), route),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("client.address", clientIP(r)),
+			attribute.String("user_agent.original", r.UserAgent()),
+		),
+	)
+	defer span.End()
+
+	if r.ContentLength > 0 {
+		span.SetAttributes(attribute.Int64("http.request.body.size", r.ContentLength))
+	}
+
+	recorder := newResponseRecorder(w)
+	t.handler.ServeHTTP(recorder, r.WithContext(ctx))
+
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", recorder.status),
+		attribute.Int64("http.response.body.size", recorder.bytes),
+	)
+	if recorder.status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(recorder.status))
+	}
+}
+
+func MakeTracedHandler(handler http.Handler, provider trace.TracerProvider, propagator propagation.TextMapPropagator, routes []string) http.Handler {
+	return &TracingMiddleware{handler, provider.Tracer(TRACER_NAME), propagator, routes}
+}
@@ -0,0 +1,378 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/olzhasar/go-fileserver/sniff"
+	"gopkg.in/yaml.v3"
+)
+
+// Reasons of violations. REASON_TOO_LARGE is reported with 413, the
+// others with 415
+const REASON_BLOCKED = "blocked"
+const REASON_NOT_ALLOWED = "not_allowed"
+const REASON_MISMATCH = "mismatch"
+const REASON_EXTENSION = "extension"
+const REASON_NAME = "name"
+const REASON_TOO_LARGE = "too_large"
+
+// Rules restrict the names, types and sizes of uploads. Empty allow lists
+// allow everything, and sizes of zero mean no limit
+type Rules struct {
+	AllowedTypes      []string `yaml:"allowed_types"`
+	BlockedTypes      []string `yaml:"blocked_types"`
+	AllowedExtensions []string `yaml:"allowed_extensions"`
+	BlockedExtensions []string `yaml:"blocked_extensions"`
+	// AllowedNames and BlockedNames are glob patterns such as report-*.pdf
+	AllowedNames []string `yaml:"allowed_names"`
+	BlockedNames []string `yaml:"blocked_names"`
+	// RejectMismatch rejects files whose content contradicts the type of
+	// their extension. Nil inherits the setting of the base rules
+	RejectMismatch *bool `yaml:"reject_mismatch"`
+	MaxSize        int64 `yaml:"max_size"`
+	// MaxSizes limit the size of types or wildcards, instead of MaxSize.
+	// The most specific pattern matching a file applies
+	MaxSizes map[string]int64 `yaml:"max_sizes"`
+}
+
+// Policy applies the Users rules to the uploads of these identities, over
+// the base Rules. Lists of user rules replace the base ones when set, even
+// to an empty list. A negative MaxSize of a user lifts the base MaxSize,
+// and user MaxSizes are added to the base ones
+type Policy struct {
+	Rules
+	Users map[string]Rules
+}
+
+// Violation is returned for uploads breaking the rules
+type Violation struct {
+	Reason   string
+	FileName string
+	// DetectedType and ExtensionType are set once the content has been read
+	DetectedType  string
+	ExtensionType string
+	// MaxSize is set for REASON_TOO_LARGE
+	MaxSize int64
+}
+
+func (v *Violation) Error() string {
+	switch v.Reason {
+	case REASON_MISMATCH:
+		return fmt.Sprintf("The content of the file is %s, which does not match its %s extension", v.DetectedType, v.ExtensionType)
+	case REASON_EXTENSION:
+		return fmt.Sprintf("The extension of %q is not allowed", v.FileName)
+	case REASON_NAME:
+		return fmt.Sprintf("The file name %q is not allowed", v.FileName)
+	case REASON_TOO_LARGE:
+		if v.DetectedType == "" {
+			return fmt.Sprintf("Files are limited to %d bytes", v.MaxSize)
+		}
+		return fmt.Sprintf("Files of type %s are limited to %d bytes", v.DetectedType, v.MaxSize)
+	default:
+		return fmt.Sprintf("Files of type %s are not allowed", v.DetectedType)
+	}
+}
+
+// New validates the base and user rules
+func New(rules Rules, users map[string]Rules) (*Policy, error) {
+	err := rules.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	for user, userRules := range users {
+		err := userRules.validate()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Rules of %q: %s", user, err))
+		}
+		users[user] = userRules
+	}
+
+	return &Policy{Rules: rules, Users: users}, nil
+}
+
+// LoadUsers reads the rules of users from a YAML file mapping identity
+// names to rules
+func LoadUsers(fileName string) (map[string]Rules, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := map[string]Rules{}
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(&users)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, errors.New(fmt.Sprintf("Invalid rules file %s: %s", fileName, err))
+	}
+
+	return users, nil
+}
+
+// For returns the rules applying to the uploads of user, who is empty for
+// anonymous uploads. A nil policy has no rules
+func (p *Policy) For(user string) Rules {
+	if p == nil {
+		return Rules{}
+	}
+
+	override, ok := p.Users[user]
+	if !ok || user == "" {
+		return p.Rules
+	}
+
+	rules := p.Rules
+	for _, list := range []struct{ base, override *[]string }{
+		{&rules.AllowedTypes, &override.AllowedTypes},
+		{&rules.BlockedTypes, &override.BlockedTypes},
+		{&rules.AllowedExtensions, &override.AllowedExtensions},
+		{&rules.BlockedExtensions, &override.BlockedExtensions},
+		{&rules.AllowedNames, &override.AllowedNames},
+		{&rules.BlockedNames, &override.BlockedNames},
+	} {
+		if *list.override != nil {
+			*list.base = *list.override
+		}
+	}
+
+	if override.RejectMismatch != nil {
+		rules.RejectMismatch = override.RejectMismatch
+	}
+
+	switch {
+	case override.MaxSize < 0:
+		rules.MaxSize = 0
+	case override.MaxSize > 0:
+		rules.MaxSize = override.MaxSize
+	}
+
+	if len(override.MaxSizes) > 0 {
+		rules.MaxSizes = map[string]int64{}
+		for pattern, size := range p.Rules.MaxSizes {
+			rules.MaxSizes[pattern] = size
+		}
+		for pattern, size := range override.MaxSizes {
+			rules.MaxSizes[pattern] = size
+		}
+	}
+
+	return rules
+}
+
+// CheckName applies the name and extension rules, which don't need the
+// content of the file
+func (r Rules) CheckName(fileName string) error {
+	name := strings.ToLower(path.Base(strings.ReplaceAll(fileName, "\\", "/")))
+
+	if matchesAny(r.BlockedNames, name, matchName) || len(r.AllowedNames) > 0 && !matchesAny(r.AllowedNames, name, matchName) {
+		return &Violation{Reason: REASON_NAME, FileName: fileName}
+	}
+
+	if matchesAny(r.BlockedExtensions, name, strings.HasSuffix) || len(r.AllowedExtensions) > 0 && !matchesAny(r.AllowedExtensions, name, strings.HasSuffix) {
+		return &Violation{Reason: REASON_EXTENSION, FileName: fileName}
+	}
+
+	return nil
+}
+
+// CheckType applies the type rules to the type detected from the content
+// of the file. Type patterns are matched against the detected type and the
+// type recorded for the file, which may be refined by its extension
+func (r Rules) CheckType(fileName, detected string) error {
+	extension := sniff.TypeByExtension(fileName)
+	resolved := sniff.Resolve(detected, extension)
+	violation := &Violation{FileName: fileName, DetectedType: detected, ExtensionType: extension}
+
+	switch {
+	case matchesType(r.BlockedTypes, detected, resolved):
+		violation.Reason = REASON_BLOCKED
+	case len(r.AllowedTypes) > 0 && !matchesType(r.AllowedTypes, detected, resolved):
+		violation.Reason = REASON_NOT_ALLOWED
+	case r.RejectMismatch != nil && *r.RejectMismatch && !sniff.Matches(detected, extension):
+		violation.Reason = REASON_MISMATCH
+	default:
+		return nil
+	}
+
+	return violation
+}
+
+// MaxSizeFor returns the size limit of files of the given types, or zero
+// if they are not limited
+func (r Rules) MaxSizeFor(mimeTypes ...string) int64 {
+	var best string
+	for pattern := range r.MaxSizes {
+		if !matchesType([]string{pattern}, mimeTypes...) {
+			continue
+		}
+		if best == "" || specificity(pattern) > specificity(best) || specificity(pattern) == specificity(best) && r.MaxSizes[pattern] < r.MaxSizes[best] {
+			best = pattern
+		}
+	}
+
+	if best != "" {
+		return r.MaxSizes[best]
+	}
+	return r.MaxSize
+}
+
+// ParseExtensions parses a comma-separated list of extensions, with or
+// without their leading dot, such as exe,.tar.gz
+func ParseExtensions(list string) ([]string, error) {
+	var extensions []string
+
+	for _, ext := range splitList(list) {
+		ext = "." + strings.TrimPrefix(ext, ".")
+		if ext == "." || strings.ContainsAny(ext, "/\\*") {
+			return nil, errors.New(fmt.Sprintf("Invalid extension %q", ext))
+		}
+		extensions = append(extensions, ext)
+	}
+
+	return extensions, nil
+}
+
+// ParseNames parses a comma-separated list of glob patterns matching file
+// names, without their directory
+func ParseNames(list string) ([]string, error) {
+	var patterns []string
+
+	for _, pattern := range splitList(list) {
+		if _, err := path.Match(pattern, ""); err != nil || strings.Contains(pattern, "/") {
+			return nil, errors.New(fmt.Sprintf("Invalid file name pattern %q", pattern))
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+// ParseSizes parses a comma-separated list of sizes in bytes by type, such
+// as image/*=10485760,video/*=1073741824
+func ParseSizes(list string) (map[string]int64, error) {
+	sizes := map[string]int64{}
+
+	for _, entry := range splitList(list) {
+		pattern, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Invalid size %q, want type=bytes", entry))
+		}
+
+		types, err := sniff.ParseTypes(pattern)
+		if err != nil || len(types) != 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid size %q, want type=bytes", entry))
+		}
+
+		size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || size <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid size %q, want a positive number of bytes", entry))
+		}
+
+		sizes[types[0]] = size
+	}
+
+	if len(sizes) == 0 {
+		return nil, nil
+	}
+	return sizes, nil
+}
+
+// validate normalizes lists read from YAML files the way the Parse
+// functions do
+func (r *Rules) validate() error {
+	for _, list := range []struct {
+		value *[]string
+		parse func(string) ([]string, error)
+	}{
+		{&r.AllowedTypes, sniff.ParseTypes},
+		{&r.BlockedTypes, sniff.ParseTypes},
+		{&r.AllowedExtensions, ParseExtensions},
+		{&r.BlockedExtensions, ParseExtensions},
+		{&r.AllowedNames, ParseNames},
+		{&r.BlockedNames, ParseNames},
+	} {
+		if *list.value == nil {
+			continue
+		}
+
+		parsed, err := list.parse(strings.Join(*list.value, ","))
+		if err != nil {
+			return err
+		}
+		if parsed == nil {
+			parsed = []string{}
+		}
+		*list.value = parsed
+	}
+
+	if r.MaxSizes != nil {
+		patterns := make([]string, 0, len(r.MaxSizes))
+		for pattern, size := range r.MaxSizes {
+			patterns = append(patterns, pattern+"="+strconv.FormatInt(size, 10))
+		}
+		sort.Strings(patterns)
+
+		sizes, err := ParseSizes(strings.Join(patterns, ","))
+		if err != nil {
+			return err
+		}
+		r.MaxSizes = sizes
+	}
+
+	return nil
+}
+
+func splitList(list string) []string {
+	var items []string
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func matchesAny(patterns []string, name string, match func(name, pattern string) bool) bool {
+	for _, pattern := range patterns {
+		if match(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchName(name, pattern string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+func matchesType(patterns []string, mimeTypes ...string) bool {
+	for _, mimeType := range mimeTypes {
+		if matchesAny(patterns, mimeType, sniff.MatchType) {
+			return true
+		}
+	}
+	return false
+}
+
+// specificity ranks exact types above wildcards, and longer wildcards
+// above shorter ones
+func specificity(pattern string) int {
+	if !strings.Contains(pattern, "*") {
+		return len(pattern) + 1000
+	}
+	return len(pattern)
+}
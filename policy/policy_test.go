@@ -0,0 +1,238 @@
+package policy_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/olzhasar/go-fileserver/policy"
+)
+
+func assertViolation(t testing.TB, err error, reason string) {
+	t.Helper()
+
+	var violation *policy.Violation
+	if !errors.As(err, &violation) {
+		t.Fatalf("Want a violation, got %v", err)
+	}
+	if violation.Reason != reason {
+		t.Errorf("Got reason %q, want %q", violation.Reason, reason)
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	extensions, _ := policy.ParseExtensions("exe, .BAT")
+	names, _ := policy.ParseNames(".htaccess,*.tmp")
+	rules := policy.Rules{BlockedExtensions: extensions, BlockedNames: names}
+
+	for _, name := range []string{"report.pdf", "archive.tar.gz", "exe"} {
+		if err := rules.CheckName(name); err != nil {
+			t.Errorf("Expected no error for %q, got %q", name, err)
+		}
+	}
+
+	assertViolation(t, rules.CheckName("setup.EXE"), policy.REASON_EXTENSION)
+	assertViolation(t, rules.CheckName("run.bat"), policy.REASON_EXTENSION)
+	assertViolation(t, rules.CheckName("dir/.htaccess"), policy.REASON_NAME)
+	assertViolation(t, rules.CheckName("dir\\draft.TMP"), policy.REASON_NAME)
+
+	t.Run("applies allow lists", func(t *testing.T) {
+		extensions, _ := policy.ParseExtensions("pdf,tar.gz")
+		names, _ := policy.ParseNames("report-*")
+		rules := policy.Rules{AllowedExtensions: extensions, AllowedNames: names}
+
+		for _, name := range []string{"report-1.pdf", "report-2.tar.gz"} {
+			if err := rules.CheckName(name); err != nil {
+				t.Errorf("Expected no error for %q, got %q", name, err)
+			}
+		}
+
+		assertViolation(t, rules.CheckName("report-1.gz"), policy.REASON_EXTENSION)
+		assertViolation(t, rules.CheckName("report-3"), policy.REASON_EXTENSION)
+		assertViolation(t, rules.CheckName("invoice.pdf"), policy.REASON_NAME)
+	})
+}
+
+func TestCheckType(t *testing.T) {
+	reject := true
+	rules := policy.Rules{
+		AllowedTypes:   []string{"image/*", "text/markdown", "application/x-executable"},
+		BlockedTypes:   []string{"application/x-executable"},
+		RejectMismatch: &reject,
+	}
+
+	for _, test := range []struct{ name, detected string }{
+		{"photo.png", "image/png"},
+		{"photo", "image/png"},
+		{"notes.md", "text/plain"},
+	} {
+		if err := rules.CheckType(test.name, test.detected); err != nil {
+			t.Errorf("Expected no error for %q, got %q", test.name, err)
+		}
+	}
+
+	assertViolation(t, rules.CheckType("tool.png", "application/x-executable"), policy.REASON_BLOCKED)
+	assertViolation(t, rules.CheckType("notes.txt", "text/plain"), policy.REASON_NOT_ALLOWED)
+	assertViolation(t, rules.CheckType("payload.png", "application/octet-stream"), policy.REASON_NOT_ALLOWED)
+	assertViolation(t, rules.CheckType("photo.jpg", "image/png"), policy.REASON_MISMATCH)
+
+	err := rules.CheckType("photo.jpg", "image/png")
+	want := &policy.Violation{Reason: policy.REASON_MISMATCH, FileName: "photo.jpg", DetectedType: "image/png", ExtensionType: "image/jpeg"}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("Got %+v, want %+v", err, want)
+	}
+}
+
+func TestMaxSizeFor(t *testing.T) {
+	sizes, err := policy.ParseSizes("image/*=100, image/png=200, */*+xml=5")
+	if err == nil {
+		t.Fatal("Expected an error for */*+xml")
+	}
+
+	sizes, err = policy.ParseSizes("image/*=100, image/png=200, application/*+xml=5, video/*=1000")
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	rules := policy.Rules{MaxSize: 50, MaxSizes: sizes}
+
+	cases := []struct {
+		types []string
+		want  int64
+	}{
+		{[]string{"image/png"}, 200},
+		{[]string{"image/gif"}, 100},
+		{[]string{"image/svg+xml"}, 100},
+		{[]string{"application/atom+xml"}, 5},
+		{[]string{"text/plain", "text/markdown"}, 50},
+		{[]string{"application/zip", "video/mp4"}, 1000},
+	}
+
+	for _, test := range cases {
+		if got := rules.MaxSizeFor(test.types...); got != test.want {
+			t.Errorf("Got %d for %v, want %d", got, test.types, test.want)
+		}
+	}
+
+	for _, list := range []string{"image/*", "image/*=0", "image/*=big", "image=10"} {
+		if _, err := policy.ParseSizes(list); err == nil {
+			t.Errorf("Expected an error for %q", list)
+		}
+	}
+}
+
+func TestFor(t *testing.T) {
+	reject := false
+	base := policy.Rules{
+		AllowedTypes: []string{"image/*"},
+		MaxSize:      100,
+		MaxSizes:     map[string]int64{"image/png": 10},
+	}
+	users := map[string]policy.Rules{
+		"partner": {AllowedTypes: []string{}, MaxSize: -1, MaxSizes: map[string]int64{"video/*": 1000}, RejectMismatch: &reject},
+		"alice":   {MaxSize: 500},
+	}
+
+	p, err := policy.New(base, users)
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	t.Run("applies base rules to others", func(t *testing.T) {
+		for _, user := range []string{"", "bob"} {
+			if !reflect.DeepEqual(p.For(user), p.Rules) {
+				t.Errorf("Got %+v for %q, want the base rules", p.For(user), user)
+			}
+		}
+	})
+	t.Run("overrides base rules", func(t *testing.T) {
+		rules := p.For("partner")
+
+		if err := rules.CheckType("clip.mp4", "video/mp4"); err != nil {
+			t.Errorf("Expected an empty allow list to allow everything, got %q", err)
+		}
+		if got := rules.MaxSizeFor("application/zip"); got != 0 {
+			t.Errorf("Got max size %d, want no limit", got)
+		}
+		if got := rules.MaxSizeFor("video/mp4"); got != 1000 {
+			t.Errorf("Got max size %d, want 1000", got)
+		}
+		if got := rules.MaxSizeFor("image/png"); got != 10 {
+			t.Errorf("Got max size %d, want the base size 10", got)
+		}
+	})
+	t.Run("inherits unset rules", func(t *testing.T) {
+		rules := p.For("alice")
+
+		if rules.MaxSize != 500 {
+			t.Errorf("Got max size %d, want 500", rules.MaxSize)
+		}
+		assertViolation(t, rules.CheckType("clip.mp4", "video/mp4"), policy.REASON_NOT_ALLOWED)
+	})
+	t.Run("has no rules when nil", func(t *testing.T) {
+		var p *policy.Policy
+		if !reflect.DeepEqual(p.For("alice"), policy.Rules{}) {
+			t.Errorf("Got %+v, want no rules", p.For("alice"))
+		}
+	})
+	t.Run("rejects invalid rules", func(t *testing.T) {
+		_, err := policy.New(policy.Rules{}, map[string]policy.Rules{"alice": {BlockedTypes: []string{"image"}}})
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
+
+func TestLoadUsers(t *testing.T) {
+	dir := t.TempDir()
+
+	fileName := filepath.Join(dir, "users.yaml")
+	os.WriteFile(fileName, []byte(`
+partner:
+  allowed_types: [Image/*, application/pdf]
+  blocked_extensions: [exe]
+  max_sizes:
+    image/*: 1024
+alice:
+  allowed_types: []
+`), 0600)
+
+	users, err := policy.LoadUsers(fileName)
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	p, err := policy.New(policy.Rules{}, users)
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	want := policy.Rules{
+		AllowedTypes:      []string{"image/*", "application/pdf"},
+		BlockedExtensions: []string{".exe"},
+		MaxSizes:          map[string]int64{"image/*": 1024},
+	}
+	if got := p.Users["partner"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+	if got := p.Users["alice"].AllowedTypes; got == nil || len(got) != 0 {
+		t.Errorf("Got allowed types %#v, want an empty list", got)
+	}
+
+	t.Run("rejects unknown keys", func(t *testing.T) {
+		os.WriteFile(fileName, []byte("alice:\n  max_bytes: 10\n"), 0600)
+
+		if _, err := policy.LoadUsers(fileName); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+	t.Run("accepts empty files", func(t *testing.T) {
+		os.WriteFile(fileName, nil, 0600)
+
+		users, err := policy.LoadUsers(fileName)
+		if err != nil || len(users) != 0 {
+			t.Errorf("Got %v and %v, want no users", users, err)
+		}
+	})
+}
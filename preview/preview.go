@@ -0,0 +1,137 @@
+package preview
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// Types served inline unless configured otherwise
+const DEFAULT_INLINE_TYPES = "image/png,image/jpeg,image/gif,image/webp,image/avif,application/pdf,audio/*,video/*,text/*,application/json"
+
+// Kinds of previews, telling the share page how to embed a file
+const KIND_IMAGE = "image"
+const KIND_PDF = "pdf"
+const KIND_AUDIO = "audio"
+const KIND_VIDEO = "video"
+const KIND_TEXT = "text"
+const KIND_MARKDOWN = "markdown"
+
+// Types that browsers render as documents able to run scripts in the
+// origin of the server. They are always served as attachments, whatever
+// the policy
+var activeTypes = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	"text/xml",
+	"application/xml",
+	"text/xsl",
+}
+
+// Policy decides which types of files are served inline
+type Policy struct {
+	patterns []string
+}
+
+// ParsePolicy parses a comma-separated list of MIME types, or wildcards
+// such as image/* matching all subtypes
+func ParsePolicy(types string) (*Policy, error) {
+	policy := &Policy{}
+
+	for _, pattern := range strings.Split(types, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+
+		mainType, subType, ok := strings.Cut(pattern, "/")
+		if !ok || mainType == "" || mainType == "*" || subType == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid MIME type %q, want type/subtype or type/*", pattern))
+		}
+
+		policy.patterns = append(policy.patterns, pattern)
+	}
+
+	return policy, nil
+}
+
+// IsInline reports whether files of mimeType may be displayed by browsers
+func (p *Policy) IsInline(mimeType string) bool {
+	mediaType := mediaType(mimeType)
+	if mediaType == "" || IsActive(mediaType) {
+		return false
+	}
+
+	for _, pattern := range p.patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsActive reports whether mimeType is a document type able to run scripts
+func IsActive(mimeType string) bool {
+	mediaType := mediaType(mimeType)
+	for _, active := range activeTypes {
+		if mediaType == active {
+			return true
+		}
+	}
+	return false
+}
+
+// Kind returns the KIND_* of mimeType, or an empty string for types
+// without a preview
+func Kind(mimeType string) string {
+	mediaType := mediaType(mimeType)
+
+	switch {
+	case IsActive(mediaType):
+		return ""
+	case mediaType == "text/markdown":
+		return KIND_MARKDOWN
+	case isText(mediaType):
+		return KIND_TEXT
+	case mediaType == "application/pdf":
+		return KIND_PDF
+	case strings.HasPrefix(mediaType, "image/"):
+		return KIND_IMAGE
+	case strings.HasPrefix(mediaType, "audio/"):
+		return KIND_AUDIO
+	case strings.HasPrefix(mediaType, "video/"):
+		return KIND_VIDEO
+	default:
+		return ""
+	}
+}
+
+// ContentType returns the Content-Type of inline previews. Text and code
+// are served as plain text, so that browsers never interpret them
+func ContentType(mimeType string) string {
+	mediaType := mediaType(mimeType)
+	if isText(mediaType) {
+		return "text/plain; charset=utf-8"
+	}
+	return mediaType
+}
+
+func isText(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json"
+}
+
+// mediaType strips parameters such as charset from mimeType
+func mediaType(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
@@ -0,0 +1,79 @@
+package preview_test
+
+import (
+	"testing"
+
+	"github.com/olzhasar/go-fileserver/preview"
+)
+
+func TestPolicy(t *testing.T) {
+	policy, err := preview.ParsePolicy(preview.DEFAULT_INLINE_TYPES)
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	cases := []struct {
+		mimeType string
+		want     bool
+	}{
+		{"image/png", true},
+		{"application/pdf", true},
+		{"video/mp4", true},
+		{"text/x-go; charset=utf-8", true},
+		{"text/html; charset=utf-8", false},
+		{"image/svg+xml", false},
+		{"application/xml", false},
+		{"application/zip", false},
+		{"", false},
+	}
+
+	for _, test := range cases {
+		if got := policy.IsInline(test.mimeType); got != test.want {
+			t.Errorf("Got %v for %q, want %v", got, test.mimeType, test.want)
+		}
+	}
+
+	t.Run("never inlines active types", func(t *testing.T) {
+		policy, _ := preview.ParsePolicy("text/html, image/*")
+
+		if policy.IsInline("text/html") || policy.IsInline("image/svg+xml") {
+			t.Error("Want HTML and SVG served as attachments")
+		}
+		if !policy.IsInline("image/gif") {
+			t.Error("Want GIF served inline")
+		}
+	})
+	t.Run("rejects invalid types", func(t *testing.T) {
+		for _, types := range []string{"image", "*/*", "image/png,/png"} {
+			if _, err := preview.ParsePolicy(types); err == nil {
+				t.Errorf("Expected an error for %q", types)
+			}
+		}
+	})
+}
+
+func TestKind(t *testing.T) {
+	cases := map[string]string{
+		"image/jpeg":               preview.KIND_IMAGE,
+		"application/pdf":          preview.KIND_PDF,
+		"audio/mpeg":               preview.KIND_AUDIO,
+		"video/webm":               preview.KIND_VIDEO,
+		"text/markdown":            preview.KIND_MARKDOWN,
+		"text/javascript":          preview.KIND_TEXT,
+		"application/json":         preview.KIND_TEXT,
+		"image/svg+xml":            "",
+		"application/octet-stream": "",
+		"text/html; charset=utf-8": "",
+		"application/vnd.ms-excel": "",
+	}
+
+	for mimeType, want := range cases {
+		if got := preview.Kind(mimeType); got != want {
+			t.Errorf("Got kind %q for %q, want %q", got, mimeType, want)
+		}
+	}
+
+	if got := preview.ContentType("text/javascript; charset=utf-8"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Got %q, want code served as plain text", got)
+	}
+}
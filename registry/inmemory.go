@@ -1,33 +1,432 @@
 package registry
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InMemoryRegistry is safe for concurrent use
 type InMemoryRegistry struct {
-	data map[string]string
+	mu          sync.RWMutex
+	data        map[string]string
+	protections map[string]Protection
+	metadata    map[string]Metadata
+	apiKeys     map[string]APIKey
+	// seqs orders files for List, like the id column of SQLiteRegistry
+	seqs    map[string]int64
+	lastSeq int64
 }
 
-func (r *InMemoryRegistry) Record(token, fileName string) error {
+func (r *InMemoryRegistry) Record(ctx context.Context, token, fileName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	r.data[token] = fileName
+	r.metadata[token] = Metadata{CreatedAt: time.Now()}
+	r.lastSeq++
+	r.seqs[token] = r.lastSeq
 	return nil
 }
 
-func (r *InMemoryRegistry) Get(token string) (fileName string, ok bool) {
+func (r *InMemoryRegistry) Get(ctx context.Context, token string) (fileName string, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	val, ok := r.data[token]
 	return val, ok
 }
 
-func (r *InMemoryRegistry) Has(fileName string) bool {
-	_, ok := r.data[fileName]
+func (r *InMemoryRegistry) Has(ctx context.Context, token string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.has(token)
+}
+
+func (r *InMemoryRegistry) has(token string) bool {
+	_, ok := r.data[token]
 	return ok
 }
 
+func (r *InMemoryRegistry) Delete(ctx context.Context, token string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.has(token) {
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+	delete(r.data, token)
+	delete(r.protections, token)
+	delete(r.metadata, token)
+	delete(r.seqs, token)
+	return nil
+}
+
+func (r *InMemoryRegistry) SetPassword(ctx context.Context, token, passwordHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.has(token) {
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+	p := r.protections[token]
+	p.PasswordHash = passwordHash
+	r.protections[token] = p
+	return nil
+}
+
+func (r *InMemoryRegistry) SetPrivate(ctx context.Context, token string, private bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.has(token) {
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+	p := r.protections[token]
+	p.Private = private
+	r.protections[token] = p
+	return nil
+}
+
+func (r *InMemoryRegistry) GetProtection(ctx context.Context, token string) (Protection, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if !r.has(token) {
+		return Protection{}, false
+	}
+	return r.protections[token], true
+}
+
+func (r *InMemoryRegistry) RecordFailedAttempt(ctx context.Context, token string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.has(token) {
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+	p := r.protections[token]
+	p.FailedAttempts++
+	p.LastFailedAt = at
+	r.protections[token] = p
+	return nil
+}
+
+func (r *InMemoryRegistry) ResetFailedAttempts(ctx context.Context, token string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.has(token) {
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+	p := r.protections[token]
+	p.FailedAttempts = 0
+	p.LastFailedAt = time.Time{}
+	r.protections[token] = p
+	return nil
+}
+
+func (r *InMemoryRegistry) SetUploader(ctx context.Context, token, uploader string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.has(token) {
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+	m := r.metadata[token]
+	m.Uploader = uploader
+	r.metadata[token] = m
+	return nil
+}
+
+func (r *InMemoryRegistry) SetSize(ctx context.Context, token string, size int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.has(token) {
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+	m := r.metadata[token]
+	m.Size = size
+	r.metadata[token] = m
+	return nil
+}
+
+func (r *InMemoryRegistry) GetUsage(ctx context.Context, uploader string) (Usage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var usage Usage
+	for token := range r.data {
+		m := r.metadata[token]
+		if m.Uploader == uploader {
+			usage.Files++
+			usage.Bytes += m.Size
+		}
+	}
+	return usage, nil
+}
+
+func (r *InMemoryRegistry) GetTotalUsage(ctx context.Context) (Usage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var usage Usage
+	for token := range r.data {
+		usage.Files++
+		usage.Bytes += r.metadata[token].Size
+	}
+	return usage, nil
+}
+
+func (r *InMemoryRegistry) ListUsage(ctx context.Context) ([]UploaderUsage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	byUploader := make(map[string]Usage)
+	for token := range r.data {
+		m := r.metadata[token]
+		if m.Uploader == "" {
+			continue
+		}
+		usage := byUploader[m.Uploader]
+		usage.Files++
+		usage.Bytes += m.Size
+		byUploader[m.Uploader] = usage
+	}
+
+	usages := make([]UploaderUsage, 0, len(byUploader))
+	for uploader, usage := range byUploader {
+		usages = append(usages, UploaderUsage{uploader, usage})
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Uploader < usages[j].Uploader
+	})
+	return usages, nil
+}
+
+func (r *InMemoryRegistry) SetExpiry(ctx context.Context, token string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.has(token) {
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+	p := r.protections[token]
+	p.ExpiresAt = at
+	r.protections[token] = p
+	return nil
+}
+
+func (r *InMemoryRegistry) SetBlocked(ctx context.Context, token string, blocked bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.has(token) {
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+	p := r.protections[token]
+	p.Blocked = blocked
+	r.protections[token] = p
+	return nil
+}
+
+func (r *InMemoryRegistry) SetScanResult(ctx context.Context, token, status, signature string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.has(token) {
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+	p := r.protections[token]
+	p.ScanStatus = status
+	p.ScanSignature = signature
+	r.protections[token] = p
+	return nil
+}
+
+func (r *InMemoryRegistry) SetMimeType(ctx context.Context, token, mimeType string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.has(token) {
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+	m := r.metadata[token]
+	m.MimeType = mimeType
+	r.metadata[token] = m
+	return nil
+}
+
+func (r *InMemoryRegistry) SetStorageKey(ctx context.Context, token, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.has(token) {
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+	m := r.metadata[token]
+	m.StorageKey = key
+	r.metadata[token] = m
+	return nil
+}
+
+func (r *InMemoryRegistry) List(ctx context.Context, query ListQuery) (ListPage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	err := query.Validate()
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	after, err := decodeCursor(query)
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	var files []File
+	for token, fileName := range r.data {
+		p := r.protections[token]
+		file := File{
+			Token:         token,
+			FileName:      fileName,
+			Private:       p.Private,
+			Protected:     p.IsProtected(),
+			Blocked:       p.Blocked,
+			ExpiresAt:     p.ExpiresAt,
+			ScanStatus:    p.ScanStatus,
+			ScanSignature: p.ScanSignature,
+			Metadata:      r.metadataOf(token),
+		}
+
+		if !query.matches(file) {
+			continue
+		}
+		if after != nil && query.compare(positionOf(query, file, r.seqs[token]), after.position()) <= 0 {
+			continue
+		}
+
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return query.compare(r.position(query, files[i]), r.position(query, files[j])) < 0
+	})
+
+	var page ListPage
+	limit := query.pageLimit()
+	if len(files) > limit {
+		files = files[:limit]
+		page.NextCursor = newCursor(query, r.position(query, files[limit-1]))
+	}
+	page.Files = files
+
+	return page, nil
+}
+
+func (r *InMemoryRegistry) position(query ListQuery, file File) position {
+	return positionOf(query, file, r.seqs[file.Token])
+}
+
+func (r *InMemoryRegistry) GetMetadata(ctx context.Context, token string) (Metadata, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if !r.has(token) {
+		return Metadata{}, false
+	}
+	return r.metadataOf(token), true
+}
+
+// metadataOf falls back to the file name for the storage key, like
+// SQLiteRegistry does for files recorded before keys were
+func (r *InMemoryRegistry) metadataOf(token string) Metadata {
+	m := r.metadata[token]
+	if m.StorageKey == "" {
+		m.StorageKey = r.data[token]
+	}
+	return m
+}
+
+func (r *InMemoryRegistry) RecordAPIKey(ctx context.Context, key APIKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.apiKeys[key.ID]; ok {
+		return errors.New(fmt.Sprintf("API key %q already exists", key.ID))
+	}
+	r.apiKeys[key.ID] = key
+	return nil
+}
+
+func (r *InMemoryRegistry) GetAPIKey(ctx context.Context, id string) (APIKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, ok := r.apiKeys[id]
+	return key, ok
+}
+
+func (r *InMemoryRegistry) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(r.apiKeys))
+	for _, key := range r.apiKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (r *InMemoryRegistry) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, ok := r.apiKeys[id]
+	if !ok {
+		return errors.New(fmt.Sprintf("API key %q not found", id))
+	}
+	key.RevokedAt = at
+	r.apiKeys[id] = key
+	return nil
+}
+
 func (r *InMemoryRegistry) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	for key := range r.data {
 		delete(r.data, key)
 	}
+	for key := range r.protections {
+		delete(r.protections, key)
+	}
+	for key := range r.metadata {
+		delete(r.metadata, key)
+	}
+	for key := range r.apiKeys {
+		delete(r.apiKeys, key)
+	}
+	for key := range r.seqs {
+		delete(r.seqs, key)
+	}
 }
 
 func (r *InMemoryRegistry) Close() {}
 
 func NewInMemoryRegistry() Registry {
 	data := make(map[string]string)
-	return &InMemoryRegistry{data}
+	protections := make(map[string]Protection)
+	metadata := make(map[string]Metadata)
+	apiKeys := make(map[string]APIKey)
+	seqs := make(map[string]int64)
+	return &InMemoryRegistry{data: data, protections: protections, metadata: metadata, apiKeys: apiKeys, seqs: seqs}
 }
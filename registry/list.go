@@ -0,0 +1,261 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_LIST_LIMIT = 50
+const MAX_LIST_LIMIT = 1000
+
+// Files are listed by one of these keys, ties are broken by recording order
+const SORT_CREATED = "created"
+const SORT_NAME = "name"
+const SORT_SIZE = "size"
+const SORT_EXPIRES = "expires"
+
+const ORDER_ASC = "asc"
+const ORDER_DESC = "desc"
+
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// Validate checks the sort key and the ranges of query
+func (q ListQuery) Validate() error {
+	switch q.Sort {
+	case "", SORT_CREATED, SORT_NAME, SORT_SIZE, SORT_EXPIRES:
+	default:
+		return errors.New(fmt.Sprintf("Unknown sort key %q", q.Sort))
+	}
+
+	switch q.ScanStatus {
+	case "", SCAN_PENDING, SCAN_CLEAN, SCAN_INFECTED:
+	default:
+		return errors.New(fmt.Sprintf("Unknown scan status %q", q.ScanStatus))
+	}
+
+	if q.Limit < 0 {
+		return errors.New("Limit must not be negative")
+	}
+	if q.MinSize < 0 || q.MaxSize < 0 || q.MaxSize != 0 && q.MinSize > q.MaxSize {
+		return errors.New("Invalid size range")
+	}
+
+	return nil
+}
+
+func (q ListQuery) sortKey() string {
+	if q.Sort == "" {
+		return SORT_CREATED
+	}
+	return q.Sort
+}
+
+// pageLimit returns the page size requested by query
+func (q ListQuery) pageLimit() int {
+	switch {
+	case q.Limit <= 0:
+		return DEFAULT_LIST_LIMIT
+	case q.Limit > MAX_LIST_LIMIT:
+		return MAX_LIST_LIMIT
+	default:
+		return q.Limit
+	}
+}
+
+// matches applies the filters of query to file, for backends without a
+// query language
+func (q ListQuery) matches(file File) bool {
+	switch {
+	case q.Uploader != "" && file.Uploader != q.Uploader:
+		return false
+	case q.NameContains != "" && !strings.Contains(strings.ToLower(file.FileName), strings.ToLower(q.NameContains)):
+		return false
+	case q.MimeType != "" && !matchesMimeType(file.MimeType, q.MimeType):
+		return false
+	case file.Size < q.MinSize || q.MaxSize != 0 && file.Size > q.MaxSize:
+		return false
+	case !q.CreatedAfter.IsZero() && file.CreatedAt.Before(q.CreatedAfter):
+		return false
+	case !q.CreatedBefore.IsZero() && !file.CreatedAt.Before(q.CreatedBefore):
+		return false
+	case !q.ExpiresAfter.IsZero() && (file.ExpiresAt.IsZero() || file.ExpiresAt.Before(q.ExpiresAfter)):
+		return false
+	case !q.ExpiresBefore.IsZero() && (file.ExpiresAt.IsZero() || !file.ExpiresAt.Before(q.ExpiresBefore)):
+		return false
+	case q.ScanStatus != "" && file.ScanStatus != q.ScanStatus:
+		return false
+	}
+	return true
+}
+
+// matchesMimeType matches exact types and wildcards such as image/*
+func matchesMimeType(mimeType, pattern string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mimeType, prefix+"/")
+	}
+	return mimeType == pattern
+}
+
+// cursor is the position after the last file of a page: its sort key value
+// and sequence number. Cursors are only valid for the sort they were
+// created with
+type cursor struct {
+	Sort      string `json:"s"`
+	Ascending bool   `json:"a,omitempty"`
+	Number    int64  `json:"n,omitempty"`
+	Text      string `json:"t,omitempty"`
+	Seq       int64  `json:"i"`
+}
+
+// newCursor encodes the position of the last file of a page
+func newCursor(query ListQuery, last position) string {
+	c := cursor{Sort: query.sortKey(), Ascending: query.Ascending, Number: last.number, Text: last.text, Seq: last.seq}
+
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// decodeCursor returns nil for the empty cursor of the first page
+func decodeCursor(query ListQuery) (*cursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c cursor
+	err = json.Unmarshal(decoded, &c)
+	if err != nil || c.Seq <= 0 || c.Sort != query.sortKey() || c.Ascending != query.Ascending {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// ParseListQuery reads a ListQuery from URL query params: uploader, name,
+// mime_type, min_size, max_size, created_after, created_before,
+// expires_after, expires_before (RFC 3339), scan_status, sort, order (asc
+// or desc), cursor and limit. Files are sorted by name in ascending order and by
+// other keys in descending order unless order is set
+func ParseListQuery(values url.Values) (ListQuery, error) {
+	query := ListQuery{
+		Uploader:     values.Get("uploader"),
+		NameContains: values.Get("name"),
+		MimeType:     values.Get("mime_type"),
+		ScanStatus:   values.Get("scan_status"),
+		Sort:         values.Get("sort"),
+		Cursor:       values.Get("cursor"),
+	}
+
+	var errs []error
+
+	parseInt := func(name string, dest *int64) {
+		if value := values.Get(name); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				errs = append(errs, errors.New(fmt.Sprintf("Invalid %s %q", name, value)))
+			}
+			*dest = parsed
+		}
+	}
+	parseTime := func(name string, dest *time.Time) {
+		if value := values.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				errs = append(errs, errors.New(fmt.Sprintf("Invalid %s %q, want an RFC 3339 time", name, value)))
+			}
+			*dest = parsed
+		}
+	}
+
+	var limit int64
+	parseInt("limit", &limit)
+	query.Limit = int(min(limit, MAX_LIST_LIMIT))
+
+	parseInt("min_size", &query.MinSize)
+	parseInt("max_size", &query.MaxSize)
+	parseTime("created_after", &query.CreatedAfter)
+	parseTime("created_before", &query.CreatedBefore)
+	parseTime("expires_after", &query.ExpiresAfter)
+	parseTime("expires_before", &query.ExpiresBefore)
+
+	switch values.Get("order") {
+	case "":
+		query.Ascending = query.Sort == SORT_NAME
+	case ORDER_ASC:
+		query.Ascending = true
+	case ORDER_DESC:
+	default:
+		errs = append(errs, errors.New(fmt.Sprintf("Invalid order %q, want asc or desc", values.Get("order"))))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return ListQuery{}, err
+	}
+
+	return query, query.Validate()
+}
+
+// position orders files by a sort key value, either number or text, then by
+// sequence number
+type position struct {
+	number int64
+	text   string
+	seq    int64
+}
+
+func positionOf(query ListQuery, file File, seq int64) position {
+	switch query.sortKey() {
+	case SORT_NAME:
+		return position{text: file.FileName, seq: seq}
+	case SORT_SIZE:
+		return position{number: file.Size, seq: seq}
+	case SORT_EXPIRES:
+		return position{number: unixNanoOrZero(file.ExpiresAt), seq: seq}
+	default:
+		return position{seq: seq}
+	}
+}
+
+func (c *cursor) position() position {
+	return position{number: c.Number, text: c.Text, seq: c.Seq}
+}
+
+// compare returns a negative number if a comes before b in the order of
+// query
+func (q ListQuery) compare(a, b position) int {
+	result := 0
+	switch {
+	case a.number != b.number:
+		result = cmpInt(a.number, b.number)
+	case a.text != b.text:
+		result = strings.Compare(a.text, b.text)
+	default:
+		result = cmpInt(a.seq, b.seq)
+	}
+
+	if !q.Ascending {
+		return -result
+	}
+	return result
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
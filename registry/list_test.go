@@ -0,0 +1,66 @@
+package registry_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/registry"
+)
+
+func TestParseListQuery(t *testing.T) {
+	t.Run("parses filters, sort and paging", func(t *testing.T) {
+		values, _ := url.ParseQuery("uploader=alice&name=report&mime_type=image/*&min_size=10&max_size=2000" +
+			"&created_after=2024-01-01T00:00:00Z&expires_before=2024-02-01T00:00:00Z&scan_status=infected&sort=size&order=asc&cursor=abc&limit=5000")
+
+		got, err := registry.ParseListQuery(values)
+		if err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		want := registry.ListQuery{
+			Uploader:      "alice",
+			NameContains:  "report",
+			MimeType:      "image/*",
+			MinSize:       10,
+			MaxSize:       2000,
+			CreatedAfter:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			ExpiresBefore: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+			ScanStatus:    registry.SCAN_INFECTED,
+			Sort:          registry.SORT_SIZE,
+			Ascending:     true,
+			Cursor:        "abc",
+			Limit:         registry.MAX_LIST_LIMIT,
+		}
+		if got != want {
+			t.Errorf("Got %+v, want %+v", got, want)
+		}
+	})
+	t.Run("sorts names in ascending order by default", func(t *testing.T) {
+		got, _ := registry.ParseListQuery(url.Values{"sort": {"name"}})
+		if !got.Ascending {
+			t.Error("Want ascending order")
+		}
+
+		got, _ = registry.ParseListQuery(url.Values{"sort": {"name"}, "order": {"desc"}})
+		if got.Ascending {
+			t.Error("Want descending order")
+		}
+	})
+	t.Run("rejects invalid values", func(t *testing.T) {
+		for _, query := range []string{
+			"sort=owner",
+			"order=random",
+			"limit=ten",
+			"limit=-1",
+			"min_size=100&max_size=10",
+			"created_before=yesterday",
+			"scan_status=dirty",
+		} {
+			values, _ := url.ParseQuery(query)
+			if _, err := registry.ParseListQuery(values); err == nil {
+				t.Errorf("Expected an error for %s", query)
+			}
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"context"
 	"math/rand"
 )
 
@@ -17,14 +18,14 @@ func GenerateUniqueToken() string {
 	return string(letters)
 }
 
-func RecordFile(r Registry, fileName string, generateToken func() string) (token string, err error) {
+func RecordFile(ctx context.Context, r Registry, fileName string, generateToken func() string) (token string, err error) {
 	token = generateToken()
 
-	for r.Has(token) {
+	for r.Has(ctx, token) {
 		token = generateToken()
 	}
 	// todo - use mutex to make this thread-safe
-	err = r.Record(token, fileName)
+	err = r.Record(ctx, token, fileName)
 	if err != nil {
 		return "", err
 	}
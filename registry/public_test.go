@@ -1,6 +1,7 @@
 package registry_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/olzhasar/go-fileserver/registry"
@@ -34,7 +35,7 @@ func TestRecordFile(t *testing.T) {
 
 		fileName := "test.txt"
 
-		token, err := registry.RecordFile(reg, fileName, registry.GenerateUniqueToken)
+		token, err := registry.RecordFile(context.Background(), reg, fileName, registry.GenerateUniqueToken)
 
 		if err != nil {
 			t.Fatalf("Error returned while trying to record file\n%q", err)
@@ -60,8 +61,8 @@ func TestRecordFile(t *testing.T) {
 			return token_b
 		}
 
-		registry.RecordFile(reg, fileNameExisting, gen)
-		token, err := registry.RecordFile(reg, fileName, gen)
+		registry.RecordFile(context.Background(), reg, fileNameExisting, gen)
+		token, err := registry.RecordFile(context.Background(), reg, fileName, gen)
 
 		if err != nil {
 			t.Fatalf("Error returned while trying to record file\n%q", err)
@@ -77,7 +78,7 @@ func TestRecordFile(t *testing.T) {
 }
 
 func assertFileSavedUnderToken(t testing.TB, r registry.Registry, token, fileName string) {
-	got, ok := r.Get(token)
+	got, ok := r.Get(context.Background(), token)
 
 	if !ok {
 		t.Fatalf("Token %q has not been saved to registry", token)
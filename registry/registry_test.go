@@ -1,8 +1,15 @@
 package registry_test
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/olzhasar/go-fileserver/registry"
 )
@@ -42,13 +49,13 @@ func TestRegistries(t *testing.T) {
 			fileName := "test.txt"
 			token := "123456"
 
-			err := reg.Record(token, fileName)
+			err := reg.Record(context.Background(), token, fileName)
 
 			if err != nil {
 				t.Fatalf("Expected no error, got %q", err)
 			}
 
-			got, ok := reg.Get(token)
+			got, ok := reg.Get(context.Background(), token)
 
 			if !ok {
 				t.Errorf("Want %q to be in registry, but it's not", token)
@@ -62,7 +69,7 @@ func TestRegistries(t *testing.T) {
 			reg := test.createRegistry()
 			defer teardownRegistry(reg)
 
-			got, ok := reg.Get("123456")
+			got, ok := reg.Get(context.Background(), "123456")
 
 			if ok {
 				t.Error("Got ok true, want false")
@@ -77,17 +84,702 @@ func TestRegistries(t *testing.T) {
 			defer teardownRegistry(reg)
 
 			existing_token := "123456"
-			reg.Record(existing_token, "file.txt")
+			reg.Record(context.Background(), existing_token, "file.txt")
 
 			nonexistent_token := "987654"
 
-			if !reg.Has(existing_token) {
+			if !reg.Has(context.Background(), existing_token) {
 				t.Errorf("Want %q to be in registry, but it's not", existing_token)
 			}
 
-			if reg.Has(nonexistent_token) {
+			if reg.Has(context.Background(), nonexistent_token) {
 				t.Errorf("Token %q should not be in registry, but it is", nonexistent_token)
 			}
 		})
+		t.Run(fmt.Sprintf("%s:stores password protection", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			token := "123456"
+			reg.Record(context.Background(), token, "file.txt")
+
+			protection, ok := reg.GetProtection(context.Background(), token)
+			if !ok {
+				t.Fatalf("Want protection for %q, got none", token)
+			}
+			if protection.IsProtected() {
+				t.Errorf("Want file to be unprotected by default")
+			}
+
+			err := reg.SetPassword(context.Background(), token, "hash")
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			protection, _ = reg.GetProtection(context.Background(), token)
+			if protection.PasswordHash != "hash" {
+				t.Errorf("Got password hash %q, want %q", protection.PasswordHash, "hash")
+			}
+		})
+		t.Run(fmt.Sprintf("%s:stores private flag", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			token := "123456"
+			reg.Record(context.Background(), token, "file.txt")
+
+			err := reg.SetPrivate(context.Background(), token, true)
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			protection, _ := reg.GetProtection(context.Background(), token)
+			if !protection.Private {
+				t.Error("Want file to be private, but it's not")
+			}
+		})
+		t.Run(fmt.Sprintf("%s:tracks failed attempts", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			token := "123456"
+			reg.Record(context.Background(), token, "file.txt")
+
+			at := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+			reg.RecordFailedAttempt(context.Background(), token, at.Add(-time.Second))
+			reg.RecordFailedAttempt(context.Background(), token, at)
+
+			protection, _ := reg.GetProtection(context.Background(), token)
+			if protection.FailedAttempts != 2 {
+				t.Errorf("Got %d failed attempts, want 2", protection.FailedAttempts)
+			}
+			if !protection.LastFailedAt.Equal(at) {
+				t.Errorf("Got last failed at %v, want %v", protection.LastFailedAt, at)
+			}
+
+			reg.ResetFailedAttempts(context.Background(), token)
+
+			protection, _ = reg.GetProtection(context.Background(), token)
+			if protection.FailedAttempts != 0 {
+				t.Errorf("Got %d failed attempts after reset, want 0", protection.FailedAttempts)
+			}
+		})
+		t.Run(fmt.Sprintf("%s:stores uploader", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			token := "123456"
+			reg.Record(context.Background(), token, "file.txt")
+
+			err := reg.SetUploader(context.Background(), token, "alice")
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			metadata, ok := reg.GetMetadata(context.Background(), token)
+			if !ok {
+				t.Fatalf("Want metadata for %q, got none", token)
+			}
+			if metadata.Uploader != "alice" {
+				t.Errorf("Got uploader %q, want %q", metadata.Uploader, "alice")
+			}
+		})
+		t.Run(fmt.Sprintf("%s:deletes records", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			token := "123456"
+			reg.Record(context.Background(), token, "file.txt")
+
+			if err := reg.Delete(context.Background(), token); err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			if reg.Has(context.Background(), token) {
+				t.Errorf("Token %q should not be in registry, but it is", token)
+			}
+
+			if err := reg.Delete(context.Background(), token); err == nil {
+				t.Error("Got nil, want error for unknown token")
+			}
+		})
+		t.Run(fmt.Sprintf("%s:sums up usage", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			files := []struct {
+				token    string
+				uploader string
+				size     int64
+			}{
+				{"aaaaaa", "alice", 100},
+				{"bbbbbb", "alice", 50},
+				{"cccccc", "bob", 10},
+			}
+
+			for _, file := range files {
+				reg.Record(context.Background(), file.token, file.token+".txt")
+				reg.SetUploader(context.Background(), file.token, file.uploader)
+				reg.SetSize(context.Background(), file.token, file.size)
+			}
+
+			metadata, _ := reg.GetMetadata(context.Background(), "aaaaaa")
+			if metadata.Size != 100 {
+				t.Errorf("Got size %d, want 100", metadata.Size)
+			}
+
+			usage, err := reg.GetUsage(context.Background(), "alice")
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+			if usage != (registry.Usage{Files: 2, Bytes: 150}) {
+				t.Errorf("Got usage %+v for alice", usage)
+			}
+
+			usage, _ = reg.GetUsage(context.Background(), "carol")
+			if usage != (registry.Usage{}) {
+				t.Errorf("Got usage %+v for carol, want none", usage)
+			}
+
+			usage, err = reg.GetTotalUsage(context.Background())
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+			if usage != (registry.Usage{Files: 3, Bytes: 160}) {
+				t.Errorf("Got total usage %+v", usage)
+			}
+		})
+		t.Run(fmt.Sprintf("%s:stores API keys", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			createdAt := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+			first := registry.APIKey{ID: "aaaa", Name: "alice", Hash: "hash-a", Scopes: []string{"upload", "admin"}, CreatedAt: createdAt}
+			second := registry.APIKey{ID: "bbbb", Name: "bob", Hash: "hash-b", CreatedAt: createdAt.Add(time.Second)}
+
+			if err := reg.RecordAPIKey(context.Background(), first); err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+			reg.RecordAPIKey(context.Background(), second)
+
+			if err := reg.RecordAPIKey(context.Background(), first); err == nil {
+				t.Error("Got nil, want error for duplicate key id")
+			}
+
+			got, ok := reg.GetAPIKey(context.Background(), "aaaa")
+			if !ok {
+				t.Fatal("Want key to be in registry, but it's not")
+			}
+			if got.Name != "alice" || got.Hash != "hash-a" || !reflect.DeepEqual(got.Scopes, first.Scopes) || !got.CreatedAt.Equal(createdAt) {
+				t.Errorf("Got key %+v, want %+v", got, first)
+			}
+
+			keys, err := reg.ListAPIKeys(context.Background())
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+			if len(keys) != 2 || keys[0].ID != "aaaa" || keys[1].ID != "bbbb" {
+				t.Errorf("Got keys %+v", keys)
+			}
+
+			if err := reg.RevokeAPIKey(context.Background(), "bbbb", createdAt.Add(time.Hour)); err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			got, _ = reg.GetAPIKey(context.Background(), "bbbb")
+			if !got.IsRevoked() {
+				t.Error("Want key to be revoked, but it's not")
+			}
+
+			if err := reg.RevokeAPIKey(context.Background(), "cccc", createdAt); err == nil {
+				t.Error("Got nil, want error for unknown key")
+			}
+			if _, ok := reg.GetAPIKey(context.Background(), "cccc"); ok {
+				t.Error("Got ok true, want false")
+			}
+		})
+		t.Run(fmt.Sprintf("%s:lists usage per uploader", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			for i, uploader := range []string{"bob", "alice", "alice", ""} {
+				token := fmt.Sprintf("token%d", i)
+				reg.Record(context.Background(), token, token+".txt")
+				reg.SetUploader(context.Background(), token, uploader)
+				reg.SetSize(context.Background(), token, 10)
+			}
+
+			usages, err := reg.ListUsage(context.Background())
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			want := []registry.UploaderUsage{
+				{Uploader: "alice", Usage: registry.Usage{Files: 2, Bytes: 20}},
+				{Uploader: "bob", Usage: registry.Usage{Files: 1, Bytes: 10}},
+			}
+			if !reflect.DeepEqual(usages, want) {
+				t.Errorf("Got %+v, want %+v", usages, want)
+			}
+		})
+		t.Run(fmt.Sprintf("%s:stores expiry and blocked flag", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			token := "123456"
+			reg.Record(context.Background(), token, "file.txt")
+
+			expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+			if err := reg.SetExpiry(context.Background(), token, expiresAt); err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+			if err := reg.SetBlocked(context.Background(), token, true); err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			protection, _ := reg.GetProtection(context.Background(), token)
+			if !protection.Blocked || !protection.ExpiresAt.Equal(expiresAt) {
+				t.Errorf("Got %+v, want blocked file expiring at %v", protection, expiresAt)
+			}
+			if protection.IsExpired(expiresAt.Add(-time.Second)) || !protection.IsExpired(expiresAt) {
+				t.Errorf("Want file to expire at %v", expiresAt)
+			}
+
+			reg.SetExpiry(context.Background(), token, time.Time{})
+			reg.SetBlocked(context.Background(), token, false)
+
+			protection, _ = reg.GetProtection(context.Background(), token)
+			if protection.Blocked || !protection.ExpiresAt.IsZero() {
+				t.Errorf("Got %+v, want unblocked file without expiry", protection)
+			}
+
+			if err := reg.SetBlocked(context.Background(), "987654", true); err == nil {
+				t.Error("Got nil, want error for unknown token")
+			}
+		})
+		t.Run(fmt.Sprintf("%s:stores scan results", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			token := "123456"
+			reg.Record(context.Background(), token, "file.txt")
+
+			protection, _ := reg.GetProtection(context.Background(), token)
+			if protection.ScanStatus != "" {
+				t.Errorf("Got scan status %q, want none", protection.ScanStatus)
+			}
+
+			if err := reg.SetScanResult(context.Background(), token, registry.SCAN_INFECTED, "Eicar-Signature"); err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			protection, _ = reg.GetProtection(context.Background(), token)
+			if protection.ScanStatus != registry.SCAN_INFECTED || protection.ScanSignature != "Eicar-Signature" {
+				t.Errorf("Got %+v, want an infected file", protection)
+			}
+
+			if err := reg.SetScanResult(context.Background(), "987654", registry.SCAN_CLEAN, ""); err == nil {
+				t.Error("Got nil, want error for unknown token")
+			}
+		})
+		t.Run(fmt.Sprintf("%s:stores storage keys", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			reg.Record(context.Background(), "123456", "file.txt")
+			reg.Record(context.Background(), "654321", "file.txt")
+
+			if err := reg.SetStorageKey(context.Background(), "654321", "654321"); err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			// Files without a key are stored under their name
+			want := map[string]string{"123456": "file.txt", "654321": "654321"}
+
+			for token, key := range want {
+				metadata, _ := reg.GetMetadata(context.Background(), token)
+				if metadata.StorageKey != key {
+					t.Errorf("Got key %q for %s, want %q", metadata.StorageKey, token, key)
+				}
+			}
+
+			page, _ := reg.List(context.Background(), registry.ListQuery{})
+			for _, file := range page.Files {
+				if file.StorageKey != want[file.Token] {
+					t.Errorf("Got listed key %q for %s, want %q", file.StorageKey, file.Token, want[file.Token])
+				}
+			}
+
+			if err := reg.SetStorageKey(context.Background(), "987654", "987654"); err == nil {
+				t.Error("Got nil, want error for unknown token")
+			}
+		})
+		t.Run(fmt.Sprintf("%s:lists files newest first", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			before := time.Now()
+			for i := 0; i < 5; i++ {
+				token := fmt.Sprintf("token%d", i)
+				reg.Record(context.Background(), token, token+".txt")
+			}
+			reg.SetUploader(context.Background(), "token3", "alice")
+			reg.SetSize(context.Background(), "token3", 42)
+			reg.SetPassword(context.Background(), "token3", "hash")
+
+			var tokens []string
+			query := registry.ListQuery{Limit: 2}
+			for pages := 0; ; pages++ {
+				page, err := reg.List(context.Background(), query)
+				if err != nil {
+					t.Fatalf("Expected no error, got %q", err)
+				}
+				if len(page.Files) > 2 || pages > 3 {
+					t.Fatalf("Got %d files on page %d, want pages of at most 2", len(page.Files), pages)
+				}
+				for _, file := range page.Files {
+					tokens = append(tokens, file.Token)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				query.Cursor = page.NextCursor
+			}
+
+			want := []string{"token4", "token3", "token2", "token1", "token0"}
+			if !reflect.DeepEqual(tokens, want) {
+				t.Errorf("Got %v, want %v", tokens, want)
+			}
+
+			page, _ := reg.List(context.Background(), registry.ListQuery{Uploader: "alice"})
+			if len(page.Files) != 1 {
+				t.Fatalf("Got %+v, want the file of alice", page.Files)
+			}
+
+			file := page.Files[0]
+			if file.Token != "token3" || file.FileName != "token3.txt" || file.Size != 42 || !file.Protected || file.CreatedAt.Before(before.Truncate(time.Second)) {
+				t.Errorf("Got %+v", file)
+			}
+
+			if _, err := reg.List(context.Background(), registry.ListQuery{Cursor: "???"}); err != registry.ErrInvalidCursor {
+				t.Errorf("Got %v, want ErrInvalidCursor", err)
+			}
+		})
+		t.Run(fmt.Sprintf("%s:filters listed files", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			now := time.Now()
+			reg.Record(context.Background(), "aaaaaa", "Report.PDF")
+			reg.Record(context.Background(), "bbbbbb", "photo.jpg")
+			reg.Record(context.Background(), "cccccc", "report-draft.txt")
+			reg.SetExpiry(context.Background(), "bbbbbb", now.Add(-time.Minute))
+			reg.SetExpiry(context.Background(), "cccccc", now.Add(time.Hour))
+			reg.SetScanResult(context.Background(), "bbbbbb", registry.SCAN_INFECTED, "Eicar-Signature")
+			reg.SetScanResult(context.Background(), "dddddd", registry.SCAN_PENDING, "")
+
+			cases := []struct {
+				name  string
+				query registry.ListQuery
+				want  []string
+			}{
+				{"name substring", registry.ListQuery{NameContains: "report"}, []string{"cccccc", "aaaaaa"}},
+				{"expired", registry.ListQuery{ExpiresBefore: now}, []string{"bbbbbb"}},
+				{"combined", registry.ListQuery{NameContains: "report", ExpiresBefore: now}, nil},
+			}
+
+			for _, c := range cases {
+				page, err := reg.List(context.Background(), c.query)
+				if err != nil {
+					t.Fatalf("Expected no error, got %q", err)
+				}
+
+				var tokens []string
+				for _, file := range page.Files {
+					tokens = append(tokens, file.Token)
+				}
+				if !reflect.DeepEqual(tokens, c.want) {
+					t.Errorf("%s: got %v, want %v", c.name, tokens, c.want)
+				}
+			}
+		})
+		t.Run(fmt.Sprintf("%s:sorts listed files across pages", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			expiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+			files := []struct {
+				token   string
+				name    string
+				size    int64
+				expires time.Duration
+			}{
+				{"aaaaaa", "b.txt", 30, time.Hour},
+				{"bbbbbb", "a.txt", 10, 0},
+				{"cccccc", "c.txt", 30, time.Hour},
+				{"dddddd", "a.txt", 20, time.Minute},
+			}
+			for _, file := range files {
+				reg.Record(context.Background(), file.token, file.name)
+				reg.SetSize(context.Background(), file.token, file.size)
+				if file.expires != 0 {
+					reg.SetExpiry(context.Background(), file.token, expiry.Add(file.expires))
+				}
+			}
+
+			cases := []struct {
+				sort      string
+				ascending bool
+				want      []string
+			}{
+				{registry.SORT_CREATED, false, []string{"dddddd", "cccccc", "bbbbbb", "aaaaaa"}},
+				{registry.SORT_CREATED, true, []string{"aaaaaa", "bbbbbb", "cccccc", "dddddd"}},
+				{registry.SORT_NAME, true, []string{"bbbbbb", "dddddd", "aaaaaa", "cccccc"}},
+				{registry.SORT_NAME, false, []string{"cccccc", "aaaaaa", "dddddd", "bbbbbb"}},
+				{registry.SORT_SIZE, false, []string{"cccccc", "aaaaaa", "dddddd", "bbbbbb"}},
+				{registry.SORT_SIZE, true, []string{"bbbbbb", "dddddd", "aaaaaa", "cccccc"}},
+				{registry.SORT_EXPIRES, true, []string{"bbbbbb", "dddddd", "aaaaaa", "cccccc"}},
+			}
+
+			for _, c := range cases {
+				var tokens []string
+				query := registry.ListQuery{Sort: c.sort, Ascending: c.ascending, Limit: 1}
+				for pages := 0; pages < len(files)+1; pages++ {
+					page, err := reg.List(context.Background(), query)
+					if err != nil {
+						t.Fatalf("Expected no error, got %q", err)
+					}
+					for _, file := range page.Files {
+						tokens = append(tokens, file.Token)
+					}
+					if page.NextCursor == "" {
+						break
+					}
+					query.Cursor = page.NextCursor
+				}
+
+				if !reflect.DeepEqual(tokens, c.want) {
+					t.Errorf("Sorted by %s, ascending %v: got %v, want %v", c.sort, c.ascending, tokens, c.want)
+				}
+			}
+
+			t.Run("rejects cursors of other sorts", func(t *testing.T) {
+				page, _ := reg.List(context.Background(), registry.ListQuery{Sort: registry.SORT_SIZE, Limit: 1})
+
+				_, err := reg.List(context.Background(), registry.ListQuery{Sort: registry.SORT_NAME, Limit: 1, Cursor: page.NextCursor})
+				if err != registry.ErrInvalidCursor {
+					t.Errorf("Got %v, want ErrInvalidCursor", err)
+				}
+			})
+			t.Run("rejects unknown sort keys", func(t *testing.T) {
+				if _, err := reg.List(context.Background(), registry.ListQuery{Sort: "owner"}); err == nil {
+					t.Error("Expected an error")
+				}
+			})
+		})
+		t.Run(fmt.Sprintf("%s:filters listed files by type, size and time", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			now := time.Now()
+			files := []struct {
+				token    string
+				mimeType string
+				size     int64
+			}{
+				{"aaaaaa", "image/png", 100},
+				{"bbbbbb", "image/jpeg", 2000},
+				{"cccccc", "application/pdf", 500},
+				{"dddddd", "imagex/custom", 50},
+			}
+			for _, file := range files {
+				reg.Record(context.Background(), file.token, file.token)
+				reg.SetMimeType(context.Background(), file.token, file.mimeType)
+				reg.SetSize(context.Background(), file.token, file.size)
+			}
+			reg.SetExpiry(context.Background(), "cccccc", now.Add(time.Hour))
+			reg.SetScanResult(context.Background(), "bbbbbb", registry.SCAN_INFECTED, "Eicar-Signature")
+			reg.SetScanResult(context.Background(), "dddddd", registry.SCAN_PENDING, "")
+
+			cases := []struct {
+				name  string
+				query registry.ListQuery
+				want  []string
+			}{
+				{"exact type", registry.ListQuery{MimeType: "image/png"}, []string{"aaaaaa"}},
+				{"type wildcard", registry.ListQuery{MimeType: "image/*"}, []string{"bbbbbb", "aaaaaa"}},
+				{"size range", registry.ListQuery{MinSize: 100, MaxSize: 500}, []string{"cccccc", "aaaaaa"}},
+				{"minimum size", registry.ListQuery{MinSize: 1000}, []string{"bbbbbb"}},
+				{"created window", registry.ListQuery{CreatedAfter: now.Add(-time.Hour), CreatedBefore: now.Add(time.Hour), MimeType: "application/pdf"}, []string{"cccccc"}},
+				{"created later", registry.ListQuery{CreatedAfter: now.Add(time.Hour)}, nil},
+				{"expiry window", registry.ListQuery{ExpiresAfter: now, ExpiresBefore: now.Add(2 * time.Hour)}, []string{"cccccc"}},
+				{"scan status", registry.ListQuery{ScanStatus: registry.SCAN_INFECTED}, []string{"bbbbbb"}},
+			}
+
+			for _, c := range cases {
+				page, err := reg.List(context.Background(), c.query)
+				if err != nil {
+					t.Fatalf("%s: expected no error, got %q", c.name, err)
+				}
+
+				var tokens []string
+				for _, file := range page.Files {
+					tokens = append(tokens, file.Token)
+				}
+				if !reflect.DeepEqual(tokens, c.want) {
+					t.Errorf("%s: got %v, want %v", c.name, tokens, c.want)
+				}
+			}
+
+			page, _ := reg.List(context.Background(), registry.ListQuery{ScanStatus: registry.SCAN_PENDING})
+			if len(page.Files) != 1 || page.Files[0].ScanStatus != registry.SCAN_PENDING {
+				t.Errorf("Got %+v, want the pending file", page.Files)
+			}
+
+			metadata, _ := reg.GetMetadata(context.Background(), "aaaaaa")
+			if metadata.MimeType != "image/png" {
+				t.Errorf("Got MIME type %q, want image/png", metadata.MimeType)
+			}
+		})
+		t.Run(fmt.Sprintf("%s:returns error for unknown tokens", test.name), func(t *testing.T) {
+			reg := test.createRegistry()
+			defer teardownRegistry(reg)
+
+			if _, ok := reg.GetProtection(context.Background(), "987654"); ok {
+				t.Error("Got ok true, want false")
+			}
+			if err := reg.SetPassword(context.Background(), "987654", "hash"); err == nil {
+				t.Error("Got nil, want error")
+			}
+			if err := reg.RecordFailedAttempt(context.Background(), "987654", time.Now()); err == nil {
+				t.Error("Got nil, want error")
+			}
+		})
+	}
+}
+
+func TestInMemoryRegistryConcurrency(t *testing.T) {
+	reg := registry.NewInMemoryRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+
+			ctx := context.Background()
+			reg.Record(ctx, token, "test.txt")
+			reg.Get(ctx, token)
+			reg.RecordFailedAttempt(ctx, token, time.Now())
+			reg.SetSize(ctx, token, 10)
+			reg.GetProtection(ctx, token)
+			reg.GetTotalUsage(ctx)
+			reg.List(ctx, registry.ListQuery{})
+			reg.Delete(ctx, token)
+		}(fmt.Sprintf("token%d", i%5))
+	}
+	wg.Wait()
+}
+
+type StubLogger struct {
+	errors []string
+}
+
+func (s *StubLogger) Debug(msg string, args ...any) {}
+func (s *StubLogger) Info(msg string, args ...any)  {}
+func (s *StubLogger) Warn(msg string, args ...any)  {}
+
+func (s *StubLogger) Error(msg string, args ...any) {
+	s.errors = append(s.errors, msg)
+}
+
+func TestSQLiteRegistryLogsErrors(t *testing.T) {
+	logger := &StubLogger{}
+
+	reg, err := registry.NewSQLiteRegistry(TMP_DB_PATH, registry.WithLogger(logger))
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	reg.Record(context.Background(), "123456", "file.txt")
+
+	reg.Get(context.Background(), "987654")
+	if len(logger.errors) != 0 {
+		t.Fatalf("Want missing rows not to be logged, got %q", logger.errors)
+	}
+
+	reg.Clear()
+	reg.Close()
+
+	_, ok := reg.Get(context.Background(), "123456")
+	if ok {
+		t.Error("Got ok true for failed query, want false")
+	}
+
+	if len(logger.errors) != 1 {
+		t.Errorf("Got %d logged errors, want 1", len(logger.errors))
+	}
+}
+
+func TestSQLiteRegistryCancelledContext(t *testing.T) {
+	reg := NewSQLiteRegistry()
+	defer teardownRegistry(reg)
+
+	reg.Record(context.Background(), "123456", "file.txt")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, ok := reg.Get(ctx, "123456"); ok {
+		t.Error("Got ok true for cancelled query, want false")
+	}
+
+	if err := reg.Delete(ctx, "123456"); err == nil {
+		t.Error("Expected error for cancelled delete, got nil")
+	}
+
+	if !reg.Has(context.Background(), "123456") {
+		t.Error("Want token to be kept after cancelled delete")
+	}
+}
+
+func TestSQLiteRegistryMigrations(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite3")
+
+	t.Run("re-runs migrations", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			reg, err := registry.NewSQLiteRegistry(dbPath)
+			if err != nil {
+				t.Fatalf("Expected no error on start %d, got %q", i+1, err)
+			}
+			reg.Close()
+		}
+	})
+	t.Run("reports failed migrations", func(t *testing.T) {
+		db, _ := sql.Open("sqlite3", dbPath)
+		db.Exec("DROP INDEX idx_uploader")
+		db.Exec("CREATE TABLE idx_uploader (id INTEGER)")
+		db.Close()
+
+		_, err := registry.NewSQLiteRegistry(dbPath)
+		if err == nil || !strings.Contains(err.Error(), "idx_uploader") {
+			t.Errorf("Got %v, want the failed migration", err)
+		}
+	})
+}
+
+func TestSQLiteRegistryHealth(t *testing.T) {
+	reg, _ := registry.NewSQLiteRegistry(TMP_DB_PATH)
+	checker := reg.(*registry.SQLiteRegistry)
+
+	err := checker.CheckHealth(context.Background())
+	if err != nil {
+		t.Errorf("Expected no error, got %q", err)
+	}
+
+	reg.Close()
+
+	err = checker.CheckHealth(context.Background())
+	if err == nil {
+		t.Error("Expected error for closed registry, but did not get one")
 	}
 }
@@ -1,51 +1,532 @@
 package registry
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
 	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/olzhasar/go-fileserver/loggers"
 )
 
+// migrations are applied in order on every start, so statements must be
+// safe to re-run against an already migrated database. Added columns fail
+// with a duplicate column error once migrated, which is the only error
+// ignored
+var migrations = []string{
+	`ALTER TABLE files ADD COLUMN password_hash VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE files ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN last_failed_at INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN private BOOLEAN NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN uploader VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE files ADD COLUMN size INTEGER NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS idx_uploader ON files (uploader)`,
+	`CREATE TABLE IF NOT EXISTS api_keys(
+id VARCHAR(24) NOT NULL PRIMARY KEY,
+name VARCHAR(255) NOT NULL,
+key_hash VARCHAR(64) NOT NULL,
+scopes VARCHAR(255) NOT NULL,
+created_at INTEGER NOT NULL,
+revoked_at INTEGER NOT NULL DEFAULT 0
+)`,
+	`ALTER TABLE files ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN blocked BOOLEAN NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS idx_expires_at ON files (expires_at) WHERE expires_at != 0`,
+	`ALTER TABLE files ADD COLUMN mime_type VARCHAR(255) NOT NULL DEFAULT ''`,
+	// Indexes on a single column also order by id, which serves the
+	// filters and sort keys of List along with its pagination
+	`DROP INDEX IF EXISTS idx_expires_at`,
+	`CREATE INDEX IF NOT EXISTS idx_files_expires_at ON files (expires_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_files_created_at ON files (created_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_files_filename ON files (filename)`,
+	`CREATE INDEX IF NOT EXISTS idx_files_size ON files (size)`,
+	`CREATE INDEX IF NOT EXISTS idx_files_mime_type ON files (mime_type)`,
+	`ALTER TABLE files ADD COLUMN scan_status VARCHAR(16) NOT NULL DEFAULT ''`,
+	`ALTER TABLE files ADD COLUMN scan_signature VARCHAR(255) NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS idx_files_scan_status ON files (scan_status)`,
+	// Files recorded before content was stored by key have no key and
+	// are stored under their file name
+	`ALTER TABLE files ADD COLUMN storage_key VARCHAR(255) NOT NULL DEFAULT ''`,
+}
+
+// sortColumns maps the sort keys of List to columns, SORT_CREATED is the id
+var sortColumns = map[string]string{
+	SORT_NAME:    "filename",
+	SORT_SIZE:    "size",
+	SORT_EXPIRES: "expires_at",
+}
+
 type SQLiteRegistry struct {
-	db *sql.DB
+	db     *sql.DB
+	logger loggers.Logger
 }
 
-func (r *SQLiteRegistry) Record(token, fileName string) error {
-	_, err := r.db.Exec("INSERT INTO files (token, filename) VALUES (?, ?)", token, fileName)
+type SQLiteOption func(r *SQLiteRegistry)
+
+func WithLogger(logger loggers.Logger) SQLiteOption {
+	return func(r *SQLiteRegistry) {
+		r.logger = logger
+	}
+}
+
+func (r *SQLiteRegistry) Record(ctx context.Context, token, fileName string) error {
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO files (token, filename, created_at) VALUES (?, ?, ?)", token, fileName, time.Now().UnixNano(),
+	)
 	return err
 }
 
-func (r *SQLiteRegistry) Get(token string) (fileName string, ok bool) {
-	err := r.db.QueryRow("SELECT filename FROM files WHERE token = ?", token).Scan(&fileName)
-	if err == sql.ErrNoRows {
+func (r *SQLiteRegistry) Get(ctx context.Context, token string) (fileName string, ok bool) {
+	err := r.db.QueryRowContext(ctx, "SELECT filename FROM files WHERE token = ?", token).Scan(&fileName)
+	if err != nil {
+		r.logQueryError(ctx, "Get", err)
 		return fileName, false
 	}
 	return fileName, true
 }
 
-func (r *SQLiteRegistry) Has(token string) bool {
+func (r *SQLiteRegistry) Has(ctx context.Context, token string) bool {
 	var exists bool
-	r.db.QueryRow("SELECT 1 FROM FILES WHERE token = ?", token).Scan(&exists)
+	err := r.db.QueryRowContext(ctx, "SELECT 1 FROM FILES WHERE token = ?", token).Scan(&exists)
+	if err != nil {
+		r.logQueryError(ctx, "Has", err)
+	}
 	return exists
 }
 
+func (r *SQLiteRegistry) Delete(ctx context.Context, token string) error {
+	return r.updateRecord(ctx, "DELETE FROM files WHERE token = ?", token)
+}
+
+func (r *SQLiteRegistry) SetPassword(ctx context.Context, token, passwordHash string) error {
+	return r.updateRecord(ctx, "UPDATE files SET password_hash = ? WHERE token = ?", passwordHash, token)
+}
+
+func (r *SQLiteRegistry) SetPrivate(ctx context.Context, token string, private bool) error {
+	return r.updateRecord(ctx, "UPDATE files SET private = ? WHERE token = ?", private, token)
+}
+
+func (r *SQLiteRegistry) GetProtection(ctx context.Context, token string) (protection Protection, ok bool) {
+	var lastFailedAt, expiresAt int64
+
+	err := r.db.QueryRowContext(ctx,
+		"SELECT private, password_hash, failed_attempts, last_failed_at, blocked, expires_at, scan_status, scan_signature FROM files WHERE token = ?", token,
+	).Scan(
+		&protection.Private, &protection.PasswordHash, &protection.FailedAttempts, &lastFailedAt, &protection.Blocked, &expiresAt,
+		&protection.ScanStatus, &protection.ScanSignature,
+	)
+	if err != nil {
+		r.logQueryError(ctx, "GetProtection", err)
+		return Protection{}, false
+	}
+
+	protection.LastFailedAt = timeOrZero(lastFailedAt)
+	protection.ExpiresAt = timeOrZero(expiresAt)
+
+	return protection, true
+}
+
+func (r *SQLiteRegistry) RecordFailedAttempt(ctx context.Context, token string, at time.Time) error {
+	return r.updateRecord(ctx,
+		"UPDATE files SET failed_attempts = failed_attempts + 1, last_failed_at = ? WHERE token = ?",
+		at.UnixNano(), token,
+	)
+}
+
+func (r *SQLiteRegistry) ResetFailedAttempts(ctx context.Context, token string) error {
+	return r.updateRecord(ctx, "UPDATE files SET failed_attempts = 0, last_failed_at = 0 WHERE token = ?", token)
+}
+
+func (r *SQLiteRegistry) SetUploader(ctx context.Context, token, uploader string) error {
+	return r.updateRecord(ctx, "UPDATE files SET uploader = ? WHERE token = ?", uploader, token)
+}
+
+func (r *SQLiteRegistry) SetSize(ctx context.Context, token string, size int64) error {
+	return r.updateRecord(ctx, "UPDATE files SET size = ? WHERE token = ?", size, token)
+}
+
+func (r *SQLiteRegistry) GetMetadata(ctx context.Context, token string) (metadata Metadata, ok bool) {
+	var createdAt int64
+
+	err := r.db.QueryRowContext(ctx,
+		"SELECT uploader, size, mime_type, created_at, CASE WHEN storage_key = '' THEN filename ELSE storage_key END FROM files WHERE token = ?", token,
+	).Scan(&metadata.Uploader, &metadata.Size, &metadata.MimeType, &createdAt, &metadata.StorageKey)
+	if err != nil {
+		r.logQueryError(ctx, "GetMetadata", err)
+		return Metadata{}, false
+	}
+
+	metadata.CreatedAt = timeOrZero(createdAt)
+	return metadata, true
+}
+
+func (r *SQLiteRegistry) GetUsage(ctx context.Context, uploader string) (usage Usage, err error) {
+	err = r.db.QueryRowContext(ctx,
+		"SELECT COUNT(*), COALESCE(SUM(size), 0) FROM files WHERE uploader = ?", uploader,
+	).Scan(&usage.Files, &usage.Bytes)
+	return usage, err
+}
+
+func (r *SQLiteRegistry) GetTotalUsage(ctx context.Context) (usage Usage, err error) {
+	err = r.db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(size), 0) FROM files").Scan(&usage.Files, &usage.Bytes)
+	return usage, err
+}
+
+func (r *SQLiteRegistry) ListUsage(ctx context.Context) ([]UploaderUsage, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT uploader, COUNT(*), COALESCE(SUM(size), 0) FROM files WHERE uploader != '' GROUP BY uploader ORDER BY uploader",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usages []UploaderUsage
+	for rows.Next() {
+		var usage UploaderUsage
+		err := rows.Scan(&usage.Uploader, &usage.Files, &usage.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+
+	return usages, rows.Err()
+}
+
+func (r *SQLiteRegistry) SetExpiry(ctx context.Context, token string, at time.Time) error {
+	return r.updateRecord(ctx, "UPDATE files SET expires_at = ? WHERE token = ?", unixNanoOrZero(at), token)
+}
+
+func (r *SQLiteRegistry) SetBlocked(ctx context.Context, token string, blocked bool) error {
+	return r.updateRecord(ctx, "UPDATE files SET blocked = ? WHERE token = ?", blocked, token)
+}
+
+func (r *SQLiteRegistry) SetScanResult(ctx context.Context, token, status, signature string) error {
+	return r.updateRecord(ctx, "UPDATE files SET scan_status = ?, scan_signature = ? WHERE token = ?", status, signature, token)
+}
+
+func (r *SQLiteRegistry) SetMimeType(ctx context.Context, token, mimeType string) error {
+	return r.updateRecord(ctx, "UPDATE files SET mime_type = ? WHERE token = ?", mimeType, token)
+}
+
+func (r *SQLiteRegistry) SetStorageKey(ctx context.Context, token, key string) error {
+	return r.updateRecord(ctx, "UPDATE files SET storage_key = ? WHERE token = ?", key, token)
+}
+
+// List pages through files with keyset pagination: the cursor holds the
+// sort key value and id of the last file of the previous page, so deep pages
+// cost as much as the first one
+func (r *SQLiteRegistry) List(ctx context.Context, query ListQuery) (ListPage, error) {
+	err := query.Validate()
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	after, err := decodeCursor(query)
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	conditions, args := listConditions(query)
+
+	direction, comparison := "DESC", "<"
+	if query.Ascending {
+		direction, comparison = "ASC", ">"
+	}
+
+	column, sorted := sortColumns[query.sortKey()]
+	order := "id " + direction
+	if sorted {
+		order = column + " " + direction + ", " + order
+	}
+
+	if after != nil {
+		if !sorted {
+			conditions = append(conditions, "id "+comparison+" ?")
+			args = append(args, after.Seq)
+		} else {
+			var value any = after.Number
+			if query.sortKey() == SORT_NAME {
+				value = after.Text
+			}
+			conditions = append(conditions, fmt.Sprintf("(%[1]s %[2]s ? OR %[1]s = ? AND id %[2]s ?)", column, comparison))
+			args = append(args, value, value, after.Seq)
+		}
+	}
+
+	statement := "SELECT id, token, filename, private, password_hash, blocked, expires_at, scan_status, scan_signature, uploader, size, mime_type, created_at, " +
+		"CASE WHEN storage_key = '' THEN filename ELSE storage_key END FROM files"
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	// One extra row tells whether there is a next page
+	limit := query.pageLimit()
+	statement += " ORDER BY " + order + " LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := r.db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return ListPage{}, err
+	}
+	defer rows.Close()
+
+	var page ListPage
+	var lastID int64
+	for rows.Next() {
+		if len(page.Files) == limit {
+			page.NextCursor = newCursor(query, positionOf(query, page.Files[limit-1], lastID))
+			break
+		}
+
+		var file File
+		var passwordHash string
+		var expiresAt, createdAt int64
+
+		err := rows.Scan(
+			&lastID, &file.Token, &file.FileName, &file.Private, &passwordHash, &file.Blocked,
+			&expiresAt, &file.ScanStatus, &file.ScanSignature, &file.Uploader, &file.Size, &file.MimeType, &createdAt,
+			&file.StorageKey,
+		)
+		if err != nil {
+			return ListPage{}, err
+		}
+
+		file.Protected = passwordHash != ""
+		file.ExpiresAt = timeOrZero(expiresAt)
+		file.CreatedAt = timeOrZero(createdAt)
+		page.Files = append(page.Files, file)
+	}
+
+	return page, rows.Err()
+}
+
+// listConditions translates the filters of query to SQL
+func listConditions(query ListQuery) ([]string, []any) {
+	var conditions []string
+	var args []any
+
+	add := func(condition string, values ...any) {
+		conditions = append(conditions, condition)
+		args = append(args, values...)
+	}
+
+	if query.Uploader != "" {
+		add("uploader = ?", query.Uploader)
+	}
+	if query.NameContains != "" {
+		add("instr(lower(filename), lower(?)) > 0", query.NameContains)
+	}
+	if prefix, ok := strings.CutSuffix(query.MimeType, "/*"); ok {
+		// '0' follows '/', so the range holds every subtype and uses the index
+		add("mime_type >= ? AND mime_type < ?", prefix+"/", prefix+"0")
+	} else if query.MimeType != "" {
+		add("mime_type = ?", query.MimeType)
+	}
+	if query.MinSize > 0 {
+		add("size >= ?", query.MinSize)
+	}
+	if query.MaxSize > 0 {
+		add("size <= ?", query.MaxSize)
+	}
+	if !query.CreatedAfter.IsZero() {
+		add("created_at >= ?", query.CreatedAfter.UnixNano())
+	}
+	if !query.CreatedBefore.IsZero() {
+		add("created_at < ?", query.CreatedBefore.UnixNano())
+	}
+	if !query.ExpiresAfter.IsZero() {
+		add("expires_at >= ?", query.ExpiresAfter.UnixNano())
+	}
+	if !query.ExpiresBefore.IsZero() {
+		add("expires_at != 0 AND expires_at < ?", query.ExpiresBefore.UnixNano())
+	}
+	if query.ScanStatus != "" {
+		add("scan_status = ?", query.ScanStatus)
+	}
+
+	return conditions, args
+}
+
+func (r *SQLiteRegistry) RecordAPIKey(ctx context.Context, key APIKey) error {
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO api_keys (id, name, key_hash, scopes, created_at, revoked_at) VALUES (?, ?, ?, ?, ?, ?)",
+		key.ID, key.Name, key.Hash, strings.Join(key.Scopes, ","), key.CreatedAt.UnixNano(), unixNanoOrZero(key.RevokedAt),
+	)
+	return err
+}
+
+func (r *SQLiteRegistry) GetAPIKey(ctx context.Context, id string) (APIKey, bool) {
+	row := r.db.QueryRowContext(ctx, "SELECT id, name, key_hash, scopes, created_at, revoked_at FROM api_keys WHERE id = ?", id)
+
+	key, err := scanAPIKey(row)
+	if err != nil {
+		r.logQueryError(ctx, "GetAPIKey", err)
+		return APIKey{}, false
+	}
+
+	return key, true
+}
+
+func (r *SQLiteRegistry) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT id, name, key_hash, scopes, created_at, revoked_at FROM api_keys ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (r *SQLiteRegistry) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	result, err := r.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = ? WHERE id = ?", at.UnixNano(), id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return errors.New(fmt.Sprintf("API key %q not found", id))
+	}
+
+	return nil
+}
+
 func (r *SQLiteRegistry) Clear() {
 	_, err := r.db.Exec("DELETE FROM files;")
 	if err != nil {
 		panic(err)
 	}
+
+	_, err = r.db.Exec("DELETE FROM api_keys;")
+	if err != nil {
+		panic(err)
+	}
 }
 
 func (r *SQLiteRegistry) Close() {
-	r.db.Close()
+	err := r.db.Close()
+	if err != nil {
+		r.logger.Error("Unable to close SQLite registry", "error", err)
+	}
+}
+
+// CheckHealth pings the database and runs a query against the files table
+func (r *SQLiteRegistry) CheckHealth(ctx context.Context) error {
+	err := r.db.PingContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	return r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM (SELECT 1 FROM files LIMIT 1)").Scan(&count)
+}
+
+// logQueryError logs failed lookups, except for missing rows. Queries
+// cancelled along with their request are only logged at debug level
+func (r *SQLiteRegistry) logQueryError(ctx context.Context, operation string, err error) {
+	logger := loggers.FromContext(ctx, r.logger)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case ctx.Err() != nil:
+		logger.Debug("SQLite registry query cancelled", "operation", operation, "error", err)
+	default:
+		logger.Error("SQLite registry query failed", "operation", operation, "error", err)
+	}
+}
+
+func (r *SQLiteRegistry) updateRecord(ctx context.Context, query string, args ...any) error {
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		token := args[len(args)-1]
+		return errors.New(fmt.Sprintf("Token %q not found in registry", token))
+	}
+
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
 }
 
-func NewSQLiteRegistry(dbPath string) (Registry, error) {
+func scanAPIKey(row scanner) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var createdAt, revokedAt int64
+
+	err := row.Scan(&key.ID, &key.Name, &key.Hash, &scopes, &createdAt, &revokedAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	key.CreatedAt = time.Unix(0, createdAt)
+	if revokedAt != 0 {
+		key.RevokedAt = time.Unix(0, revokedAt)
+	}
+
+	return key, nil
+}
+
+func timeOrZero(unixNano int64) time.Time {
+	if unixNano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, unixNano)
+}
+
+func unixNanoOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func NewSQLiteRegistry(dbPath string, opts ...SQLiteOption) (Registry, error) {
+	r := &SQLiteRegistry{logger: loggers.NopLogger{}}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
-		return &SQLiteRegistry{}, err
+		return r, err
 	}
+	r.db = db
 
-	db.Exec(`
+	_, err = db.Exec(`
 CREATE TABLE IF NOT EXISTS files(
 id INTEGER NOT NULL PRIMARY KEY,
 token VARCHAR(24),
@@ -53,6 +534,18 @@ filename VARCHAR(255)
 );
 CREATE UNIQUE INDEX IF NOT EXISTS idx_token ON files (token);
 `)
+	if err != nil {
+		db.Close()
+		return r, errors.New(fmt.Sprintf("Unable to create SQLite registry tables in %s: %s", dbPath, err))
+	}
+
+	for i, migration := range migrations {
+		_, err = db.Exec(migration)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			db.Close()
+			return r, errors.New(fmt.Sprintf("SQLite registry migration %d failed: %s", i, err))
+		}
+	}
 
-	return &SQLiteRegistry{db}, nil
+	return r, nil
 }
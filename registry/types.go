@@ -1,9 +1,153 @@
 package registry
 
+import (
+	"context"
+	"time"
+)
+
+// Statuses of virus scans. Files recorded while scanning was disabled have
+// no status
+const SCAN_PENDING = "pending"
+const SCAN_CLEAN = "clean"
+const SCAN_INFECTED = "infected"
+
+// Protection holds the access protection state of a recorded file
+type Protection struct {
+	// Private files can only be downloaded through signed URLs
+	Private        bool
+	PasswordHash   string
+	FailedAttempts int
+	LastFailedAt   time.Time
+	// Blocked files can't be downloaded by anyone
+	Blocked bool
+	// ExpiresAt is zero for files that never expire
+	ExpiresAt time.Time
+	// ScanStatus is one of the SCAN_* statuses, or empty if the file was
+	// never scanned
+	ScanStatus string
+	// ScanSignature names the malware found in infected files
+	ScanSignature string
+}
+
+func (p Protection) IsProtected() bool {
+	return p.PasswordHash != ""
+}
+
+func (p Protection) IsExpired(now time.Time) bool {
+	return !p.ExpiresAt.IsZero() && !now.Before(p.ExpiresAt)
+}
+
+// Metadata holds descriptive information about a recorded file
+type Metadata struct {
+	// Uploader is the name of the authenticated identity that uploaded the file
+	Uploader  string
+	Size      int64
+	MimeType  string
+	CreatedAt time.Time
+	// StorageKey locates the stored content. Files recorded before content
+	// was stored by key use their file name
+	StorageKey string
+}
+
+// Usage sums up the files recorded for an uploader or the whole registry
+type Usage struct {
+	Files int64
+	Bytes int64
+}
+
+// UploaderUsage is the usage of a single uploader
+type UploaderUsage struct {
+	Uploader string
+	Usage
+}
+
+// File is a recorded file as returned by List
+type File struct {
+	Token     string
+	FileName  string
+	Private   bool
+	Protected bool
+	Blocked   bool
+	ExpiresAt time.Time
+	// ScanStatus and ScanSignature are the result of the virus scan
+	ScanStatus    string
+	ScanSignature string
+	Metadata
+}
+
+// ListQuery selects the files returned by List. Zero values don't filter,
+// time ranges include their start and exclude their end
+type ListQuery struct {
+	Uploader string
+	// NameContains matches a case-insensitive substring of the file name
+	NameContains string
+	// MimeType matches exactly, or all subtypes if it ends with /*
+	MimeType      string
+	MinSize       int64
+	MaxSize       int64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// ExpiresAfter and ExpiresBefore only match files that expire
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+	// ScanStatus matches one of the SCAN_* statuses exactly
+	ScanStatus string
+	// Sort is one of the SORT_* keys, SORT_CREATED if empty
+	Sort      string
+	Ascending bool
+	// Cursor is the NextCursor of the previous page, empty for the first one
+	Cursor string
+	// Limit is the page size, DEFAULT_LIST_LIMIT if zero and at most
+	// MAX_LIST_LIMIT
+	Limit int
+}
+
+// ListPage is a page of files. NextCursor is empty on the last page
+type ListPage struct {
+	Files      []File
+	NextCursor string
+}
+
+// APIKey is a stored API key. Only the hash of the key itself is kept
+type APIKey struct {
+	ID        string
+	Name      string
+	Hash      string
+	Scopes    []string
+	CreatedAt time.Time
+	RevokedAt time.Time
+}
+
+func (k APIKey) IsRevoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
 type Registry interface {
-	Record(token, fileName string) error
-	Get(token string) (fileName string, ok bool)
-	Has(token string) bool
+	Record(ctx context.Context, token, fileName string) error
+	Get(ctx context.Context, token string) (fileName string, ok bool)
+	Has(ctx context.Context, token string) bool
+	Delete(ctx context.Context, token string) error
+	SetPassword(ctx context.Context, token, passwordHash string) error
+	SetPrivate(ctx context.Context, token string, private bool) error
+	GetProtection(ctx context.Context, token string) (protection Protection, ok bool)
+	RecordFailedAttempt(ctx context.Context, token string, at time.Time) error
+	ResetFailedAttempts(ctx context.Context, token string) error
+	SetUploader(ctx context.Context, token, uploader string) error
+	SetSize(ctx context.Context, token string, size int64) error
+	SetMimeType(ctx context.Context, token, mimeType string) error
+	SetStorageKey(ctx context.Context, token, key string) error
+	GetMetadata(ctx context.Context, token string) (metadata Metadata, ok bool)
+	GetUsage(ctx context.Context, uploader string) (Usage, error)
+	GetTotalUsage(ctx context.Context) (Usage, error)
+	ListUsage(ctx context.Context) ([]UploaderUsage, error)
+	SetExpiry(ctx context.Context, token string, at time.Time) error
+	SetBlocked(ctx context.Context, token string, blocked bool) error
+	SetScanResult(ctx context.Context, token, status, signature string) error
+	List(ctx context.Context, query ListQuery) (ListPage, error)
+	RecordAPIKey(ctx context.Context, key APIKey) error
+	GetAPIKey(ctx context.Context, id string) (key APIKey, ok bool)
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
 	Clear()
 	Close()
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/admin"
+	"github.com/olzhasar/go-fileserver/certs"
+	"github.com/olzhasar/go-fileserver/config"
+	"github.com/olzhasar/go-fileserver/loggers"
+	"github.com/olzhasar/go-fileserver/manager"
+	"github.com/olzhasar/go-fileserver/middleware"
+	"github.com/olzhasar/go-fileserver/preview"
+	"github.com/olzhasar/go-fileserver/server"
+	"github.com/olzhasar/go-fileserver/signer"
+)
+
+const CONFIG_POLL_INTERVAL = 2 * time.Second
+
+// reloader applies the reloadable settings of a changed config to the
+// running server. Settings that require a restart are kept and logged
+type reloader struct {
+	loader *config.Loader
+
+	logger          *loggers.SwappableLogger
+	fileLogger      *loggers.FileLogger
+	accessLogWriter *loggers.SwappableWriter
+	manager         *manager.FileManager
+	fileServer      *server.FileServer
+	jwt             *middleware.JWTMiddleware
+	rateLimiter     *middleware.RateLimitMiddleware
+	ipRateLimiter   *middleware.RateLimitMiddleware
+	certs           *certs.Reloader
+	admin           *admin.Handler
+
+	mu      sync.Mutex
+	current config.Config
+}
+
+// watch reloads the config and TLS certificates on SIGHUP and whenever
+// their files change. SIGHUP also reopens the log file, so logrotate keeps
+// working, and rereads the upload rules of users
+func (r *reloader) watch() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			r.reopenLog()
+			r.reload()
+			r.reloadUploadPolicy()
+			r.reloadCerts(true)
+		}
+	}()
+
+	path := r.loader.Path()
+	if path == "" && r.certs == nil {
+		return
+	}
+
+	go func() {
+		var last os.FileInfo
+		if path != "" {
+			last, _ = os.Stat(path)
+		}
+
+		for range time.Tick(CONFIG_POLL_INTERVAL) {
+			r.reloadCerts(false)
+
+			if path == "" {
+				continue
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+
+			if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+				last = info
+				r.reload()
+			}
+		}
+	}()
+}
+
+// reloadCerts reloads the TLS certificate if its files changed, or
+// unconditionally if force is set. Established connections keep theirs
+func (r *reloader) reloadCerts(force bool) {
+	if r.certs == nil {
+		return
+	}
+
+	var changed bool
+	var err error
+	if force {
+		changed, err = true, r.certs.Reload()
+	} else {
+		changed, err = r.certs.ReloadIfChanged()
+	}
+
+	if err != nil {
+		r.logger.Error("Unable to reload TLS certificate, keeping the current one", "error", err)
+	} else if changed {
+		r.logger.Info("TLS certificate reloaded")
+	}
+}
+
+// reloadUploadPolicy rereads the users file of the upload rules, which is
+// not watched like the config file
+func (r *reloader) reloadUploadPolicy() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.current.Uploads.UsersFile == "" {
+		return
+	}
+
+	uploadPolicy, err := newUploadPolicy(r.current.Uploads)
+	if err != nil {
+		r.logger.Error("Unable to reload upload rules, keeping the current ones", "error", err)
+		return
+	}
+
+	r.manager.SetUploadPolicy(uploadPolicy)
+}
+
+func (r *reloader) reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := r.loader.Reload()
+	if err != nil {
+		r.logger.Error("Invalid configuration, keeping the current one", "error", err)
+		return
+	}
+
+	next, rejected := r.current.Reload(next)
+	for _, key := range rejected {
+		r.logger.Warn("Setting can only be changed by a restart, keeping the current value", "setting", key)
+	}
+
+	if next == r.current {
+		return
+	}
+
+	err = r.apply(next)
+	if err != nil {
+		r.logger.Error("Unable to apply configuration, keeping the current one", "error", err)
+		return
+	}
+
+	r.current = next
+	r.logger.Info("Configuration reloaded")
+}
+
+// apply builds every changed component before swapping any of them, so a
+// failure leaves the server untouched
+func (r *reloader) apply(next config.Config) error {
+	var urlSigner *signer.Signer
+	if next.Signing.Keys != "" {
+		var err error
+		urlSigner, err = newSigner(next.Signing.Keys)
+		if err != nil {
+			return err
+		}
+	}
+
+	inlinePolicy, err := preview.ParsePolicy(next.Preview.InlineTypes)
+	if err != nil {
+		return err
+	}
+
+	uploadPolicy, err := newUploadPolicy(next.Uploads)
+	if err != nil {
+		return err
+	}
+
+	var verifier middleware.TokenVerifier
+	if next.JWT != r.current.JWT {
+		jwtVerifier, err := newJWTVerifier(next.JWT)
+		if err != nil {
+			return err
+		}
+		if jwtVerifier != nil {
+			verifier = jwtVerifier
+		}
+	}
+
+	// The logger is built last, as nothing closes its file if a later step
+	// fails
+	var logger loggers.Logger
+	var fileLogger *loggers.FileLogger
+	if next.Log != r.current.Log {
+		logger, fileLogger, err = newLogger(next.Log)
+		if err != nil {
+			return err
+		}
+	}
+
+	if logger != nil {
+		r.logger.Swap(logger)
+		r.accessLogWriter.Swap(logWriter(fileLogger))
+		if r.fileLogger != nil {
+			r.fileLogger.Close()
+		}
+		r.fileLogger = fileLogger
+	}
+
+	r.fileServer.SetSigner(urlSigner, next.Signing.SignToken)
+	r.fileServer.SetInlinePolicy(inlinePolicy)
+
+	if r.admin != nil {
+		r.admin.SetToken(next.Admin.Token)
+	}
+
+	if next.JWT != r.current.JWT {
+		r.jwt.SetVerifier(verifier)
+	}
+
+	r.manager.SetQuotas(newQuotas(next.Quotas))
+	r.manager.SetUploadPolicy(uploadPolicy)
+	r.rateLimiter.SetConfig(newRateLimitConfig(next.RateLimit))
+	r.ipRateLimiter.SetConfig(newIPRateLimitConfig(next.RateLimit))
+
+	return nil
+}
+
+func (r *reloader) reopenLog() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fileLogger == nil {
+		return
+	}
+
+	err := r.fileLogger.Reopen()
+	if err != nil {
+		r.logger.Error("Unable to reopen log file", "error", err)
+	}
+}
+
+func (r *reloader) closeLog() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fileLogger == nil {
+		return nil
+	}
+	return r.fileLogger.Close()
+}
@@ -0,0 +1,210 @@
+// Package clamdtest provides a fake clamd daemon for tests
+package clamdtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// EICAR is the standard antivirus test file, reported as infected
+const EICAR = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+const SIGNATURE = "Eicar-Test-Signature"
+
+// Default limit of the size of streams, as StreamMaxLength of clamd
+const DEFAULT_STREAM_MAX_LENGTH = 25 * 1024 * 1024
+
+// Server speaks the PING and INSTREAM commands of clamd, reporting streams
+// containing EICAR as infected
+type Server struct {
+	// Address of the server, as accepted by scanner.NewClamd
+	Address string
+
+	listener        net.Listener
+	streamMaxLength int
+	conns           sync.WaitGroup
+
+	// gate holds replies to scans while Block is in effect
+	gate sync.RWMutex
+
+	mu    sync.Mutex
+	scans int
+}
+
+type Option func(s *Server)
+
+// WithStreamMaxLength makes the server reject streams larger than length
+func WithStreamMaxLength(length int) Option {
+	return func(s *Server) {
+		s.streamMaxLength = length
+	}
+}
+
+// NewServer starts a server listening on a local TCP port
+func NewServer(opts ...Option) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("clamdtest: failed to listen: %v", err))
+	}
+
+	return start(listener, "tcp:"+listener.Addr().String(), opts)
+}
+
+// NewUnixServer starts a server listening on a Unix socket in a temporary
+// directory, which is removed by Close
+func NewUnixServer(opts ...Option) *Server {
+	dir, err := os.MkdirTemp("", "clamdtest")
+	if err != nil {
+		panic(fmt.Sprintf("clamdtest: failed to create a socket directory: %v", err))
+	}
+
+	path := filepath.Join(dir, "clamd.ctl")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		panic(fmt.Sprintf("clamdtest: failed to listen: %v", err))
+	}
+
+	return start(listener, "unix:"+path, opts)
+}
+
+func start(listener net.Listener, address string, opts []Option) *Server {
+	s := &Server{Address: address, listener: listener, streamMaxLength: DEFAULT_STREAM_MAX_LENGTH}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.conns.Add(1)
+	go s.serve()
+
+	return s
+}
+
+// Scans returns the number of streams scanned so far
+func (s *Server) Scans() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scans
+}
+
+// Block holds the replies to scans until Unblock is called
+func (s *Server) Block() {
+	s.gate.Lock()
+}
+
+func (s *Server) Unblock() {
+	s.gate.Unlock()
+}
+
+// Close stops the server and waits for its connections to finish
+func (s *Server) Close() {
+	s.listener.Close()
+	s.conns.Wait()
+
+	if path, ok := strings.CutPrefix(s.Address, "unix:"); ok {
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func (s *Server) serve() {
+	defer s.conns.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	prefix, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+
+	delimiter := byte('\n')
+	if prefix == 'z' {
+		delimiter = 0
+	}
+
+	command, err := reader.ReadString(delimiter)
+	if err != nil {
+		return
+	}
+
+	reply := func(message string) {
+		conn.Write(append([]byte(message), delimiter))
+	}
+
+	switch strings.TrimSuffix(command, string(delimiter)) {
+	case "PING":
+		reply("PONG")
+	case "INSTREAM":
+		content, err := s.readStream(reader)
+		if err != nil {
+			reply("INSTREAM size limit exceeded. ERROR")
+			// Let the client finish writing, so that it reads the reply
+			io.Copy(io.Discard, reader)
+			return
+		}
+
+		s.mu.Lock()
+		s.scans++
+		s.mu.Unlock()
+
+		s.gate.RLock()
+		defer s.gate.RUnlock()
+
+		if bytes.Contains(content, []byte(EICAR)) {
+			reply(fmt.Sprintf("stream: %s FOUND", SIGNATURE))
+		} else {
+			reply("stream: OK")
+		}
+	default:
+		reply("UNKNOWN COMMAND")
+	}
+}
+
+func (s *Server) readStream(reader io.Reader) ([]byte, error) {
+	var content []byte
+
+	for {
+		var size uint32
+		err := binary.Read(reader, binary.BigEndian, &size)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return content, nil
+		}
+		if len(content)+int(size) > s.streamMaxLength {
+			return nil, errors.New(fmt.Sprintf("Stream of %d bytes is too large", len(content)+int(size)))
+		}
+
+		chunk := make([]byte, size)
+		_, err = io.ReadFull(reader, chunk)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, chunk...)
+	}
+}
@@ -0,0 +1,240 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Size of the chunks streamed to clamd
+const CHUNK_SIZE = 64 * 1024
+
+const DEFAULT_TIMEOUT = time.Minute
+
+var ErrSizeLimit = errors.New("The file exceeds the stream size limit of clamd")
+
+// Scanner checks content for malware
+type Scanner interface {
+	Scan(ctx context.Context, content io.Reader) (Result, error)
+}
+
+type Result struct {
+	Infected bool
+	// Signature names the malware found in infected files
+	Signature string
+}
+
+// Clamd scans content with the INSTREAM command of a clamd daemon
+type Clamd struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+type ClamdOption func(c *Clamd)
+
+// WithTimeout limits the time taken by a scan, including the connection to
+// clamd. Zero means no limit
+func WithTimeout(timeout time.Duration) ClamdOption {
+	return func(c *Clamd) {
+		c.timeout = timeout
+	}
+}
+
+// NewClamd creates a client of the clamd daemon listening at address, given
+// as host:port, tcp:host:port or unix:/path/to/clamd.ctl
+func NewClamd(address string, opts ...ClamdOption) (*Clamd, error) {
+	c := &Clamd{network: "tcp", address: address, timeout: DEFAULT_TIMEOUT}
+
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		c.network, c.address = "unix", path
+	} else if hostPort, ok := strings.CutPrefix(address, "tcp:"); ok {
+		c.address = hostPort
+	}
+
+	if c.network == "unix" && c.address == "" {
+		return nil, errors.New(fmt.Sprintf("Invalid clamd address %q", address))
+	}
+	if c.network == "tcp" {
+		if _, _, err := net.SplitHostPort(c.address); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid clamd address %q, want host:port or unix:/path", address))
+		}
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// Scan streams content to clamd. Errors reported by clamd are returned
+// as errors, not as infected results
+func (c *Clamd) Scan(ctx context.Context, content io.Reader) (Result, error) {
+	conn, stop, err := c.dial(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer stop()
+
+	err = c.stream(conn, content)
+	if err != nil {
+		return Result{}, err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return parseReply(reply)
+}
+
+// CheckHealth pings clamd
+func (c *Clamd) CheckHealth(ctx context.Context) error {
+	conn, stop, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	_, err = conn.Write([]byte("zPING\x00"))
+	if err != nil {
+		return err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return errors.New(fmt.Sprintf("Unexpected reply of clamd: %q", reply))
+	}
+
+	return nil
+}
+
+// dial connects to clamd. The returned function closes the connection,
+// which is also interrupted when ctx is done
+func (c *Clamd) dial(ctx context.Context) (net.Conn, func(), error) {
+	cancel := func() {}
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stopInterrupt := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+
+	return conn, func() {
+		stopInterrupt()
+		cancel()
+		conn.Close()
+	}, nil
+}
+
+func (c *Clamd) stream(conn net.Conn, content io.Reader) error {
+	writer := bufio.NewWriterSize(conn, CHUNK_SIZE+4)
+
+	_, err := writer.WriteString("zINSTREAM\x00")
+	if err != nil {
+		return writeFailed(conn, err)
+	}
+
+	chunk := make([]byte, CHUNK_SIZE)
+	for {
+		n, err := io.ReadFull(content, chunk)
+		if n > 0 {
+			if err := writeChunk(writer, chunk[:n]); err != nil {
+				return writeFailed(conn, err)
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeChunk(writer, nil)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return writeFailed(conn, err)
+	}
+
+	return nil
+}
+
+// writeFailed returns the error reported by clamd before closing the
+// connection, such as when the stream is too large, or err otherwise
+func writeFailed(conn net.Conn, err error) error {
+	reply, replyErr := readReply(conn)
+	if replyErr != nil {
+		return err
+	}
+
+	_, replyErr = parseReply(reply)
+	if replyErr != nil {
+		return replyErr
+	}
+	return err
+}
+
+func writeChunk(writer *bufio.Writer, chunk []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+
+	_, err := writer.Write(size[:])
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(chunk)
+	return err
+}
+
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+// parseReply reads replies such as "stream: OK" and
+// "stream: Eicar-Test-Signature FOUND"
+func parseReply(reply string) (Result, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return Result{}, ErrSizeLimit
+	case strings.HasSuffix(reply, " ERROR"):
+		return Result{}, errors.New(fmt.Sprintf("clamd error: %s", strings.TrimSuffix(reply, " ERROR")))
+	default:
+		return Result{}, errors.New(fmt.Sprintf("Unexpected reply of clamd: %q", reply))
+	}
+}
@@ -0,0 +1,105 @@
+package scanner_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/scanner"
+	"github.com/olzhasar/go-fileserver/scanner/clamdtest"
+)
+
+func TestClamd(t *testing.T) {
+	servers := map[string]*clamdtest.Server{
+		"tcp":  clamdtest.NewServer(),
+		"unix": clamdtest.NewUnixServer(),
+	}
+
+	for network, server := range servers {
+		t.Run(network, func(t *testing.T) {
+			defer server.Close()
+
+			clamd, err := scanner.NewClamd(server.Address)
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+
+			result, err := clamd.Scan(context.Background(), strings.NewReader("hello world"))
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+			if result.Infected {
+				t.Errorf("Got %+v, want a clean result", result)
+			}
+
+			// The signature spans several chunks
+			content := strings.Repeat("a", scanner.CHUNK_SIZE-10) + clamdtest.EICAR
+			result, err = clamd.Scan(context.Background(), strings.NewReader(content))
+			if err != nil {
+				t.Fatalf("Expected no error, got %q", err)
+			}
+			want := scanner.Result{Infected: true, Signature: clamdtest.SIGNATURE}
+			if result != want {
+				t.Errorf("Got %+v, want %+v", result, want)
+			}
+
+			if server.Scans() != 2 {
+				t.Errorf("Got %d scans, want 2", server.Scans())
+			}
+
+			if err := clamd.CheckHealth(context.Background()); err != nil {
+				t.Errorf("Expected no error, got %q", err)
+			}
+		})
+	}
+}
+
+func TestClamdErrors(t *testing.T) {
+	t.Run("reports the size limit", func(t *testing.T) {
+		server := clamdtest.NewServer(clamdtest.WithStreamMaxLength(100))
+		defer server.Close()
+
+		clamd, _ := scanner.NewClamd(server.Address)
+
+		_, err := clamd.Scan(context.Background(), strings.NewReader(strings.Repeat("a", 101)))
+		if !errors.Is(err, scanner.ErrSizeLimit) {
+			t.Errorf("Got %v, want %v", err, scanner.ErrSizeLimit)
+		}
+	})
+	t.Run("times out", func(t *testing.T) {
+		server := clamdtest.NewServer()
+		defer server.Close()
+
+		clamd, _ := scanner.NewClamd(server.Address, scanner.WithTimeout(50*time.Millisecond))
+
+		server.Block()
+		_, err := clamd.Scan(context.Background(), strings.NewReader("hello world"))
+		server.Unblock()
+
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+	t.Run("fails when clamd is down", func(t *testing.T) {
+		server := clamdtest.NewServer()
+		server.Close()
+
+		clamd, _ := scanner.NewClamd(server.Address)
+
+		if _, err := clamd.Scan(context.Background(), strings.NewReader("hello world")); err == nil {
+			t.Error("Expected an error from Scan")
+		}
+		if err := clamd.CheckHealth(context.Background()); err == nil {
+			t.Error("Expected an error from CheckHealth")
+		}
+	})
+	t.Run("rejects invalid addresses", func(t *testing.T) {
+		for _, address := range []string{"", "localhost", "unix:", "tcp:3310"} {
+			if _, err := scanner.NewClamd(address); err == nil {
+				t.Errorf("Expected an error for %q", address)
+			}
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/manager"
+	"github.com/olzhasar/go-fileserver/preview"
+	"github.com/olzhasar/go-fileserver/storages"
+)
+
+// Share pages only fetch text previews up to this size
+const MAX_TEXT_PREVIEW_BYTES = 1 << 20
+
+// Previews may only be embedded by the share page and can't load anything.
+// PDF viewers need their own scripts and styles, so only framing is
+// restricted for them
+const PREVIEW_CONTENT_SECURITY_POLICY = "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; frame-ancestors 'self'"
+const PDF_CONTENT_SECURITY_POLICY = "frame-ancestors 'self'"
+
+// handlePreview serves files whose type is allowed by the inline policy
+// with an inline Content-Disposition, and other files as attachments.
+// Access is checked like downloads, and byte ranges are supported so that
+// audio and video can be seeked
+func (f *FileServer) handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, MSG_ERR_INVALID_REQUEST_METHOD, http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, MSG_ERR_MISSING_QUERY_PARAM, http.StatusBadRequest)
+		return
+	}
+
+	opts := manager.LoadOptions{Password: r.Header.Get(PASSWORD_HEADER)}
+
+	signed, valid := f.verifySignedQuery(r.URL.Query(), token)
+	if signed && !valid {
+		http.Error(w, MSG_ERR_INVALID_SIGNATURE, http.StatusForbidden)
+		return
+	}
+	opts.AllowPrivate = signed
+
+	upload, err := f.manager.LoadFile(r.Context(), token, opts)
+	if err != nil {
+		handleLoadError(w, r, token, err)
+		return
+	}
+	defer upload.File.Close()
+
+	mimeType := guessFileContentType(upload)
+	if !f.inlinePolicy().IsInline(mimeType) {
+		setFileHeaders(w, upload)
+		storages.CopyContext(r.Context(), w, upload.File)
+		return
+	}
+
+	policy := PREVIEW_CONTENT_SECURITY_POLICY
+	if preview.Kind(mimeType) == preview.KIND_PDF {
+		policy = PDF_CONTENT_SECURITY_POLICY
+	}
+
+	w.Header().Set("Content-Type", preview.ContentType(mimeType))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": upload.Name}))
+	w.Header().Set("Content-Security-Policy", policy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	seeker, ok := upload.File.(io.ReadSeeker)
+	if !ok {
+		w.Header().Set("Content-Length", strconv.FormatInt(upload.Size, 10))
+		storages.CopyContext(r.Context(), w, upload.File)
+		return
+	}
+
+	http.ServeContent(w, r, "", time.Time{}, seeker)
+}
+
+// previewFor returns the preview URL and kind shown on the share page of
+// info, or empty strings if the file can't be previewed there
+func (f *FileServer) previewFor(info manager.FileInfo, query string) (string, string) {
+	kind := preview.Kind(info.MimeType)
+
+	switch {
+	case kind == "" || info.Protected:
+		return "", ""
+	case !f.inlinePolicy().IsInline(info.MimeType):
+		return "", ""
+	case (kind == preview.KIND_TEXT || kind == preview.KIND_MARKDOWN) && info.Size > MAX_TEXT_PREVIEW_BYTES:
+		return "", ""
+	}
+
+	return PREVIEW_URL + "?" + query, kind
+}
@@ -1,17 +1,46 @@
 package server
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"math"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/loggers"
 	"github.com/olzhasar/go-fileserver/manager"
+	"github.com/olzhasar/go-fileserver/policy"
+	"github.com/olzhasar/go-fileserver/preview"
+	"github.com/olzhasar/go-fileserver/registry"
+	"github.com/olzhasar/go-fileserver/signer"
 	"github.com/olzhasar/go-fileserver/storages"
 )
 
 const UPLOAD_URL = "/upload"
 const DOWNLOAD_URL = "/download"
+const SIGN_URL = "/sign"
+const USAGE_URL = "/me/usage"
+const FILES_URL = "/me/files"
+const DELETE_URL = "/delete"
+const PREVIEW_URL = "/preview"
+const SHARE_URL = "/share/"
+const STATIC_URL = "/static/"
+
+const DEFAULT_SIGNED_URL_TTL = time.Hour
+const MAX_SIGNED_URL_TTL = 7 * 24 * time.Hour
+
+// Size of the largest form field accepted along with uploads
+const MAX_FORM_FIELD_SIZE = 4096
 
 const MSG_UPLOAD_SUCCESS = "File uploaded successfully"
 const MSG_ERR_INVALID_REQUEST_METHOD = "Invalid request method"
@@ -19,13 +48,122 @@ const MSG_ERR_CANNOT_READ_FILE = "Unable to read uploaded file"
 const MSG_ERR_FILE_NOT_FOUND = "File not found"
 const MSG_ERR_CANNOT_SEND_FILE = "Unable to send file"
 const MSG_ERR_MISSING_QUERY_PARAM = "Missing filename query param"
+const MSG_ERR_PASSWORD_REQUIRED = "Password required"
+const MSG_ERR_INVALID_PASSWORD = "Invalid password"
+const MSG_ERR_TOO_MANY_ATTEMPTS = "Too many failed password attempts"
+const MSG_ERR_INVALID_SIGNATURE = "Invalid or expired signed URL"
+const MSG_ERR_SIGNED_URL_REQUIRED = "This file requires a signed URL"
+const MSG_ERR_FILE_BLOCKED = "This file has been blocked"
+const MSG_ERR_FILE_EXPIRED = "This file has expired"
+const MSG_ERR_SIGNING_DISABLED = "URL signing is not configured"
+const MSG_ERR_UNAUTHORIZED = "Unauthorized"
+const MSG_ERR_INVALID_TTL = "Invalid ttl"
+const MSG_ERR_AUTHENTICATION_REQUIRED = "Authentication required"
+const MSG_ERR_INVALID_EXPIRY = "Invalid expires_in, want a positive duration such as 24h"
+const MSG_ERR_CANNOT_DESCRIBE_FILE = "Unable to describe file"
+const MSG_ERR_FILE_QUARANTINED = "This file has been quarantined because it is infected"
+const MSG_ERR_SCAN_PENDING = "This file is being scanned for viruses, try again shortly"
+const MSG_ERR_SCAN_FAILED = "Unable to scan the file for viruses, try again later"
+const MSG_ERR_NOT_UPLOADER = "Only the uploader can delete this file"
+
+var errInvalidExpiry = errors.New(MSG_ERR_INVALID_EXPIRY)
+
+// Header used by scripts to pass the password of a protected file
+const PASSWORD_HEADER = "X-File-Password"
+
+// Seconds clients are asked to wait for pending virus scans
+const SCAN_RETRY_AFTER = 5
+
+var passwordPromptTemplate = template.Must(template.New("prompt").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Password required</title></head>
+<body>
+<form method="POST" action="{{.Action}}">
+<p>This file is password protected.</p>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="password" name="password" autofocus>
+<button type="submit">Download</button>
+</form>
+</body>
+</html>
+`))
 
 type FileServer struct {
-	manager manager.SaverLoader
+	manager   manager.SaverLoader
+	signer    *signer.Signer
+	signToken string
+	signerMu  sync.RWMutex
+	inline    *preview.Policy
+	inlineMu  sync.RWMutex
+	logger    loggers.Logger
+	now       func() time.Time
+}
+
+type Option func(f *FileServer)
+
+// WithSigner enables signed download URLs. Signed URLs are minted by the
+// sign endpoint, which requires signToken as a bearer token or an identity
+// with the download-private scope
+func WithSigner(s *signer.Signer, signToken string) Option {
+	return func(f *FileServer) {
+		f.signer = s
+		f.signToken = signToken
+	}
+}
+
+// WithInlinePolicy sets the types of files previewed inline, by default
+// preview.DEFAULT_INLINE_TYPES
+func WithInlinePolicy(policy *preview.Policy) Option {
+	return func(f *FileServer) {
+		f.inline = policy
+	}
 }
 
-func NewFileServer(f manager.SaverLoader) *FileServer {
-	return &FileServer{f}
+func WithLogger(logger loggers.Logger) Option {
+	return func(f *FileServer) {
+		f.logger = logger
+	}
+}
+
+// SetSigner replaces the URL signer and sign token, a nil signer disables
+// signed URLs
+func (f *FileServer) SetSigner(s *signer.Signer, signToken string) {
+	f.signerMu.Lock()
+	defer f.signerMu.Unlock()
+
+	f.signer = s
+	f.signToken = signToken
+}
+
+func (f *FileServer) signing() (*signer.Signer, string) {
+	f.signerMu.RLock()
+	defer f.signerMu.RUnlock()
+	return f.signer, f.signToken
+}
+
+// SetInlinePolicy replaces the types of files previewed inline
+func (f *FileServer) SetInlinePolicy(policy *preview.Policy) {
+	f.inlineMu.Lock()
+	defer f.inlineMu.Unlock()
+	f.inline = policy
+}
+
+func (f *FileServer) inlinePolicy() *preview.Policy {
+	f.inlineMu.RLock()
+	defer f.inlineMu.RUnlock()
+	return f.inline
+}
+
+func NewFileServer(f manager.SaverLoader, opts ...Option) *FileServer {
+	inline, _ := preview.ParsePolicy(preview.DEFAULT_INLINE_TYPES)
+	server := &FileServer{manager: f, inline: inline, logger: loggers.NopLogger{}, now: time.Now}
+
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	return server
 }
 
 func (f *FileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -33,81 +171,544 @@ func (f *FileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	mux.HandleFunc("/upload", f.handleUpload)
 	mux.HandleFunc("/download", f.handleDownload)
+	mux.HandleFunc("/sign", f.handleSign)
+	mux.HandleFunc("/me/usage", f.handleUsage)
+	mux.HandleFunc("/me/files", f.handleFiles)
+	mux.HandleFunc(DELETE_URL, f.handleDelete)
+	mux.HandleFunc(PREVIEW_URL, f.handlePreview)
+	mux.HandleFunc(SHARE_URL, f.handleShare)
+	mux.HandleFunc(STATIC_URL, f.handleStatic)
 	mux.HandleFunc("/", f.handleRoot)
 
 	mux.ServeHTTP(w, req)
 }
 
-func (f *FileServer) handleRoot(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "Welcome to the FileServer. Use upload/ or download/ endpoints")
-}
-
 func (f *FileServer) handleUpload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, MSG_ERR_INVALID_REQUEST_METHOD, http.StatusMethodNotAllowed)
 		return
 	}
 
-	file, fileHeader, err := r.FormFile("file")
+	// The file is streamed to the manager, so limits are enforced while it
+	// is received rather than once it has been buffered
+	form, err := r.MultipartReader()
 	if err != nil {
 		http.Error(w, MSG_ERR_CANNOT_READ_FILE, http.StatusBadRequest)
 		return
 	}
 
-	token, err := f.manager.SaveFile(fileHeader.Filename, file)
+	fields := url.Values{}
+	file, err := readFormFields(form, fields)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, MSG_ERR_CANNOT_READ_FILE, http.StatusBadRequest)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	opts, err := f.saveOptions(fields)
+	if err != nil {
+		http.Error(w, MSG_ERR_INVALID_EXPIRY, http.StatusBadRequest)
+		return
+	}
+
+	// Fields may also follow the file, as they do with curl -F
+	opts.Trailer = func() (manager.SaveOptions, error) {
+		trailer := url.Values{}
+		for {
+			_, err := readFormFields(form, trailer)
+			if err == io.EOF {
+				return f.saveOptions(trailer)
+			}
+			if err != nil {
+				return manager.SaveOptions{}, err
+			}
+		}
+	}
+
+	token, err := f.manager.SaveFile(r.Context(), file.FileName(), file, opts)
+	if errors.Is(err, errInvalidExpiry) {
+		http.Error(w, MSG_ERR_INVALID_EXPIRY, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		f.handleSaveError(w, r, err)
+		return
+	}
 
 	downloadUrl := buildDownloadURL(r.Host, token)
+
+	// The web UI asks for JSON, scripts keep getting the plain download URL
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusOK, uploadResponse{
+			Token:    token,
+			URL:      downloadUrl,
+			ShareURL: buildShareURL(r.Host, token),
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, downloadUrl)
 }
 
+// readFormFields reads the form fields preceding the next file into fields
+// and returns the file unread, or io.EOF at the end of the form
+func readFormFields(form *multipart.Reader, fields url.Values) (*multipart.Part, error) {
+	for {
+		part, err := form.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			if part.FormName() == "file" {
+				return part, nil
+			}
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, MAX_FORM_FIELD_SIZE+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(value) > MAX_FORM_FIELD_SIZE {
+			return nil, errors.New(fmt.Sprintf("Form field %q is too long", part.FormName()))
+		}
+		fields.Add(part.FormName(), string(value))
+	}
+}
+
+// saveOptions reads the options of an upload from its form fields
+func (f *FileServer) saveOptions(fields url.Values) (manager.SaveOptions, error) {
+	opts := manager.SaveOptions{
+		Password: fields.Get("password"),
+		Private:  fields.Get("private") == "true",
+	}
+
+	if value := fields.Get("expires_in"); value != "" {
+		expiresIn, err := time.ParseDuration(value)
+		if err != nil || expiresIn <= 0 {
+			return manager.SaveOptions{}, errInvalidExpiry
+		}
+		opts.ExpiresAt = f.now().Add(expiresIn)
+	}
+
+	return opts, nil
+}
+
 func (f *FileServer) handleDownload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
+	if r.Method != "GET" && r.Method != "POST" {
 		http.Error(w, MSG_ERR_INVALID_REQUEST_METHOD, http.StatusBadRequest)
 		return
 	}
 
-	queryParams := r.URL.Query()
-	token := queryParams.Get("token")
+	token := r.FormValue("token")
 
 	if token == "" {
 		http.Error(w, MSG_ERR_MISSING_QUERY_PARAM, http.StatusBadRequest)
 		return
 	}
 
-	upload, err := f.manager.LoadFile(token)
+	opts := manager.LoadOptions{Password: r.Header.Get(PASSWORD_HEADER)}
+	if opts.Password == "" && r.Method == "POST" {
+		opts.Password = r.PostFormValue("password")
+	}
+
+	signed, valid := f.verifySignedQuery(r.URL.Query(), token)
+	if signed && !valid {
+		http.Error(w, MSG_ERR_INVALID_SIGNATURE, http.StatusForbidden)
+		return
+	}
+	opts.AllowPrivate = signed
+
+	upload, err := f.manager.LoadFile(r.Context(), token, opts)
 	if err != nil {
-		http.Error(w, MSG_ERR_FILE_NOT_FOUND, http.StatusNotFound)
+		handleLoadError(w, r, token, err)
 		return
 	}
 	defer upload.File.Close()
 
-	_, err = io.Copy(w, upload.File)
+	setFileHeaders(w, upload)
+
+	_, err = storages.CopyContext(r.Context(), w, upload.File)
+	if r.Context().Err() != nil {
+		loggers.FromContext(r.Context(), f.logger).Info("Download cancelled", "token", token)
+		return
+	}
 	if err != nil {
+		loggers.FromContext(r.Context(), f.logger).Error("Unable to send file", "token", token, "error", err)
 		http.Error(w, MSG_ERR_CANNOT_SEND_FILE, http.StatusInternalServerError)
 		return
 	}
+}
 
-	setFileHeaders(w, upload)
+func (f *FileServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, MSG_ERR_INVALID_REQUEST_METHOD, http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := f.manager.Usage(r.Context())
+	if errors.Is(err, manager.ErrAnonymousUsage) {
+		writeJSON(w, http.StatusUnauthorized, errorResponse{Error: MSG_ERR_AUTHENTICATION_REQUIRED})
+		return
+	}
+	if err != nil {
+		loggers.FromContext(r.Context(), f.logger).Error("Unable to report usage", "error", err)
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, usageResponse{
+		Uploader: report.Uploader,
+		Files:    report.Usage.Files,
+		Bytes:    report.Usage.Bytes,
+		Quota:    report.Quota,
+	})
+}
+
+// handleFiles lists the files uploaded by the authenticated identity,
+// filtered, sorted and paged by the query params of registry.ParseListQuery
+func (f *FileServer) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, MSG_ERR_INVALID_REQUEST_METHOD, http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := registry.ParseListQuery(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	page, err := f.manager.ListFiles(r.Context(), query)
+	switch {
+	case errors.Is(err, manager.ErrAnonymousListing):
+		writeJSON(w, http.StatusUnauthorized, errorResponse{Error: MSG_ERR_AUTHENTICATION_REQUIRED})
+		return
+	case errors.Is(err, registry.ErrInvalidCursor):
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	case err != nil:
+		loggers.FromContext(r.Context(), f.logger).Error("Unable to list files", "error", err)
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+
+	response := filesResponse{Files: make([]fileResponse, 0, len(page.Files)), NextCursor: page.NextCursor}
+	for _, file := range page.Files {
+		response.Files = append(response.Files, fileResponse{
+			Token:      file.Token,
+			FileName:   file.FileName,
+			URL:        buildDownloadURL(r.Host, file.Token),
+			Size:       file.Size,
+			MimeType:   file.MimeType,
+			Private:    file.Private,
+			Protected:  file.Protected,
+			Blocked:    file.Blocked,
+			ScanStatus: file.ScanStatus,
+			CreatedAt:  timeOrNil(file.CreatedAt),
+			ExpiresAt:  timeOrNil(file.ExpiresAt),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleSign mints a signed download URL for the token form value, valid
+// for the optional ttl duration, e.g. 30m
+// handleDelete deletes the file of the token query param if the
+// authenticated identity uploaded it or has the delete-any scope
+func (f *FileServer) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, MSG_ERR_INVALID_REQUEST_METHOD, http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: MSG_ERR_MISSING_QUERY_PARAM})
+		return
+	}
+
+	err := f.manager.RemoveFile(r.Context(), token)
+	switch {
+	case errors.Is(err, manager.ErrAnonymousDelete):
+		writeJSON(w, http.StatusUnauthorized, errorResponse{Error: MSG_ERR_AUTHENTICATION_REQUIRED})
+		return
+	case errors.Is(err, manager.ErrInvalidToken):
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: MSG_ERR_FILE_NOT_FOUND})
+		return
+	case errors.Is(err, manager.ErrNotUploader):
+		writeJSON(w, http.StatusForbidden, errorResponse{Error: MSG_ERR_NOT_UPLOADER})
+		return
+	case err != nil:
+		loggers.FromContext(r.Context(), f.logger).Error("Unable to delete file", "error", err)
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *FileServer) handleSign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, MSG_ERR_INVALID_REQUEST_METHOD, http.StatusMethodNotAllowed)
+		return
+	}
+
+	urlSigner, signToken := f.signing()
+	if urlSigner == nil {
+		http.Error(w, MSG_ERR_SIGNING_DISABLED, http.StatusNotFound)
+		return
+	}
+
+	if !isSignAuthorized(r, signToken) {
+		http.Error(w, MSG_ERR_UNAUTHORIZED, http.StatusUnauthorized)
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, MSG_ERR_MISSING_QUERY_PARAM, http.StatusBadRequest)
+		return
+	}
+
+	ttl := DEFAULT_SIGNED_URL_TTL
+	if value := r.FormValue("ttl"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 || parsed > MAX_SIGNED_URL_TTL {
+			http.Error(w, MSG_ERR_INVALID_TTL, http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	signedUrl := urlSigner.SignURL(r.Host+DOWNLOAD_URL, token, f.now().Add(ttl))
+	fmt.Fprint(w, signedUrl)
+}
+
+// verifySignedQuery reports whether query carries a signature and whether
+// the signature is valid for token. The token of requests is read from
+// their form, where POST bodies take precedence over the query, so it must
+// be the token the query was signed for
+func (f *FileServer) verifySignedQuery(query url.Values, token string) (signed, valid bool) {
+	if !query.Has(signer.SIGNATURE_PARAM) {
+		return false, false
+	}
+
+	urlSigner, _ := f.signing()
+	return true, urlSigner != nil && query.Get("token") == token && urlSigner.VerifyQuery(query, f.now()) == nil
+}
+
+func isSignAuthorized(r *http.Request, signToken string) bool {
+	if auth.IdentityFromContext(r.Context()).HasScope(auth.ScopeDownloadPrivate) {
+		return true
+	}
+
+	if signToken == "" {
+		return false
+	}
+
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(bearer), []byte(signToken)) == 1
+}
+
+// handleSaveError responds to exceeded per-user quotas and size limits
+// with 413, to exceeded global quotas with 507 and to other violations of
+// the upload policy with 415. Infected files are rejected with 422, and
+// uploads that couldn't be scanned with 503
+func (f *FileServer) handleSaveError(w http.ResponseWriter, r *http.Request, err error) {
+	var infected *manager.InfectedError
+	if errors.As(err, &infected) {
+		writeJSON(w, http.StatusUnprocessableEntity, infectedErrorResponse{Error: infected.Error(), Signature: infected.Signature})
+		return
+	}
+
+	if errors.Is(err, manager.ErrScanFailed) {
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: MSG_ERR_SCAN_FAILED})
+		return
+	}
+
+	var violation *policy.Violation
+	if errors.As(err, &violation) {
+		status := http.StatusUnsupportedMediaType
+		if violation.Reason == policy.REASON_TOO_LARGE {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		writeJSON(w, status, policyErrorResponse{
+			Error:         violation.Error(),
+			Reason:        violation.Reason,
+			DetectedType:  violation.DetectedType,
+			ExtensionType: violation.ExtensionType,
+			MaxSize:       violation.MaxSize,
+		})
+		return
+	}
+
+	var exceeded *manager.QuotaExceededError
+	if !errors.As(err, &exceeded) {
+		loggers.FromContext(r.Context(), f.logger).Error("Unable to save upload", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusRequestEntityTooLarge
+	if exceeded.Scope == manager.QUOTA_GLOBAL {
+		status = http.StatusInsufficientStorage
+	}
+
+	writeJSON(w, status, quotaErrorResponse{
+		Error: exceeded.Error(),
+		Quota: exceeded.Scope,
+		Limit: exceeded.Limit,
+		Max:   exceeded.Max,
+	})
+}
+
+func handleLoadError(w http.ResponseWriter, r *http.Request, token string, err error) {
+	var tooMany *manager.TooManyAttemptsError
+
+	switch {
+	case errors.Is(err, manager.ErrPasswordRequired):
+		promptPassword(w, r, token, MSG_ERR_PASSWORD_REQUIRED, "")
+	case errors.Is(err, manager.ErrInvalidPassword):
+		promptPassword(w, r, token, MSG_ERR_INVALID_PASSWORD, MSG_ERR_INVALID_PASSWORD)
+	case errors.Is(err, manager.ErrPrivateFile):
+		http.Error(w, MSG_ERR_SIGNED_URL_REQUIRED, http.StatusForbidden)
+	case errors.Is(err, manager.ErrBlockedFile):
+		http.Error(w, MSG_ERR_FILE_BLOCKED, http.StatusGone)
+	case errors.Is(err, manager.ErrExpiredFile):
+		http.Error(w, MSG_ERR_FILE_EXPIRED, http.StatusGone)
+	case errors.Is(err, manager.ErrQuarantinedFile):
+		http.Error(w, MSG_ERR_FILE_QUARANTINED, http.StatusGone)
+	case errors.Is(err, manager.ErrScanPending):
+		w.Header().Set("Retry-After", strconv.Itoa(SCAN_RETRY_AFTER))
+		http.Error(w, MSG_ERR_SCAN_PENDING, http.StatusConflict)
+	case errors.As(err, &tooMany):
+		retryAfter := int(math.Ceil(tooMany.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, MSG_ERR_TOO_MANY_ATTEMPTS, http.StatusTooManyRequests)
+	default:
+		http.Error(w, MSG_ERR_FILE_NOT_FOUND, http.StatusNotFound)
+	}
+}
+
+// promptPassword responds with 401. Browsers get an HTML form posting the
+// password back to the download endpoint, other clients a plain message
+func promptPassword(w http.ResponseWriter, r *http.Request, token, message, htmlMessage string) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, message, http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+
+	passwordPromptTemplate.Execute(w, struct {
+		Action  string
+		Token   string
+		Message string
+	}{DOWNLOAD_URL, token, htmlMessage})
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type quotaErrorResponse struct {
+	Error string `json:"error"`
+	Quota string `json:"quota"`
+	Limit string `json:"limit"`
+	Max   int64  `json:"max"`
+}
+
+type policyErrorResponse struct {
+	Error         string `json:"error"`
+	Reason        string `json:"reason"`
+	DetectedType  string `json:"detected_type,omitempty"`
+	ExtensionType string `json:"extension_type,omitempty"`
+	MaxSize       int64  `json:"max_size,omitempty"`
+}
+
+type infectedErrorResponse struct {
+	Error     string `json:"error"`
+	Signature string `json:"signature"`
+}
+
+type uploadResponse struct {
+	Token    string `json:"token"`
+	URL      string `json:"url"`
+	ShareURL string `json:"share_url"`
+}
+
+type usageResponse struct {
+	Uploader string        `json:"uploader"`
+	Files    int64         `json:"files"`
+	Bytes    int64         `json:"bytes"`
+	Quota    manager.Quota `json:"quota"`
+}
+
+type fileResponse struct {
+	Token     string `json:"token"`
+	FileName  string `json:"filename"`
+	URL       string `json:"url"`
+	Size      int64  `json:"size"`
+	MimeType  string `json:"mime_type,omitempty"`
+	Private   bool   `json:"private"`
+	Protected bool   `json:"protected"`
+	Blocked   bool   `json:"blocked"`
+	// ScanStatus is set for files uploaded while scanning was enabled
+	ScanStatus string     `json:"scan_status,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+type filesResponse struct {
+	Files      []fileResponse `json:"files"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
 }
 
 func buildDownloadURL(host string, token string) string {
 	return host + DOWNLOAD_URL + "?token=" + token
 }
 
+func buildShareURL(host string, token string) string {
+	return host + SHARE_URL + token
+}
+
 func setFileHeaders(w http.ResponseWriter, upload storages.UploadedFile) {
 	w.Header().Set("Content-Length", strconv.FormatInt(upload.Size, 10))
 	w.Header().Set("Content-Disposition", "attachment; filename="+upload.Name)
 	w.Header().Set("Content-Type", guessFileContentType(upload))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 }
 
+// guessFileContentType prefers the type detected on upload to the one of
+// the file name extension
 func guessFileContentType(upload storages.UploadedFile) string {
+	if upload.MimeType != "" {
+		return upload.MimeType
+	}
+
 	contentType := upload.MimeTypeByExt()
 	if contentType == "" {
 		contentType = "application/octet-stream"
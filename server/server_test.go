@@ -2,55 +2,205 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/olzhasar/go-fileserver/auth"
+	"github.com/olzhasar/go-fileserver/manager"
+	"github.com/olzhasar/go-fileserver/policy"
+	"github.com/olzhasar/go-fileserver/preview"
+	"github.com/olzhasar/go-fileserver/registry"
+	"github.com/olzhasar/go-fileserver/signer"
 	"github.com/olzhasar/go-fileserver/storages"
 )
 
 type StubFile struct {
-	fileName string
-	content  string
+	fileName  string
+	content   string
+	password  string
+	private   bool
+	uploader  string
+	expiresAt time.Time
+	// mimeType stands for the type detected on upload
+	mimeType string
+	// err is returned by LoadFile and DescribeFile, e.g. for scanned files
+	err error
 }
 
 type StubFileManager struct {
-	data map[string]StubFile
+	data      map[string]StubFile
+	saveErr   error
+	saveOpts  manager.SaveOptions
+	listQuery registry.ListQuery
 }
 
-func (s *StubFileManager) SaveFile(fileName string, content io.Reader) (token string, err error) {
-	token = "token"
+func (s *StubFileManager) SaveFile(ctx context.Context, fileName string, content io.Reader, opts manager.SaveOptions) (token string, err error) {
+	s.saveOpts = opts
+	if s.saveErr != nil {
+		return "", s.saveErr
+	}
 	buf := new(strings.Builder)
 	io.Copy(buf, content)
-	s.data[token] = StubFile{fileName, buf.String()}
+	if opts.Trailer != nil {
+		trailer, err := opts.Trailer()
+		if err != nil {
+			return "", err
+		}
+		if trailer.Password != "" {
+			opts.Password = trailer.Password
+		}
+		opts.Private = opts.Private || trailer.Private
+		if !trailer.ExpiresAt.IsZero() {
+			opts.ExpiresAt = trailer.ExpiresAt
+		}
+	}
+	token = "token"
+	if opts.Password != "" {
+		token = "protected"
+	}
+	if opts.Private {
+		token = "private"
+	}
+	uploader := ""
+	if identity := auth.IdentityFromContext(ctx); identity != nil {
+		uploader = identity.Name
+	}
+	s.data[token] = StubFile{fileName, buf.String(), opts.Password, opts.Private, uploader, opts.ExpiresAt, "", nil}
 	return token, nil
 }
 
-func (s *StubFileManager) LoadFile(token string) (upload storages.UploadedFile, err error) {
+func (s *StubFileManager) LoadFile(ctx context.Context, token string, opts manager.LoadOptions) (upload storages.UploadedFile, err error) {
 	loaded, ok := s.data[token]
 	if !ok {
 		return storages.UploadedFile{}, errors.New(fmt.Sprintf("token %q is missing", token))
 	}
+	if loaded.err != nil {
+		return storages.UploadedFile{}, loaded.err
+	}
 
-	buf := &bytes.Buffer{}
-	buf.WriteString(loaded.content)
+	allowPrivate := opts.AllowPrivate || auth.IdentityFromContext(ctx).HasScope(auth.ScopeDownloadPrivate)
+	if loaded.private && !allowPrivate {
+		return storages.UploadedFile{}, manager.ErrPrivateFile
+	}
 
-	f := storages.InMemoryFile{Buffer: buf}
+	password := opts.Password
+	if loaded.password != "" {
+		if password == "" {
+			return storages.UploadedFile{}, manager.ErrPasswordRequired
+		}
+		if password == "locked" {
+			return storages.UploadedFile{}, &manager.TooManyAttemptsError{RetryAfter: 1500 * time.Millisecond}
+		}
+		if password != loaded.password {
+			return storages.UploadedFile{}, manager.ErrInvalidPassword
+		}
+	}
+
+	f := storages.InMemoryFile{Buffer: strings.NewReader(loaded.content)}
 	size := int64(len(loaded.content))
 
-	return storages.UploadedFile{File: f, Name: loaded.fileName, Size: size}, nil
+	return storages.UploadedFile{File: f, Name: loaded.fileName, Size: size, MimeType: loaded.mimeType}, nil
+}
+
+func (s *StubFileManager) Usage(ctx context.Context) (manager.UsageReport, error) {
+	identity := auth.IdentityFromContext(ctx)
+	if identity == nil {
+		return manager.UsageReport{}, manager.ErrAnonymousUsage
+	}
+
+	report := manager.UsageReport{Uploader: identity.Name, Quota: manager.Quota{MaxFiles: 10, MaxBytes: 1024}}
+	for _, file := range s.data {
+		if file.uploader == identity.Name {
+			report.Usage.Files++
+			report.Usage.Bytes += int64(len(file.content))
+		}
+	}
+
+	return report, nil
+}
+
+func (s *StubFileManager) ListFiles(ctx context.Context, query registry.ListQuery) (registry.ListPage, error) {
+	identity := auth.IdentityFromContext(ctx)
+	if identity == nil {
+		return registry.ListPage{}, manager.ErrAnonymousListing
+	}
+	if query.Cursor == "invalid" {
+		return registry.ListPage{}, registry.ErrInvalidCursor
+	}
+	s.listQuery = query
+
+	var page registry.ListPage
+	for token, file := range s.data {
+		if file.uploader == identity.Name {
+			page.Files = append(page.Files, registry.File{
+				Token:    token,
+				FileName: file.fileName,
+				Private:  file.private,
+				Metadata: registry.Metadata{Uploader: file.uploader, Size: int64(len(file.content))},
+			})
+		}
+	}
+
+	return page, nil
+}
+
+func (s *StubFileManager) RemoveFile(ctx context.Context, token string) error {
+	identity := auth.IdentityFromContext(ctx)
+	if identity == nil {
+		return manager.ErrAnonymousDelete
+	}
+
+	file, ok := s.data[token]
+	if !ok {
+		return manager.ErrInvalidToken
+	}
+	if file.uploader != identity.Name && !identity.HasScope(auth.ScopeDeleteAny) {
+		return manager.ErrNotUploader
+	}
+
+	delete(s.data, token)
+	return nil
+}
+
+func (s *StubFileManager) DescribeFile(ctx context.Context, token string, opts manager.LoadOptions) (manager.FileInfo, error) {
+	file, ok := s.data[token]
+	if !ok {
+		return manager.FileInfo{}, manager.ErrInvalidToken
+	}
+	if file.err != nil {
+		return manager.FileInfo{}, file.err
+	}
+	if file.private && !opts.AllowPrivate {
+		return manager.FileInfo{}, manager.ErrPrivateFile
+	}
+
+	return manager.FileInfo{
+		FileName:  file.fileName,
+		Size:      int64(len(file.content)),
+		MimeType:  mime.TypeByExtension(filepath.Ext(file.fileName)),
+		Protected: file.password != "",
+		ExpiresAt: file.expiresAt,
+	}, nil
 }
 
 func NewStubFileManager() *StubFileManager {
 	data := make(map[string]StubFile)
-	return &StubFileManager{data}
+	return &StubFileManager{data: data}
 }
 
 func TestRoot(t *testing.T) {
@@ -63,6 +213,118 @@ func TestRoot(t *testing.T) {
 	server.ServeHTTP(response, request)
 
 	assertResponseStatus(t, response, http.StatusOK)
+	assertResponseHeader(t, response, "Content-Type", []string{"text/html; charset=utf-8"})
+
+	if !strings.Contains(response.Body.String(), `action="/upload"`) {
+		t.Errorf("Want the upload form, got %q", response.Body.String())
+	}
+}
+
+func TestUI(t *testing.T) {
+	mgr := NewStubFileManager()
+	server := NewFileServer(mgr)
+
+	t.Run("serves embedded assets", func(t *testing.T) {
+		for _, path := range []string{STATIC_URL + "app.js", STATIC_URL + "style.css"} {
+			request := httptest.NewRequest(http.MethodGet, path, nil)
+			response := httptest.NewRecorder()
+
+			server.ServeHTTP(response, request)
+
+			assertResponseStatus(t, response, http.StatusOK)
+		}
+	})
+	t.Run("does not list assets", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, STATIC_URL, nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusNotFound)
+	})
+	t.Run("returns 404 for unknown paths", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/unknown", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusNotFound)
+	})
+	t.Run("loads nothing from other origins", func(t *testing.T) {
+		for _, name := range []string{"index.html", "share.html"} {
+			page, _ := uiFiles.ReadFile("ui/" + name)
+			if strings.Contains(string(page), "http://") || strings.Contains(string(page), "https://") {
+				t.Errorf("Want %s to use local assets only", name)
+			}
+		}
+	})
+}
+
+func TestSharePage(t *testing.T) {
+	mgr := NewStubFileManager()
+	key := signer.Key{ID: "k1", Secret: []byte("secret")}
+	sign, _ := signer.NewSigner(key)
+	server := NewFileServer(mgr, WithSigner(sign, "sign-token"))
+
+	mgr.data["token"] = StubFile{fileName: "report.txt", content: strings.Repeat("a", 1536)}
+	mgr.data["protected"] = StubFile{fileName: "secret.txt", content: "secret", password: "password"}
+	mgr.data["private"] = StubFile{fileName: "private.txt", content: "private", private: true}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("describes the file", func(t *testing.T) {
+		response := get(SHARE_URL + "token")
+
+		assertResponseStatus(t, response, http.StatusOK)
+		for _, want := range []string{"report.txt", "1.5 KB", "text/plain", `href="/download?token=token"`} {
+			if !strings.Contains(response.Body.String(), want) {
+				t.Errorf("Want %q in the page", want)
+			}
+		}
+	})
+	t.Run("asks for the password of protected files", func(t *testing.T) {
+		response := get(SHARE_URL + "protected")
+
+		assertResponseStatus(t, response, http.StatusOK)
+		if !strings.Contains(response.Body.String(), `type="password"`) {
+			t.Error("Want a password field")
+		}
+	})
+	t.Run("passes signatures on to the download", func(t *testing.T) {
+		query := sign.SignQuery("private", time.Now().Add(time.Minute))
+		response := get(SHARE_URL + "private?" + query.Encode())
+
+		assertResponseStatus(t, response, http.StatusOK)
+		if !strings.Contains(response.Body.String(), template.HTMLEscapeString(query.Get(signer.SIGNATURE_PARAM))) {
+			t.Error("Want the signature in the download link")
+		}
+	})
+	t.Run("embeds previews", func(t *testing.T) {
+		response := get(SHARE_URL + "token")
+		if !strings.Contains(response.Body.String(), `data-src="/preview?token=token"`) {
+			t.Error("Want a text preview")
+		}
+
+		response = get(SHARE_URL + "protected")
+		if strings.Contains(response.Body.String(), PREVIEW_URL) {
+			t.Error("Want no preview of protected files")
+		}
+	})
+	t.Run("rejects private files without signature", func(t *testing.T) {
+		assertResponseStatus(t, get(SHARE_URL+"private"), http.StatusForbidden)
+	})
+	t.Run("rejects invalid signatures", func(t *testing.T) {
+		assertResponseStatus(t, get(SHARE_URL+"private?sig=forged"), http.StatusForbidden)
+	})
+	t.Run("returns 404 for unknown tokens", func(t *testing.T) {
+		assertResponseStatus(t, get(SHARE_URL+"unknown"), http.StatusNotFound)
+		assertResponseStatus(t, get(SHARE_URL), http.StatusNotFound)
+	})
 }
 
 func TestUpload(t *testing.T) {
@@ -98,6 +360,64 @@ func TestUpload(t *testing.T) {
 		}
 
 		assertFileUploadedProperly(t, mgr, token, fileContent)
+
+	})
+	t.Run("records authenticated uploader", func(t *testing.T) {
+		request := createFileUploadRequest(http.MethodPost, "file", "test_file.txt", "test content")
+		identity := &auth.Identity{Name: "alice", Scopes: []auth.Scope{auth.ScopeUpload}}
+		request = request.WithContext(auth.WithIdentity(request.Context(), identity))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusOK)
+
+		if mgr.data["token"].uploader != "alice" {
+			t.Errorf("Got uploader %q, want %q", mgr.data["token"].uploader, "alice")
+		}
+	})
+	t.Run("sets expiry", func(t *testing.T) {
+		now := time.Now()
+		server.now = func() time.Time { return now }
+		defer func() { server.now = time.Now }()
+
+		request := createFileUploadRequest(http.MethodPost, "file", "test_file.txt", "test content", "expires_in", "24h")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusOK)
+		if got := mgr.data["token"].expiresAt; !got.Equal(now.Add(24 * time.Hour)) {
+			t.Errorf("Got expiry %v, want %v", got, now.Add(24*time.Hour))
+		}
+	})
+	t.Run("rejects invalid expiry", func(t *testing.T) {
+		for _, value := range []string{"tomorrow", "-1h"} {
+			request := createFileUploadRequest(http.MethodPost, "file", "test_file.txt", "test content", "expires_in", value)
+			response := httptest.NewRecorder()
+
+			server.ServeHTTP(response, request)
+
+			assertResponseStatus(t, response, http.StatusBadRequest)
+			assertResponseBody(t, response, MSG_ERR_INVALID_EXPIRY+"\n")
+		}
+	})
+	t.Run("responds with JSON on request", func(t *testing.T) {
+		request := createFileUploadRequest(http.MethodPost, "file", "test_file.txt", "test content")
+		request.Header.Set("Accept", "application/json")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusOK)
+
+		var body uploadResponse
+		json.Unmarshal(response.Body.Bytes(), &body)
+
+		want := uploadResponse{Token: "token", URL: "example.com/download?token=token", ShareURL: "example.com/share/token"}
+		if body != want {
+			t.Errorf("Got %+v, want %+v", body, want)
+		}
 	})
 	t.Run("throws error for invalid request method", func(t *testing.T) {
 		fileName := "test_file.txt"
@@ -140,7 +460,7 @@ func TestDownload(t *testing.T) {
 		buf := &bytes.Buffer{}
 		buf.WriteString(fileContent)
 
-		token, _ := mgr.SaveFile(fileName, buf)
+		token, _ := mgr.SaveFile(context.Background(), fileName, buf, manager.SaveOptions{})
 
 		request := httptest.NewRequest(http.MethodGet, buildDownloadUrl(token), nil)
 		response := httptest.NewRecorder()
@@ -151,6 +471,18 @@ func TestDownload(t *testing.T) {
 		assertResponseBody(t, response, fileContent)
 		assertResponseFileHeaders(t, response, fileName, fileContent)
 	})
+	t.Run("serves the type detected on upload", func(t *testing.T) {
+		mgr.data["detected"] = StubFile{fileName: "photo.txt", content: "\x89PNG", mimeType: "image/png"}
+
+		request := httptest.NewRequest(http.MethodGet, buildDownloadUrl("detected"), nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusOK)
+		assertResponseHeader(t, response, "Content-Type", []string{"image/png"})
+		assertResponseHeader(t, response, "X-Content-Type-Options", []string{"nosniff"})
+	})
 	t.Run("returns error if filename query param is missing", func(t *testing.T) {
 		request := httptest.NewRequest(http.MethodGet, DOWNLOAD_URL, nil)
 		response := httptest.NewRecorder()
@@ -170,13 +502,642 @@ func TestDownload(t *testing.T) {
 
 		assertResponseStatus(t, response, http.StatusNotFound)
 	})
+	t.Run("returns 410 for blocked and expired files", func(t *testing.T) {
+		for _, err := range []error{manager.ErrBlockedFile, manager.ErrExpiredFile} {
+			request := httptest.NewRequest(http.MethodGet, buildDownloadUrl("token"), nil)
+			response := httptest.NewRecorder()
+
+			handleLoadError(response, request, "token", err)
+
+			assertResponseStatus(t, response, http.StatusGone)
+		}
+	})
+}
+
+func TestProtectedDownload(t *testing.T) {
+	mgr := NewStubFileManager()
+	server := NewFileServer(mgr)
+
+	fileName := "secret.txt"
+	fileContent := "secret content"
+
+	request := createFileUploadRequest(http.MethodPost, "file", fileName, fileContent, "password", "hunter2")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	downloadUrl := DOWNLOAD_URL + "?token=protected"
+
+	t.Run("upload stores password", func(t *testing.T) {
+		if mgr.data["protected"].password != "hunter2" {
+			t.Fatalf("Got password %q, want %q", mgr.data["protected"].password, "hunter2")
+		}
+	})
+	t.Run("returns 401 without password", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, downloadUrl, nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusUnauthorized)
+		assertResponseBody(t, response, MSG_ERR_PASSWORD_REQUIRED+"\n")
+	})
+	t.Run("returns password prompt for browsers", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, downloadUrl, nil)
+		request.Header.Set("Accept", "text/html,application/xhtml+xml")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusUnauthorized)
+		assertResponseHeader(t, response, "Content-Type", []string{"text/html; charset=utf-8"})
+
+		body := response.Body.String()
+		if !strings.Contains(body, `<input type="password" name="password"`) {
+			t.Errorf("Password input missing from prompt %q", body)
+		}
+		if !strings.Contains(body, `value="protected"`) {
+			t.Errorf("Token missing from prompt %q", body)
+		}
+	})
+	t.Run("accepts password via header", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, downloadUrl, nil)
+		request.Header.Set(PASSWORD_HEADER, "hunter2")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusOK)
+		assertResponseBody(t, response, fileContent)
+	})
+	t.Run("accepts password via form POST", func(t *testing.T) {
+		form := url.Values{"token": {"protected"}, "password": {"hunter2"}}
+		request := httptest.NewRequest(http.MethodPost, DOWNLOAD_URL, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusOK)
+		assertResponseBody(t, response, fileContent)
+	})
+	t.Run("returns 401 for invalid password", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, downloadUrl, nil)
+		request.Header.Set(PASSWORD_HEADER, "wrong")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusUnauthorized)
+		assertResponseBody(t, response, MSG_ERR_INVALID_PASSWORD+"\n")
+	})
+	t.Run("returns 429 while token is locked", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, downloadUrl, nil)
+		request.Header.Set(PASSWORD_HEADER, "locked")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusTooManyRequests)
+		assertResponseHeader(t, response, "Retry-After", []string{"2"})
+	})
+}
+
+func TestSignedDownload(t *testing.T) {
+	mgr := NewStubFileManager()
+	key := signer.Key{ID: "k1", Secret: []byte("secret")}
+	sign, _ := signer.NewSigner(key)
+	server := NewFileServer(mgr, WithSigner(sign, "sign-token"))
+
+	now := time.Now()
+	server.now = func() time.Time { return now }
+
+	fileName := "private.txt"
+	fileContent := "private content"
+
+	request := createFileUploadRequest(http.MethodPost, "file", fileName, fileContent, "private", "true")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	t.Run("rejects unsigned download of private file", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, DOWNLOAD_URL+"?token=private", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusForbidden)
+		assertResponseBody(t, response, MSG_ERR_SIGNED_URL_REQUIRED+"\n")
+	})
+	t.Run("downloads with signed URL", func(t *testing.T) {
+		signedUrl := sign.SignURL(DOWNLOAD_URL, "private", now.Add(time.Minute))
+
+		request := httptest.NewRequest(http.MethodGet, signedUrl, nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusOK)
+		assertResponseBody(t, response, fileContent)
+	})
+	t.Run("downloads private file with download-private scope", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, DOWNLOAD_URL+"?token=private", nil)
+		identity := &auth.Identity{Name: "alice", Scopes: []auth.Scope{auth.ScopeDownloadPrivate}}
+		request = request.WithContext(auth.WithIdentity(request.Context(), identity))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusOK)
+		assertResponseBody(t, response, fileContent)
+	})
+	t.Run("rejects expired signed URL", func(t *testing.T) {
+		signedUrl := sign.SignURL(DOWNLOAD_URL, "private", now.Add(-time.Minute))
+
+		request := httptest.NewRequest(http.MethodGet, signedUrl, nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusForbidden)
+		assertResponseBody(t, response, MSG_ERR_INVALID_SIGNATURE+"\n")
+	})
+	t.Run("rejects signature for a token other than the posted one", func(t *testing.T) {
+		mgr.data["other"] = StubFile{fileName: "other.txt", content: "other content", private: true}
+		defer delete(mgr.data, "other")
+
+		query := sign.SignQuery("private", now.Add(time.Minute))
+		request := httptest.NewRequest(http.MethodPost, DOWNLOAD_URL+"?"+query.Encode(), strings.NewReader("token=other"))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusForbidden)
+		assertResponseBody(t, response, MSG_ERR_INVALID_SIGNATURE+"\n")
+	})
+	t.Run("rejects signature for another token", func(t *testing.T) {
+		query := sign.SignQuery("token", now.Add(time.Minute))
+		query.Set("token", "private")
+
+		request := httptest.NewRequest(http.MethodGet, DOWNLOAD_URL+"?"+query.Encode(), nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusForbidden)
+	})
+	t.Run("sign endpoint requires authorization", func(t *testing.T) {
+		request := createSignRequest("private", "")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusUnauthorized)
+
+		request = createSignRequest("private", "")
+		request.Header.Set("Authorization", "Bearer wrong")
+		response = httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusUnauthorized)
+	})
+	t.Run("sign endpoint mints working URL", func(t *testing.T) {
+		request := createSignRequest("private", "30m")
+		request.Header.Set("Authorization", "Bearer sign-token")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusOK)
+
+		parsedUrl, err := url.Parse(response.Body.String())
+		if err != nil {
+			t.Fatalf("Invalid signed url %q returned", response.Body.String())
+		}
+
+		wantExpiry := fmt.Sprint(now.Add(30 * time.Minute).Unix())
+		if got := parsedUrl.Query().Get(signer.EXPIRY_PARAM); got != wantExpiry {
+			t.Errorf("Got expiry %q, want %q", got, wantExpiry)
+		}
+
+		if err := sign.VerifyQuery(parsedUrl.Query(), now); err != nil {
+			t.Errorf("Expected valid signature, got %q", err)
+		}
+	})
+	t.Run("sign endpoint accepts download-private identity", func(t *testing.T) {
+		request := createSignRequest("private", "")
+		identity := &auth.Identity{Name: "alice", Scopes: []auth.Scope{auth.ScopeDownloadPrivate}}
+		request = request.WithContext(auth.WithIdentity(request.Context(), identity))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusOK)
+	})
+	t.Run("sign endpoint rejects invalid ttl", func(t *testing.T) {
+		request := createSignRequest("private", "1000h")
+		request.Header.Set("Authorization", "Bearer sign-token")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusBadRequest)
+		assertResponseBody(t, response, MSG_ERR_INVALID_TTL+"\n")
+	})
+	t.Run("uses replaced signer and sign token", func(t *testing.T) {
+		rotated, _ := signer.NewSigner(signer.Key{ID: "k2", Secret: []byte("rotated")})
+		server.SetSigner(rotated, "new-token")
+		defer server.SetSigner(sign, "sign-token")
+
+		request := createSignRequest("private", "")
+		request.Header.Set("Authorization", "Bearer sign-token")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusUnauthorized)
+
+		signedUrl := sign.SignURL(DOWNLOAD_URL, "private", now.Add(time.Minute))
+		response = httptest.NewRecorder()
+
+		server.ServeHTTP(response, httptest.NewRequest(http.MethodGet, signedUrl, nil))
+
+		assertResponseStatus(t, response, http.StatusForbidden)
+	})
+}
+
+func TestPreview(t *testing.T) {
+	mgr := NewStubFileManager()
+	server := NewFileServer(mgr)
+
+	mgr.data["image"] = StubFile{fileName: "photo.png", content: "0123456789"}
+	mgr.data["code"] = StubFile{fileName: "main.go", content: "package main"}
+	mgr.data["html"] = StubFile{fileName: "page.html", content: "<script>alert(1)</script>"}
+	mgr.data["svg"] = StubFile{fileName: "logo.svg", content: "<svg onload=alert(1)>"}
+	mgr.data["protected"] = StubFile{fileName: "secret.png", content: "secret", password: "password"}
+
+	get := func(token string, headers ...string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, PREVIEW_URL+"?token="+token, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			request.Header.Set(headers[i], headers[i+1])
+		}
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("serves safe types inline", func(t *testing.T) {
+		response := get("image")
+
+		assertResponseStatus(t, response, http.StatusOK)
+		assertResponseBody(t, response, "0123456789")
+		assertResponseHeader(t, response, "Content-Type", []string{"image/png"})
+		assertResponseHeader(t, response, "Content-Disposition", []string{"inline; filename=photo.png"})
+		assertResponseHeader(t, response, "X-Content-Type-Options", []string{"nosniff"})
+		assertResponseHeader(t, response, "Content-Security-Policy", []string{PREVIEW_CONTENT_SECURITY_POLICY})
+	})
+	t.Run("serves code as plain text", func(t *testing.T) {
+		response := get("code")
+
+		assertResponseHeader(t, response, "Content-Type", []string{"text/plain; charset=utf-8"})
+		assertResponseHeader(t, response, "Content-Disposition", []string{"inline; filename=main.go"})
+	})
+	t.Run("forces attachment for HTML and SVG", func(t *testing.T) {
+		for _, token := range []string{"html", "svg"} {
+			response := get(token)
+
+			assertResponseStatus(t, response, http.StatusOK)
+			if disposition := response.Header().Get("Content-Disposition"); !strings.HasPrefix(disposition, "attachment") {
+				t.Errorf("Got Content-Disposition %q for %s, want attachment", disposition, token)
+			}
+		}
+	})
+	t.Run("supports ranges", func(t *testing.T) {
+		response := get("image", "Range", "bytes=2-5")
+
+		assertResponseStatus(t, response, http.StatusPartialContent)
+		assertResponseBody(t, response, "2345")
+		assertResponseHeader(t, response, "Content-Range", []string{"bytes 2-5/10"})
+	})
+	t.Run("requires the password of protected files", func(t *testing.T) {
+		assertResponseStatus(t, get("protected"), http.StatusUnauthorized)
+		assertResponseStatus(t, get("protected", PASSWORD_HEADER, "password"), http.StatusOK)
+	})
+	t.Run("uses replaced inline policy", func(t *testing.T) {
+		policy, _ := preview.ParsePolicy("application/pdf")
+		server.SetInlinePolicy(policy)
+
+		response := get("image")
+		assertResponseHeader(t, response, "Content-Disposition", []string{"attachment; filename=photo.png"})
+	})
+}
+
+func TestUploadPolicy(t *testing.T) {
+	mgr := NewStubFileManager()
+	server := NewFileServer(mgr)
+
+	cases := []struct {
+		name      string
+		violation *policy.Violation
+		status    int
+		want      map[string]any
+	}{
+		{
+			"mismatched content types",
+			&policy.Violation{Reason: policy.REASON_MISMATCH, FileName: "photo.png", DetectedType: "application/x-executable", ExtensionType: "image/png"},
+			http.StatusUnsupportedMediaType,
+			map[string]any{"reason": policy.REASON_MISMATCH, "detected_type": "application/x-executable", "extension_type": "image/png"},
+		},
+		{
+			"blocked extensions",
+			&policy.Violation{Reason: policy.REASON_EXTENSION, FileName: "setup.exe"},
+			http.StatusUnsupportedMediaType,
+			map[string]any{"reason": policy.REASON_EXTENSION},
+		},
+		{
+			"size limits",
+			&policy.Violation{Reason: policy.REASON_TOO_LARGE, FileName: "photo.png", DetectedType: "image/png", MaxSize: 1024},
+			http.StatusRequestEntityTooLarge,
+			map[string]any{"reason": policy.REASON_TOO_LARGE, "detected_type": "image/png", "max_size": float64(1024)},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run("returns JSON error for "+test.name, func(t *testing.T) {
+			mgr.saveErr = test.violation
+			defer func() { mgr.saveErr = nil }()
+
+			request := createFileUploadRequest(http.MethodPost, "file", test.violation.FileName, "content")
+			response := httptest.NewRecorder()
+
+			server.ServeHTTP(response, request)
+
+			assertResponseStatus(t, response, test.status)
+			assertResponseHeader(t, response, "Content-Type", []string{"application/json"})
+
+			var body map[string]any
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatalf("Invalid JSON response %q", response.Body.String())
+			}
+
+			test.want["error"] = test.violation.Error()
+			if !reflect.DeepEqual(body, test.want) {
+				t.Errorf("Got body %v, want %v", body, test.want)
+			}
+		})
+	}
+}
+
+func TestScanning(t *testing.T) {
+	mgr := NewStubFileManager()
+	server := NewFileServer(mgr)
+
+	mgr.data["pending"] = StubFile{fileName: "notes.txt", content: "hello", err: manager.ErrScanPending}
+	mgr.data["infected"] = StubFile{fileName: "eicar.txt", content: "eicar", err: manager.ErrQuarantinedFile}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("asks to retry downloads of files being scanned", func(t *testing.T) {
+		for _, target := range []string{DOWNLOAD_URL + "?token=pending", SHARE_URL + "pending"} {
+			response := get(target)
+
+			assertResponseStatus(t, response, http.StatusConflict)
+			assertResponseHeader(t, response, "Retry-After", []string{strconv.Itoa(SCAN_RETRY_AFTER)})
+		}
+	})
+	t.Run("returns 410 for quarantined files", func(t *testing.T) {
+		for _, target := range []string{DOWNLOAD_URL + "?token=infected", SHARE_URL + "infected"} {
+			response := get(target)
+
+			assertResponseStatus(t, response, http.StatusGone)
+			if !strings.Contains(response.Body.String(), MSG_ERR_FILE_QUARANTINED) {
+				t.Errorf("Want %q in the response", MSG_ERR_FILE_QUARANTINED)
+			}
+		}
+	})
+	t.Run("returns JSON error for infected uploads", func(t *testing.T) {
+		mgr.saveErr = &manager.InfectedError{Signature: "Eicar-Test-Signature"}
+		defer func() { mgr.saveErr = nil }()
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, createFileUploadRequest(http.MethodPost, "file", "eicar.txt", "eicar"))
+
+		assertResponseStatus(t, response, http.StatusUnprocessableEntity)
+		assertResponseBody(t, response, `{"error":"The file is infected with Eicar-Test-Signature","signature":"Eicar-Test-Signature"}`+"\n")
+	})
+	t.Run("returns 503 when uploads can't be scanned", func(t *testing.T) {
+		mgr.saveErr = manager.ErrScanFailed
+		defer func() { mgr.saveErr = nil }()
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, createFileUploadRequest(http.MethodPost, "file", "notes.txt", "hello"))
+
+		assertResponseStatus(t, response, http.StatusServiceUnavailable)
+		assertResponseBody(t, response, `{"error":"`+MSG_ERR_SCAN_FAILED+`"}`+"\n")
+	})
+}
+
+func TestQuotas(t *testing.T) {
+	mgr := NewStubFileManager()
+	server := NewFileServer(mgr)
+
+	alice := &auth.Identity{Name: "alice", Scopes: []auth.Scope{auth.ScopeUpload}}
+
+	cases := []struct {
+		name   string
+		err    *manager.QuotaExceededError
+		status int
+	}{
+		{"per-user quota", &manager.QuotaExceededError{Scope: manager.QUOTA_USER, Limit: manager.QUOTA_LIMIT_BYTES, Max: 1024}, http.StatusRequestEntityTooLarge},
+		{"global quota", &manager.QuotaExceededError{Scope: manager.QUOTA_GLOBAL, Limit: manager.QUOTA_LIMIT_FILES, Max: 10}, http.StatusInsufficientStorage},
+	}
+
+	for _, test := range cases {
+		t.Run("returns JSON error for exceeded "+test.name, func(t *testing.T) {
+			mgr.saveErr = test.err
+			defer func() { mgr.saveErr = nil }()
+
+			request := createFileUploadRequest(http.MethodPost, "file", "big.bin", "content")
+			response := httptest.NewRecorder()
+
+			server.ServeHTTP(response, request)
+
+			assertResponseStatus(t, response, test.status)
+			assertResponseHeader(t, response, "Content-Type", []string{"application/json"})
+
+			var body map[string]any
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatalf("Invalid JSON response %q", response.Body.String())
+			}
+
+			want := map[string]any{
+				"error": test.err.Error(),
+				"quota": test.err.Scope,
+				"limit": test.err.Limit,
+				"max":   float64(test.err.Max),
+			}
+			if !reflect.DeepEqual(body, want) {
+				t.Errorf("Got body %v, want %v", body, want)
+			}
+		})
+	}
+
+	t.Run("rejects uploads without reading the whole file", func(t *testing.T) {
+		mgr.saveErr = &manager.QuotaExceededError{Scope: manager.QUOTA_USER, Limit: manager.QUOTA_LIMIT_BYTES, Max: 1024}
+		defer func() { mgr.saveErr = nil }()
+
+		head := bytes.Buffer{}
+		writer := multipart.NewWriter(&head)
+		writer.CreateFormFile("file", "big.bin")
+		content := &countingReader{reader: io.LimitReader(zeroReader{}, 64<<20)}
+
+		request := httptest.NewRequest(http.MethodPost, UPLOAD_URL, io.MultiReader(&head, content))
+		request.Header.Add("Content-Type", writer.FormDataContentType())
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusRequestEntityTooLarge)
+		if content.read > 1<<20 {
+			t.Errorf("Read %d bytes of the file, want the upload rejected first", content.read)
+		}
+	})
+	t.Run("reports usage of authenticated identity", func(t *testing.T) {
+		request := createFileUploadRequest(http.MethodPost, "file", "a.txt", "12345")
+		request = request.WithContext(auth.WithIdentity(request.Context(), alice))
+		server.ServeHTTP(httptest.NewRecorder(), request)
+
+		request = httptest.NewRequest(http.MethodGet, USAGE_URL, nil)
+		request = request.WithContext(auth.WithIdentity(request.Context(), alice))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusOK)
+		assertResponseBody(t, response, `{"uploader":"alice","files":1,"bytes":5,"quota":{"max_files":10,"max_bytes":1024}}`+"\n")
+	})
+	t.Run("usage requires authentication", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, USAGE_URL, nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseStatus(t, response, http.StatusUnauthorized)
+	})
+}
+
+func TestListFiles(t *testing.T) {
+	mgr := NewStubFileManager()
+	server := NewFileServer(mgr)
+	alice := &auth.Identity{Name: "alice", Scopes: []auth.Scope{auth.ScopeUpload}}
+
+	request := createFileUploadRequest(http.MethodPost, "file", "a.txt", "12345")
+	request = request.WithContext(auth.WithIdentity(request.Context(), alice))
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	list := func(target string, identity *auth.Identity) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+		if identity != nil {
+			request = request.WithContext(auth.WithIdentity(request.Context(), identity))
+		}
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("lists files of authenticated identity", func(t *testing.T) {
+		response := list(FILES_URL+"?mime_type=text/*&min_size=1&sort=size&order=asc&limit=10", alice)
+
+		assertResponseStatus(t, response, http.StatusOK)
+		assertResponseBody(t, response, `{"files":[{"token":"token","filename":"a.txt","url":"example.com/download?token=token","size":5,"private":false,"protected":false,"blocked":false}]}`+"\n")
+
+		want := registry.ListQuery{MimeType: "text/*", MinSize: 1, Sort: registry.SORT_SIZE, Ascending: true, Limit: 10}
+		if mgr.listQuery != want {
+			t.Errorf("Got query %+v, want %+v", mgr.listQuery, want)
+		}
+	})
+	t.Run("rejects invalid queries", func(t *testing.T) {
+		for _, target := range []string{"?sort=owner", "?max_size=big", "?created_after=yesterday", "?cursor=invalid"} {
+			response := list(FILES_URL+target, alice)
+			assertResponseStatus(t, response, http.StatusBadRequest)
+		}
+	})
+	t.Run("requires authentication", func(t *testing.T) {
+		assertResponseStatus(t, list(FILES_URL, nil), http.StatusUnauthorized)
+	})
+}
+
+func TestDeleteFile(t *testing.T) {
+	alice := &auth.Identity{Name: "alice", Scopes: []auth.Scope{auth.ScopeUpload}}
+	bob := &auth.Identity{Name: "bob", Scopes: []auth.Scope{auth.ScopeUpload}}
+	moderator := &auth.Identity{Name: "moderator", Scopes: []auth.Scope{auth.ScopeDeleteAny}}
+
+	setup := func() (*StubFileManager, *FileServer) {
+		mgr := NewStubFileManager()
+		server := NewFileServer(mgr)
+
+		request := createFileUploadRequest(http.MethodPost, "file", "a.txt", "12345")
+		request = request.WithContext(auth.WithIdentity(request.Context(), alice))
+		server.ServeHTTP(httptest.NewRecorder(), request)
+		return mgr, server
+	}
+
+	remove := func(server *FileServer, method, target string, identity *auth.Identity) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		if identity != nil {
+			request = request.WithContext(auth.WithIdentity(request.Context(), identity))
+		}
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("lets uploaders delete their files", func(t *testing.T) {
+		mgr, server := setup()
+
+		response := remove(server, http.MethodDelete, DELETE_URL+"?token=token", alice)
+
+		assertResponseStatus(t, response, http.StatusNoContent)
+		if _, ok := mgr.data["token"]; ok {
+			t.Error("Want the file to be deleted")
+		}
+	})
+	t.Run("lets delete-any identities delete any file", func(t *testing.T) {
+		mgr, server := setup()
+
+		response := remove(server, http.MethodDelete, DELETE_URL+"?token=token", moderator)
+
+		assertResponseStatus(t, response, http.StatusNoContent)
+		if _, ok := mgr.data["token"]; ok {
+			t.Error("Want the file to be deleted")
+		}
+	})
+	t.Run("rejects other identities", func(t *testing.T) {
+		mgr, server := setup()
+
+		assertResponseStatus(t, remove(server, http.MethodDelete, DELETE_URL+"?token=token", bob), http.StatusForbidden)
+		assertResponseStatus(t, remove(server, http.MethodDelete, DELETE_URL+"?token=token", nil), http.StatusUnauthorized)
+		if _, ok := mgr.data["token"]; !ok {
+			t.Error("Want the file to be kept")
+		}
+	})
+	t.Run("rejects invalid requests", func(t *testing.T) {
+		_, server := setup()
+
+		assertResponseStatus(t, remove(server, http.MethodGet, DELETE_URL+"?token=token", alice), http.StatusMethodNotAllowed)
+		assertResponseStatus(t, remove(server, http.MethodDelete, DELETE_URL, alice), http.StatusBadRequest)
+		assertResponseStatus(t, remove(server, http.MethodDelete, DELETE_URL+"?token=missing", alice), http.StatusNotFound)
+	})
 }
 
 // ------
 // helper funcs
 // ------
 
-func createFileUploadRequest(method, fieldName, fileName, content string) *http.Request {
+func createFileUploadRequest(method, fieldName, fileName, content string, fields ...string) *http.Request {
 	buffer := bytes.Buffer{}
 	writer := multipart.NewWriter(&buffer)
 	defer writer.Close()
@@ -184,12 +1145,46 @@ func createFileUploadRequest(method, fieldName, fileName, content string) *http.
 	part, _ := writer.CreateFormFile(fieldName, fileName)
 	fmt.Fprint(part, content)
 
+	for i := 0; i+1 < len(fields); i += 2 {
+		writer.WriteField(fields[i], fields[i+1])
+	}
+
 	request := httptest.NewRequest(method, UPLOAD_URL, &buffer)
 	request.Header.Add("Content-Type", writer.FormDataContentType())
 
 	return request
 }
 
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func createSignRequest(token, ttl string) *http.Request {
+	form := url.Values{"token": {token}}
+	if ttl != "" {
+		form.Set("ttl", ttl)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, SIGN_URL, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return request
+}
+
 // ------
 // asserts
 // ------
@@ -228,6 +1223,7 @@ func assertResponseFileHeaders(t testing.TB, response *httptest.ResponseRecorder
 	assertResponseHeader(t, response, "Content-Type", []string{"text/plain; charset=utf-8"})
 	assertResponseHeader(t, response, "Content-Disposition", []string{"attachment; filename=" + fileName})
 	assertResponseHeader(t, response, "Content-Length", []string{contentLength})
+	assertResponseHeader(t, response, "X-Content-Type-Options", []string{"nosniff"})
 }
 
 func assertFileUploadedProperly(t testing.TB, mgr *StubFileManager, token string, fileContent string) {
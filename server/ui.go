@@ -0,0 +1,168 @@
+package server
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/loggers"
+	"github.com/olzhasar/go-fileserver/manager"
+)
+
+// Pages only load scripts and styles served by the FileServer itself, so
+// the UI works without internet access
+const UI_CONTENT_SECURITY_POLICY = "default-src 'self'; img-src 'self' data:; frame-ancestors 'none'"
+
+//go:embed ui
+var uiFiles embed.FS
+
+var uiTemplates = template.Must(template.New("ui").Funcs(template.FuncMap{
+	"formatSize": formatSize,
+	"formatTime": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+}).ParseFS(uiFiles, "ui/*.html"))
+
+var staticHandler = http.StripPrefix(STATIC_URL, http.FileServer(http.FS(mustSub(uiFiles, "ui/static"))))
+
+type indexPage struct {
+	Static string
+	Upload string
+}
+
+type sharePage struct {
+	Static   string
+	Error    string
+	File     manager.FileInfo
+	Download string
+	ShareURL string
+	// Preview is the URL embedded by the page, of the kind PreviewKind
+	Preview     string
+	PreviewKind string
+}
+
+// handleRoot serves the upload page
+func (f *FileServer) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, MSG_ERR_INVALID_REQUEST_METHOD, http.StatusMethodNotAllowed)
+		return
+	}
+
+	renderPage(w, r, http.StatusOK, "index.html", indexPage{Static: STATIC_URL, Upload: UPLOAD_URL})
+}
+
+// handleStatic serves the scripts and styles of the UI, without directory
+// listings
+func (f *FileServer) handleStatic(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	staticHandler.ServeHTTP(w, r)
+}
+
+// handleShare describes the file of the token in the path and links to its
+// download. The query of signed URLs is passed on to the download link
+func (f *FileServer) handleShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, MSG_ERR_INVALID_REQUEST_METHOD, http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, SHARE_URL)
+	if token == "" || strings.Contains(token, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := sharePage{Static: STATIC_URL, ShareURL: r.URL.RequestURI()}
+
+	query := r.URL.Query()
+	query.Set("token", token)
+
+	opts := manager.LoadOptions{}
+	signed, valid := f.verifySignedQuery(query, token)
+	if signed && !valid {
+		page.Error = MSG_ERR_INVALID_SIGNATURE
+		renderPage(w, r, http.StatusForbidden, "share.html", page)
+		return
+	}
+	opts.AllowPrivate = signed
+
+	info, err := f.manager.DescribeFile(r.Context(), token, opts)
+	if err != nil {
+		status := http.StatusNotFound
+		page.Error = MSG_ERR_FILE_NOT_FOUND
+
+		switch {
+		case errors.Is(err, manager.ErrPrivateFile):
+			status, page.Error = http.StatusForbidden, MSG_ERR_SIGNED_URL_REQUIRED
+		case errors.Is(err, manager.ErrBlockedFile):
+			status, page.Error = http.StatusGone, MSG_ERR_FILE_BLOCKED
+		case errors.Is(err, manager.ErrExpiredFile):
+			status, page.Error = http.StatusGone, MSG_ERR_FILE_EXPIRED
+		case errors.Is(err, manager.ErrQuarantinedFile):
+			status, page.Error = http.StatusGone, MSG_ERR_FILE_QUARANTINED
+		case errors.Is(err, manager.ErrScanPending):
+			w.Header().Set("Retry-After", strconv.Itoa(SCAN_RETRY_AFTER))
+			status, page.Error = http.StatusConflict, MSG_ERR_SCAN_PENDING
+		case !errors.Is(err, manager.ErrInvalidToken):
+			loggers.FromContext(r.Context(), f.logger).Error("Unable to describe file", "token", token, "error", err)
+			status, page.Error = http.StatusInternalServerError, MSG_ERR_CANNOT_DESCRIBE_FILE
+		}
+
+		renderPage(w, r, status, "share.html", page)
+		return
+	}
+
+	page.File = info
+	page.Download = DOWNLOAD_URL + "?" + query.Encode()
+	page.Preview, page.PreviewKind = f.previewFor(info, query.Encode())
+	renderPage(w, r, http.StatusOK, "share.html", page)
+}
+
+func renderPage(w http.ResponseWriter, r *http.Request, status int, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", UI_CONTENT_SECURITY_POLICY)
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+
+	if r.Method == "HEAD" {
+		return
+	}
+
+	uiTemplates.ExecuteTemplate(w, name, data)
+}
+
+// formatSize formats bytes with binary units, e.g. 1.5 MB
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit && exp < 3; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGT"[exp])
+}
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
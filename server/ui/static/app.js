@@ -0,0 +1,329 @@
+"use strict";
+
+// Uploads every dropped or chosen file with its own request so each gets a
+// progress bar, then shows the share link of the file
+(function () {
+  var form = document.getElementById("upload-form");
+  if (form) {
+    initUploads(form);
+  }
+  initCopyButtons(document);
+  initPreviews(document);
+
+  function initUploads(form) {
+    var dropZone = document.getElementById("drop-zone");
+    var input = document.getElementById("file-input");
+    var list = document.getElementById("uploads");
+    var template = document.getElementById("upload-template");
+
+    input.addEventListener("change", function () {
+      uploadAll(input.files);
+      input.value = "";
+    });
+
+    ["dragenter", "dragover"].forEach(function (name) {
+      dropZone.addEventListener(name, function (event) {
+        event.preventDefault();
+        dropZone.classList.add("dragging");
+      });
+    });
+    ["dragleave", "drop"].forEach(function (name) {
+      dropZone.addEventListener(name, function (event) {
+        event.preventDefault();
+        dropZone.classList.remove("dragging");
+      });
+    });
+    dropZone.addEventListener("drop", function (event) {
+      uploadAll(event.dataTransfer.files);
+    });
+
+    form.addEventListener("submit", function (event) {
+      event.preventDefault();
+      uploadAll(input.files);
+    });
+
+    function uploadAll(files) {
+      for (var i = 0; i < files.length; i++) {
+        upload(files[i]);
+      }
+    }
+
+    function upload(file) {
+      var item = template.content.firstElementChild.cloneNode(true);
+      var progress = item.querySelector("progress");
+      item.querySelector(".upload-name").textContent = file.name;
+      item.querySelector(".upload-size").textContent = formatSize(file.size);
+      list.insertBefore(item, list.firstChild);
+
+      var data = new FormData();
+      data.append("file", file);
+      data.append("password", form.elements.password.value);
+      data.append("expires_in", form.elements.expires_in.value);
+
+      var request = new XMLHttpRequest();
+      request.open("POST", form.getAttribute("action"));
+      request.setRequestHeader("Accept", "application/json");
+      if (form.elements.api_key.value) {
+        request.setRequestHeader("X-API-Key", form.elements.api_key.value);
+      }
+
+      request.upload.addEventListener("progress", function (event) {
+        if (event.lengthComputable) {
+          progress.value = (event.loaded / event.total) * 100;
+        }
+      });
+      request.addEventListener("load", function () {
+        if (request.status !== 200) {
+          fail(item, errorMessage(request));
+          return;
+        }
+        var response = JSON.parse(request.responseText);
+        progress.value = 100;
+        item.classList.add("done");
+        // URLs of the server carry the host but no scheme
+        item.querySelector(".upload-link").value = location.protocol + "//" + response.share_url;
+        initCopyButtons(item);
+      });
+      request.addEventListener("error", function () {
+        fail(item, "Upload failed, check your connection");
+      });
+
+      request.send(data);
+    }
+  }
+
+  function fail(item, message) {
+    item.classList.add("failed");
+    item.querySelector(".upload-error").textContent = message;
+  }
+
+  // errorMessage reads the error of JSON responses or plain text ones
+  function errorMessage(request) {
+    try {
+      return JSON.parse(request.responseText).error;
+    } catch (e) {
+      return request.responseText.trim() || request.statusText;
+    }
+  }
+
+  function initCopyButtons(root) {
+    var buttons = root.querySelectorAll(".copy-button");
+    for (var i = 0; i < buttons.length; i++) {
+      initCopyButton(buttons[i]);
+    }
+  }
+
+  function initCopyButton(button) {
+    var link = button.parentNode.querySelector(".upload-link");
+    if (link.value && link.value.charAt(0) === "/") {
+      link.value = location.origin + link.value;
+    }
+
+    button.onclick = function () {
+      var done = function () {
+        button.textContent = "Copied";
+        setTimeout(function () {
+          button.textContent = "Copy link";
+        }, 2000);
+      };
+
+      if (navigator.clipboard && window.isSecureContext) {
+        navigator.clipboard.writeText(link.value).then(done);
+        return;
+      }
+      link.select();
+      document.execCommand("copy");
+      done();
+    };
+  }
+
+  // Text previews are fetched and rendered with DOM nodes only, file
+  // contents are never parsed as HTML
+  function initPreviews(root) {
+    var previews = root.querySelectorAll(".preview-text");
+    for (var i = 0; i < previews.length; i++) {
+      loadPreview(previews[i]);
+    }
+  }
+
+  function loadPreview(container) {
+    fetch(container.dataset.src, { credentials: "same-origin" })
+      .then(function (response) {
+        if (!response.ok) {
+          throw new Error(response.statusText);
+        }
+        return response.text();
+      })
+      .then(function (text) {
+        if (container.dataset.kind === "markdown") {
+          var article = document.createElement("article");
+          article.className = "markdown";
+          renderMarkdown(article, text);
+          container.appendChild(article);
+        } else {
+          container.appendChild(codeBlock(text, container.dataset.name));
+        }
+      })
+      .catch(function () {
+        container.remove();
+      });
+  }
+
+  var KEYWORDS = [
+    "break", "case", "catch", "class", "const", "continue", "def", "default",
+    "defer", "do", "elif", "else", "enum", "export", "extends", "false",
+    "final", "finally", "fn", "for", "func", "function", "go", "if", "impl",
+    "import", "in", "interface", "let", "map", "match", "mut", "new", "nil",
+    "null", "package", "private", "pub", "public", "range", "return",
+    "select", "self", "static", "struct", "super", "switch", "this", "throw",
+    "true", "try", "type", "typeof", "use", "var", "void", "while", "with",
+    "yield", "None", "True", "False"
+  ];
+  var HASH_COMMENT_EXTENSIONS = ["py", "rb", "sh", "bash", "zsh", "yml", "yaml", "toml", "conf", "ini", "pl", "r", "mk"];
+
+  function codeBlock(text, name) {
+    var pre = document.createElement("pre");
+    var code = document.createElement("code");
+    highlight(code, text, name);
+    pre.appendChild(code);
+    return pre;
+  }
+
+  // highlight appends text to code, wrapping comments, strings, numbers and
+  // common keywords in spans. Hash comments are only recognized in
+  // languages using them, so CSS colors and C directives stay intact
+  function highlight(code, text, name) {
+    var extension = (name || "").split(".").pop().toLowerCase();
+    var comment = HASH_COMMENT_EXTENSIONS.indexOf(extension) >= 0 ? "#[^\n]*" : "\\/\\/[^\\n]*|\\/\\*[\\s\\S]*?\\*\\/";
+    var pattern = new RegExp(
+      "(" + comment + ")" +
+      "|(\"(?:[^\"\\\\\n]|\\\\.)*\"|'(?:[^'\\\\\n]|\\\\.)*'|`[^`]*`)" +
+      "|(\\b\\d+(?:\\.\\d+)?\\b)" +
+      "|\\b(" + KEYWORDS.join("|") + ")\\b",
+      "g"
+    );
+    var classes = [null, "token-comment", "token-string", "token-number", "token-keyword"];
+
+    var last = 0;
+    var match;
+    while ((match = pattern.exec(text)) !== null) {
+      code.appendChild(document.createTextNode(text.slice(last, match.index)));
+      var span = document.createElement("span");
+      for (var i = 1; i < classes.length; i++) {
+        if (match[i] !== undefined) {
+          span.className = classes[i];
+        }
+      }
+      span.textContent = match[0];
+      code.appendChild(span);
+      last = pattern.lastIndex;
+    }
+    code.appendChild(document.createTextNode(text.slice(last)));
+  }
+
+  // renderMarkdown supports headings, paragraphs, lists, block quotes,
+  // fenced code, rules, emphasis, inline code and links
+  function renderMarkdown(parent, text) {
+    var lines = text.replace(/\r\n?/g, "\n").split("\n");
+    var i = 0;
+
+    while (i < lines.length) {
+      var line = lines[i];
+      var match;
+
+      if (/^\s*$/.test(line)) {
+        i++;
+      } else if ((match = /^\s*(```|~~~)\s*(\S*)/.exec(line))) {
+        var fence = match[1];
+        var code = [];
+        for (i++; i < lines.length && lines[i].trim().indexOf(fence) !== 0; i++) {
+          code.push(lines[i]);
+        }
+        i++;
+        parent.appendChild(codeBlock(code.join("\n"), "code." + match[2]));
+      } else if ((match = /^(#{1,6})\s+(.*?)\s*#*\s*$/.exec(line))) {
+        appendInline(append(parent, "h" + match[1].length), match[2]);
+        i++;
+      } else if (/^\s*([-*_])(\s*\1){2,}\s*$/.test(line)) {
+        append(parent, "hr");
+        i++;
+      } else if (/^\s*>/.test(line)) {
+        var quoted = [];
+        for (; i < lines.length && /^\s*>/.test(lines[i]); i++) {
+          quoted.push(lines[i].replace(/^\s*>\s?/, ""));
+        }
+        renderMarkdown(append(parent, "blockquote"), quoted.join("\n"));
+      } else if ((match = /^\s*([-*+]|\d+[.)])\s+/.exec(line))) {
+        var ordered = /\d/.test(match[1]);
+        var list = append(parent, ordered ? "ol" : "ul");
+        var itemPattern = ordered ? /^\s*\d+[.)]\s+(.*)$/ : /^\s*[-*+]\s+(.*)$/;
+        var item = null;
+        for (; i < lines.length && !/^\s*$/.test(lines[i]); i++) {
+          var itemMatch = itemPattern.exec(lines[i]);
+          if (itemMatch) {
+            item = append(list, "li");
+            appendInline(item, itemMatch[1]);
+          } else {
+            appendInline(item, " " + lines[i].trim());
+          }
+        }
+      } else {
+        var paragraph = [];
+        for (; i < lines.length && !/^\s*$/.test(lines[i]) && !/^(#{1,6}\s|\s*(```|~~~|>))/.test(lines[i]); i++) {
+          paragraph.push(lines[i].trim());
+        }
+        appendInline(append(parent, "p"), paragraph.join(" "));
+      }
+    }
+  }
+
+  var INLINE_PATTERN = /`([^`]+)`|\*\*([^*]+)\*\*|__([^_]+)__|\*([^*]+)\*|_([^_]+)_|!?\[([^\]]*)\]\(([^)\s]+)(?:\s+"[^"]*")?\)/g;
+
+  function appendInline(parent, text) {
+    var last = 0;
+    var match;
+    INLINE_PATTERN.lastIndex = 0;
+
+    while ((match = INLINE_PATTERN.exec(text)) !== null) {
+      parent.appendChild(document.createTextNode(text.slice(last, match.index)));
+      last = INLINE_PATTERN.lastIndex;
+
+      if (match[1] !== undefined) {
+        append(parent, "code").textContent = match[1];
+      } else if (match[2] !== undefined || match[3] !== undefined) {
+        append(parent, "strong").textContent = match[2] || match[3];
+      } else if (match[4] !== undefined || match[5] !== undefined) {
+        append(parent, "em").textContent = match[4] || match[5];
+      } else {
+        // Images are shown as links, as other origins are never loaded
+        var link = append(parent, "a");
+        link.textContent = match[6] || match[7];
+        if (isSafeURL(match[7])) {
+          link.href = match[7];
+          link.rel = "noopener noreferrer nofollow";
+        }
+      }
+    }
+
+    parent.appendChild(document.createTextNode(text.slice(last)));
+  }
+
+  function isSafeURL(url) {
+    var scheme = /^([a-z][a-z0-9+.-]*):/i.exec(url);
+    return !scheme || /^(https?|mailto)$/i.test(scheme[1]);
+  }
+
+  function append(parent, tag) {
+    return parent.appendChild(document.createElement(tag));
+  }
+
+  function formatSize(bytes) {
+    var units = ["B", "KB", "MB", "GB", "TB"];
+    var i = 0;
+    while (bytes >= 1024 && i < units.length - 1) {
+      bytes /= 1024;
+      i++;
+    }
+    return (i === 0 ? bytes : bytes.toFixed(1)) + " " + units[i];
+  }
+})();
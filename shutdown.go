@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/loggers"
+	"github.com/olzhasar/go-fileserver/middleware"
+)
+
+type shutdownHook struct {
+	name  string
+	close func(ctx context.Context) error
+}
+
+// shutdownHooks release resources once the server stopped, in reverse
+// order of registration
+type shutdownHooks []shutdownHook
+
+func (h *shutdownHooks) add(name string, close func(ctx context.Context) error) {
+	*h = append(*h, shutdownHook{name, close})
+}
+
+func (h shutdownHooks) run(ctx context.Context, logger loggers.Logger) {
+	for i := len(h) - 1; i >= 0; i-- {
+		err := h[i].close(ctx)
+		if err != nil {
+			logger.Error("Unable to shut down", "component", h[i].name, "error", err)
+		}
+	}
+}
+
+// serving is an HTTP server and the listeners it accepts connections on
+type serving struct {
+	server    *http.Server
+	listeners []net.Listener
+}
+
+func (s serving) serve(serveErr chan<- error) {
+	// Serve sets an empty TLSConfig while configuring HTTP/2, so it must be
+	// checked before serving the first listener
+	useTLS := s.server.TLSConfig != nil
+
+	for _, listener := range s.listeners {
+		go func(listener net.Listener) {
+			if useTLS {
+				serveErr <- s.server.ServeTLS(listener, "", "")
+				return
+			}
+			serveErr <- s.server.Serve(listener)
+		}(listener)
+	}
+}
+
+// serveUntilSignal serves until SIGINT or SIGTERM. It then drains new
+// uploads, waits drainDelay for load balancers to notice failing readiness
+// checks and gives in-flight requests up to timeout to finish
+func serveUntilSignal(servers []serving, drainer *middleware.DrainMiddleware, logger loggers.Logger, drainDelay, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listeners := 0
+	for _, s := range servers {
+		listeners += len(s.listeners)
+	}
+
+	serveErr := make(chan error, listeners)
+	for _, s := range servers {
+		s.serve(serveErr)
+	}
+
+	select {
+	case err := <-serveErr:
+		for _, s := range servers {
+			s.server.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	logger.Info("Shutting down, draining in-flight requests", "timeout", timeout)
+	drainer.Drain()
+	time.Sleep(drainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, server *http.Server) {
+			defer wg.Done()
+
+			errs[i] = server.Shutdown(shutdownCtx)
+			if errors.Is(errs[i], context.DeadlineExceeded) {
+				logger.Warn("Shutdown timeout exceeded, closing remaining connections")
+				errs[i] = server.Close()
+			}
+		}(i, s.server)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
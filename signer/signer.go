@@ -0,0 +1,142 @@
+// Package signer mints and verifies HMAC-signed, time-limited download URLs.
+//
+// A signed URL carries three query params next to the file token:
+//
+//	/download?token=<token>&exp=<unix seconds>&sig=<key id>.<signature>
+//
+// The signature is an HMAC-SHA256 of the token and expiry made with one of
+// the server secrets. New URLs are always signed with the first key, while
+// any configured key is accepted during verification, so secrets can be
+// rotated by prepending a new key and dropping the old one once all links
+// signed with it have expired.
+package signer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const EXPIRY_PARAM = "exp"
+const SIGNATURE_PARAM = "sig"
+
+var ErrNoKeys = errors.New("At least one signing key is required")
+var ErrInvalidSignature = errors.New("Invalid signature")
+var ErrExpired = errors.New("Signed URL has expired")
+
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+type Signer struct {
+	keys []Key
+}
+
+func NewSigner(keys ...Key) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	for _, key := range keys {
+		if key.ID == "" || strings.ContainsAny(key.ID, ".,:") {
+			return nil, errors.New(fmt.Sprintf("Invalid signing key id %q", key.ID))
+		}
+		if len(key.Secret) == 0 {
+			return nil, errors.New(fmt.Sprintf("Empty secret for signing key %q", key.ID))
+		}
+	}
+
+	return &Signer{keys}, nil
+}
+
+// ParseKeys parses keys in the "id:secret,id2:secret2" format
+func ParseKeys(value string) ([]Key, error) {
+	var keys []Key
+
+	for _, pair := range strings.Split(value, ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Invalid signing key %q, want id:secret", pair))
+		}
+		keys = append(keys, Key{ID: id, Secret: []byte(secret)})
+	}
+
+	return keys, nil
+}
+
+// Sign returns the signature of token valid until expires
+func (s *Signer) Sign(token string, expires time.Time) string {
+	key := s.keys[0]
+	return key.ID + "." + computeSignature(key.Secret, token, expires.Unix())
+}
+
+// SignQuery returns the query params of a signed download URL
+func (s *Signer) SignQuery(token string, expires time.Time) url.Values {
+	return url.Values{
+		"token":         {token},
+		EXPIRY_PARAM:    {strconv.FormatInt(expires.Unix(), 10)},
+		SIGNATURE_PARAM: {s.Sign(token, expires)},
+	}
+}
+
+// SignURL appends signed query params to downloadURL,
+// e.g. https://files.example.com/download
+func (s *Signer) SignURL(downloadURL, token string, expires time.Time) string {
+	return downloadURL + "?" + s.SignQuery(token, expires).Encode()
+}
+
+// Verify checks the signature and expiry of a signed URL
+func (s *Signer) Verify(token, expiry, signature string, now time.Time) error {
+	exp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	keyID, mac, ok := strings.Cut(signature, ".")
+	if !ok {
+		return ErrInvalidSignature
+	}
+
+	key, ok := s.findKey(keyID)
+	if !ok {
+		return ErrInvalidSignature
+	}
+
+	want := computeSignature(key.Secret, token, exp)
+	if !hmac.Equal([]byte(mac), []byte(want)) {
+		return ErrInvalidSignature
+	}
+
+	if !now.Before(time.Unix(exp, 0)) {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+// VerifyQuery checks the signed params of a download URL query
+func (s *Signer) VerifyQuery(query url.Values, now time.Time) error {
+	return s.Verify(query.Get("token"), query.Get(EXPIRY_PARAM), query.Get(SIGNATURE_PARAM), now)
+}
+
+func (s *Signer) findKey(id string) (Key, bool) {
+	for _, key := range s.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+func computeSignature(secret []byte, token string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%d", token, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
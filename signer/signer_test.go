@@ -0,0 +1,122 @@
+package signer_test
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olzhasar/go-fileserver/signer"
+)
+
+func newSigner(t testing.TB, keys ...signer.Key) *signer.Signer {
+	t.Helper()
+
+	s, err := signer.NewSigner(keys...)
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	return s
+}
+
+func TestSigner(t *testing.T) {
+	oldKey := signer.Key{ID: "old", Secret: []byte("old secret")}
+	newKey := signer.Key{ID: "new", Secret: []byte("new secret")}
+
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	expires := now.Add(time.Hour)
+
+	t.Run("verifies signed URL", func(t *testing.T) {
+		s := newSigner(t, newKey)
+
+		signed := s.SignURL("http://localhost:8080/download", "token", expires)
+
+		parsed, err := url.Parse(signed)
+		if err != nil {
+			t.Fatalf("Invalid signed url %q", signed)
+		}
+
+		if err := s.VerifyQuery(parsed.Query(), now); err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+	})
+	t.Run("rejects expired URL", func(t *testing.T) {
+		s := newSigner(t, newKey)
+
+		query := s.SignQuery("token", expires)
+
+		err := s.VerifyQuery(query, expires)
+		if err != signer.ErrExpired {
+			t.Fatalf("Got error %v, want %v", err, signer.ErrExpired)
+		}
+	})
+	t.Run("rejects tampered params", func(t *testing.T) {
+		s := newSigner(t, newKey)
+
+		query := s.SignQuery("token", expires)
+		query.Set("token", "other")
+
+		if err := s.VerifyQuery(query, now); err != signer.ErrInvalidSignature {
+			t.Errorf("Got error %v, want %v", err, signer.ErrInvalidSignature)
+		}
+
+		query = s.SignQuery("token", expires)
+		query.Set(signer.EXPIRY_PARAM, "9999999999")
+
+		if err := s.VerifyQuery(query, now); err != signer.ErrInvalidSignature {
+			t.Errorf("Got error %v, want %v", err, signer.ErrInvalidSignature)
+		}
+	})
+	t.Run("accepts rotated keys", func(t *testing.T) {
+		before := newSigner(t, oldKey)
+		after := newSigner(t, newKey, oldKey)
+
+		query := before.SignQuery("token", expires)
+		if err := after.VerifyQuery(query, now); err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+
+		sig := after.Sign("token", expires)
+		if !strings.HasPrefix(sig, "new.") {
+			t.Errorf("Got signature %q, want it to be signed with the first key", sig)
+		}
+	})
+	t.Run("rejects removed keys", func(t *testing.T) {
+		before := newSigner(t, oldKey)
+		after := newSigner(t, newKey)
+
+		query := before.SignQuery("token", expires)
+		if err := after.VerifyQuery(query, now); err != signer.ErrInvalidSignature {
+			t.Fatalf("Got error %v, want %v", err, signer.ErrInvalidSignature)
+		}
+	})
+}
+
+func TestNewSigner(t *testing.T) {
+	if _, err := signer.NewSigner(); err != signer.ErrNoKeys {
+		t.Errorf("Got error %v, want %v", err, signer.ErrNoKeys)
+	}
+
+	if _, err := signer.NewSigner(signer.Key{ID: "a.b", Secret: []byte("s")}); err == nil {
+		t.Error("Got nil, want error for invalid key id")
+	}
+
+	if _, err := signer.NewSigner(signer.Key{ID: "a"}); err == nil {
+		t.Error("Got nil, want error for empty secret")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := signer.ParseKeys("new:s3cret, old:0ld")
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	if len(keys) != 2 || keys[0].ID != "new" || string(keys[1].Secret) != "0ld" {
+		t.Errorf("Got keys %+v", keys)
+	}
+
+	if _, err := signer.ParseKeys("nosecret"); err == nil {
+		t.Error("Got nil, want error")
+	}
+}
@@ -0,0 +1,300 @@
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Number of leading bytes read by Detect. Office documents are told apart
+// from other zip archives by the names of their first entries, so more
+// than the 512 bytes of http.DetectContentType are needed
+const HEAD_SIZE = 8192
+
+const OCTET_STREAM = "application/octet-stream"
+
+type signature struct {
+	offset   int
+	magic    []byte
+	mimeType string
+}
+
+// Signatures checked in order, before the container formats that need a
+// closer look and before http.DetectContentType
+var signatures = []signature{
+	// Archives and compressed files
+	{0, []byte("\x1f\x8b"), "application/gzip"},
+	{0, []byte("\xfd7zXZ\x00"), "application/x-xz"},
+	{0, []byte("7z\xbc\xaf\x27\x1c"), "application/x-7z-compressed"},
+	{0, []byte("Rar!\x1a\x07"), "application/vnd.rar"},
+	{0, []byte("\x28\xb5\x2f\xfd"), "application/zstd"},
+	{257, []byte("ustar"), "application/x-tar"},
+	{0, []byte("MSCF\x00\x00\x00\x00"), "application/vnd.ms-cab-compressed"},
+
+	// Documents
+	{0, []byte("%PDF-"), "application/pdf"},
+	{0, []byte("{\\rtf"), "application/rtf"},
+	{0, []byte("%!PS"), "application/postscript"},
+	{0, []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), "application/x-ole-storage"},
+	{0, []byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+
+	// Images
+	{0, []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	{0, []byte("\xff\xd8\xff"), "image/jpeg"},
+	{0, []byte("GIF87a"), "image/gif"},
+	{0, []byte("GIF89a"), "image/gif"},
+	{0, []byte("\x00\x00\x01\x00"), "image/vnd.microsoft.icon"},
+	{0, []byte("II*\x00"), "image/tiff"},
+	{0, []byte("MM\x00*"), "image/tiff"},
+	{0, []byte("8BPS"), "image/vnd.adobe.photoshop"},
+
+	// Audio
+	{0, []byte("fLaC"), "audio/flac"},
+	{0, []byte("ID3"), "audio/mpeg"},
+	{0, []byte("MThd"), "audio/midi"},
+	{0, []byte("#!AMR"), "audio/amr"},
+
+	// Fonts
+	{0, []byte("wOFF"), "font/woff"},
+	{0, []byte("wOF2"), "font/woff2"},
+	{0, []byte("\x00\x01\x00\x00\x00"), "font/ttf"},
+	{0, []byte("OTTO"), "font/otf"},
+
+	// Executables
+	{0, []byte("\x7fELF"), "application/x-executable"},
+	{0, []byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{0, []byte("\xce\xfa\xed\xfe"), "application/x-mach-binary"},
+	{0, []byte("\xca\xfe\xba\xbe"), "application/x-mach-binary"},
+	{0, []byte("\x00asm"), "application/wasm"},
+	{0, []byte("dex\n"), "application/vnd.android.dex"},
+}
+
+// Entries identifying zip based formats, found in the first local file
+// headers of an archive
+var zipEntries = []struct {
+	prefix   string
+	mimeType string
+}{
+	{"word/", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+	{"xl/", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+	{"ppt/", "application/vnd.openxmlformats-officedocument.presentationml.presentation"},
+	{"AndroidManifest.xml", "application/vnd.android.package-archive"},
+	{"classes.dex", "application/vnd.android.package-archive"},
+	{"META-INF/MANIFEST.MF", "application/java-archive"},
+}
+
+// Brands of ISO base media files, such as MP4 and HEIC
+var ftypBrands = map[string]string{
+	"avif": "image/avif",
+	"avis": "image/avif",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"qt  ": "video/quicktime",
+	"M4A ": "audio/mp4",
+	"M4B ": "audio/mp4",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"3g2a": "video/3gpp2",
+}
+
+// Detect returns the media type of content from its first bytes, without
+// parameters such as charset. It returns OCTET_STREAM if the type is
+// unknown
+func Detect(head []byte) string {
+	if len(head) > HEAD_SIZE {
+		head = head[:HEAD_SIZE]
+	}
+
+	for _, sig := range signatures {
+		if hasMagic(head, sig.offset, sig.magic) {
+			return sig.mimeType
+		}
+	}
+
+	switch {
+	case hasMagic(head, 0, []byte("PK\x03\x04")):
+		return detectZip(head)
+	case hasMagic(head, 4, []byte("ftyp")):
+		return detectFtyp(head)
+	case hasMagic(head, 0, []byte("RIFF")):
+		return detectRIFF(head)
+	case hasMagic(head, 0, []byte("\x1a\x45\xdf\xa3")):
+		return detectEBML(head)
+	case hasMagic(head, 0, []byte("OggS")):
+		return detectOgg(head)
+	case hasMagic(head, 0, []byte("MZ")) && len(head) >= 64:
+		return detectMZ(head)
+	case hasMagic(head, 0, []byte("BZh")) && len(head) > 3 && '1' <= head[3] && head[3] <= '9':
+		return "application/x-bzip2"
+	case hasMagic(head, 0, []byte("BM")) && hasMagic(head, 6, []byte("\x00\x00\x00\x00")):
+		return "image/bmp"
+	case isMPEGAudio(head):
+		return "audio/mpeg"
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return OCTET_STREAM
+	}
+
+	// http.DetectContentType takes anything starting with BM for a bitmap,
+	// which has been ruled out above
+	if mediaType == "image/bmp" {
+		if bytes.ContainsFunc(head, isBinary) {
+			return OCTET_STREAM
+		}
+		return "text/plain"
+	}
+
+	return mediaType
+}
+
+func hasMagic(head []byte, offset int, magic []byte) bool {
+	return len(head) >= offset+len(magic) && bytes.Equal(head[offset:offset+len(magic)], magic)
+}
+
+// detectZip tells OpenDocument and EPUB files by their uncompressed
+// mimetype entry, and other formats by the names of their entries
+func detectZip(head []byte) string {
+	// The mimetype entry is stored first and uncompressed, so its size is
+	// known from its header
+	const mimetypeEntry = "mimetype"
+	if hasMagic(head, 30, []byte(mimetypeEntry)) {
+		size := int(binary.LittleEndian.Uint32(head[18:]))
+		extraLength := int(binary.LittleEndian.Uint16(head[28:]))
+		start := 30 + len(mimetypeEntry) + extraLength
+
+		if size > 0 && start+size <= len(head) {
+			mimeType := string(head[start : start+size])
+			if mimeType == "application/epub+zip" || strings.HasPrefix(mimeType, "application/vnd.oasis.opendocument.") {
+				return mimeType
+			}
+		}
+	}
+
+	for _, name := range zipEntryNames(head) {
+		for _, entry := range zipEntries {
+			if strings.HasPrefix(name, entry.prefix) {
+				return entry.mimeType
+			}
+		}
+	}
+
+	return "application/zip"
+}
+
+// zipEntryNames walks the local file headers found in head. Entries whose
+// size is only known after their data are not skipped, so later names are
+// searched for instead
+func zipEntryNames(head []byte) []string {
+	var names []string
+
+	for offset := 0; offset+30 <= len(head); {
+		if !hasMagic(head, offset, []byte("PK\x03\x04")) {
+			next := bytes.Index(head[offset+1:], []byte("PK\x03\x04"))
+			if next < 0 {
+				break
+			}
+			offset += next + 1
+			continue
+		}
+
+		flags := binary.LittleEndian.Uint16(head[offset+6:])
+		compressedSize := int(binary.LittleEndian.Uint32(head[offset+18:]))
+		nameLength := int(binary.LittleEndian.Uint16(head[offset+26:]))
+		extraLength := int(binary.LittleEndian.Uint16(head[offset+28:]))
+
+		start := offset + 30
+		if start+nameLength > len(head) {
+			break
+		}
+		names = append(names, string(head[start:start+nameLength]))
+
+		if flags&0x08 != 0 {
+			offset = start + nameLength
+			continue
+		}
+		offset = start + nameLength + extraLength + compressedSize
+	}
+
+	return names
+}
+
+// detectMZ tells Windows executables from DOS ones by the PE header the
+// MZ header points to
+func detectMZ(head []byte) string {
+	offset := int(binary.LittleEndian.Uint32(head[0x3c:]))
+	if offset >= 0 && hasMagic(head, offset, []byte("PE\x00\x00")) {
+		return "application/vnd.microsoft.portable-executable"
+	}
+	return "application/x-dosexec"
+}
+
+func detectFtyp(head []byte) string {
+	if len(head) < 12 {
+		return OCTET_STREAM
+	}
+
+	if mimeType, ok := ftypBrands[string(head[8:12])]; ok {
+		return mimeType
+	}
+	return "video/mp4"
+}
+
+func detectRIFF(head []byte) string {
+	if len(head) < 12 {
+		return OCTET_STREAM
+	}
+
+	switch string(head[8:12]) {
+	case "WAVE":
+		return "audio/wav"
+	case "AVI ":
+		return "video/x-msvideo"
+	case "WEBP":
+		return "image/webp"
+	default:
+		return OCTET_STREAM
+	}
+}
+
+// detectEBML tells WebM from other Matroska files by the DocType element
+func detectEBML(head []byte) string {
+	if bytes.Contains(head, []byte("webm")) {
+		return "video/webm"
+	}
+	return "video/x-matroska"
+}
+
+func detectOgg(head []byte) string {
+	switch {
+	case bytes.Contains(head, []byte("\x80theora")):
+		return "video/ogg"
+	case bytes.Contains(head, []byte("OpusHead")), bytes.Contains(head, []byte("\x01vorbis")):
+		return "audio/ogg"
+	default:
+		return "application/ogg"
+	}
+}
+
+// isBinary reports control characters that don't occur in text, as
+// http.DetectContentType does
+func isBinary(r rune) bool {
+	return r <= 0x08 || r == 0x0b || 0x0e <= r && r <= 0x1a || 0x1c <= r && r <= 0x1f
+}
+
+// isMPEGAudio checks for an MP3 frame header without an ID3 tag
+func isMPEGAudio(head []byte) bool {
+	if len(head) < 3 || head[0] != 0xff || head[1]&0xe0 != 0xe0 {
+		return false
+	}
+
+	version := (head[1] >> 3) & 0x03
+	layer := (head[1] >> 1) & 0x03
+	bitrate := head[2] >> 4
+	return version != 0x01 && layer != 0x00 && bitrate != 0x0f
+}
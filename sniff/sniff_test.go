@@ -0,0 +1,187 @@
+package sniff_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"hash/crc32"
+	"testing"
+
+	"github.com/olzhasar/go-fileserver/sniff"
+)
+
+func zipOf(t testing.TB, entries ...string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for i := 0; i+1 < len(entries); i += 2 {
+		content := []byte(entries[i+1])
+
+		// Like office suites, store the mimetype entry with its size in
+		// the local header
+		if entries[i] == "mimetype" {
+			w, err := writer.CreateRaw(&zip.FileHeader{
+				Name:               entries[i],
+				Method:             zip.Store,
+				CRC32:              crc32.ChecksumIEEE(content),
+				CompressedSize64:   uint64(len(content)),
+				UncompressedSize64: uint64(len(content)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(content)
+			continue
+		}
+
+		w, err := writer.Create(entries[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+	}
+	writer.Close()
+
+	return buf.Bytes()
+}
+
+func tarOf(t testing.TB) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	writer.WriteHeader(&tar.Header{Name: "file.txt", Mode: 0644, Size: 4})
+	writer.Write([]byte("text"))
+	writer.Close()
+
+	return buf.Bytes()
+}
+
+func gzipOf(content []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write(content)
+	writer.Close()
+	return buf.Bytes()
+}
+
+func TestDetect(t *testing.T) {
+	pe := make([]byte, 128)
+	copy(pe, "MZ")
+	pe[0x3c] = 0x40
+	copy(pe[0x40:], "PE\x00\x00")
+
+	cases := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "image/png"},
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF"), "image/jpeg"},
+		{"webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), "image/webp"},
+		{"wav", []byte("RIFF\x00\x00\x00\x00WAVEfmt "), "audio/wav"},
+		{"pdf", []byte("%PDF-1.7\n"), "application/pdf"},
+		{"zip", zipOf(t, "notes.txt", "hello"), "application/zip"},
+		{"docx", zipOf(t, "[Content_Types].xml", "<Types/>", "word/document.xml", "<w:document/>"), "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"xlsx", zipOf(t, "[Content_Types].xml", "<Types/>", "xl/workbook.xml", "<workbook/>"), "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{"odt", zipOf(t, "mimetype", "application/vnd.oasis.opendocument.text", "content.xml", "<office/>"), "application/vnd.oasis.opendocument.text"},
+		{"epub", zipOf(t, "mimetype", "application/epub+zip"), "application/epub+zip"},
+		{"jar", zipOf(t, "META-INF/MANIFEST.MF", "Manifest-Version: 1.0"), "application/java-archive"},
+		{"tar", tarOf(t), "application/x-tar"},
+		{"gzip", gzipOf([]byte("text")), "application/gzip"},
+		{"7z", []byte("7z\xbc\xaf\x27\x1c\x00\x04"), "application/x-7z-compressed"},
+		{"mp4", []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00"), "video/mp4"},
+		{"mov", []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00"), "video/quicktime"},
+		{"avif", []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"), "image/avif"},
+		{"webm", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm"), "video/webm"},
+		{"mp3", []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), "audio/mpeg"},
+		{"mp3 without tag", []byte("\xff\xfb\x90\x64\x00"), "audio/mpeg"},
+		{"ogg", []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x01vorbis"), "audio/ogg"},
+		{"elf", []byte("\x7fELF\x02\x01\x01"), "application/x-executable"},
+		{"pe", pe, "application/vnd.microsoft.portable-executable"},
+		{"ole", []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1\x00\x00"), "application/x-ole-storage"},
+		{"html", []byte("<!DOCTYPE html><html><body>hi</body></html>"), "text/html"},
+		{"text", []byte("Just some text"), "text/plain"},
+		{"text starting like a bitmap", []byte("BMW makes cars"), "text/plain"},
+		{"unknown binary", []byte("\x00\x01\x02\x03\x04\x05"), sniff.OCTET_STREAM},
+		{"empty", nil, "text/plain"},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			if got := sniff.Detect(test.content); got != test.want {
+				t.Errorf("Got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	cases := []struct {
+		fileName string
+		detected string
+		want     bool
+	}{
+		{"photo.png", "image/png", true},
+		{"photo.PNG", "image/png", true},
+		{"notes.md", "text/plain", true},
+		{"main.go", "text/plain", true},
+		{"data.json", "text/plain", true},
+		{"report.docx", "application/zip", true},
+		{"report.doc", "application/x-ole-storage", true},
+		{"logo.svg", "text/xml", true},
+		{"song.m4a", "video/mp4", true},
+		{"archive.bin", "application/zip", true},
+		{"photo.png", sniff.OCTET_STREAM, true},
+		{"photo.png", "text/html", false},
+		{"notes.txt", "text/html", false},
+		{"invoice.pdf", "application/vnd.microsoft.portable-executable", false},
+		{"photo.jpg", "image/png", false},
+	}
+
+	for _, test := range cases {
+		extension := sniff.TypeByExtension(test.fileName)
+		if got := sniff.Matches(test.detected, extension); got != test.want {
+			t.Errorf("Got %v for %s detected as %s, want %v", got, test.fileName, test.detected, test.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	cases := []struct {
+		detected  string
+		extension string
+		want      string
+	}{
+		{"text/plain", "text/markdown", "text/markdown"},
+		{"application/zip", "application/epub+zip", "application/epub+zip"},
+		{sniff.OCTET_STREAM, "image/png", sniff.OCTET_STREAM},
+		{sniff.OCTET_STREAM, "text/html", sniff.OCTET_STREAM},
+		{"text/html", "image/png", "text/html"},
+		{"image/png", sniff.OCTET_STREAM, "image/png"},
+	}
+
+	for _, test := range cases {
+		if got := sniff.Resolve(test.detected, test.extension); got != test.want {
+			t.Errorf("Got %q for %s with extension type %s, want %q", got, test.detected, test.extension, test.want)
+		}
+	}
+}
+
+func TestParseTypes(t *testing.T) {
+	got, err := sniff.ParseTypes(" application/x-executable, image/* ,application/*+xml,")
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+	if len(got) != 3 || !sniff.MatchType("image/png", got[1]) || !sniff.MatchType("application/rss+xml", got[2]) {
+		t.Errorf("Got %v", got)
+	}
+
+	for _, list := range []string{"executable", "*/*", "image/**"} {
+		if _, err := sniff.ParseTypes(list); err == nil {
+			t.Errorf("Expected an error for %q", list)
+		}
+	}
+}
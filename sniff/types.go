@@ -0,0 +1,212 @@
+package sniff
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// Types of the extensions of the formats known to Detect, so that
+// extensions are compared to detected types under the same names whatever
+// the mime.types files of the system
+var extensionTypes = map[string]string{
+	".zip":    "application/zip",
+	".gz":     "application/gzip",
+	".tgz":    "application/gzip",
+	".bz2":    "application/x-bzip2",
+	".xz":     "application/x-xz",
+	".7z":     "application/x-7z-compressed",
+	".rar":    "application/vnd.rar",
+	".zst":    "application/zstd",
+	".tar":    "application/x-tar",
+	".cab":    "application/vnd.ms-cab-compressed",
+	".pdf":    "application/pdf",
+	".rtf":    "application/rtf",
+	".ps":     "application/postscript",
+	".eps":    "application/postscript",
+	".doc":    "application/msword",
+	".xls":    "application/vnd.ms-excel",
+	".ppt":    "application/vnd.ms-powerpoint",
+	".msi":    "application/x-msi",
+	".docx":   "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx":   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx":   "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":    "application/vnd.oasis.opendocument.text",
+	".ods":    "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":    "application/vnd.oasis.opendocument.presentation",
+	".epub":   "application/epub+zip",
+	".jar":    "application/java-archive",
+	".apk":    "application/vnd.android.package-archive",
+	".sqlite": "application/vnd.sqlite3",
+	".db":     "application/vnd.sqlite3",
+	".png":    "image/png",
+	".jpg":    "image/jpeg",
+	".jpeg":   "image/jpeg",
+	".gif":    "image/gif",
+	".webp":   "image/webp",
+	".bmp":    "image/bmp",
+	".ico":    "image/vnd.microsoft.icon",
+	".tif":    "image/tiff",
+	".tiff":   "image/tiff",
+	".psd":    "image/vnd.adobe.photoshop",
+	".avif":   "image/avif",
+	".heic":   "image/heic",
+	".heif":   "image/heif",
+	".svg":    "image/svg+xml",
+	".mp3":    "audio/mpeg",
+	".flac":   "audio/flac",
+	".wav":    "audio/wav",
+	".ogg":    "audio/ogg",
+	".oga":    "audio/ogg",
+	".opus":   "audio/ogg",
+	".m4a":    "audio/mp4",
+	".mid":    "audio/midi",
+	".midi":   "audio/midi",
+	".amr":    "audio/amr",
+	".mp4":    "video/mp4",
+	".m4v":    "video/mp4",
+	".mov":    "video/quicktime",
+	".3gp":    "video/3gpp",
+	".3g2":    "video/3gpp2",
+	".webm":   "video/webm",
+	".mkv":    "video/x-matroska",
+	".avi":    "video/x-msvideo",
+	".ogv":    "video/ogg",
+	".woff":   "font/woff",
+	".woff2":  "font/woff2",
+	".ttf":    "font/ttf",
+	".otf":    "font/otf",
+	".exe":    "application/vnd.microsoft.portable-executable",
+	".dll":    "application/vnd.microsoft.portable-executable",
+	".wasm":   "application/wasm",
+	".html":   "text/html",
+	".htm":    "text/html",
+	".xml":    "text/xml",
+	".txt":    "text/plain",
+	".md":     "text/markdown",
+	".csv":    "text/csv",
+	".json":   "application/json",
+}
+
+// Formats stored in the containers of other formats. Detect names the
+// container when it can't tell the format, so any of these types is
+// consistent with it
+var containers = map[string][]string{
+	"application/zip": {
+		"application/vnd.openxmlformats-officedocument.*",
+		"application/vnd.oasis.opendocument.*",
+		"application/epub+zip",
+		"application/java-archive",
+		"application/vnd.android.package-archive",
+	},
+	"application/x-ole-storage": {
+		"application/msword",
+		"application/vnd.ms-excel",
+		"application/vnd.ms-powerpoint",
+		"application/x-msi",
+	},
+	"text/xml":         {"application/xml", "image/svg+xml", "application/*+xml"},
+	"video/mp4":        {"audio/mp4", "video/quicktime", "video/3gpp", "video/3gpp2"},
+	"application/ogg":  {"audio/ogg", "video/ogg"},
+	"video/ogg":        {"audio/ogg"},
+	"video/webm":       {"audio/webm"},
+	"video/x-matroska": {"video/webm", "audio/webm"},
+	"application/gzip": {"application/x-tar"},
+}
+
+// TypeByExtension returns the media type of the extension of fileName,
+// without parameters, or OCTET_STREAM if it is unknown
+func TypeByExtension(fileName string) string {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if mimeType, ok := extensionTypes[ext]; ok {
+		return mimeType
+	}
+
+	mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext))
+	if err != nil {
+		return OCTET_STREAM
+	}
+	return mediaType
+}
+
+// IsText reports whether mimeType is a textual format
+func IsText(mimeType string) bool {
+	switch {
+	case strings.HasPrefix(mimeType, "text/"):
+		return true
+	case strings.HasSuffix(mimeType, "+xml"), strings.HasSuffix(mimeType, "+json"):
+		return true
+	}
+
+	switch mimeType {
+	case "application/json", "application/javascript", "application/xml", "application/x-sh",
+		"application/yaml", "application/x-yaml", "application/toml", "application/sql":
+		return true
+	}
+	return false
+}
+
+// Matches checks that the type detected from the content of a file is
+// consistent with the type of its extension. Unknown types of either kind
+// match anything, as there is nothing to compare
+func Matches(detected, extension string) bool {
+	switch {
+	case detected == OCTET_STREAM || extension == OCTET_STREAM:
+		return true
+	case detected == extension:
+		return true
+	case detected == "text/plain" && IsText(extension):
+		return true
+	}
+
+	for _, pattern := range containers[detected] {
+		if MatchType(extension, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the type to record for a file: the detected type, or
+// the type of its extension if it refines a matching detected type, e.g.
+// text/markdown for text/plain content. Unrecognized content is kept as
+// application/octet-stream whatever its extension claims
+func Resolve(detected, extension string) string {
+	if detected != OCTET_STREAM && extension != OCTET_STREAM && Matches(detected, extension) {
+		return extension
+	}
+	return detected
+}
+
+// MatchType matches exact types and wildcards such as image/* or
+// application/*+xml
+func MatchType(mimeType, pattern string) bool {
+	prefix, suffix, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return mimeType == pattern
+	}
+	return len(mimeType) >= len(prefix)+len(suffix) && strings.HasPrefix(mimeType, prefix) && strings.HasSuffix(mimeType, suffix)
+}
+
+// ParseTypes parses a comma-separated list of types or wildcards
+func ParseTypes(list string) ([]string, error) {
+	var patterns []string
+
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+
+		mainType, subType, ok := strings.Cut(pattern, "/")
+		if !ok || mainType == "" || strings.Contains(mainType, "*") || subType == "" || strings.Count(subType, "*") > 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid MIME type %q, want type/subtype or a wildcard such as type/*", pattern))
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
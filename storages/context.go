@@ -0,0 +1,25 @@
+package storages
+
+import (
+	"context"
+	"io"
+)
+
+// CopyContext copies from src to dst like io.Copy, but stops with the
+// context error as soon as ctx is cancelled, e.g. when a client disconnects
+func CopyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, &contextReader{ctx: ctx, reader: src})
+}
+
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	err := c.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package storages
+
+import "errors"
+
+func freeBytes(path string) (uint64, error) {
+	return 0, errors.New("Free disk space check is not supported on this platform")
+}
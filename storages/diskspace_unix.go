@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package storages
+
+import "syscall"
+
+// freeBytes returns the disk space available to unprivileged users
+func freeBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
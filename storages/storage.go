@@ -2,18 +2,26 @@ package storages
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/olzhasar/go-fileserver/loggers"
 )
 
 type UploadedFile struct {
 	File io.ReadCloser
 	Name string
 	Size int64
+	// MimeType is the type recorded when the file was uploaded, if known
+	MimeType string
 }
 
 func (u *UploadedFile) MimeTypeByExt() string {
@@ -21,15 +29,37 @@ func (u *UploadedFile) MimeTypeByExt() string {
 }
 
 type Storage interface {
-	SaveFile(fileName string, content io.Reader) error
-	LoadFile(fileName string) (uploaded UploadedFile, err error)
+	SaveFile(ctx context.Context, fileName string, content io.Reader) error
+	LoadFile(ctx context.Context, fileName string) (uploaded UploadedFile, err error)
+	Delete(ctx context.Context, fileName string) error
+	// List returns the names of all stored files
+	List(ctx context.Context) ([]string, error)
 }
 
 type FileSystemStorage struct {
-	uploadDir string
+	uploadDir    string
+	minFreeBytes uint64
+	logger       loggers.Logger
+}
+
+type FileSystemOption func(f *FileSystemStorage)
+
+func WithLogger(logger loggers.Logger) FileSystemOption {
+	return func(f *FileSystemStorage) {
+		f.logger = logger
+	}
 }
 
-func (f *FileSystemStorage) SaveFile(fileName string, source io.Reader) error {
+// WithMinFreeBytes makes health checks fail once less disk space is left
+func WithMinFreeBytes(minFreeBytes uint64) FileSystemOption {
+	return func(f *FileSystemStorage) {
+		f.minFreeBytes = minFreeBytes
+	}
+}
+
+// SaveFile stops writing when ctx is cancelled and leaves the partial file
+// for the caller to delete
+func (f *FileSystemStorage) SaveFile(ctx context.Context, fileName string, source io.Reader) error {
 	newFilePath := f.buildPath(fileName)
 	newFile, err := os.Create(newFilePath)
 
@@ -37,17 +67,26 @@ func (f *FileSystemStorage) SaveFile(fileName string, source io.Reader) error {
 		return err
 	}
 
-	defer newFile.Close()
+	_, err = CopyContext(ctx, newFile, source)
+	if err != nil {
+		newFile.Close()
+		return err
+	}
 
-	_, err = io.Copy(newFile, source)
+	err = newFile.Close()
 	if err != nil {
+		loggers.FromContext(ctx, f.logger).Error("Unable to close saved file", "path", newFilePath, "error", err)
 		return err
 	}
 
 	return nil
 }
 
-func (f *FileSystemStorage) LoadFile(fileName string) (upload UploadedFile, err error) {
+func (f *FileSystemStorage) LoadFile(ctx context.Context, fileName string) (upload UploadedFile, err error) {
+	if err := ctx.Err(); err != nil {
+		return UploadedFile{}, err
+	}
+
 	path := f.buildPath(fileName)
 
 	file, err := os.Open(path)
@@ -58,6 +97,7 @@ func (f *FileSystemStorage) LoadFile(fileName string) (upload UploadedFile, err
 
 	stat, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return UploadedFile{}, err
 	}
 
@@ -70,18 +110,87 @@ func (f *FileSystemStorage) LoadFile(fileName string) (upload UploadedFile, err
 	return upload, nil
 }
 
+func (f *FileSystemStorage) Delete(ctx context.Context, fileName string) error {
+	return os.Remove(f.buildPath(fileName))
+}
+
+// List skips directories and hidden files, such as health check probes
+func (f *FileSystemStorage) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(f.uploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+
+	return names, nil
+}
+
+// CheckHealth writes and removes a probe file in the upload directory and
+// checks the free disk space against the configured minimum
+func (f *FileSystemStorage) CheckHealth(ctx context.Context) error {
+	probe, err := os.CreateTemp(f.uploadDir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = probe.WriteString("ok")
+	if closeErr := probe.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(probe.Name()); err == nil {
+		err = removeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if f.minFreeBytes == 0 {
+		return nil
+	}
+
+	free, err := freeBytes(f.uploadDir)
+	if err != nil {
+		return err
+	}
+
+	if free < f.minFreeBytes {
+		return errors.New(fmt.Sprintf("Only %d bytes of disk space left, want at least %d", free, f.minFreeBytes))
+	}
+
+	return nil
+}
+
 func (f *FileSystemStorage) buildPath(fileName string) string {
 	return filepath.Join(f.uploadDir, fileName)
 }
 
-func NewFileSystemStoage(uploadDir string) Storage {
-	os.MkdirAll(uploadDir, 0755)
+func NewFileSystemStoage(uploadDir string, opts ...FileSystemOption) Storage {
+	storage := &FileSystemStorage{uploadDir: uploadDir, logger: loggers.NopLogger{}}
+
+	for _, opt := range opts {
+		opt(storage)
+	}
+
+	err := os.MkdirAll(uploadDir, 0755)
+	if err != nil {
+		storage.logger.Error("Unable to create upload directory", "path", uploadDir, "error", err)
+	}
 
-	return &FileSystemStorage{uploadDir: uploadDir}
+	return storage
 }
 
+// InMemoryStorage is safe for concurrent use, except for direct access to
+// Files
 type InMemoryStorage struct {
 	Files map[string]string
+	mu    sync.RWMutex
 }
 
 type InMemoryFile struct {
@@ -96,30 +205,71 @@ func (i InMemoryFile) Close() error {
 	return nil
 }
 
-func (i *InMemoryStorage) SaveFile(fileName string, source io.Reader) error {
+// Seek is supported when Buffer is an io.Seeker, such as a *strings.Reader
+func (i InMemoryFile) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := i.Buffer.(io.Seeker)
+	if !ok {
+		return 0, errors.New("Buffer does not support seeking")
+	}
+	return seeker.Seek(offset, whence)
+}
+
+func (i *InMemoryStorage) SaveFile(ctx context.Context, fileName string, source io.Reader) error {
 	buff := &bytes.Buffer{}
-	io.Copy(buff, source)
+	_, err := CopyContext(ctx, buff, source)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	i.Files[fileName] = buff.String()
 	return nil
 }
 
-func (i *InMemoryStorage) LoadFile(fileName string) (UploadedFile, error) {
+func (i *InMemoryStorage) LoadFile(ctx context.Context, fileName string) (UploadedFile, error) {
+	i.mu.RLock()
 	content, ok := i.Files[fileName]
+	i.mu.RUnlock()
 
 	if !ok {
 		return UploadedFile{}, errors.New(fmt.Sprintf("File %q not found in storage", fileName))
 	}
 
-	buff := &bytes.Buffer{}
-	buff.WriteString(content)
-	file := InMemoryFile{buff}
+	file := InMemoryFile{strings.NewReader(content)}
 
 	size := int64(len(content))
 
 	return UploadedFile{File: file, Name: fileName, Size: size}, nil
 }
 
+func (i *InMemoryStorage) Delete(ctx context.Context, fileName string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, ok := i.Files[fileName]; !ok {
+		return errors.New(fmt.Sprintf("File %q not found in storage", fileName))
+	}
+	delete(i.Files, fileName)
+	return nil
+}
+
+func (i *InMemoryStorage) List(ctx context.Context) ([]string, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	names := make([]string, 0, len(i.Files))
+	for name := range i.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
 func (i *InMemoryStorage) Clear() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
 	for k := range i.Files {
 		delete(i.Files, k)
 	}
@@ -127,5 +277,5 @@ func (i *InMemoryStorage) Clear() {
 
 func NewInMemoryStorage() *InMemoryStorage {
 	files := make(map[string]string)
-	return &InMemoryStorage{files}
+	return &InMemoryStorage{Files: files}
 }
@@ -2,11 +2,18 @@ package storages_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"github.com/olzhasar/go-fileserver/storages"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"testing/iotest"
 )
 
 const TMP_DIR = "tmp"
@@ -41,7 +48,7 @@ func TestFileSystemStorage(t *testing.T) {
 
 		storage := storages.NewFileSystemStoage(TMP_DIR)
 
-		storage.SaveFile(fileName, buff)
+		storage.SaveFile(context.Background(), fileName, buff)
 
 		assertFileSaved(t, fileName, fileContent)
 	})
@@ -56,12 +63,73 @@ func TestFileSystemStorage(t *testing.T) {
 		buff := &bytes.Buffer{}
 		buff.WriteString(fileContent)
 
-		storage.SaveFile(fileName, buff)
+		storage.SaveFile(context.Background(), fileName, buff)
 
-		uploadedFile, _ := storage.LoadFile(fileName)
+		uploadedFile, _ := storage.LoadFile(context.Background(), fileName)
 
 		checkUploadedFile(t, uploadedFile, fileName, fileContent)
 	})
+	t.Run("deletes file from the upload directory", func(t *testing.T) {
+		defer setupTest()()
+
+		fileName := "example.txt"
+		storage := storages.NewFileSystemStoage(TMP_DIR)
+		storage.SaveFile(context.Background(), fileName, createContentBuffer("content"))
+
+		err := storage.Delete(context.Background(), fileName)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %q", err)
+		}
+
+		assertPathDoesNotExist(t, filepath.Join(TMP_DIR, fileName))
+	})
+	t.Run("lists stored files", func(t *testing.T) {
+		defer setupTest()()
+
+		storage := storages.NewFileSystemStoage(TMP_DIR)
+		storage.SaveFile(context.Background(), "b.txt", createContentBuffer("b"))
+		storage.SaveFile(context.Background(), "a.txt", createContentBuffer("a"))
+		os.WriteFile(filepath.Join(TMP_DIR, ".healthcheck-1"), nil, 0644)
+		os.Mkdir(filepath.Join(TMP_DIR, "nested"), 0755)
+
+		names, err := storage.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(names, []string{"a.txt", "b.txt"}) {
+			t.Errorf("Got %v, want [a.txt b.txt]", names)
+		}
+	})
+}
+
+func TestFileSystemStorageHealth(t *testing.T) {
+	t.Run("passes for writable directory", func(t *testing.T) {
+		storage := storages.NewFileSystemStoage(t.TempDir(), storages.WithMinFreeBytes(1))
+
+		err := storage.(*storages.FileSystemStorage).CheckHealth(context.Background())
+		if err != nil {
+			t.Errorf("Expected no error, got %q", err)
+		}
+	})
+	t.Run("fails below free space threshold", func(t *testing.T) {
+		storage := storages.NewFileSystemStoage(t.TempDir(), storages.WithMinFreeBytes(math.MaxUint64))
+
+		err := storage.(*storages.FileSystemStorage).CheckHealth(context.Background())
+		if err == nil {
+			t.Error("Expected error, but did not get one")
+		}
+	})
+	t.Run("fails for missing directory", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "uploads")
+		storage := storages.NewFileSystemStoage(dir)
+		os.RemoveAll(dir)
+
+		err := storage.(*storages.FileSystemStorage).CheckHealth(context.Background())
+		if err == nil {
+			t.Error("Expected error, but did not get one")
+		}
+	})
 }
 
 func TestInMemoryStorage(t *testing.T) {
@@ -72,7 +140,7 @@ func TestInMemoryStorage(t *testing.T) {
 		buff := createContentBuffer(fileContent)
 
 		storage := storages.NewInMemoryStorage()
-		storage.SaveFile(fileName, buff)
+		storage.SaveFile(context.Background(), fileName, buff)
 
 		if val, ok := storage.Files[fileName]; !ok {
 			t.Errorf("Expected %q to be in storage, but it wasn't", fileName)
@@ -87,9 +155,9 @@ func TestInMemoryStorage(t *testing.T) {
 		buff := createContentBuffer(fileContent)
 
 		storage := storages.NewInMemoryStorage()
-		storage.SaveFile(fileName, buff)
+		storage.SaveFile(context.Background(), fileName, buff)
 
-		uploaded, err := storage.LoadFile(fileName)
+		uploaded, err := storage.LoadFile(context.Background(), fileName)
 
 		if err != nil {
 			t.Fatalf("Expected no error, but got %q", err)
@@ -101,17 +169,82 @@ func TestInMemoryStorage(t *testing.T) {
 	})
 	t.Run("Throws error when loading missing file", func(t *testing.T) {
 		storage := storages.NewInMemoryStorage()
-		_, err := storage.LoadFile("nonexisting.txt")
+		_, err := storage.LoadFile(context.Background(), "nonexisting.txt")
 
 		if err == nil {
 			t.Fatal("Expected error, but did not get one")
 		}
 	})
+	t.Run("Deletes file from memory", func(t *testing.T) {
+		storage := storages.NewInMemoryStorage()
+		storage.SaveFile(context.Background(), "test.txt", createContentBuffer("test"))
+
+		err := storage.Delete(context.Background(), "test.txt")
+		if err != nil {
+			t.Fatalf("Expected no error, but got %q", err)
+		}
+
+		if _, ok := storage.Files["test.txt"]; ok {
+			t.Error("Expected file to be deleted, but it wasn't")
+		}
+
+		if storage.Delete(context.Background(), "test.txt") == nil {
+			t.Error("Expected error, but did not get one")
+		}
+	})
+	t.Run("Is safe for concurrent use", func(t *testing.T) {
+		storage := storages.NewInMemoryStorage()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(fileName string) {
+				defer wg.Done()
+
+				storage.SaveFile(context.Background(), fileName, createContentBuffer("test"))
+				if upload, err := storage.LoadFile(context.Background(), fileName); err == nil {
+					upload.File.Close()
+				}
+				storage.List(context.Background())
+				storage.Delete(context.Background(), fileName)
+			}(fmt.Sprintf("test-%d.txt", i%5))
+		}
+		wg.Wait()
+	})
+	t.Run("Does not keep partially read files", func(t *testing.T) {
+		storage := storages.NewInMemoryStorage()
+
+		content := io.MultiReader(createContentBuffer("partial"), iotest.ErrReader(errors.New("broken")))
+
+		err := storage.SaveFile(context.Background(), "test.txt", content)
+		if err == nil {
+			t.Fatal("Expected error, but did not get one")
+		}
+
+		if _, ok := storage.Files["test.txt"]; ok {
+			t.Error("Expected partial file not to be saved")
+		}
+	})
+	t.Run("Stops saving when context is cancelled", func(t *testing.T) {
+		storage := storages.NewInMemoryStorage()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := storage.SaveFile(ctx, "test.txt", createContentBuffer("content"))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+
+		if _, ok := storage.Files["test.txt"]; ok {
+			t.Error("Expected cancelled file not to be saved")
+		}
+	})
 	t.Run("Clear deletes everything from map", func(t *testing.T) {
 		storage := storages.NewInMemoryStorage()
 
 		buff := createContentBuffer("test")
-		storage.SaveFile("test.txt", buff)
+		storage.SaveFile(context.Background(), "test.txt", buff)
 
 		storage.Clear()
 
@@ -0,0 +1,91 @@
+package tracing
+
+import (
+	"context"
+	"io"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/olzhasar/go-fileserver/manager"
+	"github.com/olzhasar/go-fileserver/registry"
+	"github.com/olzhasar/go-fileserver/storages"
+)
+
+// InstrumentManager wraps m so that saves, loads, descriptions, listings,
+// removals and usage reports are recorded as spans, parents of the registry and storage spans
+func InstrumentManager(m manager.SaverLoader, provider trace.TracerProvider) manager.SaverLoader {
+	return &tracedManager{m, tracer(provider)}
+}
+
+type tracedManager struct {
+	manager manager.SaverLoader
+	tracer  trace.Tracer
+}
+
+func (t *tracedManager) SaveFile(ctx context.Context, fileName string, content io.Reader, opts manager.SaveOptions) (string, error) {
+	ctx, span := t.tracer.Start(ctx, "FileManager.SaveFile", trace.WithAttributes(
+		attribute.Bool("fileserver.private", opts.Private),
+		attribute.Bool("fileserver.protected", opts.Password != ""),
+		attribute.Bool("fileserver.expires", !opts.ExpiresAt.IsZero()),
+	))
+
+	counter := &countingReader{reader: content}
+	token, err := t.manager.SaveFile(ctx, fileName, counter, opts)
+
+	span.SetAttributes(ATTR_FILE_SIZE.Int64(counter.read))
+	if err == nil {
+		span.SetAttributes(ATTR_TOKEN_HASH.String(HashToken(token)))
+	}
+
+	endSpan(span, err)
+	return token, err
+}
+
+func (t *tracedManager) LoadFile(ctx context.Context, token string, opts manager.LoadOptions) (storages.UploadedFile, error) {
+	ctx, span := t.tracer.Start(ctx, "FileManager.LoadFile", trace.WithAttributes(
+		ATTR_TOKEN_HASH.String(HashToken(token)),
+	))
+
+	upload, err := t.manager.LoadFile(ctx, token, opts)
+	if err == nil {
+		span.SetAttributes(ATTR_FILE_SIZE.Int64(upload.Size))
+	}
+
+	endSpan(span, err)
+	return upload, err
+}
+
+func (t *tracedManager) Usage(ctx context.Context) (manager.UsageReport, error) {
+	ctx, span := t.tracer.Start(ctx, "FileManager.Usage")
+	report, err := t.manager.Usage(ctx)
+	endSpan(span, err)
+	return report, err
+}
+
+func (t *tracedManager) ListFiles(ctx context.Context, query registry.ListQuery) (registry.ListPage, error) {
+	ctx, span := t.tracer.Start(ctx, "FileManager.ListFiles")
+	page, err := t.manager.ListFiles(ctx, query)
+	endSpan(span, err)
+	return page, err
+}
+
+func (t *tracedManager) DescribeFile(ctx context.Context, token string, opts manager.LoadOptions) (manager.FileInfo, error) {
+	ctx, span := t.tracer.Start(ctx, "FileManager.DescribeFile", trace.WithAttributes(
+		ATTR_TOKEN_HASH.String(HashToken(token)),
+	))
+
+	info, err := t.manager.DescribeFile(ctx, token, opts)
+	endSpan(span, err)
+	return info, err
+}
+
+func (t *tracedManager) RemoveFile(ctx context.Context, token string) error {
+	ctx, span := t.tracer.Start(ctx, "FileManager.RemoveFile", trace.WithAttributes(
+		ATTR_TOKEN_HASH.String(HashToken(token)),
+	))
+
+	err := t.manager.RemoveFile(ctx, token)
+	endSpan(span, err)
+	return err
+}
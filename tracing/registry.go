@@ -0,0 +1,221 @@
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/olzhasar/go-fileserver/health"
+	"github.com/olzhasar/go-fileserver/registry"
+)
+
+// InstrumentRegistry wraps r so that every operation is recorded as a span.
+// Tokens are added to spans as hashes
+func InstrumentRegistry(r registry.Registry, provider trace.TracerProvider) registry.Registry {
+	return &tracedRegistry{r, tracer(provider)}
+}
+
+type tracedRegistry struct {
+	registry registry.Registry
+	tracer   trace.Tracer
+}
+
+func (t *tracedRegistry) start(ctx context.Context, operation string, token string) (context.Context, trace.Span) {
+	ctx, span := t.tracer.Start(ctx, "registry."+operation, trace.WithSpanKind(trace.SpanKindClient))
+	if token != "" {
+		span.SetAttributes(ATTR_TOKEN_HASH.String(HashToken(token)))
+	}
+	return ctx, span
+}
+
+func (t *tracedRegistry) Record(ctx context.Context, token, fileName string) error {
+	ctx, span := t.start(ctx, "Record", token)
+	err := t.registry.Record(ctx, token, fileName)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) Get(ctx context.Context, token string) (string, bool) {
+	ctx, span := t.start(ctx, "Get", token)
+	value, ok := t.registry.Get(ctx, token)
+	endSpan(span, nil)
+	return value, ok
+}
+
+func (t *tracedRegistry) Has(ctx context.Context, token string) bool {
+	ctx, span := t.start(ctx, "Has", token)
+	ok := t.registry.Has(ctx, token)
+	endSpan(span, nil)
+	return ok
+}
+
+func (t *tracedRegistry) Delete(ctx context.Context, token string) error {
+	ctx, span := t.start(ctx, "Delete", token)
+	err := t.registry.Delete(ctx, token)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) SetPassword(ctx context.Context, token, passwordHash string) error {
+	ctx, span := t.start(ctx, "SetPassword", token)
+	err := t.registry.SetPassword(ctx, token, passwordHash)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) SetPrivate(ctx context.Context, token string, private bool) error {
+	ctx, span := t.start(ctx, "SetPrivate", token)
+	err := t.registry.SetPrivate(ctx, token, private)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) GetProtection(ctx context.Context, token string) (registry.Protection, bool) {
+	ctx, span := t.start(ctx, "GetProtection", token)
+	value, ok := t.registry.GetProtection(ctx, token)
+	endSpan(span, nil)
+	return value, ok
+}
+
+func (t *tracedRegistry) RecordFailedAttempt(ctx context.Context, token string, at time.Time) error {
+	ctx, span := t.start(ctx, "RecordFailedAttempt", token)
+	err := t.registry.RecordFailedAttempt(ctx, token, at)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) ResetFailedAttempts(ctx context.Context, token string) error {
+	ctx, span := t.start(ctx, "ResetFailedAttempts", token)
+	err := t.registry.ResetFailedAttempts(ctx, token)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) SetUploader(ctx context.Context, token, uploader string) error {
+	ctx, span := t.start(ctx, "SetUploader", token)
+	err := t.registry.SetUploader(ctx, token, uploader)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) SetSize(ctx context.Context, token string, size int64) error {
+	ctx, span := t.start(ctx, "SetSize", token)
+	err := t.registry.SetSize(ctx, token, size)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) GetMetadata(ctx context.Context, token string) (registry.Metadata, bool) {
+	ctx, span := t.start(ctx, "GetMetadata", token)
+	value, ok := t.registry.GetMetadata(ctx, token)
+	endSpan(span, nil)
+	return value, ok
+}
+
+func (t *tracedRegistry) GetUsage(ctx context.Context, uploader string) (registry.Usage, error) {
+	ctx, span := t.start(ctx, "GetUsage", "")
+	value, err := t.registry.GetUsage(ctx, uploader)
+	endSpan(span, err)
+	return value, err
+}
+
+func (t *tracedRegistry) GetTotalUsage(ctx context.Context) (registry.Usage, error) {
+	ctx, span := t.start(ctx, "GetTotalUsage", "")
+	value, err := t.registry.GetTotalUsage(ctx)
+	endSpan(span, err)
+	return value, err
+}
+
+func (t *tracedRegistry) SetMimeType(ctx context.Context, token, mimeType string) error {
+	ctx, span := t.start(ctx, "SetMimeType", token)
+	err := t.registry.SetMimeType(ctx, token, mimeType)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) ListUsage(ctx context.Context) ([]registry.UploaderUsage, error) {
+	ctx, span := t.start(ctx, "ListUsage", "")
+	value, err := t.registry.ListUsage(ctx)
+	endSpan(span, err)
+	return value, err
+}
+
+func (t *tracedRegistry) SetExpiry(ctx context.Context, token string, at time.Time) error {
+	ctx, span := t.start(ctx, "SetExpiry", token)
+	err := t.registry.SetExpiry(ctx, token, at)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) SetBlocked(ctx context.Context, token string, blocked bool) error {
+	ctx, span := t.start(ctx, "SetBlocked", token)
+	err := t.registry.SetBlocked(ctx, token, blocked)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) SetScanResult(ctx context.Context, token, status, signature string) error {
+	ctx, span := t.start(ctx, "SetScanResult", token)
+	err := t.registry.SetScanResult(ctx, token, status, signature)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) SetStorageKey(ctx context.Context, token, key string) error {
+	ctx, span := t.start(ctx, "SetStorageKey", token)
+	err := t.registry.SetStorageKey(ctx, token, key)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) List(ctx context.Context, query registry.ListQuery) (registry.ListPage, error) {
+	ctx, span := t.start(ctx, "List", "")
+	value, err := t.registry.List(ctx, query)
+	endSpan(span, err)
+	return value, err
+}
+
+func (t *tracedRegistry) RecordAPIKey(ctx context.Context, key registry.APIKey) error {
+	ctx, span := t.start(ctx, "RecordAPIKey", "")
+	err := t.registry.RecordAPIKey(ctx, key)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) GetAPIKey(ctx context.Context, id string) (registry.APIKey, bool) {
+	ctx, span := t.start(ctx, "GetAPIKey", "")
+	value, ok := t.registry.GetAPIKey(ctx, id)
+	endSpan(span, nil)
+	return value, ok
+}
+
+func (t *tracedRegistry) ListAPIKeys(ctx context.Context) ([]registry.APIKey, error) {
+	ctx, span := t.start(ctx, "ListAPIKeys", "")
+	value, err := t.registry.ListAPIKeys(ctx)
+	endSpan(span, err)
+	return value, err
+}
+
+func (t *tracedRegistry) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	ctx, span := t.start(ctx, "RevokeAPIKey", "")
+	err := t.registry.RevokeAPIKey(ctx, id, at)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedRegistry) Clear() {
+	t.registry.Clear()
+}
+
+func (t *tracedRegistry) Close() {
+	t.registry.Close()
+}
+
+// CheckHealth forwards to the wrapped registry if it is a health.HealthChecker
+func (t *tracedRegistry) CheckHealth(ctx context.Context) error {
+	if checker, ok := t.registry.(health.HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
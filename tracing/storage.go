@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"context"
+	"io"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/olzhasar/go-fileserver/health"
+	"github.com/olzhasar/go-fileserver/storages"
+)
+
+// InstrumentStorage wraps s so that every operation is recorded as a span
+func InstrumentStorage(s storages.Storage, provider trace.TracerProvider) storages.Storage {
+	return &tracedStorage{s, tracer(provider)}
+}
+
+type tracedStorage struct {
+	storage storages.Storage
+	tracer  trace.Tracer
+}
+
+func (t *tracedStorage) SaveFile(ctx context.Context, fileName string, content io.Reader) error {
+	ctx, span := t.tracer.Start(ctx, "storage.SaveFile")
+
+	counter := &countingReader{reader: content}
+	err := t.storage.SaveFile(ctx, fileName, counter)
+
+	span.SetAttributes(ATTR_FILE_SIZE.Int64(counter.read))
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStorage) LoadFile(ctx context.Context, fileName string) (storages.UploadedFile, error) {
+	ctx, span := t.tracer.Start(ctx, "storage.LoadFile")
+
+	upload, err := t.storage.LoadFile(ctx, fileName)
+	if err == nil {
+		span.SetAttributes(ATTR_FILE_SIZE.Int64(upload.Size))
+	}
+
+	endSpan(span, err)
+	return upload, err
+}
+
+func (t *tracedStorage) Delete(ctx context.Context, fileName string) error {
+	ctx, span := t.tracer.Start(ctx, "storage.Delete")
+	err := t.storage.Delete(ctx, fileName)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStorage) List(ctx context.Context) ([]string, error) {
+	ctx, span := t.tracer.Start(ctx, "storage.List")
+	names, err := t.storage.List(ctx)
+	endSpan(span, err)
+	return names, err
+}
+
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+// CheckHealth forwards to the wrapped storage if it is a health.HealthChecker
+func (t *tracedStorage) CheckHealth(ctx context.Context) error {
+	if checker, ok := t.storage.(health.HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package tracing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const TRACER_NAME = "github.com/olzhasar/go-fileserver"
+const DEFAULT_SERVICE_NAME = "fileserver"
+
+const EXPORTER_NONE = "none"
+const EXPORTER_STDOUT = "stdout"
+const EXPORTER_FILE = "file"
+const EXPORTER_OTLP = "otlp"
+
+const ATTR_TOKEN_HASH = attribute.Key("fileserver.token_hash")
+const ATTR_FILE_SIZE = attribute.Key("fileserver.file_size")
+
+type Config struct {
+	// Exporter is one of "none", "stdout", "file" or "otlp"
+	Exporter string
+	// Endpoint is the host:port of the OTLP/HTTP collector. The standard
+	// OTEL_EXPORTER_OTLP_* variables are used when empty
+	Endpoint string
+	// FilePath receives JSON encoded spans with the file exporter
+	FilePath    string
+	ServiceName string
+	// SampleRatio is the fraction of new traces that are sampled. Zero samples
+	// everything. Traces started upstream keep their sampling decision
+	SampleRatio float64
+}
+
+// NewTracerProvider builds a tracer provider exporting spans in batches.
+// Call Shutdown on it to flush pending spans
+func NewTracerProvider(ctx context.Context, config Config) (*sdktrace.TracerProvider, error) {
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = DEFAULT_SERVICE_NAME
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", serviceName))
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+
+	if config.SampleRatio > 0 && config.SampleRatio < 1 {
+		sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))
+		opts = append(opts, sdktrace.WithSampler(sampler))
+	}
+
+	exporter, err := newExporter(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	if exporter != nil {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	return sdktrace.NewTracerProvider(opts...), nil
+}
+
+func newExporter(ctx context.Context, config Config) (sdktrace.SpanExporter, error) {
+	switch strings.ToLower(config.Exporter) {
+	case "", EXPORTER_NONE:
+		return nil, nil
+	case EXPORTER_STDOUT:
+		return stdouttrace.New()
+	case EXPORTER_FILE:
+		if config.FilePath == "" {
+			return nil, errors.New("Trace file path is required by the file exporter")
+		}
+
+		file, err := os.OpenFile(config.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		return &fileExporter{exporter, file}, nil
+	case EXPORTER_OTLP:
+		var opts []otlptracehttp.Option
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown trace exporter %q", config.Exporter))
+	}
+}
+
+// fileExporter closes the trace file once the exporter is shut down
+type fileExporter struct {
+	sdktrace.SpanExporter
+	file *os.File
+}
+
+func (f *fileExporter) Shutdown(ctx context.Context) error {
+	err := f.SpanExporter.Shutdown(ctx)
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Propagator reads and writes W3C traceparent and baggage headers
+func Propagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+}
+
+// HashToken identifies download tokens in spans without exposing them, as
+// tokens grant access to files
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+func tracer(provider trace.TracerProvider) trace.Tracer {
+	return provider.Tracer(TRACER_NAME)
+}
+
+// endSpan records err on the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
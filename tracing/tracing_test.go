@@ -0,0 +1,109 @@
+package tracing_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/olzhasar/go-fileserver/manager"
+	"github.com/olzhasar/go-fileserver/registry"
+	"github.com/olzhasar/go-fileserver/storages"
+	"github.com/olzhasar/go-fileserver/tracing"
+)
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) (string, bool) {
+	for _, attr := range span.Attributes() {
+		if string(attr.Key) == key {
+			return attr.Value.Emit(), true
+		}
+	}
+	return "", false
+}
+
+func TestInstrumentedStack(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	reg := tracing.InstrumentRegistry(registry.NewInMemoryRegistry(), provider)
+	storage := tracing.InstrumentStorage(storages.NewInMemoryStorage(), provider)
+	mgr := tracing.InstrumentManager(manager.NewFileManager(reg, storage), provider)
+
+	token, err := mgr.SaveFile(context.Background(), "file.txt", strings.NewReader("content"), manager.SaveOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	spans := recorder.Ended()
+
+	var root sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if span.Name() == "FileManager.SaveFile" {
+			root = span
+		}
+	}
+	if root == nil {
+		t.Fatal("Want a FileManager.SaveFile span, got none")
+	}
+
+	if size, _ := spanAttribute(root, "fileserver.file_size"); size != "7" {
+		t.Errorf("Got file size attribute %q, want 7", size)
+	}
+	if hash, _ := spanAttribute(root, "fileserver.token_hash"); hash != tracing.HashToken(token) {
+		t.Errorf("Got token hash attribute %q, want %q", hash, tracing.HashToken(token))
+	}
+
+	names := map[string]bool{}
+	for _, span := range spans {
+		names[span.Name()] = true
+
+		if span != root && span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("Want span %q to be a child of the manager span", span.Name())
+		}
+
+		for _, attr := range span.Attributes() {
+			if attr.Value.Emit() == token {
+				t.Errorf("Span %q exposes the token in %q", span.Name(), attr.Key)
+			}
+		}
+	}
+
+	for _, name := range []string{"registry.Record", "registry.SetSize", "storage.SaveFile"} {
+		if !names[name] {
+			t.Errorf("Want a %q span, got none", name)
+		}
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+
+	provider, err := tracing.NewTracerProvider(context.Background(), tracing.Config{Exporter: tracing.EXPORTER_FILE, FilePath: path})
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	_, span := provider.Tracer("test").Start(context.Background(), "test-span")
+	span.End()
+
+	err = provider.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got %q", err)
+	}
+
+	content, _ := os.ReadFile(path)
+	if !strings.Contains(string(content), "test-span") {
+		t.Errorf("Want trace file to contain the span, got %q", content)
+	}
+}
+
+func TestUnknownExporter(t *testing.T) {
+	_, err := tracing.NewTracerProvider(context.Background(), tracing.Config{Exporter: "carrier-pigeon"})
+	if err == nil {
+		t.Error("Expected error, but did not get one")
+	}
+}